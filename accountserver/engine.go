@@ -64,6 +64,9 @@ type ContainerListingRecord struct {
 	Bytes        int64    `xml:"bytes" json:"bytes"`
 	Count        int64    `xml:"count" json:"count"`
 	LastModified string   `xml:"last_modified" json:"last_modified"`
+	// StoragePolicy is the name of the container's storage policy, filled in by the server from StoragePolicyIndex.
+	StoragePolicy      string `xml:"storage_policy,omitempty" json:"storage_policy,omitempty"`
+	StoragePolicyIndex int    `xml:"-" json:"-"`
 }
 
 // SubdirListingRecord is the struct used for serializing subdirs in json and xml account listings.
@@ -85,6 +88,14 @@ type ContainerRecord struct {
 	StoragePolicyIndex int    `json:"storage_policy_index"`
 }
 
+// PolicyStat represents a row in the policy_stat table - the account's usage in a single storage policy.
+type PolicyStat struct {
+	StoragePolicyIndex int   `json:"storage_policy_index"`
+	ContainerCount     int64 `json:"container_count"`
+	ObjectCount        int64 `json:"object_count"`
+	BytesUsed          int64 `json:"bytes_used"`
+}
+
 // SyncRecord represents a row in the incoming_sync table.  It is used by replication.
 type SyncRecord struct {
 	SyncPoint int64  `json:"sync_point"`
@@ -95,6 +106,8 @@ type SyncRecord struct {
 type Account interface {
 	// GetInfo returns the AccountInfo struct for the account.
 	GetInfo() (*AccountInfo, error)
+	// PolicyStats returns the account's usage broken down by storage policy.
+	PolicyStats() ([]*PolicyStat, error)
 	// IsDeleted returns true if the account has been deleted.
 	IsDeleted() (bool, error)
 	// Delete deletes the account.
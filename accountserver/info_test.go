@@ -0,0 +1,47 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package accountserver
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintAccountInfo(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutContainer("c", "100000001.00000", "0", 2, 20, 0))
+	require.Nil(t, db.UpdateMetadata(map[string][]string{"X-Account-Meta-Color": {"blue", "100000002.00000"}}))
+
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+
+	out := &bytes.Buffer{}
+	require.Nil(t, printAccountInfo(out, dbFile, nil))
+	assert.Contains(t, out.String(), "Path: /a\n")
+	assert.Contains(t, out.String(), "  Container Count: 1\n")
+	assert.Contains(t, out.String(), "  Object Count: 2\n")
+	assert.Contains(t, out.String(), "  Bytes Used: 20\n")
+	assert.Contains(t, out.String(), "User Metadata:\n  X-Account-Meta-Color: blue (100000002.00000)\n")
+	assert.True(t, strings.HasSuffix(out.String(), fmt.Sprintf("Sync Table:\n  %s: 1 (local)\n", info.ID)), out.String())
+	assert.NotContains(t, out.String(), "Ring locations")
+}
@@ -46,6 +46,7 @@ var (
 // Replicator is the account replicator daemon object
 type Replicator struct {
 	checkMounts    bool
+	failedDevices  *fs.FailedDevices
 	deviceRoot     string
 	reconCachePath string
 	logger         srv.LowLevelLogger
@@ -325,6 +326,10 @@ func (rd *replicationDevice) replicate() {
 		rd.r.LogError("Device not mounted: %s", devicePath)
 		return
 	}
+	if rd.r.failedDevices.IsFailed(rd.dev.Device) {
+		rd.r.LogError("Device marked failed: %s", devicePath)
+		return
+	}
 	results := make(chan string, 100)
 	go rd.i.findAccountDbs(devicePath, results)
 	for dbFile := range results {
@@ -562,6 +567,7 @@ func GetReplicator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, err
 		startRun:       make(chan string),
 		reconCachePath: serverconf.GetDefault("account-replicator", "recon_cache_path", "/var/cache/swift"),
 		checkMounts:    serverconf.GetBool("account-replicator", "mount_check", true),
+		failedDevices:  fs.NewFailedDevices(serverconf.GetDefault("account-replicator", "failed_devices_file", fs.DefaultFailedDevicesFile)),
 		deviceRoot:     serverconf.GetDefault("account-replicator", "devices", "/srv/node"),
 		serverPort:     int(serverconf.GetInt("account-replicator", "bind_port", 6000)),
 		reclaimAge:     serverconf.GetInt("account-replicator", "reclaim_age", 604800),
@@ -39,6 +39,9 @@ import (
 // GetHashPrefixAndSuffix is a pointer to hummingbird's function of the same name, for overriding in tests.
 var GetHashPrefixAndSuffix = conf.GetHashPrefixAndSuffix
 
+// LoadPolicies is a pointer to hummingbird's function of the same name, for overriding in tests.
+var LoadPolicies = conf.LoadPolicies
+
 // AccountServer contains all of the information for a running account server.
 type AccountServer struct {
 	driveRoot        string
@@ -48,9 +51,11 @@ type AccountServer struct {
 	logLevel         string
 	diskInUse        *common.KeyedLimit
 	checkMounts      bool
+	failedDevices    *fs.FailedDevices
 	accountEngine    AccountEngine
 	updateClient     *http.Client
 	autoCreatePrefix string
+	policies         conf.PolicyList
 }
 
 func formatTimestamp(ts string) (string, error) {
@@ -127,6 +132,22 @@ func (server *AccountServer) AccountGetHandler(writer http.ResponseWriter, reque
 		headers.Set("X-Account-Container-Count", strconv.FormatInt(info.ContainerCount, 10))
 		headers.Set("X-Account-Object-Count", strconv.FormatInt(info.ObjectCount, 10))
 		headers.Set("X-Account-Bytes-Used", strconv.FormatInt(info.BytesUsed, 10))
+		stats, err := db.PolicyStats()
+		if err != nil {
+			srv.GetLogger(request).LogError("Unable to get policy stats: %v", err)
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		for _, stat := range stats {
+			policy, ok := server.policies[stat.StoragePolicyIndex]
+			if !ok {
+				continue
+			}
+			prefix := "X-Account-Storage-Policy-" + policy.Name
+			headers.Set(prefix+"-Container-Count", strconv.FormatInt(stat.ContainerCount, 10))
+			headers.Set(prefix+"-Object-Count", strconv.FormatInt(stat.ObjectCount, 10))
+			headers.Set(prefix+"-Bytes-Used", strconv.FormatInt(stat.BytesUsed, 10))
+		}
 		if ts, err := formatTimestamp(info.CreatedAt); err == nil {
 			headers.Set("X-Timestamp", ts)
 		}
@@ -157,6 +178,13 @@ func (server *AccountServer) AccountGetHandler(writer http.ResponseWriter, reque
 		srv.StandardResponse(writer, http.StatusInternalServerError)
 		return
 	}
+	for _, obj := range containers {
+		if cr, ok := obj.(*ContainerListingRecord); ok {
+			if policy, ok := server.policies[cr.StoragePolicyIndex]; ok {
+				cr.StoragePolicy = policy.Name
+			}
+		}
+	}
 	format := request.Form.Get("format")
 	if format == "" { /* TODO: real accept parsing */
 		accept := request.Header.Get("Accept")
@@ -436,6 +464,11 @@ func (server *AccountServer) AcquireDevice(next http.Handler) http.Handler {
 					return
 				}
 			}
+			if server.failedDevices.IsFailed(device) {
+				vars["Method"] = request.Method
+				srv.CustomErrorResponse(writer, 507, vars)
+				return
+			}
 
 			forceAcquire := request.Header.Get("X-Force-Acquire") == "true"
 			if concRequests := server.diskInUse.Acquire(device, forceAcquire); concRequests != 0 {
@@ -499,6 +532,7 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	server.autoCreatePrefix = serverconf.GetDefault("app:account-server", "auto_create_account_prefix", ".")
 	server.driveRoot = serverconf.GetDefault("app:account-server", "devices", "/srv/node")
 	server.checkMounts = serverconf.GetBool("app:account-server", "mount_check", true)
+	server.failedDevices = fs.NewFailedDevices(serverconf.GetDefault("app:account-server", "failed_devices_file", fs.DefaultFailedDevicesFile))
 	server.logLevel = serverconf.GetDefault("app:account-server", "log_level", "INFO")
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:account-server", "disk_limit", 25, 10000))
 	bindIP = serverconf.GetDefault("app:account-server", "bind_ip", "0.0.0.0")
@@ -506,6 +540,7 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	if server.logger, err = srv.SetupLogger(serverconf, flags, "app:account-server", "account-server"); err != nil {
 		return "", 0, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	server.policies = LoadPolicies()
 	server.accountEngine = newLRUEngine(server.driveRoot, server.hashPathPrefix, server.hashPathSuffix, 32)
 	connTimeout := time.Duration(serverconf.GetFloat("app:account-server", "conn_timeout", 1.0) * float64(time.Second))
 	nodeTimeout := time.Duration(serverconf.GetFloat("app:account-server", "node_timeout", 10.0) * float64(time.Second))
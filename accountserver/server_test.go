@@ -16,15 +16,19 @@
 package accountserver
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/test"
 )
 
@@ -47,6 +51,10 @@ func makeTestServer() (http.Handler, func(), error) {
 		accountEngine:    newLRUEngine(dir, "changeme", "changeme", 32),
 		diskInUse:        common.NewKeyedLimit(2, 2),
 		autoCreatePrefix: ".",
+		policies: conf.PolicyList{
+			0: {Index: 0, Name: "gold", Default: true},
+			1: {Index: 1, Name: "silver"},
+		},
 	}
 	cleanup := func() {
 		os.RemoveAll(dir)
@@ -66,6 +74,30 @@ func TestAccountGetNotFound(t *testing.T) {
 	require.Equal(t, 404, rsp.Status)
 }
 
+func TestAccountFailedDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "device"), 0777))
+	failedFile := filepath.Join(dir, "failed_devices.json")
+	require.Nil(t, fs.WriteFailedDevices(failedFile, map[string]fs.FailedDevice{"device": {Errors: 3}}))
+	server := &AccountServer{
+		driveRoot:     dir,
+		logLevel:      "INFO",
+		logger:        test.FakeLowLevelLogger{},
+		failedDevices: fs.NewFailedDevices(failedFile),
+		accountEngine: newLRUEngine(dir, "changeme", "changeme", 32),
+		diskInUse:     common.NewKeyedLimit(2, 2),
+	}
+	handler := server.GetHandler(*new(conf.Config))
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("GET", "/device/1/a", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 507, rsp.Status)
+}
+
 func TestAccountDeleteNotFound(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
@@ -253,6 +285,69 @@ func TestAccountPutContainersGet(t *testing.T) {
 	require.Equal(t, "application/xml; charset=utf-8", rsp.Header().Get("Content-Type"))
 }
 
+func TestAccountPolicyStats(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	for i, policy := range []string{"0", "1", "1", "2"} {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("PUT", "/device/1/a/c"+strconv.Itoa(i), nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Put-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Object-Count", "2")
+		req.Header.Set("X-Bytes-Used", "10")
+		req.Header.Set("X-Backend-Storage-Policy-Index", policy)
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 201, rsp.Status)
+	}
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("HEAD", "/device/1/a", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 204, rsp.Status)
+	require.Equal(t, "4", rsp.Header().Get("X-Account-Container-Count"))
+	require.Equal(t, "1", rsp.Header().Get("X-Account-Storage-Policy-Gold-Container-Count"))
+	require.Equal(t, "2", rsp.Header().Get("X-Account-Storage-Policy-Gold-Object-Count"))
+	require.Equal(t, "10", rsp.Header().Get("X-Account-Storage-Policy-Gold-Bytes-Used"))
+	require.Equal(t, "2", rsp.Header().Get("X-Account-Storage-Policy-Silver-Container-Count"))
+	require.Equal(t, "4", rsp.Header().Get("X-Account-Storage-Policy-Silver-Object-Count"))
+	require.Equal(t, "20", rsp.Header().Get("X-Account-Storage-Policy-Silver-Bytes-Used"))
+	for key := range rsp.Header() {
+		require.False(t, strings.HasPrefix(key, "X-Account-Storage-Policy-Policy-2"))
+	}
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a?format=json", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	var listing []map[string]interface{}
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &listing))
+	require.Equal(t, 4, len(listing))
+	require.Equal(t, "gold", listing[0]["storage_policy"])
+	require.Equal(t, "silver", listing[1]["storage_policy"])
+	require.Equal(t, "silver", listing[2]["storage_policy"])
+	_, ok := listing[3]["storage_policy"]
+	require.False(t, ok)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a?format=xml", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	require.Contains(t, rsp.Body.String(), "<name>c1</name><bytes>10</bytes><count>2</count>")
+	require.Contains(t, rsp.Body.String(), "<storage_policy>silver</storage_policy>")
+}
+
 func TestContainerGetTextEmpty(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
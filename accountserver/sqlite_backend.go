@@ -151,6 +151,31 @@ func (db *sqliteAccount) GetInfo() (*AccountInfo, error) {
 	return info, nil
 }
 
+// PolicyStats returns the account's container count, object count and bytes used in each storage policy.
+func (db *sqliteAccount) PolicyStats() ([]*PolicyStat, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT storage_policy_index, container_count, object_count, bytes_used
+						   FROM policy_stat ORDER BY storage_policy_index`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := []*PolicyStat{}
+	for rows.Next() {
+		stat := &PolicyStat{}
+		if err := rows.Scan(&stat.StoragePolicyIndex, &stat.ContainerCount, &stat.ObjectCount, &stat.BytesUsed); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
 func (db *sqliteAccount) invalidateCache() {
 	db.infoCache.Store(&AccountInfo{invalid: true})
 }
@@ -323,7 +348,7 @@ func (db *sqliteAccount) ListContainers(limit int, marker string, endMarker stri
 	}
 	var point, pointDirection, queryTail, queryStart string
 
-	queryStart = "SELECT name, object_count, bytes_used, put_timestamp FROM container WHERE "
+	queryStart = "SELECT name, object_count, bytes_used, put_timestamp, storage_policy_index FROM container WHERE "
 	if reverse {
 		marker, endMarker = endMarker, marker
 		queryTail = "ORDER BY name DESC LIMIT ?"
@@ -371,7 +396,7 @@ func (db *sqliteAccount) ListContainers(limit int, marker string, endMarker stri
 		for rows.Next() && len(results) < limit {
 			gotResults = true
 			record := &ContainerListingRecord{}
-			if err := rows.Scan(&record.Name, &record.Count, &record.Bytes, &record.LastModified); err != nil {
+			if err := rows.Scan(&record.Name, &record.Count, &record.Bytes, &record.LastModified, &record.StoragePolicyIndex); err != nil {
 				return nil, err
 			}
 			if f, err := strconv.ParseFloat(record.LastModified, 64); err != nil {
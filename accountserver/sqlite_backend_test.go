@@ -101,6 +101,25 @@ func TestContainerListings(t *testing.T) {
 	require.Equal(t, "b", records[0].(*ContainerListingRecord).Name)
 }
 
+func TestPolicyStats(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutContainer("a", common.GetTimestamp(), "0", 1, 5, 0))
+	require.Nil(t, db.PutContainer("b", common.GetTimestamp(), "0", 2, 10, 1))
+	require.Nil(t, db.PutContainer("c", common.GetTimestamp(), "0", 3, 15, 1))
+	stats, err := db.PolicyStats()
+	require.Nil(t, err)
+	require.Equal(t, []*PolicyStat{
+		{StoragePolicyIndex: 0, ContainerCount: 1, ObjectCount: 1, BytesUsed: 5},
+		{StoragePolicyIndex: 1, ContainerCount: 2, ObjectCount: 5, BytesUsed: 25},
+	}, stats)
+	records, err := db.ListContainers(10000, "", "", "", "", false)
+	require.Nil(t, err)
+	require.Equal(t, 0, records[0].(*ContainerListingRecord).StoragePolicyIndex)
+	require.Equal(t, 1, records[1].(*ContainerListingRecord).StoragePolicyIndex)
+}
+
 func TestNewID(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("200000000.00000")
 	require.Nil(t, err)
@@ -121,10 +121,38 @@ func DoJobs(name string, work []func() bool, concurrency int) {
 	fmt.Printf("  99%%: %.5fs\n", jobTimes[int(float64(len(jobTimes))*0.99)])
 }
 
+// newClient creates a client from the auth settings in the given section of a bench config.
+func newClient(benchconf conf.Config, section string) (client.Client, error) {
+	return client.NewClientFromConfig(client.ClientConfig{
+		AuthURL:                     benchconf.GetDefault(section, "auth", "http://localhost:8080/auth/v1.0"),
+		Username:                    benchconf.GetDefault(section, "user", "test:tester"),
+		APIKey:                      benchconf.GetDefault(section, "key", "testing"),
+		Password:                    benchconf.GetDefault(section, "password", ""),
+		Tenant:                      benchconf.GetDefault(section, "project", ""),
+		ProjectID:                   benchconf.GetDefault(section, "project_id", ""),
+		UserDomain:                  benchconf.GetDefault(section, "user_domain", ""),
+		ProjectDomain:               benchconf.GetDefault(section, "project_domain", ""),
+		Token:                       benchconf.GetDefault(section, "token", ""),
+		ApplicationCredentialID:     benchconf.GetDefault(section, "application_credential_id", ""),
+		ApplicationCredentialName:   benchconf.GetDefault(section, "application_credential_name", ""),
+		ApplicationCredentialSecret: benchconf.GetDefault(section, "application_credential_secret", ""),
+		Region:                      benchconf.GetDefault(section, "region", ""),
+		Interface:                   benchconf.GetDefault(section, "interface", ""),
+		Insecure:                    benchconf.GetBool(section, "allow_insecure_auth_cert", false),
+	})
+}
+
+// printAuthUsage lists the optional keystone settings understood by newClient.
+func printAuthUsage() {
+	fmt.Println("For keystone v3, use a /v3 auth url and some of:")
+	fmt.Println("    password, project, project_id, user_domain, project_domain, token,")
+	fmt.Println("    application_credential_id, application_credential_name,")
+	fmt.Println("    application_credential_secret, region, interface")
+}
+
 func RunBench(args []string) {
 	if len(args) < 1 {
 		fmt.Println("Usage: [configuration file]")
-		fmt.Println("Only supports auth 1.0.")
 		fmt.Println("The configuration file should look something like:")
 		fmt.Println("    [bench]")
 		fmt.Println("    auth = http://localhost:8080/auth/v1.0")
@@ -137,6 +165,7 @@ func RunBench(args []string) {
 		fmt.Println("    delete = yes")
 		fmt.Println("    allow_insecure_auth_cert = no")
 		fmt.Println("    single_container = false")
+		printAuthUsage()
 		os.Exit(1)
 	}
 
@@ -146,24 +175,15 @@ func RunBench(args []string) {
 		os.Exit(1)
 	}
 
-	authURL := benchconf.GetDefault("bench", "auth", "http://localhost:8080/auth/v1.0")
-	authUser := benchconf.GetDefault("bench", "user", "test:tester")
-	authKey := benchconf.GetDefault("bench", "key", "testing")
 	concurrency := int(benchconf.GetInt("bench", "concurrency", 16))
 	objectSize := benchconf.GetInt("bench", "object_size", 131072)
 	numObjects := benchconf.GetInt("bench", "num_objects", 5000)
 	numGets := benchconf.GetInt("bench", "num_gets", 30000)
 	delete := benchconf.GetBool("bench", "delete", true)
 	singleContainer := benchconf.GetBool("bench", "single_container", false)
-	allowInsecureAuthCert := benchconf.GetBool("bench", "allow_insecure_auth_cert", false)
 	salt := fmt.Sprintf("%d", rand.Int63())
 
-	var cli client.Client
-	if allowInsecureAuthCert {
-		cli, err = client.NewInsecureClient("", authUser, "", authKey, "", authURL, false)
-	} else {
-		cli, err = client.NewClient("", authUser, "", authKey, "", authURL, false)
-	}
+	cli, err := newClient(benchconf, "bench")
 	if err != nil {
 		fmt.Println("Error creating client:", err)
 		os.Exit(1)
@@ -224,7 +244,6 @@ func RunThrash(args []string) {
 	rand.Seed(time.Now().UTC().UnixNano())
 	if len(args) < 1 {
 		fmt.Println("Usage: [configuration file]")
-		fmt.Println("Only supports auth 1.0.")
 		fmt.Println("The configuration file should look something like:")
 		fmt.Println("    [thrash]")
 		fmt.Println("    auth = http://localhost:8080/auth/v1.0")
@@ -235,6 +254,7 @@ func RunThrash(args []string) {
 		fmt.Println("    num_objects = 5000")
 		fmt.Println("    gets_per_object = 5")
 		fmt.Println("    allow_insecure_auth_cert = no")
+		printAuthUsage()
 		os.Exit(1)
 	}
 
@@ -244,22 +264,13 @@ func RunThrash(args []string) {
 		os.Exit(1)
 	}
 
-	authURL := thrashconf.GetDefault("thrash", "auth", "http://localhost:8080/auth/v1.0")
-	authUser := thrashconf.GetDefault("thrash", "user", "test:tester")
-	authKey := thrashconf.GetDefault("thrash", "key", "testing")
 	concurrency := int(thrashconf.GetInt("thrash", "concurrency", 16))
 	objectSize := thrashconf.GetInt("thrash", "object_size", 131072)
 	numObjects := thrashconf.GetInt("thrash", "num_objects", 5000)
 	numGets := int(thrashconf.GetInt("thrash", "gets_per_object", 5))
-	allowInsecureAuthCert := thrashconf.GetBool("bench", "allow_insecure_auth_cert", false)
 	salt := fmt.Sprintf("%d", rand.Int63())
 
-	var cli client.Client
-	if allowInsecureAuthCert {
-		cli, err = client.NewInsecureClient("", authUser, "", authKey, "", authURL, false)
-	} else {
-		cli, err = client.NewClient("", authUser, "", authKey, "", authURL, false)
-	}
+	cli, err := newClient(thrashconf, "thrash")
 	if err != nil {
 		fmt.Println("Error creating client:", err)
 		os.Exit(1)
@@ -1,9 +1,13 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 // HTTPError represents a non-200 HTTP response code.
@@ -15,9 +19,10 @@ func (e HTTPError) Error() string {
 
 // ContainerRecord is an entry in an account listing.
 type ContainerRecord struct {
-	Count int64  `json:"count"`
-	Bytes int64  `json:"bytes"`
-	Name  string `json:"name"`
+	Count  int64  `json:"count"`
+	Bytes  int64  `json:"bytes"`
+	Name   string `json:"name"`
+	Subdir string `json:"subdir,omitempty"`
 }
 
 // ObjectRecord is an entry in a container listing.
@@ -27,6 +32,7 @@ type ObjectRecord struct {
 	Bytes        int    `json:"bytes"`
 	Name         string `json:"name"`
 	ContentType  string `json:"content_type"`
+	Subdir       string `json:"subdir,omitempty"`
 }
 
 // Client is an API interface to CloudFiles.
@@ -46,6 +52,193 @@ type Client interface {
 	GetObject(container string, obj string, headers map[string]string) (io.ReadCloser, map[string]string, error)
 	HeadObject(container string, obj string, headers map[string]string) (map[string]string, error)
 	DeleteObject(container string, obj string, headers map[string]string) (err error)
+	GetURL() string
+}
+
+// ByteRange is a range of bytes to GET, with an inclusive End.  An End of -1 reads from Start to the end of the
+// object, and a Start of -1 reads the last End bytes.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r ByteRange) String() string {
+	if r.Start < 0 {
+		return fmt.Sprintf("-%d", r.End)
+	} else if r.End < 0 {
+		return fmt.Sprintf("%d-", r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// RequestOptions are the optional parts of a ClientV2 request.  Zero values are left out of the request.
+type RequestOptions struct {
+	Headers           http.Header
+	Query             url.Values
+	Ranges            []ByteRange
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   time.Time
+	IfUnmodifiedSince time.Time
+}
+
+func (o *RequestOptions) apply(req *http.Request) {
+	if o == nil {
+		return
+	}
+	for k, v := range o.Headers {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if len(o.Ranges) > 0 {
+		ranges := make([]string, len(o.Ranges))
+		for i, r := range o.Ranges {
+			ranges[i] = r.String()
+		}
+		req.Header.Set("Range", "bytes="+strings.Join(ranges, ","))
+	}
+	if o.IfMatch != "" {
+		req.Header.Set("If-Match", o.IfMatch)
+	}
+	if o.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", o.IfNoneMatch)
+	}
+	if !o.IfModifiedSince.IsZero() {
+		req.Header.Set("If-Modified-Since", o.IfModifiedSince.UTC().Format(http.TimeFormat))
+	}
+	if !o.IfUnmodifiedSince.IsZero() {
+		req.Header.Set("If-Unmodified-Since", o.IfUnmodifiedSince.UTC().Format(http.TimeFormat))
+	}
+}
+
+// ListOptions narrow down and page account and container listings.  PageSize is how many records each request
+// fetches, leaving it up to the server when 0.
+type ListOptions struct {
+	Prefix    string
+	Delimiter string
+	Marker    string
+	EndMarker string
+	PageSize  int
+	Headers   http.Header
+}
+
+// listPager holds the paging state the listing iterators share.
+type listPager struct {
+	marker string
+	done   bool
+	err    error
+}
+
+// nextPage fetches the page after the marker with fetch, which returns how many records it got and the marker to
+// continue from, and returns false once the listing is over or has failed.  Only an empty page ends a listing, since
+// servers can send fewer records than were asked for before the end.
+func (p *listPager) nextPage(fetch func(marker string) (int, string, error)) bool {
+	if p.done || p.err != nil {
+		return false
+	}
+	count, marker, err := fetch(p.marker)
+	if err != nil || count == 0 {
+		p.done, p.err = true, err
+		return false
+	}
+	p.marker = marker
+	return true
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (p *listPager) Err() error {
+	return p.err
+}
+
+// ContainerIterator lazily pages through an account listing.  Call Next until it returns false, then check Err.
+type ContainerIterator struct {
+	listPager
+	fetch   func(marker string) ([]ContainerRecord, error)
+	page    []ContainerRecord
+	current ContainerRecord
+}
+
+// Next advances to the next record, fetching another page of the listing when needed.
+func (it *ContainerIterator) Next() bool {
+	for len(it.page) == 0 {
+		if !it.nextPage(func(marker string) (int, string, error) {
+			page, err := it.fetch(marker)
+			if err != nil || len(page) == 0 {
+				return 0, "", err
+			}
+			it.page = page
+			if last := page[len(page)-1]; last.Subdir != "" {
+				return len(page), last.Subdir, nil
+			}
+			return len(page), page[len(page)-1].Name, nil
+		}) {
+			return false
+		}
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Record returns the current record.
+func (it *ContainerIterator) Record() ContainerRecord {
+	return it.current
+}
+
+// ObjectIterator lazily pages through a container listing.  Call Next until it returns false, then check Err.
+type ObjectIterator struct {
+	listPager
+	fetch   func(marker string) ([]ObjectRecord, error)
+	page    []ObjectRecord
+	current ObjectRecord
+}
+
+// Next advances to the next record, fetching another page of the listing when needed.
+func (it *ObjectIterator) Next() bool {
+	for len(it.page) == 0 {
+		if !it.nextPage(func(marker string) (int, string, error) {
+			page, err := it.fetch(marker)
+			if err != nil || len(page) == 0 {
+				return 0, "", err
+			}
+			it.page = page
+			if last := page[len(page)-1]; last.Subdir != "" {
+				return len(page), last.Subdir, nil
+			}
+			return len(page), page[len(page)-1].Name, nil
+		}) {
+			return false
+		}
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Record returns the current record.
+func (it *ObjectIterator) Record() ObjectRecord {
+	return it.current
+}
+
+// ClientV2 is the context-aware version of Client.  Headers keep all their values, and non-2xx responses are
+// returned as an HTTPError, including 304s and 412s from conditional requests.
+type ClientV2 interface {
+	PutAccount(ctx context.Context, opts *RequestOptions) error
+	PostAccount(ctx context.Context, opts *RequestOptions) error
+	ListContainers(ctx context.Context, opts *ListOptions) *ContainerIterator
+	HeadAccount(ctx context.Context, opts *RequestOptions) (http.Header, error)
+	DeleteAccount(ctx context.Context, opts *RequestOptions) error
+	PutContainer(ctx context.Context, container string, opts *RequestOptions) error
+	PostContainer(ctx context.Context, container string, opts *RequestOptions) error
+	ListObjects(ctx context.Context, container string, opts *ListOptions) *ObjectIterator
+	HeadContainer(ctx context.Context, container string, opts *RequestOptions) (http.Header, error)
+	DeleteContainer(ctx context.Context, container string, opts *RequestOptions) error
+	PutObject(ctx context.Context, container string, obj string, src io.Reader, opts *RequestOptions) (http.Header, error)
+	// PutLargeObject uploads src in segments of segmentSize bytes to the "<container>_segments" container, then
+	// writes a static large object manifest of them to container/obj.
+	PutLargeObject(ctx context.Context, container string, obj string, src io.Reader, segmentSize int64, opts *RequestOptions) (http.Header, error)
+	PostObject(ctx context.Context, container string, obj string, opts *RequestOptions) error
+	GetObject(ctx context.Context, container string, obj string, opts *RequestOptions) (io.ReadCloser, http.Header, error)
+	HeadObject(ctx context.Context, container string, obj string, opts *RequestOptions) (http.Header, error)
+	DeleteObject(ctx context.Context, container string, obj string, opts *RequestOptions) error
+	GetURL() string
 }
 
 // ProxyClient is similar to Client except it also accepts an account parameter to its operations.  This is meant to be used by the proxy server.
@@ -66,3 +259,10 @@ type ProxyClient interface {
 	HeadObject(account string, container string, obj string, headers http.Header) (http.Header, int)
 	DeleteObject(account string, container string, obj string, headers http.Header) int
 }
+
+// TrailerReader is implemented by PutObject sources that have trailers to send to the object servers.  The values
+// are filled in once the source has been read to EOF, so the trailer's keys must all be present beforehand.
+type TrailerReader interface {
+	io.Reader
+	Trailer() http.Header
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/troubling/hummingbird/common"
@@ -31,10 +32,17 @@ func mkquery(options map[string]string) string {
 }
 
 type ProxyDirectClient struct {
-	client        *http.Client
-	AccountRing   ring.Ring
-	ContainerRing ring.Ring
-	ObjectRing    ring.Ring
+	client                   *http.Client
+	AccountRing              ring.Ring
+	ContainerRing            ring.Ring
+	ObjectRing               ring.Ring
+	sortingMethod            string
+	readAffinity             []affinityRule
+	writeAffinity            []affinityRule
+	errorSuppressionLimit    int
+	errorSuppressionInterval time.Duration
+	nodeStatsLock            sync.Mutex
+	nodeStats                map[string]*nodeStat
 }
 
 func (c *ProxyDirectClient) quorumResponse(reqs ...*http.Request) int {
@@ -45,7 +53,7 @@ func (c *ProxyDirectClient) quorumResponse(reqs ...*http.Request) int {
 	for _, req := range reqs {
 		go func(req *http.Request) {
 			status := 500
-			if resp, err := c.client.Do(req); err == nil {
+			if resp, err := c.do(req); err == nil {
 				status = resp.StatusCode
 				resp.Body.Close()
 			}
@@ -78,7 +86,7 @@ func (c *ProxyDirectClient) firstResponse(reqs ...*http.Request) (resp *http.Res
 		go func(r *http.Request) {
 			cancel := make(chan struct{})
 			r.Cancel = cancel
-			response, err := c.client.Do(r)
+			response, err := c.do(r)
 			if err != nil {
 				response = nil
 			}
@@ -100,6 +108,65 @@ func (c *ProxyDirectClient) firstResponse(reqs ...*http.Request) (resp *http.Res
 	return nil
 }
 
+// responseTimestamp returns the newest of a backend response's timestamps, standardized so they compare as strings.
+// Account and container servers send their put and delete timestamps too, which say more about which replica is
+// newest than when it was created.
+func responseTimestamp(headers http.Header) string {
+	newest := ""
+	for _, key := range []string{"X-Backend-Timestamp", "X-Backend-Put-Timestamp", "X-Backend-Delete-Timestamp"} {
+		if ts, err := common.StandardizeTimestamp(headers.Get(key)); err == nil && ts > newest {
+			newest = ts
+		}
+	}
+	return newest
+}
+
+// newestResponse sends all of the requests at once, and returns the successful or 404 response with the newest
+// timestamp.  That way a replica that missed an update or a delete can't serve stale data.
+func (c *ProxyDirectClient) newestResponse(reqs ...*http.Request) (newest *http.Response) {
+	responses := make(chan *http.Response)
+	for _, req := range reqs {
+		go func(r *http.Request) {
+			response, err := c.do(r)
+			if err != nil {
+				response = nil
+			}
+			responses <- response
+		}(req)
+	}
+	newestTimestamp := ""
+	for range reqs {
+		resp := <-responses
+		if resp == nil {
+			continue
+		}
+		if resp.StatusCode/100 != 2 && resp.StatusCode != 404 {
+			resp.Body.Close()
+			continue
+		}
+		// on a tie, data wins over a 404 that has no timestamp to go on.
+		ts := responseTimestamp(resp.Header)
+		if newest == nil || ts > newestTimestamp || (ts == newestTimestamp && newest.StatusCode == 404 && resp.StatusCode != 404) {
+			if newest != nil {
+				newest.Body.Close()
+			}
+			newest, newestTimestamp = resp, ts
+		} else {
+			resp.Body.Close()
+		}
+	}
+	return newest
+}
+
+// readResponse returns the newest response if the request asked for it with X-Newest, or else the first successful
+// one.
+func (c *ProxyDirectClient) readResponse(headers http.Header, reqs ...*http.Request) *http.Response {
+	if common.LooksTrue(headers.Get("X-Newest")) {
+		return c.newestResponse(reqs...)
+	}
+	return c.firstResponse(reqs...)
+}
+
 var _ ProxyClient = &ProxyDirectClient{}
 
 func (c *ProxyDirectClient) PutAccount(account string, headers http.Header) int {
@@ -134,7 +201,7 @@ func (c *ProxyDirectClient) GetAccount(account string, options map[string]string
 	partition := c.AccountRing.GetPartition(account, "", "")
 	reqs := make([]*http.Request, 0)
 	query := mkquery(options)
-	for _, device := range c.AccountRing.GetNodes(partition) {
+	for _, device := range c.readNodes(c.AccountRing, partition) {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s%s", device.Ip, device.Port, device.Device, partition,
 			common.Urlencode(account), query)
 		req, _ := http.NewRequest("GET", url, nil)
@@ -143,7 +210,7 @@ func (c *ProxyDirectClient) GetAccount(account string, options map[string]string
 		}
 		reqs = append(reqs, req)
 	}
-	resp := c.firstResponse(reqs...)
+	resp := c.readResponse(headers, reqs...)
 	if resp == nil {
 		return nil, nil, 404
 	}
@@ -153,7 +220,7 @@ func (c *ProxyDirectClient) GetAccount(account string, options map[string]string
 func (c *ProxyDirectClient) HeadAccount(account string, headers http.Header) (http.Header, int) {
 	partition := c.AccountRing.GetPartition(account, "", "")
 	reqs := make([]*http.Request, 0)
-	for _, device := range c.AccountRing.GetNodes(partition) {
+	for _, device := range c.readNodes(c.AccountRing, partition) {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s", device.Ip, device.Port, device.Device, partition,
 			common.Urlencode(account))
 		req, err := http.NewRequest("HEAD", url, nil)
@@ -165,7 +232,7 @@ func (c *ProxyDirectClient) HeadAccount(account string, headers http.Header) (ht
 		}
 		reqs = append(reqs, req)
 	}
-	resp := c.firstResponse(reqs...)
+	resp := c.readResponse(headers, reqs...)
 	if resp == nil {
 		return nil, 404
 	}
@@ -226,7 +293,7 @@ func (c *ProxyDirectClient) GetContainer(account string, container string, optio
 	partition := c.ContainerRing.GetPartition(account, container, "")
 	reqs := make([]*http.Request, 0)
 	query := mkquery(options)
-	for _, device := range c.ContainerRing.GetNodes(partition) {
+	for _, device := range c.readNodes(c.ContainerRing, partition) {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s/%s%s", device.Ip, device.Port, device.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), query)
 		req, _ := http.NewRequest("GET", url, nil)
@@ -235,7 +302,7 @@ func (c *ProxyDirectClient) GetContainer(account string, container string, optio
 		}
 		reqs = append(reqs, req)
 	}
-	resp := c.firstResponse(reqs...)
+	resp := c.readResponse(headers, reqs...)
 	if resp == nil {
 		return nil, nil, 404
 	}
@@ -245,7 +312,7 @@ func (c *ProxyDirectClient) GetContainer(account string, container string, optio
 func (c *ProxyDirectClient) HeadContainer(account string, container string, headers http.Header) (http.Header, int) {
 	partition := c.ContainerRing.GetPartition(account, container, "")
 	reqs := make([]*http.Request, 0)
-	for _, device := range c.ContainerRing.GetNodes(partition) {
+	for _, device := range c.readNodes(c.ContainerRing, partition) {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", device.Ip, device.Port, device.Device, partition,
 			common.Urlencode(account), common.Urlencode(container))
 		req, err := http.NewRequest("HEAD", url, nil)
@@ -257,7 +324,7 @@ func (c *ProxyDirectClient) HeadContainer(account string, container string, head
 		}
 		reqs = append(reqs, req)
 	}
-	resp := c.firstResponse(reqs...)
+	resp := c.readResponse(headers, reqs...)
 	if resp == nil {
 		return nil, 404
 	}
@@ -291,7 +358,7 @@ func (c *ProxyDirectClient) PutObject(account string, container string, obj stri
 	containerDevices := c.ContainerRing.GetNodes(containerPartition)
 	var writers []*io.PipeWriter
 	reqs := make([]*http.Request, 0)
-	for i, device := range c.ObjectRing.GetNodes(partition) {
+	for i, device := range c.writeNodes(c.ObjectRing, partition) {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s/%s/%s", device.Ip, device.Port, device.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 		rp, wp := io.Pipe()
@@ -311,11 +378,20 @@ func (c *ProxyDirectClient) PutObject(account string, container string, obj stri
 		req.Header.Set("X-Container-Host", fmt.Sprintf("%s:%d", containerDevices[i].Ip, containerDevices[i].Port))
 		req.Header.Set("X-Container-Device", containerDevices[i].Device)
 		req.Header.Set("Expect", "100-Continue")
+		if tr, ok := src.(TrailerReader); ok {
+			req.Trailer = tr.Trailer()
+		}
 		reqs = append(reqs, req)
 	}
 	go func() {
 		mw := io.MultiWriter(writers[0], writers[1], writers[2])
-		io.Copy(mw, src)
+		if _, err := io.Copy(mw, src); err != nil {
+			// abort the backend requests rather than let them store a truncated object.
+			for _, writer := range writers {
+				writer.CloseWithError(err)
+			}
+			return
+		}
 		for _, writer := range writers {
 			writer.Close()
 		}
@@ -346,7 +422,7 @@ func (c *ProxyDirectClient) PostObject(account string, container string, obj str
 
 func (c *ProxyDirectClient) GetObject(account string, container string, obj string, headers http.Header) (io.ReadCloser, http.Header, int) {
 	partition := c.ObjectRing.GetPartition(account, container, obj)
-	nodes := c.ObjectRing.GetNodes(partition)
+	nodes := c.readNodes(c.ObjectRing, partition)
 	reqs := make([]*http.Request, 0, len(nodes))
 	for _, device := range nodes {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s/%s/%s", device.Ip, device.Port, device.Device, partition,
@@ -360,13 +436,138 @@ func (c *ProxyDirectClient) GetObject(account string, container string, obj stri
 		}
 		reqs = append(reqs, req)
 	}
-	resp := c.firstResponse(reqs...)
+	resp := c.readResponse(headers, reqs...)
 	if resp == nil {
 		return nil, nil, 404
 	}
+	path := common.Urlencode(account) + "/" + common.Urlencode(container) + "/" + common.Urlencode(obj)
+	if body := c.newResumingObjectReader(resp, partition, path, nodes, headers); body != nil {
+		return body, resp.Header, resp.StatusCode
+	}
 	return resp.Body, resp.Header, resp.StatusCode
 }
 
+// resumingObjectReader streams an object GET, and if the node it's reading from fails partway through, carries on
+// from the same byte with a ranged GET to another node, pinned to the original ETag with If-Match.
+type resumingObjectReader struct {
+	c         *ProxyDirectClient
+	body      io.ReadCloser
+	key       string
+	urls      []string
+	more      ring.MoreNodes
+	handoffs  uint64
+	partition uint64
+	path      string
+	headers   http.Header
+	etag      string
+	offset    int64
+	end       int64
+}
+
+// newResumingObjectReader wraps a full or single-range GET response in a resumingObjectReader.  It returns nil for
+// responses that can't be resumed, like multipart range responses or ones without an ETag.
+func (c *ProxyDirectClient) newResumingObjectReader(resp *http.Response, partition uint64, path string, nodes []*ring.Device, headers http.Header) io.ReadCloser {
+	r := &resumingObjectReader{c: c, body: resp.Body, partition: partition, path: path, headers: headers, etag: resp.Header.Get("ETag")}
+	if r.etag == "" || resp.Request == nil {
+		return nil
+	}
+	r.key = requestKey(resp.Request)
+	switch resp.StatusCode {
+	case 200:
+		length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		if err != nil {
+			return nil
+		}
+		r.end = length - 1
+	case 206:
+		var length int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &r.offset, &r.end, &length); err != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	for _, device := range nodes {
+		if url := r.deviceURL(device); url != resp.Request.URL.String() {
+			r.urls = append(r.urls, url)
+		}
+	}
+	r.more = c.ObjectRing.GetMoreNodes(partition)
+	return r
+}
+
+func (r *resumingObjectReader) deviceURL(device *ring.Device) string {
+	return fmt.Sprintf("http://%s:%d/%s/%d/%s", device.Ip, device.Port, device.Device, r.partition, r.path)
+}
+
+// nextURL returns the next node to try resuming from: the other primaries, then as many handoffs as there are
+// replicas.
+func (r *resumingObjectReader) nextURL() string {
+	if len(r.urls) > 0 {
+		url := r.urls[0]
+		r.urls = r.urls[1:]
+		return url
+	}
+	if r.more == nil || r.handoffs >= r.c.ObjectRing.ReplicaCount() {
+		return ""
+	}
+	r.handoffs++
+	if device := r.more.Next(); device != nil {
+		return r.deviceURL(device)
+	}
+	return ""
+}
+
+func (r *resumingObjectReader) resume() io.ReadCloser {
+	for url := r.nextURL(); url != ""; url = r.nextURL() {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			continue
+		}
+		for key := range r.headers {
+			req.Header.Set(key, r.headers.Get(key))
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.end))
+		req.Header.Set("If-Match", r.etag)
+		resp, err := r.c.do(req)
+		if err != nil {
+			continue
+		}
+		var start, end, length int64
+		if resp.StatusCode != 206 || resp.Header.Get("ETag") != r.etag {
+			resp.Body.Close()
+		} else if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &length); err != nil || start != r.offset {
+			resp.Body.Close()
+		} else {
+			r.key = requestKey(req)
+			return resp.Body
+		}
+	}
+	return nil
+}
+
+func (r *resumingObjectReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	r.body.Close()
+	r.c.recordResponse(r.key, 0, 1)
+	if r.offset > r.end {
+		return n, io.EOF
+	}
+	if body := r.resume(); body != nil {
+		r.body = body
+		return n, nil
+	}
+	return n, err
+}
+
+func (r *resumingObjectReader) Close() error {
+	return r.body.Close()
+}
+
 func (c *ProxyDirectClient) GrepObject(account string, container string, obj string, search string) (io.ReadCloser, http.Header, int) {
 	partition := c.ObjectRing.GetPartition(account, container, obj)
 	nodes := c.ObjectRing.GetNodes(partition)
@@ -389,7 +590,7 @@ func (c *ProxyDirectClient) GrepObject(account string, container string, obj str
 
 func (c *ProxyDirectClient) HeadObject(account string, container string, obj string, headers http.Header) (http.Header, int) {
 	partition := c.ObjectRing.GetPartition(account, container, obj)
-	nodes := c.ObjectRing.GetNodes(partition)
+	nodes := c.readNodes(c.ObjectRing, partition)
 	reqs := make([]*http.Request, 0, len(nodes))
 	for _, device := range nodes {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s/%s/%s", device.Ip, device.Port, device.Device, partition,
@@ -403,7 +604,7 @@ func (c *ProxyDirectClient) HeadObject(account string, container string, obj str
 		}
 		reqs = append(reqs, req)
 	}
-	resp := c.firstResponse(reqs...)
+	resp := c.readResponse(headers, reqs...)
 	if resp == nil {
 		return nil, 404
 	}
@@ -416,7 +617,7 @@ func (c *ProxyDirectClient) DeleteObject(account string, container string, obj s
 	containerPartition := c.ContainerRing.GetPartition(account, container, "")
 	containerDevices := c.ContainerRing.GetNodes(containerPartition)
 	reqs := make([]*http.Request, 0)
-	for i, device := range c.ObjectRing.GetNodes(partition) {
+	for i, device := range c.writeNodes(c.ObjectRing, partition) {
 		url := fmt.Sprintf("http://%s:%d/%s/%d/%s/%s/%s", device.Ip, device.Port, device.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 		req, _ := http.NewRequest("DELETE", url, nil)
@@ -432,53 +633,94 @@ func (c *ProxyDirectClient) DeleteObject(account string, container string, obj s
 	return c.quorumResponse(reqs...)
 }
 
-func NewProxyDirectClient() (ProxyClient, error) {
-	c := &ProxyDirectClient{}
+// NewProxyDirectClient creates a ProxyClient using the rings in /etc/hummingbird or /etc/swift, configured by the
+// proxy server's section of its config.
+func NewProxyDirectClient(config conf.Section) (ProxyClient, error) {
 	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
 	if err != nil {
 		return nil, err
 	}
-	c.ObjectRing, err = ring.GetRing("object", hashPathPrefix, hashPathSuffix, 0)
+	objectRing, err := ring.GetRing("object", hashPathPrefix, hashPathSuffix, 0)
 	if err != nil {
 		return nil, err
 	}
-	c.ContainerRing, err = ring.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	containerRing, err := ring.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
 	if err != nil {
 		return nil, err
 	}
-	c.AccountRing, err = ring.GetRing("account", hashPathPrefix, hashPathSuffix, 0)
+	accountRing, err := ring.GetRing("account", hashPathPrefix, hashPathSuffix, 0)
 	if err != nil {
 		return nil, err
 	}
-	c.client = &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 5 * time.Second,
-			}).Dial,
-		},
-		Timeout: 120 * time.Minute,
-	}
-	return c, nil
+	return newProxyDirectClient(config, accountRing, containerRing, objectRing)
 }
 
+// NewProxyDirectClientWithRings creates a ProxyClient using the given rings and default settings.
 func NewProxyDirectClientWithRings(accountRing ring.Ring, containerRing ring.Ring, objectRing ring.Ring) (ProxyClient, error) {
-	c := &ProxyDirectClient{}
-	c.AccountRing = accountRing
-	c.ContainerRing = containerRing
-	c.ObjectRing = objectRing
+	return newProxyDirectClient(conf.Section{}, accountRing, containerRing, objectRing)
+}
+
+func newProxyDirectClient(config conf.Section, accountRing ring.Ring, containerRing ring.Ring, objectRing ring.Ring) (*ProxyDirectClient, error) {
+	c := &ProxyDirectClient{
+		AccountRing:              accountRing,
+		ContainerRing:            containerRing,
+		ObjectRing:               objectRing,
+		sortingMethod:            strings.ToLower(config.GetDefault("sorting_method", "")),
+		errorSuppressionLimit:    int(config.GetInt("error_suppression_limit", 10)),
+		errorSuppressionInterval: time.Duration(config.GetFloat("error_suppression_interval", 60) * float64(time.Second)),
+		nodeStats:                map[string]*nodeStat{},
+	}
+	switch c.sortingMethod {
+	case "", "shuffle", "timing", "affinity":
+	default:
+		return nil, fmt.Errorf("Unknown sorting_method %q", c.sortingMethod)
+	}
+	var err error
+	if c.readAffinity, err = parseAffinity(config.GetDefault("read_affinity", "")); err != nil {
+		return nil, err
+	}
+	if c.writeAffinity, err = parseAffinity(config.GetDefault("write_affinity", "")); err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.GetFloat("conn_timeout", 10) * float64(time.Second)),
+		KeepAlive: 5 * time.Second,
+	}
+	// node_timeout is how long a node can go without responding or moving any data, not a limit on the whole
+	// request, so large objects can take as long as they need.
+	nodeTimeout := time.Duration(config.GetFloat("node_timeout", 10) * float64(time.Second))
 	c.client = &http.Client{
 		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 5 * time.Second,
-			}).Dial,
+			Dial: func(network, addr string) (net.Conn, error) {
+				conn, err := dialer.Dial(network, addr)
+				if err != nil || nodeTimeout <= 0 {
+					return conn, err
+				}
+				return &idleTimeoutConn{Conn: conn, timeout: nodeTimeout}, nil
+			},
+			ResponseHeaderTimeout: nodeTimeout,
 		},
-		Timeout: 120 * time.Minute,
 	}
 	return c, nil
 }
 
+// idleTimeoutConn fails reads and writes once the connection has been idle for too long.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	// the response is read while a request body is still being sent, so sending counts as activity for both.
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
 type directClient struct {
 	*ProxyDirectClient
 	account string
@@ -627,9 +869,13 @@ func (c *directClient) DeleteObject(container string, obj string, headers map[st
 	return nil
 }
 
+func (c *directClient) GetURL() string {
+	return "<direct>/" + common.Urlencode(c.account)
+}
+
 // NewDirectClient creates a new direct client with the given account name.
 func NewDirectClient(account string) (Client, error) {
-	rdc, err := NewProxyDirectClient()
+	rdc, err := NewProxyDirectClient(conf.Section{})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+// faultyObjectServer serves one object, optionally dying after sending failAfter bytes of it.
+type faultyObjectServer struct {
+	server    *httptest.Server
+	data      []byte
+	etag      string
+	failAfter int
+	requests  []*http.Request
+}
+
+func newFaultyObjectServer(data []byte, etag string, failAfter int) *faultyObjectServer {
+	s := &faultyObjectServer{data: data, etag: etag, failAfter: failAfter}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+type truncatingWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		w.ResponseWriter.Write(p[:w.left])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.left -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (s *faultyObjectServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.requests = append(s.requests, request)
+	if s.data == nil {
+		writer.WriteHeader(404)
+		return
+	}
+	writer.Header().Set("ETag", s.etag)
+	if s.failAfter >= 0 {
+		writer = &truncatingWriter{ResponseWriter: writer, left: s.failAfter}
+	}
+	http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *faultyObjectServer) device() *ring.Device {
+	u, _ := url.Parse(s.server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return &ring.Device{Ip: u.Hostname(), Port: port, Device: "sda"}
+}
+
+func newResumingTestClient(servers ...*faultyObjectServer) *ProxyDirectClient {
+	r := &test.FakeRing{}
+	for _, s := range servers[:3] {
+		r.MockDevices = append(r.MockDevices, s.device())
+	}
+	if len(servers) > 3 {
+		r.MockMoreNodes = servers[3].device()
+	}
+	return &ProxyDirectClient{client: &http.Client{}, ObjectRing: r}
+}
+
+func testObjectData() []byte {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestGetObjectResumesFullGet(t *testing.T) {
+	data := testObjectData()
+	servers := []*faultyObjectServer{newFaultyObjectServer(data, `"abc"`, 100), newFaultyObjectServer(data, `"abc"`, -1),
+		newFaultyObjectServer(data, `"abc"`, -1)}
+	for _, s := range servers {
+		defer s.server.Close()
+	}
+	c := newResumingTestClient(servers...)
+	body, headers, code := c.GetObject("a", "c", "o", http.Header{})
+	require.Equal(t, 200, code)
+	require.Equal(t, "1000", headers.Get("Content-Length"))
+	read, err := ioutil.ReadAll(body)
+	require.Nil(t, err)
+	require.Nil(t, body.Close())
+	require.Equal(t, data, read)
+	require.Equal(t, 1, len(servers[1].requests))
+	require.Equal(t, "bytes=100-999", servers[1].requests[0].Header.Get("Range"))
+	require.Equal(t, `"abc"`, servers[1].requests[0].Header.Get("If-Match"))
+	require.Equal(t, "/sda/0/a/c/o", servers[1].requests[0].URL.Path)
+	require.Equal(t, 0, len(servers[2].requests))
+}
+
+func TestGetObjectResumesRange(t *testing.T) {
+	data := testObjectData()
+	servers := []*faultyObjectServer{newFaultyObjectServer(data, `"abc"`, 50), newFaultyObjectServer(data, `"abc"`, -1),
+		newFaultyObjectServer(data, `"abc"`, -1)}
+	for _, s := range servers {
+		defer s.server.Close()
+	}
+	c := newResumingTestClient(servers...)
+	body, _, code := c.GetObject("a", "c", "o", http.Header{"Range": {"bytes=200-699"}})
+	require.Equal(t, 206, code)
+	read, err := ioutil.ReadAll(body)
+	require.Nil(t, err)
+	require.Equal(t, data[200:700], read)
+	require.Equal(t, "bytes=250-699", servers[1].requests[0].Header.Get("Range"))
+}
+
+func TestGetObjectResumesFromHandoff(t *testing.T) {
+	data := testObjectData()
+	// the second primary has a different version of the object, and the third dies too.
+	servers := []*faultyObjectServer{newFaultyObjectServer(data, `"abc"`, 100), newFaultyObjectServer(data, `"def"`, -1),
+		newFaultyObjectServer(data, `"abc"`, 300), newFaultyObjectServer(data, `"abc"`, -1)}
+	for _, s := range servers {
+		defer s.server.Close()
+	}
+	c := newResumingTestClient(servers...)
+	body, _, code := c.GetObject("a", "c", "o", http.Header{})
+	require.Equal(t, 200, code)
+	read, err := ioutil.ReadAll(body)
+	require.Nil(t, err)
+	require.Equal(t, data, read)
+	require.Equal(t, "bytes=400-999", servers[3].requests[0].Header.Get("Range"))
+}
+
+func TestGetObjectResumeFails(t *testing.T) {
+	data := testObjectData()
+	servers := []*faultyObjectServer{newFaultyObjectServer(data, `"abc"`, 100), newFaultyObjectServer(nil, "", -1),
+		newFaultyObjectServer(data, `"def"`, -1)}
+	for _, s := range servers {
+		defer s.server.Close()
+	}
+	c := newResumingTestClient(servers...)
+	body, _, code := c.GetObject("a", "c", "o", http.Header{})
+	require.Equal(t, 200, code)
+	read, err := ioutil.ReadAll(body)
+	require.NotNil(t, err)
+	require.Equal(t, data[:100], read)
+}
+
+// replicaServer stands in for a backend with its own version of a resource.
+func replicaServer(status int, headers map[string]string, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		for k, v := range headers {
+			writer.Header().Set(k, v)
+		}
+		writer.WriteHeader(status)
+		writer.Write([]byte(body))
+	}))
+}
+
+func newReplicaTestClient(servers ...*httptest.Server) *ProxyDirectClient {
+	r := &test.FakeRing{}
+	for _, s := range servers {
+		r.MockDevices = append(r.MockDevices, (&faultyObjectServer{server: s}).device())
+	}
+	return &ProxyDirectClient{client: &http.Client{}, ObjectRing: r, ContainerRing: r, AccountRing: r}
+}
+
+func TestGetObjectNewest(t *testing.T) {
+	servers := []*httptest.Server{
+		replicaServer(200, map[string]string{"X-Backend-Timestamp": "1000000001.00000"}, "old"),
+		replicaServer(200, map[string]string{"X-Backend-Timestamp": "1000000003.00000"}, "new"),
+		replicaServer(200, map[string]string{"X-Backend-Timestamp": "1000000002.00000"}, "mid"),
+	}
+	for _, s := range servers {
+		defer s.Close()
+	}
+	c := newReplicaTestClient(servers...)
+	body, _, code := c.GetObject("a", "c", "o", http.Header{})
+	require.Equal(t, 200, code)
+	data, _ := ioutil.ReadAll(body)
+	require.Equal(t, "old", string(data))
+
+	body, headers, code := c.GetObject("a", "c", "o", http.Header{"X-Newest": {"true"}})
+	require.Equal(t, 200, code)
+	data, _ = ioutil.ReadAll(body)
+	require.Equal(t, "new", string(data))
+	require.Equal(t, "1000000003.00000", headers.Get("X-Backend-Timestamp"))
+}
+
+func TestGetObjectNewestTombstone(t *testing.T) {
+	servers := []*httptest.Server{
+		replicaServer(200, map[string]string{"X-Backend-Timestamp": "1000000001.00000"}, "old"),
+		replicaServer(404, map[string]string{"X-Backend-Timestamp": "1000000002.00000"}, ""),
+		replicaServer(404, nil, ""),
+	}
+	for _, s := range servers {
+		defer s.Close()
+	}
+	c := newReplicaTestClient(servers...)
+	_, code := c.HeadObject("a", "c", "o", http.Header{"X-Newest": {"true"}})
+	require.Equal(t, 404, code)
+
+	// a 404 without a timestamp doesn't beat data.
+	servers[1].Close()
+	servers[1] = replicaServer(503, nil, "")
+	c = newReplicaTestClient(servers...)
+	_, code = c.HeadObject("a", "c", "o", http.Header{"X-Newest": {"true"}})
+	require.Equal(t, 200, code)
+}
+
+func TestHeadContainerNewest(t *testing.T) {
+	servers := []*httptest.Server{
+		replicaServer(204, map[string]string{"X-Backend-Timestamp": "1000000001.00000", "X-Backend-Put-Timestamp": "1000000001.00000",
+			"X-Container-Object-Count": "1"}, ""),
+		replicaServer(404, map[string]string{"X-Backend-Timestamp": "1000000001.00000", "X-Backend-Put-Timestamp": "1000000001.00000",
+			"X-Backend-Delete-Timestamp": "1000000002.00000"}, ""),
+		replicaServer(204, map[string]string{"X-Backend-Timestamp": "1000000001.00000", "X-Backend-Put-Timestamp": "1000000003.00000",
+			"X-Container-Object-Count": "0"}, ""),
+	}
+	for _, s := range servers {
+		defer s.Close()
+	}
+	c := newReplicaTestClient(servers...)
+	headers, code := c.HeadContainer("a", "c", http.Header{"X-Newest": {"true"}})
+	require.Equal(t, 204, code)
+	require.Equal(t, "0", headers.Get("X-Container-Object-Count"))
+
+	headers, code = c.HeadAccount("a", http.Header{"X-Newest": {"true"}})
+	require.Equal(t, 204, code)
+	require.Equal(t, "1000000003.00000", headers.Get("X-Backend-Put-Timestamp"))
+}
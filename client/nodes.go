@@ -0,0 +1,232 @@
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// nodeStat is what the proxy remembers about a backend device between requests.
+type nodeStat struct {
+	errors    int
+	lastError time.Time
+	timing    float64
+}
+
+// affinityRule gives the nodes in a region, or in a zone of that region, a priority.  Lower priorities go first.
+type affinityRule struct {
+	region   int
+	zone     int
+	priority int
+}
+
+var affinityLocation = regexp.MustCompile(`^r(\d+)(?:z(\d+))?$`)
+
+// parseAffinity parses settings like "r1=100, r1z2=200".  The priorities can be left off, like "r1, r2z1", which
+// matters for write affinity where nodes are just in it or not.
+func parseAffinity(value string) ([]affinityRule, error) {
+	var rules []affinityRule
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		rule := affinityRule{zone: -1}
+		location := item
+		if i := strings.Index(item, "="); i >= 0 {
+			location = strings.TrimSpace(item[:i])
+			priority, err := strconv.Atoi(strings.TrimSpace(item[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid affinity priority in %q", item)
+			}
+			rule.priority = priority
+		}
+		m := affinityLocation.FindStringSubmatch(location)
+		if m == nil {
+			return nil, fmt.Errorf("Invalid affinity location %q", location)
+		}
+		rule.region, _ = strconv.Atoi(m[1])
+		if m[2] != "" {
+			rule.zone, _ = strconv.Atoi(m[2])
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// affinityPriority returns the best priority of the rules matching the device, and whether any did.
+func affinityPriority(rules []affinityRule, device *ring.Device) (priority int, ok bool) {
+	for _, rule := range rules {
+		if device.Region == rule.region && (rule.zone < 0 || device.Zone == rule.zone) && (!ok || rule.priority < priority) {
+			priority, ok = rule.priority, true
+		}
+	}
+	return priority, ok
+}
+
+// deviceKey identifies a device in nodeStats.  IPv6 addresses are bracketed, the same as in a request's host.
+func deviceKey(device *ring.Device) string {
+	return net.JoinHostPort(device.Ip, strconv.Itoa(device.Port)) + "/" + device.Device
+}
+
+// requestKey returns the deviceKey of the node a backend request is for.
+func requestKey(req *http.Request) string {
+	hostPort := req.URL.Host
+	if host, port, err := net.SplitHostPort(hostPort); err == nil {
+		hostPort = net.JoinHostPort(host, port)
+	}
+	return hostPort + "/" + strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+}
+
+// do sends a backend request, keeping track of how long the node takes to respond and whether it's failing.
+func (c *ProxyDirectClient) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	switch {
+	case err != nil:
+		c.recordResponse(requestKey(req), time.Since(start), 1)
+	case resp.StatusCode == http.StatusInsufficientStorage:
+		// an unmounted drive isn't coming back by itself, so there's no point in trying it until the interval is up.
+		c.recordResponse(requestKey(req), time.Since(start), c.errorSuppressionLimit)
+	case resp.StatusCode/100 == 5:
+		c.recordResponse(requestKey(req), time.Since(start), 1)
+	default:
+		c.recordResponse(requestKey(req), time.Since(start), 0)
+	}
+	return resp, err
+}
+
+func (c *ProxyDirectClient) recordResponse(key string, elapsed time.Duration, errors int) {
+	c.nodeStatsLock.Lock()
+	defer c.nodeStatsLock.Unlock()
+	if c.nodeStats == nil {
+		c.nodeStats = map[string]*nodeStat{}
+	}
+	stat := c.nodeStats[key]
+	if stat == nil {
+		stat = &nodeStat{timing: elapsed.Seconds()}
+		c.nodeStats[key] = stat
+	}
+	if errors > 0 {
+		stat.errors += errors
+		stat.lastError = time.Now()
+	}
+	// timings are a moving average, so one slow response doesn't sink a node.
+	stat.timing = stat.timing*0.8 + elapsed.Seconds()*0.2
+}
+
+// errorLimited returns true if a node has had too many errors lately to bother sending it requests.
+func (c *ProxyDirectClient) errorLimited(device *ring.Device) bool {
+	if c.errorSuppressionLimit <= 0 {
+		return false
+	}
+	c.nodeStatsLock.Lock()
+	defer c.nodeStatsLock.Unlock()
+	stat := c.nodeStats[deviceKey(device)]
+	if stat == nil || stat.errors < c.errorSuppressionLimit {
+		return false
+	}
+	if time.Since(stat.lastError) > c.errorSuppressionInterval {
+		stat.errors = 0
+		return false
+	}
+	return true
+}
+
+// readNodes returns the primary nodes to read from in the order to try them, leaving out error limited ones.
+func (c *ProxyDirectClient) readNodes(r ring.Ring, partition uint64) []*ring.Device {
+	primaries := r.GetNodes(partition)
+	nodes := make([]*ring.Device, 0, len(primaries))
+	for _, device := range primaries {
+		if !c.errorLimited(device) {
+			nodes = append(nodes, device)
+		}
+	}
+	if len(nodes) == 0 {
+		// they can't all be skipped, or nothing would ever clear them.
+		nodes = append(nodes, primaries...)
+	}
+	switch c.sortingMethod {
+	case "shuffle":
+		shuffled := make([]*ring.Device, len(nodes))
+		for i, j := range rand.Perm(len(nodes)) {
+			shuffled[i] = nodes[j]
+		}
+		nodes = shuffled
+	case "timing":
+		// nodes without a timing yet go first, so they get one.
+		timings := make(map[*ring.Device]float64, len(nodes))
+		c.nodeStatsLock.Lock()
+		for _, device := range nodes {
+			timings[device] = -1
+			if stat := c.nodeStats[deviceKey(device)]; stat != nil {
+				timings[device] = stat.timing
+			}
+		}
+		c.nodeStatsLock.Unlock()
+		sort.SliceStable(nodes, func(i, j int) bool { return timings[nodes[i]] < timings[nodes[j]] })
+	case "affinity":
+		sort.SliceStable(nodes, func(i, j int) bool {
+			pi, iok := affinityPriority(c.readAffinity, nodes[i])
+			pj, jok := affinityPriority(c.readAffinity, nodes[j])
+			return iok && (!jok || pi < pj)
+		})
+	}
+	return nodes
+}
+
+// writeNodes returns the nodes to write an object to.  That's the primaries, except that error limited ones, and with
+// write affinity ones outside of it, are swapped for handoffs that are fine.  Replication moves the data to the
+// primaries later.  The nodes stay in primary order, since container updates are matched to them by index.
+//
+// Object PUTs and DELETEs use it, since a handoff can hold new data or a tombstone until replication catches up.
+// Object POSTs stay on the primaries because a handoff without the object could only 404, and account and container
+// writes do too, the way write affinity in Swift is only about where object data lands.
+func (c *ProxyDirectClient) writeNodes(r ring.Ring, partition uint64) []*ring.Device {
+	primaries := r.GetNodes(partition)
+	nodes := make([]*ring.Device, len(primaries))
+	copy(nodes, primaries)
+	good := func(device *ring.Device) bool {
+		if c.errorLimited(device) {
+			return false
+		}
+		_, local := affinityPriority(c.writeAffinity, device)
+		return len(c.writeAffinity) == 0 || local
+	}
+	used := make(map[string]bool, len(nodes))
+	for _, device := range nodes {
+		used[deviceKey(device)] = true
+	}
+	var more ring.MoreNodes
+	handoffs := uint64(0)
+	for i, device := range nodes {
+		if good(device) {
+			continue
+		}
+		if more == nil {
+			if more = r.GetMoreNodes(partition); more == nil {
+				break
+			}
+		}
+		for ; handoffs < 2*r.ReplicaCount(); handoffs++ {
+			handoff := more.Next()
+			if handoff == nil {
+				break
+			}
+			if !used[deviceKey(handoff)] && good(handoff) {
+				used[deviceKey(handoff)] = true
+				nodes[i] = handoff
+				handoffs++
+				break
+			}
+		}
+	}
+	return nodes
+}
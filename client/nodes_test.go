@@ -0,0 +1,238 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+type sliceMoreNodes []*ring.Device
+
+func (m *sliceMoreNodes) Next() *ring.Device {
+	if len(*m) == 0 {
+		return nil
+	}
+	device := (*m)[0]
+	*m = (*m)[1:]
+	return device
+}
+
+func proxyConfig(t *testing.T, settings map[string]string) conf.Section {
+	data := "[app:proxy-server]\n"
+	for k, v := range settings {
+		data += k + " = " + v + "\n"
+	}
+	config, err := conf.StringConfig(data)
+	require.Nil(t, err)
+	return config.GetSection("app:proxy-server")
+}
+
+func newNodesTestClient(t *testing.T, settings map[string]string) *ProxyDirectClient {
+	c, err := newProxyDirectClient(proxyConfig(t, settings), &test.FakeRing{}, &test.FakeRing{}, &test.FakeRing{})
+	require.Nil(t, err)
+	return c
+}
+
+func TestParseAffinity(t *testing.T) {
+	rules, err := parseAffinity("r1=100, r1z2=50,r2")
+	require.Nil(t, err)
+	require.Equal(t, []affinityRule{{region: 1, zone: -1, priority: 100}, {region: 1, zone: 2, priority: 50},
+		{region: 2, zone: -1}}, rules)
+	rules, err = parseAffinity("")
+	require.Nil(t, err)
+	require.Nil(t, rules)
+	_, err = parseAffinity("r1=high")
+	require.NotNil(t, err)
+	_, err = parseAffinity("z1=100")
+	require.NotNil(t, err)
+
+	priority, ok := affinityPriority(rules, &ring.Device{Region: 1, Zone: 2})
+	require.False(t, ok)
+	rules, _ = parseAffinity("r1=100, r1z2=50")
+	priority, ok = affinityPriority(rules, &ring.Device{Region: 1, Zone: 2})
+	require.True(t, ok)
+	require.Equal(t, 50, priority)
+	priority, ok = affinityPriority(rules, &ring.Device{Region: 1, Zone: 3})
+	require.True(t, ok)
+	require.Equal(t, 100, priority)
+}
+
+func TestNewProxyDirectClientConfig(t *testing.T) {
+	c := newNodesTestClient(t, map[string]string{"sorting_method": "Affinity", "read_affinity": "r2=1",
+		"error_suppression_limit": "3", "error_suppression_interval": "1.5", "node_timeout": "30"})
+	require.Equal(t, "affinity", c.sortingMethod)
+	require.Equal(t, 3, c.errorSuppressionLimit)
+	require.Equal(t, 1500*time.Millisecond, c.errorSuppressionInterval)
+	require.Equal(t, time.Duration(0), c.client.Timeout)
+	require.Equal(t, 30*time.Second, c.client.Transport.(*http.Transport).ResponseHeaderTimeout)
+	require.Equal(t, []affinityRule{{region: 2, zone: -1, priority: 1}}, c.readAffinity)
+
+	c = newNodesTestClient(t, nil)
+	require.Equal(t, 10*time.Second, c.client.Transport.(*http.Transport).ResponseHeaderTimeout)
+	require.Equal(t, 10, c.errorSuppressionLimit)
+	require.Equal(t, time.Minute, c.errorSuppressionInterval)
+
+	for _, settings := range []map[string]string{{"sorting_method": "random"}, {"read_affinity": "x"}, {"write_affinity": "r1=x"}} {
+		_, err := newProxyDirectClient(proxyConfig(t, settings), &test.FakeRing{}, &test.FakeRing{}, &test.FakeRing{})
+		require.NotNil(t, err)
+	}
+}
+
+func TestNodeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+	slow := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(200)
+		for i := 0; i < 5; i++ {
+			writer.Write([]byte("x"))
+			writer.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer slow.Close()
+	c := newNodesTestClient(t, map[string]string{"node_timeout": "0.15"})
+
+	start := time.Now()
+	req, _ := http.NewRequest("GET", hung.URL, nil)
+	_, err := c.client.Do(req)
+	require.NotNil(t, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	// a response that keeps moving can take longer than node_timeout in total.
+	req, _ = http.NewRequest("GET", slow.URL, nil)
+	resp, err := c.client.Do(req)
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "xxxxx", string(data))
+}
+
+func TestErrorLimiting(t *testing.T) {
+	var lock sync.Mutex
+	requests := map[string]int{}
+	servers := make([]*httptest.Server, 3)
+	for i := range servers {
+		status := 200
+		if i == 0 {
+			status = 503
+		}
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			lock.Lock()
+			requests[request.Host]++
+			lock.Unlock()
+			writer.WriteHeader(status)
+		}))
+		defer servers[i].Close()
+	}
+	c := newReplicaTestClient(servers...)
+	c.errorSuppressionLimit = 2
+	c.errorSuppressionInterval = time.Hour
+	bad := c.ObjectRing.GetNodes(0)[0]
+	for i := 0; i < 2; i++ {
+		_, code := c.HeadObject("a", "c", "o", http.Header{"X-Newest": {"true"}})
+		require.Equal(t, 200, code)
+	}
+	require.True(t, c.errorLimited(bad))
+	require.Equal(t, 2, len(c.readNodes(c.ObjectRing, 0)))
+	_, code := c.HeadObject("a", "c", "o", http.Header{"X-Newest": {"true"}})
+	require.Equal(t, 200, code)
+	require.Equal(t, 2, requests[servers[0].Listener.Addr().String()])
+
+	// once the interval is up, the node gets another chance.
+	c.errorSuppressionInterval = 0
+	require.False(t, c.errorLimited(bad))
+	require.Equal(t, 3, len(c.readNodes(c.ObjectRing, 0)))
+
+	// an unmounted drive is limited right away.
+	c.errorSuppressionInterval = time.Hour
+	req, _ := http.NewRequest("HEAD", servers[1].URL+"/sda/0/a/c/o", nil)
+	c.client = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 507, Body: http.NoBody, Request: req}, nil
+	})}
+	_, err := c.do(req)
+	require.Nil(t, err)
+	require.True(t, c.errorLimited(c.ObjectRing.GetNodes(0)[1]))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestNodeKeys(t *testing.T) {
+	for _, device := range []*ring.Device{{Ip: "1.2.3.4", Port: 6000, Device: "sda"}, {Ip: "fe80::1", Port: 6000, Device: "sdb"}} {
+		req, err := http.NewRequest("PUT", "http://"+net.JoinHostPort(device.Ip, "6000")+"/"+device.Device+"/1/a/c/o", nil)
+		require.Nil(t, err)
+		require.Equal(t, deviceKey(device), requestKey(req))
+	}
+	require.Equal(t, "[fe80::1]:6000/sdb", deviceKey(&ring.Device{Ip: "fe80::1", Port: 6000, Device: "sdb"}))
+}
+
+func TestReadNodesSorting(t *testing.T) {
+	devices := []*ring.Device{
+		{Ip: "1.1.1.1", Port: 1, Device: "sda", Region: 1, Zone: 1},
+		{Ip: "2.2.2.2", Port: 2, Device: "sda", Region: 2, Zone: 1},
+		{Ip: "3.3.3.3", Port: 3, Device: "sda", Region: 1, Zone: 2},
+	}
+	r := &test.FakeRing{MockDevices: devices}
+	c := newNodesTestClient(t, map[string]string{"sorting_method": "affinity", "read_affinity": "r1=100, r2=50, r1z2=10"})
+	require.Equal(t, []*ring.Device{devices[2], devices[1], devices[0]}, c.readNodes(r, 0))
+	c.readAffinity, _ = parseAffinity("r2=1")
+	require.Equal(t, []*ring.Device{devices[1], devices[0], devices[2]}, c.readNodes(r, 0))
+
+	c.sortingMethod = "timing"
+	c.recordResponse(deviceKey(devices[0]), 3*time.Second, 0)
+	c.recordResponse(deviceKey(devices[1]), 2*time.Second, 0)
+	c.recordResponse(deviceKey(devices[2]), time.Second, 0)
+	require.Equal(t, []*ring.Device{devices[2], devices[1], devices[0]}, c.readNodes(r, 0))
+	delete(c.nodeStats, deviceKey(devices[0]))
+	require.Equal(t, []*ring.Device{devices[0], devices[2], devices[1]}, c.readNodes(r, 0))
+
+	c.sortingMethod = "shuffle"
+	require.ElementsMatch(t, devices, c.readNodes(r, 0))
+	c.sortingMethod = ""
+	require.Equal(t, devices, c.readNodes(r, 0))
+}
+
+func TestWriteNodes(t *testing.T) {
+	devices := []*ring.Device{
+		{Ip: "1.1.1.1", Port: 1, Device: "sda", Region: 1},
+		{Ip: "2.2.2.2", Port: 2, Device: "sda", Region: 2},
+		{Ip: "3.3.3.3", Port: 3, Device: "sda", Region: 1},
+	}
+	handoffs := []*ring.Device{
+		{Ip: "4.4.4.4", Port: 4, Device: "sda", Region: 2},
+		{Ip: "5.5.5.5", Port: 5, Device: "sda", Region: 1},
+		{Ip: "6.6.6.6", Port: 6, Device: "sda", Region: 1},
+	}
+	more := sliceMoreNodes(handoffs)
+	r := &test.FakeRing{MockDevices: devices, MockGetMoreNodes: &more}
+	c := newNodesTestClient(t, map[string]string{"write_affinity": "r1"})
+	require.Equal(t, []*ring.Device{devices[0], handoffs[1], devices[2]}, c.writeNodes(r, 0))
+
+	// without write affinity, only error limited nodes are swapped out.
+	more = sliceMoreNodes(handoffs)
+	c = newNodesTestClient(t, nil)
+	require.Equal(t, devices, c.writeNodes(r, 0))
+	c.recordResponse(deviceKey(devices[2]), 0, c.errorSuppressionLimit)
+	c.recordResponse(deviceKey(handoffs[0]), 0, c.errorSuppressionLimit)
+	require.Equal(t, []*ring.Device{devices[0], devices[1], handoffs[1]}, c.writeNodes(r, 0))
+
+	// if there aren't any good handoffs, the primary is used anyway.
+	more = sliceMoreNodes(nil)
+	require.Equal(t, devices, c.writeNodes(r, 0))
+}
@@ -10,28 +10,48 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/troubling/hummingbird/common"
 )
 
-// userClient is a Client to be used by end-users.  It knows how to authenticate with auth v1 and v2.
+// userClient is a Client to be used by end-users.  It knows how to authenticate with auth v1, v2 and v3.
 type userClient struct {
 	client                                              *http.Client
 	ServiceURL                                          string
 	AuthToken                                           string
 	tenant, username, password, apikey, region, authurl string
 	private                                             bool
+	retries                                             int
+	retryBackoff, maxRetryBackoff                       time.Duration
+	// keystone v3 settings
+	userDomain, projectDomain, projectID, token, endpointInterface string
+	appCredentialID, appCredentialName, appCredentialSecret        string
+	// expires is when the current token runs out, if the auth server said.
+	expires  time.Time
+	authLock sync.Mutex
 }
 
+// tokenRefreshWindow is how long before a token expires that it gets replaced.
+var tokenRefreshWindow = 5 * time.Minute
+
 var _ Client = &userClient{}
 
+// credentials returns the current service url and token, which re-authenticating can replace at any time.
+func (c *userClient) credentials() (string, string) {
+	c.authLock.Lock()
+	defer c.authLock.Unlock()
+	return c.ServiceURL, c.AuthToken
+}
+
 func (c *userClient) authedRequest(method string, path string, body io.Reader, headers map[string]string) (*http.Request, error) {
-	req, err := http.NewRequest(method, c.ServiceURL+path, body)
+	serviceURL, token := c.credentials()
+	req, err := http.NewRequest(method, serviceURL+path, body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-Auth-Token", c.AuthToken)
+	req.Header.Set("X-Auth-Token", token)
 	req.Header.Set("User-Agent", "Hummingbird Client")
 	for k, v := range headers {
 		req.Header.Set(k, v)
@@ -39,26 +59,65 @@ func (c *userClient) authedRequest(method string, path string, body io.Reader, h
 	return req, nil
 }
 
+// canReplay reports whether a request's body can be sent again.
+func canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// do sends an authed request, re-authenticating once on a 401 and retrying network errors and 5xx responses with
+// exponential backoff.  Requests whose bodies can't be rewound are only sent once.
 func (c *userClient) do(req *http.Request) (*http.Response, error) {
-	resp, err := c.client.Do(req)
-	if err != nil {
+	backoff := c.retryBackoff
+	reauthed := false
+	if err := c.refreshToken(); err != nil {
 		return nil, err
 	}
-	if resp.StatusCode == 401 {
-		resp.Body.Close()
-		if c.authenticate() != nil {
-			return nil, errors.New("Authentication failed.")
+	_, token := c.credentials()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		req.Header.Set("X-Auth-Token", token)
+		resp, err := c.client.Do(req)
+		if err == nil && resp.StatusCode == 401 && !reauthed {
+			resp.Body.Close()
+			if token, err = c.reauthenticate(token); err != nil {
+				return nil, errors.New("Authentication failed.")
+			}
+			if !canReplay(req) {
+				return nil, HTTPError(401)
+			}
+			reauthed = true
+			attempt--
+			continue
+		}
+		if (err != nil || resp.StatusCode/100 == 5) && attempt < c.retries && canReplay(req) && req.Context().Err() == nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			select {
+			case <-time.After(backoff):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			if backoff *= 2; c.maxRetryBackoff > 0 && backoff > c.maxRetryBackoff {
+				backoff = c.maxRetryBackoff
+			}
+			continue
 		}
-		resp, err = c.client.Do(req)
 		if err != nil {
 			return nil, err
 		}
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return nil, HTTPError(resp.StatusCode)
+		}
+		return resp, nil
 	}
-	if resp.StatusCode/100 != 2 {
-		resp.Body.Close()
-		return nil, HTTPError(resp.StatusCode)
-	}
-	return resp, nil
 }
 
 func (c *userClient) doRequest(method string, path string, body io.Reader, headers map[string]string) error {
@@ -215,6 +274,11 @@ func (c *userClient) DeleteObject(container string, obj string, headers map[stri
 	return c.doRequest("DELETE", "/"+container+"/"+obj, nil, headers)
 }
 
+func (c *userClient) GetURL() string {
+	serviceURL, _ := c.credentials()
+	return serviceURL
+}
+
 func (c *userClient) authenticatev1() error {
 	req, err := http.NewRequest("GET", c.authurl, nil)
 	req.Header.Set("X-Auth-User", c.username)
@@ -281,11 +345,12 @@ type KeystoneResponseV2 struct {
 }
 
 func (c *userClient) authenticatev2() (err error) {
-	if !strings.HasSuffix(c.authurl, "tokens") {
-		if c.authurl[len(c.authurl)-1] == '/' {
-			c.authurl = c.authurl + "tokens"
+	authurl := c.authurl
+	if !strings.HasSuffix(authurl, "tokens") {
+		if authurl[len(authurl)-1] == '/' {
+			authurl = authurl + "tokens"
 		} else {
-			c.authurl = c.authurl + "/tokens"
+			authurl = authurl + "/tokens"
 		}
 	}
 	var authReq []byte
@@ -305,7 +370,7 @@ func (c *userClient) authenticatev2() (err error) {
 	if err != nil {
 		return err
 	}
-	resp, err := c.client.Post(c.authurl, "application/json", bytes.NewBuffer(authReq))
+	resp, err := c.client.Post(authurl, "application/json", bytes.NewBuffer(authReq))
 	if err != nil {
 		return err
 	}
@@ -341,14 +406,191 @@ func (c *userClient) authenticatev2() (err error) {
 	return errors.New("Didn't find endpoint")
 }
 
+type KeystoneRequestV3 struct {
+	Auth struct {
+		Identity KeystoneIdentityV3 `json:"identity"`
+		Scope    *KeystoneScopeV3   `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+// KeystoneDomainV3 names a domain by either its name or its id.
+type KeystoneDomainV3 struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type KeystoneUserV3 struct {
+	ID       string            `json:"id,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Domain   *KeystoneDomainV3 `json:"domain,omitempty"`
+	Password string            `json:"password,omitempty"`
+}
+
+type KeystonePasswordAuthV3 struct {
+	User KeystoneUserV3 `json:"user"`
+}
+
+type KeystoneTokenAuthV3 struct {
+	ID string `json:"id"`
+}
+
+type KeystoneAppCredentialAuthV3 struct {
+	ID     string          `json:"id,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Secret string          `json:"secret"`
+	User   *KeystoneUserV3 `json:"user,omitempty"`
+}
+
+type KeystoneIdentityV3 struct {
+	Methods               []string                     `json:"methods"`
+	Password              *KeystonePasswordAuthV3      `json:"password,omitempty"`
+	Token                 *KeystoneTokenAuthV3         `json:"token,omitempty"`
+	ApplicationCredential *KeystoneAppCredentialAuthV3 `json:"application_credential,omitempty"`
+}
+
+type KeystoneScopeV3 struct {
+	Project struct {
+		ID     string            `json:"id,omitempty"`
+		Name   string            `json:"name,omitempty"`
+		Domain *KeystoneDomainV3 `json:"domain,omitempty"`
+	} `json:"project"`
+}
+
+type KeystoneResponseV3 struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Catalog   []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				RegionID  string `json:"region_id"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+// keystoneDomainV3 turns a domain setting into a KeystoneDomainV3, treating "default" as the id of keystone's
+// default domain.
+func keystoneDomainV3(domain string) *KeystoneDomainV3 {
+	if domain == "" || domain == "default" {
+		return &KeystoneDomainV3{ID: "default"}
+	}
+	return &KeystoneDomainV3{Name: domain}
+}
+
+func (c *userClient) authenticatev3() (err error) {
+	authurl := c.authurl
+	if !strings.HasSuffix(authurl, "/auth/tokens") {
+		authurl = strings.TrimRight(authurl, "/") + "/auth/tokens"
+	}
+	authReq := &KeystoneRequestV3{}
+	identity := &authReq.Auth.Identity
+	if c.appCredentialSecret != "" {
+		identity.Methods = []string{"application_credential"}
+		identity.ApplicationCredential = &KeystoneAppCredentialAuthV3{ID: c.appCredentialID, Name: c.appCredentialName, Secret: c.appCredentialSecret}
+		if c.appCredentialID == "" {
+			// credentials looked up by name are only unique per user.
+			identity.ApplicationCredential.User = &KeystoneUserV3{Name: c.username, Domain: keystoneDomainV3(c.userDomain)}
+		}
+	} else if c.password != "" {
+		identity.Methods = []string{"password"}
+		identity.Password = &KeystonePasswordAuthV3{User: KeystoneUserV3{Name: c.username, Domain: keystoneDomainV3(c.userDomain), Password: c.password}}
+	} else if c.token != "" {
+		identity.Methods = []string{"token"}
+		identity.Token = &KeystoneTokenAuthV3{ID: c.token}
+	} else {
+		return errors.New("Couldn't figure out what credentials to use.")
+	}
+	// application credentials are already scoped to their project.
+	if c.appCredentialSecret == "" && (c.projectID != "" || c.tenant != "") {
+		authReq.Auth.Scope = &KeystoneScopeV3{}
+		if c.projectID != "" {
+			authReq.Auth.Scope.Project.ID = c.projectID
+		} else {
+			authReq.Auth.Scope.Project.Name = c.tenant
+			authReq.Auth.Scope.Project.Domain = keystoneDomainV3(c.projectDomain)
+		}
+	}
+	body, err := json.Marshal(authReq)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Post(authurl, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return HTTPError(resp.StatusCode)
+	}
+	var authResponse KeystoneResponseV3
+	if body, err := ioutil.ReadAll(resp.Body); err != nil {
+		return err
+	} else if err = json.Unmarshal(body, &authResponse); err != nil {
+		return err
+	}
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return errors.New("Auth response had no X-Subject-Token.")
+	}
+	iface := c.endpointInterface
+	if iface == "" {
+		if c.private {
+			iface = "internal"
+		} else {
+			iface = "public"
+		}
+	}
+	for _, s := range authResponse.Token.Catalog {
+		if s.Type == "object-store" {
+			for _, e := range s.Endpoints {
+				if e.Interface == iface && (c.region == "" || e.Region == c.region || e.RegionID == c.region) {
+					c.AuthToken = token
+					c.ServiceURL = e.URL
+					c.expires = authResponse.Token.ExpiresAt
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("Didn't find endpoint")
+}
+
 func (c *userClient) authenticate() error {
-	if strings.Contains(c.authurl, "/v2") {
+	if strings.Contains(c.authurl, "/v3") {
+		return c.authenticatev3()
+	} else if strings.Contains(c.authurl, "/v2") {
 		return c.authenticatev2()
 	} else {
 		return c.authenticatev1()
 	}
 }
 
+// refreshToken re-authenticates if the token is about to expire, so requests don't have to fail with a 401 first.
+func (c *userClient) refreshToken() error {
+	c.authLock.Lock()
+	defer c.authLock.Unlock()
+	if c.expires.IsZero() || time.Now().Add(tokenRefreshWindow).Before(c.expires) {
+		return nil
+	}
+	return c.authenticate()
+}
+
+// reauthenticate replaces a token the server rejected, returning the token to retry with.  If another request already
+// replaced it, that token is used rather than authenticating again.
+func (c *userClient) reauthenticate(failed string) (string, error) {
+	c.authLock.Lock()
+	defer c.authLock.Unlock()
+	if c.AuthToken == failed {
+		if err := c.authenticate(); err != nil {
+			return "", err
+		}
+	}
+	return c.AuthToken, nil
+}
+
 // NewClient creates a new end-user client.  It authenticates immediately, and returns an error if unable to.
 func NewClient(tenant string, username string, password string, apikey string, region string, authurl string, private bool) (Client, error) {
 	c := &userClient{
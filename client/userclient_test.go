@@ -0,0 +1,191 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeystone is a keystone v3 identity server with a catalog pointing at itself for object-store requests.
+type fakeKeystone struct {
+	lock     sync.Mutex
+	server   *httptest.Server
+	requests []map[string]interface{}
+	tokens   int
+	lifetime time.Duration
+}
+
+func newFakeKeystone() *fakeKeystone {
+	k := &fakeKeystone{lifetime: time.Hour}
+	k.server = httptest.NewServer(k)
+	return k
+}
+
+func (k *fakeKeystone) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if request.URL.Path != "/v3/auth/tokens" {
+		if request.Header.Get("X-Auth-Token") != fmt.Sprintf("token%d", k.tokens) {
+			writer.WriteHeader(401)
+			return
+		}
+		writer.WriteHeader(204)
+		return
+	}
+	var authReq map[string]interface{}
+	body, _ := ioutil.ReadAll(request.Body)
+	if request.Method != "POST" || json.Unmarshal(body, &authReq) != nil {
+		writer.WriteHeader(400)
+		return
+	}
+	k.requests = append(k.requests, authReq)
+	k.tokens++
+	endpoint := func(iface, region, url string) map[string]string {
+		return map[string]string{"interface": iface, "region": region, "region_id": region, "url": url}
+	}
+	resp := map[string]interface{}{"token": map[string]interface{}{
+		"expires_at": time.Now().Add(k.lifetime).UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"catalog": []interface{}{
+			map[string]interface{}{"type": "identity", "endpoints": []interface{}{
+				endpoint("public", "RegionOne", k.server.URL+"/v3")}},
+			map[string]interface{}{"type": "object-store", "endpoints": []interface{}{
+				endpoint("public", "RegionOne", "http://public-one/v1/AUTH_p"),
+				endpoint("internal", "RegionOne", "http://internal-one/v1/AUTH_p"),
+				endpoint("public", "RegionTwo", k.server.URL+"/v1/AUTH_p"),
+				endpoint("internal", "RegionTwo", "http://internal-two/v1/AUTH_p")}},
+		},
+	}}
+	writer.Header().Set("X-Subject-Token", fmt.Sprintf("token%d", k.tokens))
+	writer.WriteHeader(201)
+	json.NewEncoder(writer).Encode(resp)
+}
+
+func (k *fakeKeystone) lastIdentity() map[string]interface{} {
+	return k.requests[len(k.requests)-1]["auth"].(map[string]interface{})
+}
+
+func TestKeystoneV3Password(t *testing.T) {
+	k := newFakeKeystone()
+	defer k.server.Close()
+	cli, err := NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", Username: "u", Password: "p",
+		Tenant: "proj", UserDomain: "users", Region: "RegionTwo"})
+	require.Nil(t, err)
+	c := cli.(*userClient)
+	require.Equal(t, "token1", c.AuthToken)
+	require.Equal(t, k.server.URL+"/v1/AUTH_p", c.ServiceURL)
+	require.False(t, c.expires.IsZero())
+	auth := k.lastIdentity()
+	identity := auth["identity"].(map[string]interface{})
+	require.Equal(t, []interface{}{"password"}, identity["methods"])
+	user := identity["password"].(map[string]interface{})["user"].(map[string]interface{})
+	require.Equal(t, "u", user["name"])
+	require.Equal(t, "p", user["password"])
+	require.Equal(t, map[string]interface{}{"name": "users"}, user["domain"])
+	project := auth["scope"].(map[string]interface{})["project"].(map[string]interface{})
+	require.Equal(t, "proj", project["name"])
+	require.Equal(t, map[string]interface{}{"id": "default"}, project["domain"])
+}
+
+func TestKeystoneV3Interface(t *testing.T) {
+	k := newFakeKeystone()
+	defer k.server.Close()
+	cli, err := NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3/", Username: "u", Password: "p",
+		Region: "RegionOne", Private: true})
+	require.Nil(t, err)
+	require.Equal(t, "http://internal-one/v1/AUTH_p", cli.GetURL())
+	require.Nil(t, k.lastIdentity()["scope"])
+
+	cli, err = NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", Username: "u", Password: "p",
+		Region: "RegionOne", Interface: "public"})
+	require.Nil(t, err)
+	require.Equal(t, "http://public-one/v1/AUTH_p", cli.GetURL())
+
+	_, err = NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", Username: "u", Password: "p",
+		Region: "RegionThree"})
+	require.NotNil(t, err)
+}
+
+func TestKeystoneV3TokenAndAppCredentials(t *testing.T) {
+	k := newFakeKeystone()
+	defer k.server.Close()
+	_, err := NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", Token: "existing", ProjectID: "abc"})
+	require.Nil(t, err)
+	identity := k.lastIdentity()["identity"].(map[string]interface{})
+	require.Equal(t, []interface{}{"token"}, identity["methods"])
+	require.Equal(t, "existing", identity["token"].(map[string]interface{})["id"])
+	require.Equal(t, "abc", k.lastIdentity()["scope"].(map[string]interface{})["project"].(map[string]interface{})["id"])
+
+	_, err = NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", ApplicationCredentialID: "appid",
+		ApplicationCredentialSecret: "shh", Tenant: "ignored"})
+	require.Nil(t, err)
+	identity = k.lastIdentity()["identity"].(map[string]interface{})
+	require.Equal(t, []interface{}{"application_credential"}, identity["methods"])
+	require.Equal(t, map[string]interface{}{"id": "appid", "secret": "shh"}, identity["application_credential"])
+	require.Nil(t, k.lastIdentity()["scope"])
+
+	_, err = NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", ApplicationCredentialName: "app",
+		ApplicationCredentialSecret: "shh", Username: "u", UserDomain: "users"})
+	require.Nil(t, err)
+	identity = k.lastIdentity()["identity"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"name": "app", "secret": "shh",
+		"user": map[string]interface{}{"name": "u", "domain": map[string]interface{}{"name": "users"}}},
+		identity["application_credential"])
+
+	_, err = NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3"})
+	require.NotNil(t, err)
+}
+
+func TestKeystoneV3Refresh(t *testing.T) {
+	k := newFakeKeystone()
+	defer k.server.Close()
+	cli, err := NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", Username: "u", Password: "p",
+		Region: "RegionTwo"})
+	require.Nil(t, err)
+	require.Nil(t, cli.PutContainer("c", nil))
+	require.Equal(t, 1, k.tokens)
+
+	// a token that's about to expire is replaced before it's used.
+	k.lifetime = time.Minute
+	require.Nil(t, cli.(*userClient).authenticate())
+	require.Equal(t, 2, k.tokens)
+	require.Nil(t, cli.PutContainer("c", nil))
+	require.Equal(t, 3, k.tokens)
+	require.Equal(t, "token3", cli.(*userClient).AuthToken)
+}
+
+func TestReauthenticateOnce(t *testing.T) {
+	k := newFakeKeystone()
+	defer k.server.Close()
+	cli, err := NewClientFromConfig(ClientConfig{AuthURL: k.server.URL + "/v3", Username: "u", Password: "p",
+		Region: "RegionTwo"})
+	require.Nil(t, err)
+	require.Equal(t, k.server.URL+"/v3", cli.(*userClient).authurl)
+
+	// every request is rejected with the revoked token, but only the first one to notice gets a new one.
+	k.lock.Lock()
+	k.tokens++
+	k.lock.Unlock()
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = cli.PutContainer("c", nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.Nil(t, err)
+	}
+	require.Equal(t, 3, k.tokens)
+	require.Equal(t, 2, len(k.requests))
+	require.Equal(t, k.server.URL+"/v3", cli.(*userClient).authurl)
+}
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+)
+
+// ClientConfig holds the settings for NewClientV2 and NewClientFromConfig.  Retries is how many times network errors
+// and 5xx responses are retried, waiting RetryBackoff before the first retry and doubling it up to MaxRetryBackoff
+// after that.
+//
+// The keystone v3 settings are used when AuthURL has "/v3" in it.  Application credentials are used if given, then
+// a password, then an existing Token.  Tenant (or ProjectID) is the project to scope to, and Interface picks the
+// object-store endpoint from the catalog, defaulting to "internal" if Private is set and "public" otherwise.
+type ClientConfig struct {
+	Tenant                      string
+	Username                    string
+	Password                    string
+	APIKey                      string
+	Region                      string
+	AuthURL                     string
+	Private                     bool
+	Insecure                    bool
+	UserDomain                  string
+	ProjectDomain               string
+	ProjectID                   string
+	Token                       string
+	ApplicationCredentialID     string
+	ApplicationCredentialName   string
+	ApplicationCredentialSecret string
+	Interface                   string
+	Retries                     int
+	RetryBackoff                time.Duration
+	MaxRetryBackoff             time.Duration
+	HTTPClient                  *http.Client
+}
+
+// userClientV2 implements ClientV2 on top of a userClient, sharing its auth token and retry settings.
+type userClientV2 struct {
+	*userClient
+}
+
+var _ ClientV2 = &userClientV2{}
+
+func (c *userClientV2) request(ctx context.Context, method string, path string, body io.Reader, opts *RequestOptions) (*http.Response, error) {
+	if opts != nil && len(opts.Query) > 0 {
+		path += "?" + opts.Query.Encode()
+	}
+	req, err := c.authedRequest(method, path, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	opts.apply(req)
+	return c.do(req)
+}
+
+func (c *userClientV2) doRequest(ctx context.Context, method string, path string, body io.Reader, opts *RequestOptions) (http.Header, error) {
+	resp, err := c.request(ctx, method, path, body, opts)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+func (c *userClientV2) list(ctx context.Context, path string, marker string, opts *ListOptions, records interface{}) error {
+	query := url.Values{"format": {"json"}}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	if opts.EndMarker != "" {
+		query.Set("end_marker", opts.EndMarker)
+	}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Delimiter != "" {
+		query.Set("delimiter", opts.Delimiter)
+	}
+	if opts.PageSize > 0 {
+		query.Set("limit", strconv.Itoa(opts.PageSize))
+	}
+	headers := http.Header{"Accept": {"application/json"}}
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	resp, err := c.request(ctx, "GET", path, nil, &RequestOptions{Headers: headers, Query: query})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, records)
+}
+
+func (c *userClientV2) PutAccount(ctx context.Context, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "PUT", "", nil, opts)
+	return err
+}
+
+func (c *userClientV2) PostAccount(ctx context.Context, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "POST", "", nil, opts)
+	return err
+}
+
+func (c *userClientV2) ListContainers(ctx context.Context, opts *ListOptions) *ContainerIterator {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	return &ContainerIterator{
+		listPager: listPager{marker: opts.Marker},
+		fetch: func(marker string) ([]ContainerRecord, error) {
+			var records []ContainerRecord
+			err := c.list(ctx, "", marker, opts, &records)
+			return records, err
+		},
+	}
+}
+
+func (c *userClientV2) HeadAccount(ctx context.Context, opts *RequestOptions) (http.Header, error) {
+	return c.doRequest(ctx, "HEAD", "", nil, opts)
+}
+
+func (c *userClientV2) DeleteAccount(ctx context.Context, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "DELETE", "", nil, opts)
+	return err
+}
+
+func (c *userClientV2) PutContainer(ctx context.Context, container string, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "PUT", "/"+common.Urlencode(container), nil, opts)
+	return err
+}
+
+func (c *userClientV2) PostContainer(ctx context.Context, container string, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "POST", "/"+common.Urlencode(container), nil, opts)
+	return err
+}
+
+func (c *userClientV2) ListObjects(ctx context.Context, container string, opts *ListOptions) *ObjectIterator {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	return &ObjectIterator{
+		listPager: listPager{marker: opts.Marker},
+		fetch: func(marker string) ([]ObjectRecord, error) {
+			var records []ObjectRecord
+			err := c.list(ctx, "/"+common.Urlencode(container), marker, opts, &records)
+			return records, err
+		},
+	}
+}
+
+func (c *userClientV2) HeadContainer(ctx context.Context, container string, opts *RequestOptions) (http.Header, error) {
+	return c.doRequest(ctx, "HEAD", "/"+common.Urlencode(container), nil, opts)
+}
+
+func (c *userClientV2) DeleteContainer(ctx context.Context, container string, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "DELETE", "/"+common.Urlencode(container), nil, opts)
+	return err
+}
+
+func (c *userClientV2) PutObject(ctx context.Context, container string, obj string, src io.Reader, opts *RequestOptions) (http.Header, error) {
+	return c.doRequest(ctx, "PUT", "/"+common.Urlencode(container)+"/"+common.Urlencode(obj), src, opts)
+}
+
+type sloSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+func (c *userClientV2) PutLargeObject(ctx context.Context, container string, obj string, src io.Reader, segmentSize int64, opts *RequestOptions) (http.Header, error) {
+	if segmentSize <= 0 {
+		return nil, fmt.Errorf("invalid segment size %d", segmentSize)
+	}
+	reader := bufio.NewReader(src)
+	if _, err := reader.Peek(1); err == io.EOF {
+		// there's nothing to segment, and empty segments aren't allowed in a manifest.
+		return c.PutObject(ctx, container, obj, bytes.NewReader(nil), opts)
+	} else if err != nil {
+		return nil, err
+	}
+	segmentContainer := container + "_segments"
+	if err := c.PutContainer(ctx, segmentContainer, nil); err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("%s/%s/%d", obj, common.GetTimestamp(), segmentSize)
+	var manifest []sloSegment
+	for i := 0; ; i++ {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// segments are buffered so they can be replayed if their PUT needs to be retried.
+		data, err := ioutil.ReadAll(io.LimitReader(reader, segmentSize))
+		if err != nil {
+			return nil, err
+		}
+		hash := md5.Sum(data)
+		etag := hex.EncodeToString(hash[:])
+		segment := fmt.Sprintf("%s/%08d", prefix, i)
+		headers, err := c.PutObject(ctx, segmentContainer, segment, bytes.NewReader(data), nil)
+		if err != nil {
+			return nil, err
+		}
+		if got := headers.Get("Etag"); got != "" && got != etag {
+			return nil, fmt.Errorf("etag mismatch uploading segment %s: %s != %s", segment, got, etag)
+		}
+		manifest = append(manifest, sloSegment{Path: "/" + segmentContainer + "/" + segment, Etag: etag, SizeBytes: int64(len(data))})
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifestOpts := &RequestOptions{Query: url.Values{"multipart-manifest": {"put"}}}
+	if opts != nil {
+		manifestOpts.Headers = opts.Headers
+		for k, v := range opts.Query {
+			manifestOpts.Query[k] = v
+		}
+	}
+	return c.PutObject(ctx, container, obj, bytes.NewReader(body), manifestOpts)
+}
+
+func (c *userClientV2) PostObject(ctx context.Context, container string, obj string, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "POST", "/"+common.Urlencode(container)+"/"+common.Urlencode(obj), nil, opts)
+	return err
+}
+
+func (c *userClientV2) GetObject(ctx context.Context, container string, obj string, opts *RequestOptions) (io.ReadCloser, http.Header, error) {
+	resp, err := c.request(ctx, "GET", "/"+common.Urlencode(container)+"/"+common.Urlencode(obj), nil, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, resp.Header, nil
+}
+
+func (c *userClientV2) HeadObject(ctx context.Context, container string, obj string, opts *RequestOptions) (http.Header, error) {
+	return c.doRequest(ctx, "HEAD", "/"+common.Urlencode(container)+"/"+common.Urlencode(obj), nil, opts)
+}
+
+func (c *userClientV2) DeleteObject(ctx context.Context, container string, obj string, opts *RequestOptions) error {
+	_, err := c.doRequest(ctx, "DELETE", "/"+common.Urlencode(container)+"/"+common.Urlencode(obj), nil, opts)
+	return err
+}
+
+func newUserClient(config ClientConfig) *userClient {
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Minute}
+		if config.Insecure {
+			httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		}
+	}
+	return &userClient{
+		client:              httpClient,
+		tenant:              config.Tenant,
+		username:            config.Username,
+		password:            config.Password,
+		apikey:              config.APIKey,
+		region:              config.Region,
+		authurl:             config.AuthURL,
+		private:             config.Private,
+		userDomain:          config.UserDomain,
+		projectDomain:       config.ProjectDomain,
+		projectID:           config.ProjectID,
+		token:               config.Token,
+		appCredentialID:     config.ApplicationCredentialID,
+		appCredentialName:   config.ApplicationCredentialName,
+		appCredentialSecret: config.ApplicationCredentialSecret,
+		endpointInterface:   config.Interface,
+		retries:             config.Retries,
+		retryBackoff:        config.RetryBackoff,
+		maxRetryBackoff:     config.MaxRetryBackoff,
+	}
+}
+
+// NewClientFromConfig creates a new end-user client from a ClientConfig.  It authenticates immediately, and returns
+// an error if unable to.
+func NewClientFromConfig(config ClientConfig) (Client, error) {
+	c := newUserClient(config)
+	if err := c.authenticate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientV2 creates a new context-aware end-user client.  It authenticates immediately, and returns an error if
+// unable to.
+func NewClientV2(ctx context.Context, config ClientConfig) (ClientV2, error) {
+	c := newUserClient(config)
+	errc := make(chan error, 1)
+	go func() { errc <- c.authenticate() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &userClientV2{c}, nil
+}
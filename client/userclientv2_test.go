@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSwift is a tiny auth v1 and storage server, with hooks to inject failures.
+type fakeSwift struct {
+	sync.Mutex
+	server   *httptest.Server
+	tokens   int
+	objects  map[string][]byte
+	headers  map[string]http.Header
+	requests []*http.Request
+	failures int
+	expire   bool
+	// maxListing caps listing pages, like a proxy's container_listing_limit.
+	maxListing int
+}
+
+func newFakeSwift() *fakeSwift {
+	f := &fakeSwift{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeSwift) client(t *testing.T, retries int) ClientV2 {
+	c, err := NewClientV2(context.Background(), ClientConfig{Username: "u", APIKey: "k", AuthURL: f.server.URL + "/auth/v1.0",
+		Retries: retries, RetryBackoff: time.Millisecond})
+	require.Nil(t, err)
+	return c
+}
+
+func (f *fakeSwift) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if request.URL.Path == "/auth/v1.0" {
+		f.tokens++
+		writer.Header().Set("X-Storage-Url", f.server.URL+"/v1/AUTH_u")
+		writer.Header().Set("X-Auth-Token", fmt.Sprintf("token%d", f.tokens))
+		return
+	}
+	body, _ := ioutil.ReadAll(request.Body)
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	f.requests = append(f.requests, request)
+	if f.expire {
+		f.expire = false
+		writer.WriteHeader(401)
+		return
+	}
+	if request.Header.Get("X-Auth-Token") != fmt.Sprintf("token%d", f.tokens) {
+		writer.WriteHeader(401)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		writer.WriteHeader(503)
+		return
+	}
+	path := strings.TrimPrefix(request.URL.Path, "/v1/AUTH_u")
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	switch {
+	case request.Method == "GET" && len(parts) == 1:
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, path+"/") && name[len(path)+1:] > request.URL.Query().Get("marker") {
+				names = append(names, name[len(path)+1:])
+			}
+		}
+		sort.Strings(names)
+		if limit, _ := strconv.Atoi(request.URL.Query().Get("limit")); limit > 0 && len(names) > limit {
+			names = names[:limit]
+		}
+		if f.maxListing > 0 && len(names) > f.maxListing {
+			names = names[:f.maxListing]
+		}
+		listing := []ObjectRecord{}
+		for _, name := range names {
+			listing = append(listing, ObjectRecord{Name: name, Bytes: len(f.objects[path+"/"+name])})
+		}
+		json.NewEncoder(writer).Encode(listing)
+	case request.Method == "PUT" && len(parts) == 2:
+		f.objects[path] = body
+		f.headers[path] = request.Header
+		writer.Header().Set("Etag", fmt.Sprintf("%x", md5.Sum(body)))
+		writer.WriteHeader(201)
+	case request.Method == "GET" && len(parts) == 2:
+		data, ok := f.objects[path]
+		if !ok {
+			writer.WriteHeader(404)
+			return
+		}
+		http.ServeContent(writer, request, path, time.Time{}, bytes.NewReader(data))
+	default:
+		writer.WriteHeader(204)
+	}
+}
+
+func TestClientV2Retries(t *testing.T) {
+	f := newFakeSwift()
+	defer f.server.Close()
+	c := f.client(t, 2)
+	f.failures = 2
+	_, err := c.PutObject(context.Background(), "c", "o", strings.NewReader("hello"), nil)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(f.requests))
+	require.Equal(t, []byte("hello"), f.objects["/c/o"])
+
+	f.failures = 3
+	_, err = c.PutObject(context.Background(), "c", "o", strings.NewReader("hello"), nil)
+	require.Equal(t, HTTPError(503), err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.failures = 1
+	_, err = c.HeadObject(ctx, "c", "o", nil)
+	require.NotNil(t, err)
+}
+
+func TestClientV2Reauth(t *testing.T) {
+	f := newFakeSwift()
+	defer f.server.Close()
+	c := f.client(t, 0)
+	f.expire = true
+	_, err := c.PutObject(context.Background(), "c", "o", strings.NewReader("hello"), nil)
+	require.Nil(t, err)
+	require.Equal(t, 2, f.tokens)
+	require.Equal(t, "token2", f.requests[1].Header.Get("X-Auth-Token"))
+	require.Equal(t, []byte("hello"), f.objects["/c/o"])
+}
+
+func TestClientV2GetOptions(t *testing.T) {
+	f := newFakeSwift()
+	defer f.server.Close()
+	c := f.client(t, 0)
+	f.objects["/c/o"] = []byte("0123456789")
+	body, headers, err := c.GetObject(context.Background(), "c", "o", &RequestOptions{Ranges: []ByteRange{{Start: 2, End: 4}}})
+	require.Nil(t, err)
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	require.Equal(t, "234", string(data))
+	require.Equal(t, "bytes 2-4/10", headers.Get("Content-Range"))
+
+	body, _, err = c.GetObject(context.Background(), "c", "o", &RequestOptions{Ranges: []ByteRange{{Start: -1, End: 3}}})
+	require.Nil(t, err)
+	data, _ = ioutil.ReadAll(body)
+	body.Close()
+	require.Equal(t, "789", string(data))
+
+	_, _, err = c.GetObject(context.Background(), "c", "o", &RequestOptions{IfMatch: "nope",
+		Query: map[string][]string{"multipart-manifest": {"get"}}, Headers: http.Header{"X-Newest": {"true"}}})
+	require.Equal(t, HTTPError(412), err)
+	last := f.requests[len(f.requests)-1]
+	require.Equal(t, "nope", last.Header.Get("If-Match"))
+	require.Equal(t, "true", last.Header.Get("X-Newest"))
+	require.Equal(t, "get", last.URL.Query().Get("multipart-manifest"))
+}
+
+func TestClientV2ListObjects(t *testing.T) {
+	f := newFakeSwift()
+	defer f.server.Close()
+	c := f.client(t, 0)
+	for i := 0; i < 7; i++ {
+		f.objects[fmt.Sprintf("/c/o%d", i)] = []byte("x")
+	}
+	it := c.ListObjects(context.Background(), "c", &ListOptions{PageSize: 3, Marker: "o0"})
+	var names []string
+	for it.Next() {
+		names = append(names, it.Record().Name)
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, []string{"o1", "o2", "o3", "o4", "o5", "o6"}, names)
+	require.Equal(t, 3, len(f.requests))
+	require.Equal(t, "o3", f.requests[1].URL.Query().Get("marker"))
+	require.Equal(t, "o6", f.requests[2].URL.Query().Get("marker"))
+
+	// a page shorter than asked for isn't the end of the listing.
+	f.maxListing = 2
+	f.requests = nil
+	it = c.ListObjects(context.Background(), "c", &ListOptions{PageSize: 3})
+	names = nil
+	for it.Next() {
+		names = append(names, it.Record().Name)
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, []string{"o0", "o1", "o2", "o3", "o4", "o5", "o6"}, names)
+	require.Equal(t, 5, len(f.requests))
+	f.maxListing = 0
+
+	f.failures = 1
+	it = c.ListObjects(context.Background(), "c", nil)
+	require.False(t, it.Next())
+	require.Equal(t, HTTPError(503), it.Err())
+}
+
+func TestClientV2PutLargeObject(t *testing.T) {
+	f := newFakeSwift()
+	defer f.server.Close()
+	c := f.client(t, 0)
+	_, err := c.PutLargeObject(context.Background(), "c", "o", strings.NewReader("0123456789"), 4,
+		&RequestOptions{Headers: http.Header{"Content-Type": {"text/plain"}}})
+	require.Nil(t, err)
+	var manifest []sloSegment
+	require.Nil(t, json.Unmarshal(f.objects["/c/o"], &manifest))
+	require.Equal(t, 3, len(manifest))
+	require.Equal(t, "text/plain", f.headers["/c/o"].Get("Content-Type"))
+	var data []byte
+	for i, segment := range manifest {
+		require.True(t, strings.HasPrefix(segment.Path, "/c_segments/o/"))
+		require.True(t, strings.HasSuffix(segment.Path, fmt.Sprintf("/4/%08d", i)))
+		data = append(data, f.objects[segment.Path]...)
+		require.Equal(t, fmt.Sprintf("%x", md5.Sum(f.objects[segment.Path])), segment.Etag)
+		require.Equal(t, int64(len(f.objects[segment.Path])), segment.SizeBytes)
+	}
+	require.Equal(t, "0123456789", string(data))
+	last := f.requests[len(f.requests)-1]
+	require.Equal(t, "put", last.URL.Query().Get("multipart-manifest"))
+
+	_, err = c.PutLargeObject(context.Background(), "c", "empty", strings.NewReader(""), 4, nil)
+	require.Nil(t, err)
+	require.Equal(t, []byte{}, f.objects["/c/empty"])
+}
@@ -31,10 +31,12 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/containerserver"
 	"github.com/troubling/hummingbird/objectserver"
 	"github.com/troubling/hummingbird/proxyserver"
+	"github.com/troubling/hummingbird/tools"
 )
 
 func WritePid(name string, pid int) error {
@@ -74,6 +76,10 @@ func GetProcess(name string) (*os.Process, error) {
 
 func findConfig(name string) string {
 	configName := strings.Split(name, "-")[0]
+	if name == "drive-audit" {
+		// drive-audit reads its section from the object server's config.
+		configName = "object"
+	}
 	configSearch := []string{
 		fmt.Sprintf("/etc/hummingbird/%s-server.conf", configName),
 		fmt.Sprintf("/etc/hummingbird/%s-server.conf.d", configName),
@@ -203,11 +209,11 @@ func ProcessControlCommand(serverCommand func(name string, args ...string)) {
 	}
 
 	switch flag.Arg(1) {
-	case "proxy", "object", "object-replicator", "object-auditor", "container", "container-replicator", "account", "account-replicator":
+	case "proxy", "object", "object-replicator", "object-auditor", "container", "container-replicator", "container-sharder", "account", "account-replicator", "drive-audit":
 		serverCommand(flag.Arg(1), flag.Args()[2:]...)
 	case "all":
 		for _, server := range []string{"proxy", "object", "object-replicator", "object-auditor",
-			"container", "container-replicator", "account", "account-replicator"} {
+			"container", "container-replicator", "container-sharder", "account", "account-replicator"} {
 			serverCommand(server)
 		}
 	default:
@@ -285,6 +291,17 @@ func main() {
 		containerReplicatorFlags.PrintDefaults()
 	}
 
+	containerSharderFlags := flag.NewFlagSet("container sharder", flag.ExitOnError)
+	containerSharderFlags.Bool("d", false, "Close stdio once the daemon is running")
+	containerSharderFlags.Bool("v", false, "Send all log messages to the console (if -d is not specified)")
+	containerSharderFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerSharderFlags.Bool("once", false, "Run one pass of the sharder")
+	containerSharderFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird container-sharder [ARGS]\n")
+		fmt.Fprintf(os.Stderr, "  Split containers with too many objects into shard containers\n")
+		containerSharderFlags.PrintDefaults()
+	}
+
 	accountFlags := flag.NewFlagSet("account server", flag.ExitOnError)
 	accountFlags.Bool("d", false, "Close stdio once the server is running")
 	accountFlags.String("c", findConfig("account"), "Config file/directory to use")
@@ -305,6 +322,19 @@ func main() {
 		accountReplicatorFlags.PrintDefaults()
 	}
 
+	driveAuditFlags := flag.NewFlagSet("drive audit", flag.ExitOnError)
+	driveAuditFlags.Bool("d", false, "Close stdio once the daemon is running")
+	driveAuditFlags.Bool("v", false, "Send all log messages to the console (if -d is not specified)")
+	driveAuditFlags.String("c", findConfig("drive-audit"), "Config file/directory to use")
+	driveAuditFlags.Bool("once", false, "Run one pass of the drive audit")
+	driveAuditFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird drive-audit [ARGS]\n")
+		fmt.Fprintf(os.Stderr, "  Watch the kernel log for disk errors and mark failing devices\n")
+		fmt.Fprintf(os.Stderr, "hummingbird drive-audit [-c config] unmark DEVICE...\n")
+		fmt.Fprintf(os.Stderr, "  Clear the failed mark on devices that have been repaired or replaced\n")
+		driveAuditFlags.PrintDefaults()
+	}
+
 	/* main flag parser, which doesn't do much */
 
 	flag.Usage = func() {
@@ -326,12 +356,26 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\n")
 		objectAuditorFlags.Usage()
 		fmt.Fprintf(os.Stderr, "\n")
+		driveAuditFlags.Usage()
+		fmt.Fprintf(os.Stderr, "\n")
 		proxyFlags.Usage()
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "hummingbird moveparts [old ring.gz]\n")
 		fmt.Fprintf(os.Stderr, "  Prioritize replication for moving partitions after a ring change\n\n")
 		fmt.Fprintf(os.Stderr, "hummingbird restoredevice [ip] [device-name]\n")
 		fmt.Fprintf(os.Stderr, "  Reconstruct a device from its peers\n\n")
+		fmt.Fprintf(os.Stderr, "hummingbird ring [builder file] [command] [args...]\n")
+		fmt.Fprintf(os.Stderr, "  Create and rebalance rings; run with no arguments for the commands.\n\n")
+		fmt.Fprintf(os.Stderr, "hummingbird ring-analyze [ring.gz] [newer ring.gz]\n")
+		fmt.Fprintf(os.Stderr, "  Report on a ring's balance and dispersion, or list the partitions moved between two rings.\n\n")
+		fmt.Fprintf(os.Stderr, "hummingbird dispersion [populate|report]\n")
+		fmt.Fprintf(os.Stderr, "  Populate or report on the dispersion containers and objects; run with no arguments for the options.\n\n")
+		fmt.Fprintf(os.Stderr, "hummingbird recon [-type object|container] [-json]\n")
+		fmt.Fprintf(os.Stderr, "  Query every server in the rings and summarize their recon stats.\n\n")
+		fmt.Fprintf(os.Stderr, "hummingbird object-info [path to .data file]\n")
+		fmt.Fprintf(os.Stderr, "  Print an object file's metadata, check its ETag and show its ring locations.\n\n")
+		fmt.Fprintf(os.Stderr, "hummingbird account-info|container-info [path to .db file]\n")
+		fmt.Fprintf(os.Stderr, "  Print a database's info, metadata and sync table and show its ring locations.\n\n")
 		fmt.Fprintf(os.Stderr, "hummingbird rescueparts [partnum1,partnum2,...]\n")
 		fmt.Fprintf(os.Stderr, "  Will send requests to all the object nodes to try to fully replicate given partitions if they have them.\n\n")
 		fmt.Fprintf(os.Stderr, "hummingbird bench CONFIG\n")
@@ -373,6 +417,9 @@ func main() {
 	case "container-replicator":
 		containerFlags.Parse(flag.Args()[1:])
 		srv.RunDaemon(containerserver.GetReplicator, containerReplicatorFlags)
+	case "container-sharder":
+		containerSharderFlags.Parse(flag.Args()[1:])
+		srv.RunDaemon(containerserver.GetSharder, containerSharderFlags)
 	case "account":
 		accountFlags.Parse(flag.Args()[1:])
 		srv.RunServers(accountserver.GetServer, accountFlags)
@@ -388,6 +435,13 @@ func main() {
 	case "object-auditor":
 		objectAuditorFlags.Parse(flag.Args()[1:])
 		srv.RunDaemon(objectserver.NewAuditor, objectAuditorFlags)
+	case "drive-audit":
+		driveAuditFlags.Parse(flag.Args()[1:])
+		if driveAuditFlags.Arg(0) == "unmark" {
+			tools.DriveAuditUnmark(driveAuditFlags.Lookup("c").Value.String(), driveAuditFlags.Args()[1:])
+		} else {
+			srv.RunDaemon(tools.NewDriveAudit, driveAuditFlags)
+		}
 	case "bench":
 		bench.RunBench(flag.Args()[1:])
 	case "dbench":
@@ -404,6 +458,20 @@ func main() {
 		objectserver.RestoreDevice(flag.Args()[1:])
 	case "rescueparts":
 		objectserver.RescueParts(flag.Args()[1:])
+	case "ring":
+		ring.BuilderCmd(flag.Args()[1:])
+	case "ring-analyze":
+		ring.AnalyzeCmd(flag.Args()[1:])
+	case "dispersion":
+		tools.Dispersion(flag.Args()[1:])
+	case "recon":
+		tools.Recon(flag.Args()[1:])
+	case "object-info":
+		objectserver.ObjectInfoCmd(flag.Args()[1:])
+	case "container-info":
+		containerserver.ContainerInfoCmd(flag.Args()[1:])
+	case "account-info":
+		accountserver.AccountInfoCmd(flag.Args()[1:])
 	default:
 		flag.Usage()
 	}
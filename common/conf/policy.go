@@ -20,9 +20,12 @@ import (
 	"strings"
 )
 
+// Policy is a storage policy.  Engine names the object engine that stores the policy's objects, and Config holds the
+// policy's whole config section, so the engine can read any settings of its own from it.
 type Policy struct {
 	Index      int
 	Type       string
+	Engine     string
 	Name       string
 	Aliases    []string
 	Default    bool
@@ -46,6 +49,7 @@ func normalLoadPolicies() PolicyList {
 	policies := map[int]*Policy{0: {
 		Index:      0,
 		Type:       "replication",
+		Engine:     "swift",
 		Name:       "Policy-0",
 		Aliases:    nil,
 		Default:    false,
@@ -67,6 +71,7 @@ func normalLoadPolicies() PolicyList {
 					policies[policyIndex] = &Policy{
 						Index:      policyIndex,
 						Type:       conf.GetDefault(key, "policy_type", "replication"),
+						Engine:     conf.GetDefault(key, "engine", "swift"),
 						Name:       conf.GetDefault(key, "name", fmt.Sprintf("Policy-%d", policyIndex)),
 						Aliases:    aliases,
 						Deprecated: conf.GetBool(key, "deprecated", false),
@@ -27,7 +27,7 @@ func TestLoadPolicy(t *testing.T) {
 	tempFile, _ := ioutil.TempFile("", "INI")
 	tempFile.Write([]byte("[swift-hash]\nswift_hash_path_prefix = changeme\nswift_hash_path_suffix = changeme\n" +
 		"[storage-policy:0]\nname = gold\naliases = yellow, orange\npolicy_type = replication\ndefault = yes\n" +
-		"[storage-policy:1]\nname = silver\npolicy_type = replication\ndeprecated = yes\n"))
+		"[storage-policy:1]\nname = silver\npolicy_type = replication\ndeprecated = yes\nengine = packed\n"))
 	oldConfigs := configLocations
 	defer func() {
 		configLocations = oldConfigs
@@ -44,6 +44,9 @@ func TestLoadPolicy(t *testing.T) {
 	require.Equal(t, policyList[1].Deprecated, true)
 	require.Equal(t, policyList[1].Default, false)
 	require.Equal(t, policyList[1].Aliases, []string{})
+	require.Equal(t, policyList[0].Engine, "swift")
+	require.Equal(t, policyList[1].Engine, "packed")
+	require.Equal(t, policyList[1].Config["engine"], "packed")
 }
 
 func TestNoPolicies(t *testing.T) {
@@ -60,4 +63,5 @@ func TestNoPolicies(t *testing.T) {
 	require.Equal(t, policyList[0].Name, "Policy-0")
 	require.Equal(t, policyList[0].Default, true)
 	require.Equal(t, policyList[0].Deprecated, false)
+	require.Equal(t, policyList[0].Engine, "swift")
 }
@@ -0,0 +1,124 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultFailedDevicesFile is where drive-audit records failed devices unless configured otherwise.
+const DefaultFailedDevicesFile = "/var/cache/swift/failed_devices.json"
+
+// failedDevicesCheckInterval is how often a FailedDevices checks its file for changes.
+var failedDevicesCheckInterval = time.Second
+
+// FailedDevice is the state drive-audit records about a device it has marked failed.  Dev is the id of the
+// filesystem that was mounted for the device at the time, so a replaced drive can be told apart from the failed one.
+type FailedDevice struct {
+	Errors   int     `json:"errors"`
+	FailedAt float64 `json:"failed_at"`
+	Dev      uint64  `json:"dev,omitempty"`
+}
+
+// ReadFailedDevices returns the devices recorded as failed in path.  A missing file means no devices have failed.
+func ReadFailedDevices(path string) (map[string]FailedDevice, error) {
+	devices := make(map[string]FailedDevice)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return devices, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &devices); err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+// WriteFailedDevices atomically replaces the failed devices recorded in path.
+func WriteFailedDevices(path string, devices map[string]FailedDevice) error {
+	data, err := json.Marshal(devices)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	f, err := NewAtomicFileWriter(dir, dir)
+	if err != nil {
+		return err
+	}
+	defer f.Abandon()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Save(path)
+}
+
+// UnmarkFailedDevice removes the device from the failed devices recorded in path, returning whether it was marked.
+func UnmarkFailedDevice(path, device string) (bool, error) {
+	devices, err := ReadFailedDevices(path)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := devices[device]; !ok {
+		return false, nil
+	}
+	delete(devices, device)
+	return true, WriteFailedDevices(path, devices)
+}
+
+// FailedDevices answers whether devices have been marked failed, rereading the file only when it has changed.
+type FailedDevices struct {
+	path    string
+	lock    sync.Mutex
+	checked time.Time
+	modTime time.Time
+	devices map[string]FailedDevice
+}
+
+// NewFailedDevices returns a FailedDevices for the state file at path.
+func NewFailedDevices(path string) *FailedDevices {
+	return &FailedDevices{path: path, devices: make(map[string]FailedDevice)}
+}
+
+// IsFailed returns true if the device is marked failed.  A nil FailedDevices has no failed devices.
+func (f *FailedDevices) IsFailed(device string) bool {
+	if f == nil {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= failedDevicesCheckInterval {
+		f.checked = now
+		if stat, err := os.Stat(f.path); err != nil {
+			f.modTime = time.Time{}
+			f.devices = make(map[string]FailedDevice)
+		} else if !stat.ModTime().Equal(f.modTime) {
+			if devices, err := ReadFailedDevices(f.path); err == nil {
+				f.modTime = stat.ModTime()
+				f.devices = devices
+			}
+		}
+	}
+	_, failed := f.devices[device]
+	return failed
+}
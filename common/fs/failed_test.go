@@ -0,0 +1,67 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedDevices(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	defer func(interval time.Duration) { failedDevicesCheckInterval = interval }(failedDevicesCheckInterval)
+	failedDevicesCheckInterval = 0
+	path := filepath.Join(tempDir, "failed_devices.json")
+
+	devices, err := ReadFailedDevices(path)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(devices))
+	f := NewFailedDevices(path)
+	require.False(t, f.IsFailed("sda"))
+
+	require.Nil(t, WriteFailedDevices(path, map[string]FailedDevice{"sda": {Errors: 2, FailedAt: 1500000000}}))
+	devices, err = ReadFailedDevices(path)
+	require.Nil(t, err)
+	require.Equal(t, map[string]FailedDevice{"sda": {Errors: 2, FailedAt: 1500000000}}, devices)
+	require.True(t, f.IsFailed("sda"))
+	require.False(t, f.IsFailed("sdb"))
+
+	marked, err := UnmarkFailedDevice(path, "sdb")
+	require.Nil(t, err)
+	require.False(t, marked)
+	marked, err = UnmarkFailedDevice(path, "sda")
+	require.Nil(t, err)
+	require.True(t, marked)
+	devices, err = ReadFailedDevices(path)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(devices))
+	require.False(t, f.IsFailed("sda"))
+
+	require.Nil(t, WriteFailedDevices(path, map[string]FailedDevice{"sda": {Errors: 2, FailedAt: 1500000000}}))
+	require.True(t, f.IsFailed("sda"))
+	require.Nil(t, os.Remove(path))
+	require.False(t, f.IsFailed("sda"))
+
+	var nilDevices *FailedDevices
+	require.False(t, nilDevices.IsFailed("sda"))
+}
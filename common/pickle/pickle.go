@@ -119,13 +119,13 @@ func pickleobj(o interface{}, buf *bytes.Buffer, scratch []byte) {
 			for _, to := range []interface{}{o.A, o.B, o.C, o.D}[:o.Len] {
 				pickleobj(to, buf, scratch)
 			}
-			buf.WriteByte('l') // TUPLE
+			buf.WriteByte('t') // TUPLE
 		case PickleArray:
 			buf.WriteString("carray\narray\n")
 			buf.WriteByte('(') // MARK
 			pickleobj(o.Type, buf, scratch)
 			pickleobj(o.Data, buf, scratch)
-			buf.WriteByte('l') // TUPLE
+			buf.WriteByte('t') // TUPLE
 			buf.WriteByte('R') // REDUCE
 		default: // why not serialize arbitrary structs as dicts while we're here
 			buf.WriteByte('(') // MARK
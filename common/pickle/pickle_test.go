@@ -450,3 +450,44 @@ func TestArbitraryStruct(t *testing.T) {
 	require.Equal(t, "hello", v2["Val1"])
 	require.Equal(t, int64(311), v2["Val2"])
 }
+
+func TestUnpickleProtocol4(t *testing.T) {
+	// python 3's pickle.dumps({'a': array.array('H', [1, 65535]), 'b': b'xy', 'c': {3}, 'd': -(1 << 40), 'e': True}, protocol=4)
+	v, err := PickleLoads([]byte("\x80\x04\x95r\x00\x00\x00\x00\x00\x00\x00}\x94(\x8c\x01a\x94\x8c\x05array\x94\x8c\x14_array_reconstructor\x94\x93\x94(\x8c\x05array\x94\x8c\x05array\x94\x93\x94\x8c\x01H\x94K\x02C\x04\x01\x00\xff\xff\x94t\x94R\x94\x8c\x01b\x94C\x02xy\x94\x8c\x01c\x94\x8f\x94(K\x03\x90\x8c\x01d\x94\x8a\x06\x00\x00\x00\x00\x00\xff\x8c\x01e\x94\x88u."))
+	require.Nil(t, err)
+	d, valid := v.(map[interface{}]interface{})
+	require.True(t, valid)
+	require.Equal(t, PickleArray{Type: "H", Data: []interface{}{int64(1), int64(65535)}}, d["a"])
+	require.Equal(t, "xy", d["b"])
+	require.Equal(t, []interface{}{int64(3)}, d["c"])
+	require.Equal(t, int64(-(1 << 40)), d["d"])
+	require.Equal(t, true, d["e"])
+}
+
+func TestUnpicklePython3Protocol2(t *testing.T) {
+	// python 3's pickle.dumps({'b': b'xy', 'c': {3}}, protocol=2)
+	v, err := PickleLoads([]byte("\x80\x02}q\x00(X\x01\x00\x00\x00bq\x01c_codecs\nencode\nq\x02X\x02\x00\x00\x00xyq\x03X\x06\x00\x00\x00latin1q\x04\x86q\x05Rq\x06X\x01\x00\x00\x00cq\x07c__builtin__\nset\nq\x08]q\tK\x03a\x85q\nRq\x0bu."))
+	require.Nil(t, err)
+	require.Equal(t, map[interface{}]interface{}{"b": "xy", "c": []interface{}{int64(3)}}, v)
+}
+
+func TestUnpickleProtocol0Bools(t *testing.T) {
+	// python 2's pickle.dumps({'e': True, 'l': 5L}, protocol=0)
+	v, err := PickleLoads([]byte("(dp0\nS'e'\np1\nI01\nsS'l'\np2\nL5L\ns."))
+	require.Nil(t, err)
+	require.Equal(t, map[interface{}]interface{}{"e": true, "l": int64(5)}, v)
+}
+
+func TestLoadArrayFromBytes(t *testing.T) {
+	v, err := PickleLoads([]byte("carray\narray\n(U\x01HU\x04\x01\x00\xff\xfftR."))
+	require.Nil(t, err)
+	require.Equal(t, PickleArray{Type: "H", Data: []interface{}{int64(1), int64(65535)}}, v)
+	_, err = PickleLoads([]byte("carray\narray\n(U\x01dU\x08\x00\x00\x00\x00\x00\x00\x00\x00tR."))
+	require.NotNil(t, err)
+}
+
+func TestPickleArrayArgsAreATuple(t *testing.T) {
+	// python won't call array.array with a list of arguments.
+	require.Equal(t, []byte("\x80\x02carray\narray\n(U\x01H(K\x01M\xff\xffltR."),
+		PickleDumps(PickleArray{Type: "H", Data: []interface{}{1, 65535}}))
+}
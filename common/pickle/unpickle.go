@@ -23,6 +23,7 @@ import (
 	"io"
 	"math"
 	"strconv"
+	"strings"
 )
 
 var markster = "HI, I'M MARK!"
@@ -235,12 +236,46 @@ func mapKey(i interface{}) (interface{}, error) {
 	}
 }
 
+// decodeLong decodes the little endian two's complement integers written by LONG1 and LONG4.
+func decodeLong(valb []byte) int64 {
+	val := int64(0)
+	for i, d := range valb {
+		val |= (int64(d) << uint64(i*8))
+	}
+	if len(valb) > 0 && len(valb) < 8 && valb[len(valb)-1] >= '\x80' {
+		val -= int64(1) << uint64(len(valb)*8)
+	}
+	return val
+}
+
+// arrayFromBytes unpacks the machine values of an array.array, as python pickles them from an array's tobytes().
+func arrayFromBytes(typecode string, data []byte) (PickleArray, error) {
+	arr := PickleArray{Type: typecode, Data: make([]interface{}, 0, len(data))}
+	switch typecode {
+	case "B":
+		for _, b := range data {
+			arr.Data = append(arr.Data, int64(b))
+		}
+	case "H":
+		for i := 0; i+1 < len(data); i += 2 {
+			arr.Data = append(arr.Data, int64(binary.LittleEndian.Uint16(data[i:])))
+		}
+	default:
+		return arr, errors.New("Invalid pickle (REDUCE): unsupported array typecode " + typecode)
+	}
+	return arr, nil
+}
+
 func PickleLoads(data []byte) (interface{}, error) {
 	state := newState(16, data)
 	for op, err := state.readByte(); err == nil; op, err = state.readByte() {
 		switch op {
 		case '\x80': // PROTO
 			state.readByte()
+		case '\x95': // FRAME
+			if _, err := state.readBytes(8); err != nil {
+				return nil, errors.New("Incomplete pickle (FRAME): " + err.Error())
+			}
 		case '(': // MARK
 			state.setMark()
 		case '.': // STOP
@@ -281,7 +316,7 @@ func PickleLoads(data []byte) (interface{}, error) {
 				return nil, errors.New("Unable to interpret Python string (STRING): " + err.Error())
 			}
 			state.push(str)
-		case 'U': //SHORT_BINSTRING
+		case 'U', 'C', '\x8c': // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
 			length, err := state.readByte()
 			if err != nil {
 				return nil, errors.New("Incomplete pickle (SHORT_BINSTRING): " + err.Error())
@@ -291,7 +326,7 @@ func PickleLoads(data []byte) (interface{}, error) {
 				return nil, errors.New("Incomplete pickle (SHORT_BINSTRING): " + err.Error())
 			}
 			state.push(string(str))
-		case 'T', 'X': // BINUNICODE, BINSTRING
+		case 'T', 'X', 'B': // BINSTRING, BINUNICODE, BINBYTES
 			length, err := state.readUint32()
 			if err != nil {
 				return nil, errors.New("Incomplete pickle (BINSTRING): " + err.Error())
@@ -363,7 +398,7 @@ func PickleLoads(data []byte) (interface{}, error) {
 				}
 			}
 			state.push(dict)
-		case ']', ')': // EMPTY_LIST, EMPTY_TUPLE
+		case ']', ')', '\x8f': // EMPTY_LIST, EMPTY_TUPLE, EMPTY_SET
 			state.push(make([]interface{}, 0))
 		case 'l', 't': // LIST, TUPLE
 			markState, err := state.mark()
@@ -384,7 +419,7 @@ func PickleLoads(data []byte) (interface{}, error) {
 			} else {
 				state.push(append(list, value))
 			}
-		case 'e': // APPENDS
+		case 'e', '\x90': // APPENDS, ADDITEMS
 			items, err := state.mark()
 			if err != nil {
 				return nil, errors.New("Invalid pickle (APPENDS): unable to find mark")
@@ -425,7 +460,15 @@ func PickleLoads(data []byte) (interface{}, error) {
 			if err != nil {
 				return nil, errors.New("Incomplete pickle (INT): " + err.Error())
 			}
-			val, err := strconv.ParseInt(line, 10, 64)
+			// protocol 0 writes True and False as INTs, and LONGs with a trailing L.
+			if op == 'I' && line == "01" {
+				state.push(true)
+				continue
+			} else if op == 'I' && line == "00" {
+				state.push(false)
+				continue
+			}
+			val, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
 			if err != nil {
 				return nil, errors.New("Invalid pickle (INT): " + err.Error())
 			}
@@ -463,20 +506,21 @@ func PickleLoads(data []byte) (interface{}, error) {
 			if err != nil {
 				return nil, errors.New("Incomplete pickle (LONG1): " + err.Error())
 			}
-			val := int64(0)
-			if length > 0 {
-				valb, err := state.readBytes(int(length))
-				if err != nil {
-					return nil, errors.New("Incomplete pickle (LONG1): " + err.Error())
-				}
-				for i, d := range valb {
-					val |= (int64(d) << uint64(i*8))
-				}
-				if valb[len(valb)-1] >= '\x80' {
-					val -= int64(1) << uint64(length*8)
-				}
+			valb, err := state.readBytes(int(length))
+			if err != nil {
+				return nil, errors.New("Incomplete pickle (LONG1): " + err.Error())
 			}
-			state.push(val)
+			state.push(decodeLong(valb))
+		case '\x8b': // LONG4
+			length, err := state.readUint32()
+			if err != nil {
+				return nil, errors.New("Incomplete pickle (LONG4): " + err.Error())
+			}
+			valb, err := state.readBytes(int(length))
+			if err != nil {
+				return nil, errors.New("Incomplete pickle (LONG4): " + err.Error())
+			}
+			state.push(decodeLong(valb))
 		case 'G': // BINFLOAT
 			val, err := state.readFloat64()
 			if err != nil {
@@ -530,6 +574,12 @@ func PickleLoads(data []byte) (interface{}, error) {
 				return nil, errors.New("Incomplete pickle (LONG_BINGET): " + err.Error())
 			}
 			state.push(state.getMemo(int(id)))
+		case '\x94': // MEMOIZE
+			top, err := state.peek()
+			if err != nil {
+				return nil, errors.New("Invalid pickle (MEMOIZE): " + err.Error())
+			}
+			state.setMemo(len(state.memoKey), top)
 		case 'r': // LONG_BINPUT
 			id, err := state.readUint32()
 			if err != nil {
@@ -550,6 +600,23 @@ func PickleLoads(data []byte) (interface{}, error) {
 				return nil, errors.New("Incomplete pickle (GLOBAL): " + err.Error())
 			}
 			state.push(pickleGlobal{module + "." + klass})
+		case '\x93': // STACK_GLOBAL
+			klass, err1 := state.pop()
+			module, err2 := state.pop()
+			if err1 != nil || err2 != nil {
+				return nil, errors.New("Incomplete pickle (STACK_GLOBAL): stack empty")
+			}
+			m, ok1 := module.(string)
+			k, ok2 := klass.(string)
+			if !ok1 || !ok2 {
+				return nil, errors.New("Invalid pickle (STACK_GLOBAL): non-string names")
+			}
+			state.push(pickleGlobal{m + "." + k})
+		case 'b': // BUILD
+			// the objects we reduce don't carry any state, so there's nothing to build.
+			if _, err := state.pop(); err != nil {
+				return nil, errors.New("Incomplete pickle (BUILD): stack empty")
+			}
 		case 'R': // REDUCE
 			arg, err1 := state.pop()
 			c, err2 := state.pop()
@@ -561,18 +628,63 @@ func PickleLoads(data []byte) (interface{}, error) {
 				return nil, errors.New("Invalid pickle (REDUCE): non-callable on stack")
 			}
 			// we'll just have to re-implement/fake python callables as the need arises.
+			as, valid := arg.([]interface{})
+			if !valid {
+				return nil, errors.New("Invalid pickle (REDUCE): args not a tuple")
+			}
 			switch callable.name {
 			case "array.array":
-				as, valid := arg.([]interface{})
-				if !valid || len(as) != 2 {
+				if len(as) != 2 {
 					return nil, errors.New("Invalid pickle (REDUCE): invalid array.array args")
 				}
-				tc, ok1 := as[0].(string)
-				val, ok2 := as[1].([]interface{})
-				if !ok1 || !ok2 {
+				tc, ok := as[0].(string)
+				if !ok {
 					return nil, errors.New("Invalid pickle (REDUCE): invalid array.array args")
 				}
-				state.push(PickleArray{Type: tc, Data: val})
+				switch val := as[1].(type) {
+				case []interface{}:
+					state.push(PickleArray{Type: tc, Data: val})
+				case string: // python 2 pickles arrays with their machine values.
+					arr, err := arrayFromBytes(tc, []byte(val))
+					if err != nil {
+						return nil, err
+					}
+					state.push(arr)
+				default:
+					return nil, errors.New("Invalid pickle (REDUCE): invalid array.array args")
+				}
+			case "array._array_reconstructor": // python 3, protocol 3 and up
+				if len(as) != 4 {
+					return nil, errors.New("Invalid pickle (REDUCE): invalid array._array_reconstructor args")
+				}
+				tc, ok1 := as[1].(string)
+				val, ok2 := as[3].(string)
+				if !ok1 || !ok2 {
+					return nil, errors.New("Invalid pickle (REDUCE): invalid array._array_reconstructor args")
+				}
+				arr, err := arrayFromBytes(tc, []byte(val))
+				if err != nil {
+					return nil, err
+				}
+				state.push(arr)
+			case "_codecs.encode": // python 3 pickles bytes as latin-1 encoded strings at protocol 2.
+				str, ok := as[0].(string)
+				if len(as) != 2 || !ok {
+					return nil, errors.New("Invalid pickle (REDUCE): invalid _codecs.encode args")
+				}
+				val := make([]byte, 0, len(str))
+				for _, r := range str {
+					val = append(val, byte(r))
+				}
+				state.push(string(val))
+			case "__builtin__.set", "builtins.set":
+				if len(as) == 0 {
+					state.push(make([]interface{}, 0))
+				} else if items, ok := as[0].([]interface{}); ok && len(as) == 1 {
+					state.push(items)
+				} else {
+					return nil, errors.New("Invalid pickle (REDUCE): invalid set args")
+				}
 			default:
 				return nil, errors.New("Invalid pickle (REDUCE): unknown callable on stack")
 			}
@@ -0,0 +1,249 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// DeviceBalance is how many partition replicas a device has, compared to its share by weight.
+type DeviceBalance struct {
+	Device   Device
+	Assigned int
+	Desired  float64
+	Balance  float64
+}
+
+// TierDispersion counts the partitions with more than one replica in the same region, zone or ip.  Unavoidable is
+// set when there are fewer tiers than replicas, so some doubling up is expected.
+type TierDispersion struct {
+	Tier        string
+	Count       int
+	Tiers       int
+	Unavoidable bool
+}
+
+// RingAnalysis describes how a ring's partitions are spread across its devices.
+type RingAnalysis struct {
+	Partitions       uint64
+	Replicas         uint64
+	Devices          []DeviceBalance
+	MaxBalance       float64
+	Dispersion       []TierDispersion
+	DuplicateDevices []uint64
+}
+
+// PartMove is one replica of a partition that's on a different device in a newer ring.
+type PartMove struct {
+	Partition uint64
+	Replica   int
+	From      *Device
+	To        *Device
+}
+
+// ringDevices returns the ring's real devices; rings written by Swift leave holes where devices were removed.
+func ringDevices(r Ring) []Device {
+	var devs []Device
+	for i, dev := range r.AllDevices() {
+		if dev.Id == i && (dev.Ip != "" || dev.Device != "") {
+			devs = append(devs, dev)
+		}
+	}
+	return devs
+}
+
+// AnalyzeRing reports on the balance and dispersion of a ring's partitions.
+func AnalyzeRing(r Ring) *RingAnalysis {
+	a := &RingAnalysis{Partitions: r.PartitionCount(), Replicas: r.ReplicaCount()}
+	devs := ringDevices(r)
+	assigned := make(map[int]int)
+	tierNames := []string{"region", "zone", "ip"}
+	tierKeys := func(dev *Device) []string {
+		return []string{
+			fmt.Sprintf("r%d", dev.Region),
+			fmt.Sprintf("r%dz%d", dev.Region, dev.Zone),
+			fmt.Sprintf("r%dz%d-%s", dev.Region, dev.Zone, dev.Ip),
+		}
+	}
+	tierCounts := make([]map[string]bool, len(tierNames))
+	for i := range tierCounts {
+		tierCounts[i] = make(map[string]bool)
+	}
+	totalWeight := 0.0
+	for i := range devs {
+		totalWeight += devs[i].Weight
+		if devs[i].Weight > 0 {
+			for t, key := range tierKeys(&devs[i]) {
+				tierCounts[t][key] = true
+			}
+		}
+	}
+	crowded := make([]int, len(tierNames))
+	for part := uint64(0); part < a.Partitions; part++ {
+		nodes := r.GetNodesInOrder(part)
+		seenDev := make(map[int]bool)
+		seenTier := make([]map[string]bool, len(tierNames))
+		isCrowded := make([]bool, len(tierNames))
+		for i := range seenTier {
+			seenTier[i] = make(map[string]bool)
+		}
+		duplicate := false
+		for _, node := range nodes {
+			assigned[node.Id]++
+			if seenDev[node.Id] {
+				duplicate = true
+			}
+			seenDev[node.Id] = true
+			for t, key := range tierKeys(node) {
+				if seenTier[t][key] {
+					isCrowded[t] = true
+				}
+				seenTier[t][key] = true
+			}
+		}
+		if duplicate {
+			a.DuplicateDevices = append(a.DuplicateDevices, part)
+		}
+		for t := range crowded {
+			if isCrowded[t] {
+				crowded[t]++
+			}
+		}
+	}
+	for t, name := range tierNames {
+		a.Dispersion = append(a.Dispersion, TierDispersion{
+			Tier:        name,
+			Count:       crowded[t],
+			Tiers:       len(tierCounts[t]),
+			Unavoidable: uint64(len(tierCounts[t])) < a.Replicas,
+		})
+	}
+	for _, dev := range devs {
+		db := DeviceBalance{Device: dev, Assigned: assigned[dev.Id]}
+		if totalWeight > 0 {
+			db.Desired = float64(a.Partitions*a.Replicas) * dev.Weight / totalWeight
+		}
+		if db.Desired > 0 {
+			db.Balance = 100 * (float64(db.Assigned) - db.Desired) / db.Desired
+		} else if db.Assigned > 0 {
+			db.Balance = math.Inf(1)
+		}
+		if math.Abs(db.Balance) > a.MaxBalance {
+			a.MaxBalance = math.Abs(db.Balance)
+		}
+		a.Devices = append(a.Devices, db)
+	}
+	return a
+}
+
+// MovedPartitions lists the partition replicas assigned to a different device in newRing than in oldRing.
+func MovedPartitions(oldRing, newRing Ring) []PartMove {
+	var moves []PartMove
+	for partition := uint64(0); true; partition++ {
+		olddevs := oldRing.GetNodesInOrder(partition)
+		newdevs := newRing.GetNodesInOrder(partition)
+		if olddevs == nil || newdevs == nil {
+			break
+		}
+		for i := range olddevs {
+			if i < len(newdevs) && olddevs[i].Id != newdevs[i].Id {
+				moves = append(moves, PartMove{Partition: partition, Replica: i, From: olddevs[i], To: newdevs[i]})
+			}
+		}
+	}
+	return moves
+}
+
+func devString(dev *Device) string {
+	return fmt.Sprintf("d%dr%dz%d-%s/%s", dev.Id, dev.Region, dev.Zone, formatAddress(dev.Ip, dev.Port), dev.Device)
+}
+
+func printAnalysis(path string, a *RingAnalysis) {
+	fmt.Printf("%s: %d partitions, %d replicas, %d devices, %.2f max balance\n", path, a.Partitions, a.Replicas,
+		len(a.Devices), a.MaxBalance)
+	fmt.Printf("%-40s %8s %10s %10s %10s\n", "Device", "weight", "assigned", "desired", "balance")
+	for _, db := range a.Devices {
+		fmt.Printf("%-40s %8.2f %10d %10.2f %10.2f\n", devString(&db.Device), db.Device.Weight, db.Assigned,
+			db.Desired, db.Balance)
+	}
+	fmt.Println("Dispersion:")
+	for _, td := range a.Dispersion {
+		note := ""
+		if td.Unavoidable && td.Count > 0 {
+			note = fmt.Sprintf(" (only %d %ss with weight, so this can't be avoided)", td.Tiers, td.Tier)
+		}
+		fmt.Printf("  %d partitions (%.2f%%) have more than one replica in the same %s%s\n", td.Count,
+			100*float64(td.Count)/math.Max(float64(a.Partitions), 1), td.Tier, note)
+	}
+	if len(a.DuplicateDevices) > 0 {
+		fmt.Printf("%d partitions have more than one replica on the same device:", len(a.DuplicateDevices))
+		for i, part := range a.DuplicateDevices {
+			if i == 20 {
+				fmt.Print(" ...")
+				break
+			}
+			fmt.Printf(" %d", part)
+		}
+		fmt.Println()
+	} else {
+		fmt.Println("No partitions have more than one replica on the same device.")
+	}
+}
+
+// AnalyzeCmd implements "hummingbird ring-analyze", which reports on a ring's balance and dispersion, or lists the
+// partitions that moved between two rings.
+func AnalyzeCmd(args []string) {
+	flags := flag.NewFlagSet("ring-analyze", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird ring-analyze <ring.gz> [<newer ring.gz>]\n")
+		fmt.Fprintf(os.Stderr, "  Reports on the ring's balance and dispersion, or given two rings lists the partitions moved between them.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return
+	}
+	r, err := LoadRing(flags.Arg(0), "", "")
+	if err != nil {
+		fmt.Println("Unable to load ring:", err)
+		return
+	}
+	if flags.NArg() == 1 {
+		printAnalysis(flags.Arg(0), AnalyzeRing(r))
+		return
+	}
+	newRing, err := LoadRing(flags.Arg(1), "", "")
+	if err != nil {
+		fmt.Println("Unable to load ring:", err)
+		return
+	}
+	if r.PartitionCount() != newRing.PartitionCount() {
+		fmt.Printf("Rings have different partition counts (%d and %d); every partition has moved.\n",
+			r.PartitionCount(), newRing.PartitionCount())
+		return
+	}
+	moves := MovedPartitions(r, newRing)
+	for _, move := range moves {
+		fmt.Printf("Partition %d replica %d: %s -> %s\n", move.Partition, move.Replica, devString(move.From),
+			devString(move.To))
+	}
+	fmt.Printf("%d partition replicas moved (%.2f%%)\n", len(moves),
+		100*float64(len(moves))/math.Max(float64(r.PartitionCount()*r.ReplicaCount()), 1))
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadBuiltRing(t *testing.T, dir, name string, b *RingBuilder) Ring {
+	path := filepath.Join(dir, name)
+	require.Nil(t, b.WriteRing(path))
+	r, err := LoadRing(path, "", "")
+	require.Nil(t, err)
+	return r
+}
+
+func TestAnalyzeRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := testBuilder(t, 4, 2, []string{"r1z1-10.0.0.1:6000/sda", "r1z1-10.0.0.1:6000/sdb", "r1z2-10.0.0.2:6000/sda",
+		"r1z2-10.0.0.2:6000/sdb"})
+	_, _, err = b.Rebalance()
+	require.Nil(t, err)
+	a := AnalyzeRing(loadBuiltRing(t, dir, "a.ring.gz", b))
+	require.Equal(t, uint64(16), a.Partitions)
+	require.Equal(t, uint64(2), a.Replicas)
+	require.Equal(t, 4, len(a.Devices))
+	for _, db := range a.Devices {
+		require.Equal(t, 8.0, db.Desired)
+		require.Equal(t, 8, db.Assigned)
+	}
+	require.Equal(t, 0.0, a.MaxBalance)
+	require.Equal(t, "region", a.Dispersion[0].Tier)
+	require.Equal(t, 16, a.Dispersion[0].Count)
+	require.True(t, a.Dispersion[0].Unavoidable)
+	require.Equal(t, "zone", a.Dispersion[1].Tier)
+	require.Equal(t, 0, a.Dispersion[1].Count)
+	require.Equal(t, 0, len(a.DuplicateDevices))
+
+	// put both replicas of partition 3 on the same device
+	b.replica2Part2Dev[1][3] = b.replica2Part2Dev[0][3]
+	a = AnalyzeRing(loadBuiltRing(t, dir, "b.ring.gz", b))
+	require.Equal(t, []uint64{3}, a.DuplicateDevices)
+	require.Equal(t, 1, a.Dispersion[1].Count)
+	require.False(t, a.Dispersion[1].Unavoidable)
+	require.True(t, a.MaxBalance > 0)
+}
+
+func TestMovedPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := testBuilder(t, 4, 2, []string{"r1z1-10.0.0.1:6000/sda", "r1z2-10.0.0.2:6000/sda", "r1z3-10.0.0.3:6000/sda"})
+	_, _, err = b.Rebalance()
+	require.Nil(t, err)
+	oldRing := loadBuiltRing(t, dir, "old.ring.gz", b)
+	require.Equal(t, 0, len(MovedPartitions(oldRing, oldRing)))
+
+	old := b.replica2Part2Dev[1][5]
+	b.replica2Part2Dev[1][5] = uint16((int(old) + 1) % 3)
+	moves := MovedPartitions(oldRing, loadBuiltRing(t, dir, "new.ring.gz", b))
+	require.Equal(t, 1, len(moves))
+	require.Equal(t, uint64(5), moves[0].Partition)
+	require.Equal(t, 1, moves[0].Replica)
+	require.Equal(t, int(old), moves[0].From.Id)
+	require.Equal(t, (int(old)+1)%3, moves[0].To.Id)
+}
@@ -0,0 +1,914 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/troubling/hummingbird/common/pickle"
+)
+
+// noneDev marks a replica that isn't assigned to any device, the same as Swift's NONE_DEV.
+const noneDev = 0xffff
+
+// maxDevices is as many devices as fit in the ring's uint16 device ids, less noneDev.
+const maxDevices = noneDev
+
+// BuilderDevice is a device as stored in a .builder file.  Parts and PartsWanted are maintained by Rebalance.
+type BuilderDevice struct {
+	Id              int
+	Region          int
+	Zone            int
+	Ip              string
+	Port            int
+	ReplicationIp   string
+	ReplicationPort int
+	Device          string
+	Weight          float64
+	Meta            string
+	Parts           int
+	PartsWanted     int
+}
+
+// RingBuilder holds the state Swift's swift-ring-builder keeps in a .builder file, and is saved in the same format so
+// either tool can be used on the result.
+type RingBuilder struct {
+	PartPower           int
+	Replicas            float64
+	MinPartHours        int
+	Parts               int
+	Overload            float64
+	Devs                []*BuilderDevice
+	DevsChanged         bool
+	Version             int
+	Id                  string
+	replica2Part2Dev    [][]uint16
+	lastPartMoves       []uint8
+	lastPartMovesEpoch  int64
+	lastPartGatherStart int
+	removeDevs          []*BuilderDevice
+}
+
+// NewRingBuilder creates a builder for a ring with 2^partPower partitions.
+func NewRingBuilder(partPower int, replicas float64, minPartHours int) (*RingBuilder, error) {
+	if partPower < 1 || partPower > 32 {
+		return nil, errors.New("part_power must be between 1 and 32")
+	}
+	if replicas < 1 || replicas != math.Trunc(replicas) {
+		return nil, errors.New("replicas must be a whole number of at least 1")
+	}
+	if minPartHours < 0 {
+		return nil, errors.New("min_part_hours must be non-negative")
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &RingBuilder{
+		PartPower:    partPower,
+		Replicas:     replicas,
+		MinPartHours: minPartHours,
+		Parts:        1 << uint(partPower),
+		Id:           hex.EncodeToString(id),
+	}, nil
+}
+
+// replicaCount is how many rows replica2Part2Dev has.  Builders only allow whole replica counts, but ones made by Swift
+// can have a fractional count, with a last row that only covers that fraction of the partitions.
+func (b *RingBuilder) replicaCount() int {
+	return int(math.Ceil(b.Replicas))
+}
+
+// replicaParts is how many partitions the replica's row covers.
+func (b *RingBuilder) replicaParts(replica int) int {
+	if whole := math.Floor(b.Replicas); replica >= int(whole) {
+		return int(float64(b.Parts) * (b.Replicas - whole))
+	}
+	return b.Parts
+}
+
+// AddDevice adds dev to the builder, assigning it the next free id if dev.Id is negative.  It returns the new device's id.
+func (b *RingBuilder) AddDevice(dev BuilderDevice) (int, error) {
+	if dev.Id < 0 {
+		dev.Id = 0
+		for dev.Id < len(b.Devs) && b.Devs[dev.Id] != nil {
+			dev.Id++
+		}
+	}
+	if dev.Id >= maxDevices {
+		return -1, fmt.Errorf("device id %d is too large", dev.Id)
+	}
+	if dev.Id < len(b.Devs) && b.Devs[dev.Id] != nil {
+		return -1, fmt.Errorf("duplicate device id %d", dev.Id)
+	}
+	for _, rd := range b.removeDevs {
+		if rd.Id == dev.Id {
+			return -1, fmt.Errorf("device id %d is being removed; rebalance before reusing it", dev.Id)
+		}
+	}
+	if dev.Weight < 0 {
+		return -1, errors.New("weight must be non-negative")
+	}
+	if dev.ReplicationIp == "" {
+		dev.ReplicationIp = dev.Ip
+	}
+	if dev.ReplicationPort == 0 {
+		dev.ReplicationPort = dev.Port
+	}
+	for _, d := range b.Devs {
+		if d != nil && d.Ip == dev.Ip && d.Port == dev.Port && d.Device == dev.Device {
+			return -1, fmt.Errorf("device %s:%d/%s already exists as id %d", dev.Ip, dev.Port, dev.Device, d.Id)
+		}
+	}
+	for len(b.Devs) <= dev.Id {
+		b.Devs = append(b.Devs, nil)
+	}
+	dev.Parts = 0
+	dev.PartsWanted = 0
+	b.Devs[dev.Id] = &dev
+	b.DevsChanged = true
+	b.Version++
+	return dev.Id, nil
+}
+
+func (b *RingBuilder) getDev(id int) (*BuilderDevice, error) {
+	if id < 0 || id >= len(b.Devs) || b.Devs[id] == nil {
+		return nil, fmt.Errorf("no device with id %d", id)
+	}
+	return b.Devs[id], nil
+}
+
+// RemoveDevice schedules the device to be removed; its partitions are reassigned on the next rebalance.  Removing a
+// device that's already scheduled to be does nothing.
+func (b *RingBuilder) RemoveDevice(id int) error {
+	dev, err := b.getDev(id)
+	if err != nil {
+		return err
+	}
+	for _, rd := range b.removeDevs {
+		if rd.Id == id {
+			return nil
+		}
+	}
+	dev.Weight = 0
+	b.removeDevs = append(b.removeDevs, dev)
+	b.DevsChanged = true
+	b.Version++
+	return nil
+}
+
+// SetDeviceWeight changes a device's weight, which takes effect on the next rebalance.
+func (b *RingBuilder) SetDeviceWeight(id int, weight float64) error {
+	dev, err := b.getDev(id)
+	if err != nil {
+		return err
+	}
+	if weight < 0 {
+		return errors.New("weight must be non-negative")
+	}
+	dev.Weight = weight
+	b.DevsChanged = true
+	b.Version++
+	return nil
+}
+
+// SetDeviceInfo replaces the device's location details with those in info, leaving its id, weight and partitions alone.
+func (b *RingBuilder) SetDeviceInfo(id int, info BuilderDevice) error {
+	dev, err := b.getDev(id)
+	if err != nil {
+		return err
+	}
+	for _, d := range b.Devs {
+		if d != nil && d != dev && d.Ip == info.Ip && d.Port == info.Port && d.Device == info.Device {
+			return fmt.Errorf("device %s:%d/%s already exists as id %d", info.Ip, info.Port, info.Device, d.Id)
+		}
+	}
+	dev.Region = info.Region
+	dev.Zone = info.Zone
+	dev.Ip = info.Ip
+	dev.Port = info.Port
+	dev.ReplicationIp = info.ReplicationIp
+	dev.ReplicationPort = info.ReplicationPort
+	dev.Device = info.Device
+	dev.Meta = info.Meta
+	b.DevsChanged = true
+	b.Version++
+	return nil
+}
+
+// PretendMinPartHoursPassed lets the next rebalance move any partition, regardless of min_part_hours.
+func (b *RingBuilder) PretendMinPartHoursPassed() {
+	for i := range b.lastPartMoves {
+		b.lastPartMoves[i] = 0xff
+	}
+}
+
+func (b *RingBuilder) updateLastPartMoves() {
+	now := time.Now().Unix()
+	elapsedHours := (now - b.lastPartMovesEpoch) / 3600
+	if elapsedHours <= 0 {
+		return
+	}
+	for i := range b.lastPartMoves {
+		if int64(b.lastPartMoves[i])+elapsedHours > 0xff {
+			b.lastPartMoves[i] = 0xff
+		} else {
+			b.lastPartMoves[i] += uint8(elapsedHours)
+		}
+	}
+	b.lastPartMovesEpoch = now
+}
+
+// tier identifies a region, zone, ip or device; shorter keys are the higher tiers.
+type tier struct {
+	depth  int
+	region int
+	zone   int
+	ip     string
+	dev    int
+}
+
+func devTiers(dev *BuilderDevice) []tier {
+	return []tier{
+		{depth: 1, region: dev.Region},
+		{depth: 2, region: dev.Region, zone: dev.Zone},
+		{depth: 3, region: dev.Region, zone: dev.Zone, ip: dev.Ip},
+		{depth: 4, region: dev.Region, zone: dev.Zone, ip: dev.Ip, dev: dev.Id},
+	}
+}
+
+// targetReplicas works out how many replicas of each partition, on average, each tier should hold.  Tiers start with
+// their share by weight, then get up to overload more than that where it's needed to keep replicas in separate tiers.
+func (b *RingBuilder) targetReplicas() map[tier]float64 {
+	children := make(map[tier][]tier)
+	weights := make(map[tier]float64)
+	devCounts := make(map[tier]int)
+	root := tier{}
+	seen := make(map[tier]bool)
+	for _, dev := range b.Devs {
+		if dev == nil || dev.Weight <= 0 {
+			continue
+		}
+		parent := root
+		for _, t := range devTiers(dev) {
+			weights[t] += dev.Weight
+			devCounts[t]++
+			if !seen[t] {
+				seen[t] = true
+				children[parent] = append(children[parent], t)
+			}
+			parent = t
+		}
+		weights[root] += dev.Weight
+		devCounts[root]++
+	}
+	target := make(map[tier]float64)
+	var place func(parent tier, replicas float64)
+	place = func(parent tier, replicas float64) {
+		target[parent] = replicas
+		kids := children[parent]
+		if len(kids) == 0 {
+			return
+		}
+		weighted := make([]float64, len(kids))
+		for i, t := range kids {
+			weighted[i] = replicas * weights[t] / weights[parent]
+		}
+		// wanted is the most even spread across the child tiers, still in proportion to weight where it can be.
+		maxPer := math.Ceil(replicas/float64(len(kids)) - 1e-9)
+		caps := make([]float64, len(kids))
+		for i, t := range kids {
+			caps[i] = math.Min(maxPer, float64(devCounts[t]))
+		}
+		wanted := waterFill(replicas, weighted, caps)
+		increase, slack := 0.0, 0.0
+		result := make([]float64, len(kids))
+		for i := range kids {
+			if wanted[i] > weighted[i] {
+				result[i] = math.Min(wanted[i], weighted[i]*(1+b.Overload))
+				increase += result[i] - weighted[i]
+			} else {
+				slack += weighted[i] - wanted[i]
+			}
+		}
+		for i := range kids {
+			if wanted[i] <= weighted[i] {
+				result[i] = weighted[i]
+				if slack > 0 {
+					result[i] -= increase * (weighted[i] - wanted[i]) / slack
+				}
+			}
+		}
+		for i, t := range kids {
+			place(t, result[i])
+		}
+	}
+	if weights[root] > 0 {
+		place(root, b.Replicas)
+	}
+	return target
+}
+
+// waterFill spreads total across slots in proportion to their weights, without letting any go over its cap.
+func waterFill(total float64, weights, caps []float64) []float64 {
+	result := make([]float64, len(weights))
+	capped := make([]bool, len(weights))
+	remaining := total
+	for remaining > 1e-9 {
+		sum := 0.0
+		for i, w := range weights {
+			if !capped[i] {
+				sum += w
+			}
+		}
+		if sum <= 0 {
+			break
+		}
+		overflow := false
+		for i, w := range weights {
+			if !capped[i] && result[i]+remaining*w/sum > caps[i] {
+				overflow = true
+			}
+		}
+		if !overflow {
+			for i, w := range weights {
+				if !capped[i] {
+					result[i] += remaining * w / sum
+				}
+			}
+			break
+		}
+		share := remaining
+		for i, w := range weights {
+			if !capped[i] && result[i]+share*w/sum > caps[i] {
+				remaining -= caps[i] - result[i]
+				result[i] = caps[i]
+				capped[i] = true
+			}
+		}
+	}
+	return result
+}
+
+type partReplica struct {
+	part    int
+	replica int
+}
+
+// Rebalance reassigns partitions to match the current devices and weights, moving each partition at most once per
+// min_part_hours except when its device is removed.  It returns how many partition replicas were reassigned and the
+// resulting balance.  Like Swift, it refuses to leave any replica unassigned, so there have to be at least as many
+// devices with weight as there are replicas.
+func (b *RingBuilder) Rebalance() (int, float64, error) {
+	replicas := b.replicaCount()
+	weightedDevs := 0
+	for _, dev := range b.Devs {
+		if dev != nil && dev.Weight > 0 {
+			weightedDevs++
+		}
+	}
+	if weightedDevs == 0 {
+		return 0, 0, errors.New("no devices with weight to assign partitions to")
+	} else if weightedDevs < replicas {
+		return 0, 0, fmt.Errorf("a replica count of %g requires at least %d devices with weight, not %d", b.Replicas, replicas, weightedDevs)
+	}
+	if b.replica2Part2Dev == nil {
+		b.lastPartMoves = make([]uint8, b.Parts)
+		for i := range b.lastPartMoves {
+			b.lastPartMoves[i] = 0xff
+		}
+		b.lastPartMovesEpoch = time.Now().Unix()
+	}
+	for len(b.replica2Part2Dev) < replicas {
+		part2dev := make([]uint16, b.replicaParts(len(b.replica2Part2Dev)))
+		for i := range part2dev {
+			part2dev[i] = noneDev
+		}
+		b.replica2Part2Dev = append(b.replica2Part2Dev, part2dev)
+	}
+	b.updateLastPartMoves()
+
+	target := b.targetReplicas()
+	for _, dev := range b.Devs {
+		if dev != nil {
+			dev.Parts = 0
+			dev.PartsWanted = int(math.Floor(target[devTiers(dev)[3]]*float64(b.Parts) + 0.5))
+		}
+	}
+	removed := make(map[int]bool)
+	for _, dev := range b.removeDevs {
+		removed[dev.Id] = true
+	}
+	for _, part2dev := range b.replica2Part2Dev {
+		for _, d := range part2dev {
+			if int(d) < len(b.Devs) && b.Devs[d] != nil {
+				b.Devs[d].Parts++
+			}
+		}
+	}
+
+	moved := make([]bool, b.Parts)
+	gathered := b.gatherParts(removed, target, moved)
+	b.placeParts(gathered, target)
+	for _, pr := range gathered {
+		b.lastPartMoves[pr.part] = 0
+	}
+
+	for id := range removed {
+		b.Devs[id] = nil
+	}
+	b.removeDevs = nil
+	for len(b.Devs) > 0 && b.Devs[len(b.Devs)-1] == nil {
+		b.Devs = b.Devs[:len(b.Devs)-1]
+	}
+	b.DevsChanged = false
+	b.Version++
+	if err := b.validate(); err != nil {
+		return 0, 0, err
+	}
+	return len(gathered), b.Balance(), nil
+}
+
+// validate checks that every replica of every partition is assigned to a device, since a ring with holes in it
+// can't be used.
+func (b *RingBuilder) validate() error {
+	for replica, part2dev := range b.replica2Part2Dev {
+		if len(part2dev) != b.replicaParts(replica) {
+			return fmt.Errorf("replica %d has %d partitions, not %d", replica, len(part2dev), b.replicaParts(replica))
+		}
+		for part, d := range part2dev {
+			if d == noneDev {
+				return fmt.Errorf("replica %d of partition %d is not assigned to a device", replica, part)
+			} else if int(d) >= len(b.Devs) || b.Devs[d] == nil {
+				return fmt.Errorf("replica %d of partition %d is assigned to missing device %d", replica, part, d)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *RingBuilder) partTierCounts(part int) map[tier]int {
+	counts := make(map[tier]int)
+	for _, part2dev := range b.replica2Part2Dev {
+		if part >= len(part2dev) {
+			continue
+		}
+		if d := part2dev[part]; d != noneDev && b.Devs[d] != nil {
+			for _, t := range devTiers(b.Devs[d]) {
+				counts[t]++
+			}
+		}
+	}
+	return counts
+}
+
+// maxPerPart is the most replicas of any one partition a tier should hold, given it should average target.
+func maxPerPart(target float64) int {
+	return int(math.Ceil(target - 1e-6))
+}
+
+func (b *RingBuilder) unassign(part, replica int, gathered []partReplica) []partReplica {
+	if d := b.replica2Part2Dev[replica][part]; d != noneDev && int(d) < len(b.Devs) && b.Devs[d] != nil {
+		b.Devs[d].Parts--
+	}
+	b.replica2Part2Dev[replica][part] = noneDev
+	return append(gathered, partReplica{part, replica})
+}
+
+func (b *RingBuilder) gatherParts(removed map[int]bool, target map[tier]float64, moved []bool) []partReplica {
+	var gathered []partReplica
+	// anything unassigned or on a device that's going away has to move, whatever min_part_hours says.
+	for replica, part2dev := range b.replica2Part2Dev {
+		for part, d := range part2dev {
+			if d == noneDev || int(d) >= len(b.Devs) || b.Devs[d] == nil || removed[int(d)] {
+				gathered = b.unassign(part, replica, gathered)
+				moved[part] = true
+			}
+		}
+	}
+	// then replicas that are crowded into the same tier as others from their partition.
+	for part := 0; part < b.Parts; part++ {
+		if moved[part] || int(b.lastPartMoves[part]) < b.MinPartHours {
+			continue
+		}
+		counts := b.partTierCounts(part)
+		for replica, part2dev := range b.replica2Part2Dev {
+			if part >= len(part2dev) {
+				continue
+			}
+			dev := b.Devs[part2dev[part]]
+			crowded := false
+			for _, t := range devTiers(dev) {
+				if counts[t] > maxPerPart(target[t]) {
+					crowded = true
+				}
+			}
+			if crowded {
+				gathered = b.unassign(part, replica, gathered)
+				moved[part] = true
+				break
+			}
+		}
+	}
+	// and finally from devices holding more than they want, starting somewhere different each time.
+	start := b.lastPartGatherStart % b.Parts
+	b.lastPartGatherStart = (b.lastPartGatherStart + b.Parts/3 + 1) % b.Parts
+	for i := 0; i < b.Parts; i++ {
+		part := (start + i) % b.Parts
+		if moved[part] || int(b.lastPartMoves[part]) < b.MinPartHours {
+			continue
+		}
+		for replica, part2dev := range b.replica2Part2Dev {
+			if part >= len(part2dev) {
+				continue
+			}
+			dev := b.Devs[part2dev[part]]
+			if dev.Parts > dev.PartsWanted {
+				gathered = b.unassign(part, replica, gathered)
+				moved[part] = true
+				break
+			}
+		}
+	}
+	return gathered
+}
+
+func (b *RingBuilder) placeParts(gathered []partReplica, target map[tier]float64) {
+	// placing partitions in order keeps replicas of the same partition near each other in the list, which lets us
+	// reuse the tier counts.
+	sort.Slice(gathered, func(i, j int) bool {
+		if gathered[i].part == gathered[j].part {
+			return gathered[i].replica < gathered[j].replica
+		}
+		return gathered[i].part < gathered[j].part
+	})
+	var candidates []*BuilderDevice
+	for _, dev := range b.Devs {
+		if dev != nil && dev.Weight > 0 {
+			candidates = append(candidates, dev)
+		}
+	}
+	for _, pr := range gathered {
+		counts := b.partTierCounts(pr.part)
+		var best *BuilderDevice
+		bestCrowding, bestWant := 0, 0.0
+		for _, dev := range candidates {
+			tiers := devTiers(dev)
+			if counts[tiers[3]] > 0 {
+				continue // already holds a replica of this partition.
+			}
+			crowding := 0
+			for depth, t := range tiers[:3] {
+				if counts[t]+1 > maxPerPart(target[t]) {
+					// crowding a region is worse than crowding a zone, which is worse than crowding a server.
+					crowding += 1 << uint(3-depth)
+				}
+			}
+			want := float64(dev.PartsWanted-dev.Parts) / math.Max(float64(dev.PartsWanted), 1)
+			if best == nil || crowding < bestCrowding || (crowding == bestCrowding && want > bestWant) {
+				best, bestCrowding, bestWant = dev, crowding, want
+			}
+		}
+		if best == nil {
+			continue // more replicas than devices; Rebalance won't let this ring be used.
+		}
+		b.replica2Part2Dev[pr.replica][pr.part] = uint16(best.Id)
+		best.Parts++
+	}
+}
+
+// Balance returns the percentage the most over or under assigned device is off from what it wants.
+func (b *RingBuilder) Balance() float64 {
+	balance := 0.0
+	for _, dev := range b.Devs {
+		if dev == nil || dev.Weight <= 0 || dev.PartsWanted <= 0 {
+			continue
+		}
+		if db := math.Abs(100 * float64(dev.Parts-dev.PartsWanted) / float64(dev.PartsWanted)); db > balance {
+			balance = db
+		}
+	}
+	return balance
+}
+
+// Assignments returns a copy of the replica to partition to device id table.
+func (b *RingBuilder) Assignments() [][]uint16 {
+	result := make([][]uint16, len(b.replica2Part2Dev))
+	for i, part2dev := range b.replica2Part2Dev {
+		result[i] = append([]uint16{}, part2dev...)
+	}
+	return result
+}
+
+// WriteRing writes a ring.gz that both LoadRing and Swift can read.
+func (b *RingBuilder) WriteRing(path string) error {
+	if b.replica2Part2Dev == nil {
+		return errors.New("the builder has not been rebalanced")
+	}
+	if b.DevsChanged {
+		return errors.New("devices have changed since the last rebalance")
+	}
+	if err := b.validate(); err != nil {
+		return err
+	}
+	devs := make([]interface{}, len(b.Devs))
+	for i, dev := range b.Devs {
+		if dev != nil {
+			devs[i] = Device{
+				Id:              dev.Id,
+				Device:          dev.Device,
+				Ip:              dev.Ip,
+				Meta:            dev.Meta,
+				Port:            dev.Port,
+				Region:          dev.Region,
+				ReplicationIp:   dev.ReplicationIp,
+				ReplicationPort: dev.ReplicationPort,
+				Weight:          dev.Weight,
+				Zone:            dev.Zone,
+			}
+		}
+	}
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"devs":          devs,
+		"part_shift":    32 - b.PartPower,
+		"replica_count": len(b.replica2Part2Dev),
+		"byteorder":     "little",
+		"version":       b.Version,
+	})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	gz := gzip.NewWriter(fp)
+	gz.Write([]byte("R1NG"))
+	binary.Write(gz, binary.BigEndian, uint16(1))
+	binary.Write(gz, binary.BigEndian, uint32(len(jsonData)))
+	gz.Write(jsonData)
+	for _, part2dev := range b.replica2Part2Dev {
+		if err := binary.Write(gz, binary.LittleEndian, part2dev); err != nil {
+			fp.Close()
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (dev *BuilderDevice) toDict() map[string]interface{} {
+	return map[string]interface{}{
+		"id":               dev.Id,
+		"region":           dev.Region,
+		"zone":             dev.Zone,
+		"ip":               dev.Ip,
+		"port":             dev.Port,
+		"replication_ip":   dev.ReplicationIp,
+		"replication_port": dev.ReplicationPort,
+		"device":           dev.Device,
+		"weight":           dev.Weight,
+		"meta":             dev.Meta,
+		"parts":            dev.Parts,
+		"parts_wanted":     dev.PartsWanted,
+	}
+}
+
+func devsToList(devs []*BuilderDevice) []interface{} {
+	list := make([]interface{}, len(devs))
+	for i, dev := range devs {
+		if dev != nil {
+			list[i] = dev.toDict()
+		}
+	}
+	return list
+}
+
+// Save writes the builder out in the pickled dict format swift-ring-builder uses.
+func (b *RingBuilder) Save(path string) error {
+	d := map[string]interface{}{
+		"part_power":              b.PartPower,
+		"replicas":                b.Replicas,
+		"min_part_hours":          b.MinPartHours,
+		"parts":                   b.Parts,
+		"devs":                    devsToList(b.Devs),
+		"devs_changed":            b.DevsChanged,
+		"version":                 b.Version,
+		"overload":                b.Overload,
+		"_last_part_moves_epoch":  b.lastPartMovesEpoch,
+		"_last_part_gather_start": b.lastPartGatherStart,
+		"_dispersion_graph":       map[string]interface{}{},
+		"dispersion":              0.0,
+		"_remove_devs":            devsToList(b.removeDevs),
+		"id":                      b.Id,
+		"_replica2part2dev":       nil,
+		"_last_part_moves":        nil,
+	}
+	if b.replica2Part2Dev != nil {
+		r2p2d := make([]interface{}, len(b.replica2Part2Dev))
+		for i, part2dev := range b.replica2Part2Dev {
+			arr := pickle.PickleArray{Type: "H", Data: make([]interface{}, len(part2dev))}
+			for j, d := range part2dev {
+				arr.Data[j] = int64(d)
+			}
+			r2p2d[i] = arr
+		}
+		d["_replica2part2dev"] = r2p2d
+		moves := pickle.PickleArray{Type: "B", Data: make([]interface{}, len(b.lastPartMoves))}
+		for i, m := range b.lastPartMoves {
+			moves.Data[i] = int64(m)
+		}
+		d["_last_part_moves"] = moves
+	}
+	tmp := path + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	gz := gzip.NewWriter(fp)
+	if _, err := gz.Write(pickle.PickleDumps(d)); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Backup saves a copy of the builder in a backups directory next to path, like swift-ring-builder does.
+func (b *RingBuilder) Backup(path string) error {
+	dir := filepath.Join(filepath.Dir(path), "backups")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return b.Save(filepath.Join(dir, fmt.Sprintf("%d.%s", time.Now().Unix(), filepath.Base(path))))
+}
+
+func dictInt(d map[interface{}]interface{}, key string) int {
+	switch v := d[key].(type) {
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+func dictFloat(d map[interface{}]interface{}, key string) float64 {
+	switch v := d[key].(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func dictString(d map[interface{}]interface{}, key string) string {
+	s, _ := d[key].(string)
+	return s
+}
+
+func devsFromList(v interface{}) []*BuilderDevice {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	devs := make([]*BuilderDevice, len(list))
+	for i, item := range list {
+		d, ok := item.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		devs[i] = &BuilderDevice{
+			Id:              dictInt(d, "id"),
+			Region:          dictInt(d, "region"),
+			Zone:            dictInt(d, "zone"),
+			Ip:              dictString(d, "ip"),
+			Port:            dictInt(d, "port"),
+			ReplicationIp:   dictString(d, "replication_ip"),
+			ReplicationPort: dictInt(d, "replication_port"),
+			Device:          dictString(d, "device"),
+			Weight:          dictFloat(d, "weight"),
+			Meta:            dictString(d, "meta"),
+			Parts:           dictInt(d, "parts"),
+			PartsWanted:     dictInt(d, "parts_wanted"),
+		}
+	}
+	return devs
+}
+
+// LoadRingBuilder reads a .builder file written by Save or by swift-ring-builder.
+func LoadRingBuilder(path string) (*RingBuilder, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	// older Swift builders aren't gzipped.
+	if gz, err := gzip.NewReader(fp); err == nil {
+		r = gz
+	} else if _, err := fp.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read builder %s: %v", path, err)
+	}
+	v, err := pickle.PickleLoads(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read builder %s: %v", path, err)
+	}
+	d, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("builder %s isn't a pickled dict", path)
+	}
+	b := &RingBuilder{
+		PartPower:           dictInt(d, "part_power"),
+		Replicas:            dictFloat(d, "replicas"),
+		MinPartHours:        dictInt(d, "min_part_hours"),
+		Parts:               dictInt(d, "parts"),
+		Overload:            dictFloat(d, "overload"),
+		Devs:                devsFromList(d["devs"]),
+		DevsChanged:         dictInt(d, "devs_changed") != 0,
+		Version:             dictInt(d, "version"),
+		Id:                  dictString(d, "id"),
+		lastPartMovesEpoch:  int64(dictFloat(d, "_last_part_moves_epoch")),
+		lastPartGatherStart: dictInt(d, "_last_part_gather_start"),
+		removeDevs:          devsFromList(d["_remove_devs"]),
+	}
+	// devices being removed are the same objects as in the device list.
+	for i, rd := range b.removeDevs {
+		if rd != nil && rd.Id < len(b.Devs) && b.Devs[rd.Id] != nil {
+			b.removeDevs[i] = b.Devs[rd.Id]
+		}
+	}
+	if b.Parts == 0 {
+		b.Parts = 1 << uint(b.PartPower)
+	}
+	if list, ok := d["_replica2part2dev"].([]interface{}); ok {
+		for replica, item := range list {
+			arr, ok := item.(pickle.PickleArray)
+			if !ok || replica >= b.replicaCount() || len(arr.Data) != b.replicaParts(replica) {
+				return nil, fmt.Errorf("builder %s has a malformed replica2part2dev table", path)
+			}
+			part2dev := make([]uint16, len(arr.Data))
+			for i, v := range arr.Data {
+				n, _ := v.(int64)
+				part2dev[i] = uint16(n)
+			}
+			b.replica2Part2Dev = append(b.replica2Part2Dev, part2dev)
+		}
+		b.lastPartMoves = make([]uint8, b.Parts)
+		if arr, ok := d["_last_part_moves"].(pickle.PickleArray); ok {
+			for i := 0; i < len(arr.Data) && i < b.Parts; i++ {
+				n, _ := arr.Data[i].(int64)
+				b.lastPartMoves[i] = uint8(n)
+			}
+		}
+	}
+	return b, nil
+}
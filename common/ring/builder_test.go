@@ -0,0 +1,309 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pickled Swift builder dicts, as written by python 3 at protocols 2 and 4.
+const swiftBuilderP2 = "gAJ9cQAoWAoAAABwYXJ0X3Bvd2VycQFLAlgIAAAAcmVwbGljYXNxAkdAAAAAAAAAAFgOAAAAbWluX3BhcnRfaG91cnNxA0sBWAUAAABwYXJ0c3EESwRYBAAAAGRldnNxBV1xBih9cQcoWAIAAABpZHEISwBYBgAAAHJlZ2lvbnEJSwFYBAAAAHpvbmVxCksBWAIAAABpcHELWAgAAAAxMC4wLjAuMXEMWAQAAABwb3J0cQ1NcBdYDgAAAHJlcGxpY2F0aW9uX2lwcQ5oDFgQAAAAcmVwbGljYXRpb25fcG9ydHEPTXAXWAYAAABkZXZpY2VxEFgDAAAAc2RhcRFYBgAAAHdlaWdodHESR0BZAAAAAAAAWAQAAABtZXRhcRNYAAAAAHEUaARLBFgMAAAAcGFydHNfd2FudGVkcRVLBHVOfXEWKGgISwJoCUsBaApLAmgLWAgAAAAxMC4wLjAuMnEXaA1NcBdoDmgXaA9NcBdoEGgRaBJHQFkAAAAAAABoE1gBAAAAbXEYaARLBGgVSwR1ZVgMAAAAZGV2c19jaGFuZ2VkcRmJWAcAAAB2ZXJzaW9ucRpLA1gIAAAAb3ZlcmxvYWRxG0cAAAAAAAAAAFgRAAAAX3JlcGxpY2EycGFydDJkZXZxHF1xHShjYXJyYXkKYXJyYXkKcR5YAQAAAEhxH11xIChLAEsCSwBLAmWGcSFScSJoHmgfXXEjKEsCSwBLAksAZYZxJFJxJWVYFgAAAF9sYXN0X3BhcnRfbW92ZXNfZXBvY2hxJkoAL2hZWBAAAABfbGFzdF9wYXJ0X21vdmVzcSdoHlgBAAAAQnEoXXEpKEsASwFLAkv/ZYZxKlJxK1gXAAAAX2xhc3RfcGFydF9nYXRoZXJfc3RhcnRxLEsAWBEAAABfZGlzcGVyc2lvbl9ncmFwaHEtfXEuSwGFcS9dcTAoSwBLAmVzWAoAAABkaXNwZXJzaW9ucTFHAAAAAAAAAABYDAAAAF9yZW1vdmVfZGV2c3EyXXEzaAhYAwAAAGFiY3E0dS4="
+const swiftBuilderP4 = "gASVmQIAAAAAAAB9lCiMCnBhcnRfcG93ZXKUSwKMCHJlcGxpY2FzlEdAAAAAAAAAAIwObWluX3BhcnRfaG91cnOUSwGMBXBhcnRzlEsEjARkZXZzlF2UKH2UKIwCaWSUSwCMBnJlZ2lvbpRLAYwEem9uZZRLAYwCaXCUjAgxMC4wLjAuMZSMBHBvcnSUTXAXjA5yZXBsaWNhdGlvbl9pcJRoDIwQcmVwbGljYXRpb25fcG9ydJRNcBeMBmRldmljZZSMA3NkYZSMBndlaWdodJRHQFkAAAAAAACMBG1ldGGUjACUaARLBIwMcGFydHNfd2FudGVklEsEdU59lChoCEsCaAlLAWgKSwJoC4wIMTAuMC4wLjKUaA1NcBdoDmgXaA9NcBdoEGgRaBJHQFkAAAAAAABoE4wBbZRoBEsEaBVLBHVljAxkZXZzX2NoYW5nZWSUiYwHdmVyc2lvbpRLA4wIb3ZlcmxvYWSURwAAAAAAAAAAjBFfcmVwbGljYTJwYXJ0MmRldpRdlCiMBWFycmF5lIwUX2FycmF5X3JlY29uc3RydWN0b3KUk5QojAVhcnJheZSMBWFycmF5lJOUjAFIlEsCQwgAAAIAAAACAJR0lFKUaCAoaCNoJEsCQwgCAAAAAgAAAJR0lFKUZYwWX2xhc3RfcGFydF9tb3Zlc19lcG9jaJRKAC9oWYwQX2xhc3RfcGFydF9tb3Zlc5RoIChoI4wBQpRLAEMEAAEC/5R0lFKUjBdfbGFzdF9wYXJ0X2dhdGhlcl9zdGFydJRLAIwRX2Rpc3BlcnNpb25fZ3JhcGiUfZRLAYWUXZQoSwBLAmVzjApkaXNwZXJzaW9ulEcAAAAAAAAAAIwMX3JlbW92ZV9kZXZzlF2UaAiMA2FiY5R1Lg=="
+
+// a pickled Swift builder dict with 2.5 replicas, so the last row of its replica2part2dev table only has two partitions.
+const swiftBuilderFractional = "gAJ9cQAoWAoAAABwYXJ0X3Bvd2VycQFLAlgIAAAAcmVwbGljYXNxAkdABAAAAAAAAFgOAAAAbWluX3BhcnRfaG91cnNxA0sBWAUAAABwYXJ0c3EESwRYBAAAAGRldnNxBV1xBih9cQcoWAIAAABpZHEISwBYBgAAAHJlZ2lvbnEJSwFYBAAAAHpvbmVxCksBWAIAAABpcHELWAgAAAAxMC4wLjAuMXEMWAQAAABwb3J0cQ1NcBdYDgAAAHJlcGxpY2F0aW9uX2lwcQ5oDFgQAAAAcmVwbGljYXRpb25fcG9ydHEPTXAXWAYAAABkZXZpY2VxEFgDAAAAc2RhcRFYBgAAAHdlaWdodHESR0BZAAAAAAAAWAQAAABtZXRhcRNYAAAAAHEUaARLAFgMAAAAcGFydHNfd2FudGVkcRVLAHV9cRYoaAhLAWgJSwFoCksCaAtYCAAAADEwLjAuMC4ycRdoDU1wF2gOaBdoD01wF2gQaBFoEkdAWQAAAAAAAGgTaBRoBEsAaBVLAHV9cRgoaAhLAmgJSwFoCksDaAtYCAAAADEwLjAuMC4zcRloDU1wF2gOaBloD01wF2gQaBFoEkdAWQAAAAAAAGgTaBRoBEsAaBVLAHVlWAwAAABkZXZzX2NoYW5nZWRxGolYBwAAAHZlcnNpb25xG0sDWAgAAABvdmVybG9hZHEcRwAAAAAAAAAAWBEAAABfcmVwbGljYTJwYXJ0MmRldnEdXXEeKGNhcnJheQphcnJheQpxH1gBAAAASHEgXXEhKEsASwJLAEsCZYZxIlJxI2gfaCBdcSQoSwJLAEsCSwBlhnElUnEmaB9oIF1xJyhLAUsBZYZxKFJxKWVYFgAAAF9sYXN0X3BhcnRfbW92ZXNfZXBvY2hxKkoAL2hZWBAAAABfbGFzdF9wYXJ0X21vdmVzcStoH1gBAAAAQnEsXXEtKEv/S/9L/0v/ZYZxLlJxL1gXAAAAX2xhc3RfcGFydF9nYXRoZXJfc3RhcnRxMEsAWAwAAABfcmVtb3ZlX2RldnNxMV1xMmgIWAQAAABmcmFjcTN1Lg=="
+
+func testBuilder(t *testing.T, partPower int, replicas float64, devs []string) *RingBuilder {
+	b, err := NewRingBuilder(partPower, replicas, 1)
+	require.Nil(t, err)
+	for _, d := range devs {
+		dev, err := parseAddValue(d)
+		require.Nil(t, err)
+		dev.Weight = 100
+		_, err = b.AddDevice(dev)
+		require.Nil(t, err)
+	}
+	return b
+}
+
+func requireDispersed(t *testing.T, b *RingBuilder, depth int) {
+	for part := 0; part < b.Parts; part++ {
+		seen := make(map[tier]bool)
+		for _, part2dev := range b.replica2Part2Dev {
+			require.NotEqual(t, uint16(noneDev), part2dev[part])
+			tr := devTiers(b.Devs[part2dev[part]])[depth]
+			require.False(t, seen[tr], "partition %d has two replicas in %v", part, tr)
+			seen[tr] = true
+		}
+	}
+}
+
+func TestUnpickleSwiftBuilder(t *testing.T) {
+	for _, data := range []string{swiftBuilderP2, swiftBuilderP4} {
+		raw, err := base64.StdEncoding.DecodeString(data)
+		require.Nil(t, err)
+		dir, err := ioutil.TempDir("", "")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "object.builder")
+		require.Nil(t, ioutil.WriteFile(path, raw, 0644))
+		b, err := LoadRingBuilder(path)
+		require.Nil(t, err)
+		require.Equal(t, 2, b.PartPower)
+		require.Equal(t, 2.0, b.Replicas)
+		require.Equal(t, 4, b.Parts)
+		require.Equal(t, 3, b.Version)
+		require.Equal(t, "abc", b.Id)
+		require.Equal(t, 3, len(b.Devs))
+		require.Nil(t, b.Devs[1])
+		require.Equal(t, "10.0.0.2", b.Devs[2].Ip)
+		require.Equal(t, "m", b.Devs[2].Meta)
+		require.Equal(t, 100.0, b.Devs[2].Weight)
+		require.Equal(t, [][]uint16{{0, 2, 0, 2}, {2, 0, 2, 0}}, b.replica2Part2Dev)
+		require.Equal(t, []uint8{0, 1, 2, 255}, b.lastPartMoves)
+		require.Equal(t, int64(1500000000), b.lastPartMovesEpoch)
+	}
+}
+
+func TestUnpickleFractionalReplicas(t *testing.T) {
+	raw, err := base64.StdEncoding.DecodeString(swiftBuilderFractional)
+	require.Nil(t, err)
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "object.builder")
+	require.Nil(t, ioutil.WriteFile(path, raw, 0644))
+	b, err := LoadRingBuilder(path)
+	require.Nil(t, err)
+	require.Equal(t, 2.5, b.Replicas)
+	require.Equal(t, [][]uint16{{0, 2, 0, 2}, {2, 0, 2, 0}, {1, 1}}, b.replica2Part2Dev)
+
+	_, _, err = b.Rebalance()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(b.replica2Part2Dev[2]))
+	ringPath := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, b.WriteRing(ringPath))
+	r, err := LoadRing(ringPath, "", "")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(r.GetNodesInOrder(1)))
+	require.Equal(t, 2, len(r.GetNodesInOrder(3)))
+}
+
+func TestParseDevSearch(t *testing.T) {
+	ds, err := parseDevSearch("d3r1z2-10.0.0.1:6000R10.1.0.1:6001/sdb_some meta")
+	require.Nil(t, err)
+	assert.Equal(t, 3, *ds.id)
+	assert.Equal(t, 1, *ds.region)
+	assert.Equal(t, 2, *ds.zone)
+	assert.Equal(t, "10.0.0.1", *ds.ip)
+	assert.Equal(t, 6000, *ds.port)
+	assert.Equal(t, "10.1.0.1", *ds.replicationIp)
+	assert.Equal(t, 6001, *ds.replicationPort)
+	assert.Equal(t, "sdb", *ds.device)
+	assert.Equal(t, "some meta", *ds.meta)
+
+	ds, err = parseDevSearch("z1-[::1]:6000/sda")
+	require.Nil(t, err)
+	assert.Nil(t, ds.region)
+	assert.Equal(t, "::1", *ds.ip)
+
+	_, err = parseDevSearch("z1-10.0.0.1:xx")
+	require.NotNil(t, err)
+
+	dev, err := parseAddValue("z1-10.0.0.1:6000/sda")
+	require.Nil(t, err)
+	assert.Equal(t, 1, dev.Region)
+	assert.Equal(t, "10.0.0.1", dev.ReplicationIp)
+	_, err = parseAddValue("r1z1-10.0.0.1")
+	require.NotNil(t, err)
+
+	change, err := parseChangeValue("10.0.0.9:7000/sdc")
+	require.Nil(t, err)
+	assert.Equal(t, "10.0.0.9", *change.ip)
+	assert.Equal(t, 7000, *change.port)
+	assert.Equal(t, "sdc", *change.device)
+}
+
+func TestRebalance(t *testing.T) {
+	var devs []string
+	for z := 1; z <= 3; z++ {
+		for d := 0; d < 4; d++ {
+			devs = append(devs, fmt.Sprintf("r1z%d-10.0.0.%d:6000/sd%c", z, z, 'a'+d))
+		}
+	}
+	b := testBuilder(t, 8, 3, devs)
+	moved, balance, err := b.Rebalance()
+	require.Nil(t, err)
+	require.Equal(t, 256*3, moved)
+	require.True(t, balance < 2, "balance %f", balance)
+	requireDispersed(t, b, 1)
+	for _, dev := range b.Devs {
+		require.Equal(t, 64, dev.PartsWanted)
+	}
+
+	// nothing can move again until min_part_hours has passed
+	_, err = b.AddDevice(BuilderDevice{Id: -1, Region: 1, Zone: 1, Ip: "10.0.0.1", Port: 6000, Device: "sde", Weight: 100})
+	require.Nil(t, err)
+	moved, _, err = b.Rebalance()
+	require.Nil(t, err)
+	require.Equal(t, 0, moved)
+
+	// zone 1 is now heavier than a third of the ring, so it takes some overload to keep the replicas in separate zones.
+	b.Overload = 0.1
+	b.PretendMinPartHoursPassed()
+	moved, balance, err = b.Rebalance()
+	require.Nil(t, err)
+	require.True(t, moved > 0)
+	require.True(t, b.Devs[12].Parts > 0)
+	require.True(t, balance < 30, "balance %f", balance)
+	requireDispersed(t, b, 1)
+}
+
+func TestRebalanceRemoveDevice(t *testing.T) {
+	b := testBuilder(t, 6, 3, []string{
+		"r1z1-10.0.0.1:6000/sda", "r1z2-10.0.0.2:6000/sda", "r1z3-10.0.0.3:6000/sda", "r1z4-10.0.0.4:6000/sda",
+	})
+	_, _, err := b.Rebalance()
+	require.Nil(t, err)
+	require.Nil(t, b.RemoveDevice(1))
+	require.Nil(t, b.RemoveDevice(1))
+	require.Equal(t, 1, len(b.removeDevs))
+	// removed devices are always moved off of, regardless of min_part_hours
+	moved, _, err := b.Rebalance()
+	require.Nil(t, err)
+	require.Equal(t, 48, moved)
+	require.Nil(t, b.Devs[1])
+	requireDispersed(t, b, 1)
+	for _, part2dev := range b.replica2Part2Dev {
+		for _, d := range part2dev {
+			require.NotEqual(t, uint16(1), d)
+		}
+	}
+}
+
+func TestRebalanceUnevenZones(t *testing.T) {
+	// two zones, one much bigger; dispersion wins over weight when overload allows it.
+	b := testBuilder(t, 6, 2, []string{"r1z1-10.0.0.1:6000/sda", "r1z2-10.0.0.2:6000/sda", "r1z2-10.0.0.2:6000/sdb",
+		"r1z2-10.0.0.2:6000/sdc"})
+	b.Overload = 1
+	_, _, err := b.Rebalance()
+	require.Nil(t, err)
+	requireDispersed(t, b, 1)
+	require.Equal(t, 64, b.Devs[0].Parts)
+}
+
+func TestBuilderSaveLoadAndWriteRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := testBuilder(t, 4, 2, []string{"r1z1-10.0.0.1:6000/sda", "r1z2-10.0.0.2:6000/sda_meta"})
+	_, _, err = b.Rebalance()
+	require.Nil(t, err)
+	path := filepath.Join(dir, "object.builder")
+	require.Nil(t, b.Save(path))
+	b2, err := LoadRingBuilder(path)
+	require.Nil(t, err)
+	require.Equal(t, b.Devs, b2.Devs)
+	require.Equal(t, b.replica2Part2Dev, b2.replica2Part2Dev)
+	require.Equal(t, b.lastPartMoves, b2.lastPartMoves)
+	require.Equal(t, b.Id, b2.Id)
+
+	ringPath := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, b2.WriteRing(ringPath))
+	r, err := LoadRing(ringPath, "", "")
+	require.Nil(t, err)
+	require.Equal(t, uint64(16), r.PartitionCount())
+	require.Equal(t, uint64(2), r.ReplicaCount())
+	for part := uint64(0); part < 16; part++ {
+		nodes := r.GetNodesInOrder(part)
+		require.Equal(t, int(b.replica2Part2Dev[0][part]), nodes[0].Id)
+		require.Equal(t, int(b.replica2Part2Dev[1][part]), nodes[1].Id)
+	}
+	require.Equal(t, "meta", r.AllDevices()[1].Meta)
+
+	_, err = b2.AddDevice(BuilderDevice{Id: -1, Zone: 3, Ip: "10.0.0.3", Port: 6000, Device: "sda", Weight: 1})
+	require.Nil(t, err)
+	require.NotNil(t, b2.WriteRing(ringPath))
+}
+
+func TestRebalanceTooFewDevices(t *testing.T) {
+	b := testBuilder(t, 4, 3, []string{"r1z1-10.0.0.1:6000/sda", "r1z2-10.0.0.2:6000/sda"})
+	_, _, err := b.Rebalance()
+	require.NotNil(t, err)
+	require.Nil(t, b.replica2Part2Dev)
+
+	// removing a device can leave too few as well.
+	b = testBuilder(t, 4, 2, []string{"r1z1-10.0.0.1:6000/sda", "r1z2-10.0.0.2:6000/sda"})
+	_, _, err = b.Rebalance()
+	require.Nil(t, err)
+	require.Nil(t, b.RemoveDevice(1))
+	_, _, err = b.Rebalance()
+	require.NotNil(t, err)
+}
+
+func TestWriteRingUnassignedReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := testBuilder(t, 4, 2, []string{"r1z1-10.0.0.1:6000/sda", "r1z2-10.0.0.2:6000/sda"})
+	_, _, err = b.Rebalance()
+	require.Nil(t, err)
+	ringPath := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, b.WriteRing(ringPath))
+	// a builder with holes in it, like one saved before Rebalance refused to make them, can't write a ring.
+	b.replica2Part2Dev[1][3] = noneDev
+	require.NotNil(t, b.WriteRing(ringPath))
+	b.replica2Part2Dev[1][3] = 7
+	require.NotNil(t, b.WriteRing(ringPath))
+}
+
+func TestBuilderCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "object.builder")
+	require.Nil(t, runBuilderCommand(path, []string{"create", "4", "2", "1"}))
+	require.Nil(t, runBuilderCommand(path, []string{"add", "r1z1-10.0.0.1:6000/sda", "100", "r1z2-10.0.0.2:6000/sda", "100"}))
+	require.NotNil(t, runBuilderCommand(path, []string{"add", "r1z1-10.0.0.1:6000/sda", "100"}))
+	require.Nil(t, runBuilderCommand(path, []string{"set_info", "d1", "r2z3-10.0.0.3:6001/sdb"}))
+	require.Nil(t, runBuilderCommand(path, []string{"set_weight", "d0", "50"}))
+	require.Nil(t, runBuilderCommand(path, []string{"set_overload", "10%"}))
+	require.Nil(t, runBuilderCommand(path, []string{"rebalance"}))
+	b, err := LoadRingBuilder(path)
+	require.Nil(t, err)
+	require.Equal(t, 2, b.Devs[1].Region)
+	require.Equal(t, 3, b.Devs[1].Zone)
+	require.Equal(t, "10.0.0.3", b.Devs[1].Ip)
+	require.Equal(t, 6001, b.Devs[1].Port)
+	require.Equal(t, "sdb", b.Devs[1].Device)
+	require.Equal(t, 50.0, b.Devs[0].Weight)
+	require.InDelta(t, 0.1, b.Overload, 0.0001)
+	_, err = os.Stat(filepath.Join(dir, "object.ring.gz"))
+	require.Nil(t, err)
+	backups, err := ioutil.ReadDir(filepath.Join(dir, "backups"))
+	require.Nil(t, err)
+	require.NotEqual(t, 0, len(backups))
+	require.NotNil(t, runBuilderCommand(path, []string{"remove", "r5"}))
+	require.NotNil(t, runBuilderCommand(path, []string{"bogus"}))
+}
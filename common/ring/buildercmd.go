@@ -0,0 +1,490 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// devSearch is a parsed swift-ring-builder search value, e.g. "d1r1z2-10.0.0.1:6000R10.1.0.1:6001/sdb_meta".  Fields
+// left out of the value are nil and match anything.
+type devSearch struct {
+	id, region, zone, port, replicationPort *int
+	ip, replicationIp, device, meta         *string
+}
+
+func readNumber(s string) (int, string, error) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, s, fmt.Errorf("expected a number at %q", s)
+	}
+	n, err := strconv.Atoi(s[:i])
+	return n, s[i:], err
+}
+
+func readAddress(s string) (string, string, error) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end == -1 {
+			return "", s, fmt.Errorf("unterminated ipv6 address at %q", s)
+		}
+		return s[1:end], s[end+1:], nil
+	}
+	end := strings.IndexAny(s, ":R/_")
+	if end == -1 {
+		end = len(s)
+	}
+	return s[:end], s[end:], nil
+}
+
+// parseDevSearch parses a search value.  It's also used for the values given to add and set_info, which are in the
+// same format.
+func parseDevSearch(value string) (*devSearch, error) {
+	ds := &devSearch{}
+	s := value
+	var err error
+	intp := func(n int) *int { return &n }
+	strp := func(v string) *string { return &v }
+	if strings.HasPrefix(s, "d") && len(s) > 1 && s[1] >= '0' && s[1] <= '9' {
+		var n int
+		if n, s, err = readNumber(s[1:]); err != nil {
+			return nil, err
+		}
+		ds.id = intp(n)
+	}
+	if strings.HasPrefix(s, "r") {
+		var n int
+		if n, s, err = readNumber(s[1:]); err != nil {
+			return nil, err
+		}
+		ds.region = intp(n)
+	}
+	if strings.HasPrefix(s, "z") {
+		var n int
+		if n, s, err = readNumber(s[1:]); err != nil {
+			return nil, err
+		}
+		ds.zone = intp(n)
+	}
+	if strings.HasPrefix(s, "-") {
+		var ip string
+		if ip, s, err = readAddress(s[1:]); err != nil {
+			return nil, err
+		}
+		ds.ip = strp(ip)
+	}
+	if strings.HasPrefix(s, ":") {
+		var n int
+		if n, s, err = readNumber(s[1:]); err != nil {
+			return nil, err
+		}
+		ds.port = intp(n)
+	}
+	if strings.HasPrefix(s, "R") {
+		var ip string
+		if ip, s, err = readAddress(s[1:]); err != nil {
+			return nil, err
+		}
+		ds.replicationIp = strp(ip)
+		if strings.HasPrefix(s, ":") {
+			var n int
+			if n, s, err = readNumber(s[1:]); err != nil {
+				return nil, err
+			}
+			ds.replicationPort = intp(n)
+		}
+	}
+	if strings.HasPrefix(s, "/") {
+		end := strings.Index(s, "_")
+		if end == -1 {
+			end = len(s)
+		}
+		ds.device = strp(s[1:end])
+		s = s[end:]
+	}
+	if strings.HasPrefix(s, "_") {
+		ds.meta = strp(s[1:])
+		s = ""
+	}
+	if s != "" {
+		return nil, fmt.Errorf("invalid search value %q: unexpected %q", value, s)
+	}
+	return ds, nil
+}
+
+func (ds *devSearch) matches(dev *BuilderDevice) bool {
+	return (ds.id == nil || *ds.id == dev.Id) &&
+		(ds.region == nil || *ds.region == dev.Region) &&
+		(ds.zone == nil || *ds.zone == dev.Zone) &&
+		(ds.ip == nil || *ds.ip == dev.Ip) &&
+		(ds.port == nil || *ds.port == dev.Port) &&
+		(ds.replicationIp == nil || *ds.replicationIp == dev.ReplicationIp) &&
+		(ds.replicationPort == nil || *ds.replicationPort == dev.ReplicationPort) &&
+		(ds.device == nil || *ds.device == dev.Device) &&
+		(ds.meta == nil || *ds.meta == dev.Meta)
+}
+
+// apply overwrites dev's details with any given in the search value.
+func (ds *devSearch) apply(dev *BuilderDevice) {
+	if ds.region != nil {
+		dev.Region = *ds.region
+	}
+	if ds.zone != nil {
+		dev.Zone = *ds.zone
+	}
+	if ds.ip != nil {
+		dev.Ip = *ds.ip
+	}
+	if ds.port != nil {
+		dev.Port = *ds.port
+	}
+	if ds.replicationIp != nil {
+		dev.ReplicationIp = *ds.replicationIp
+	}
+	if ds.replicationPort != nil {
+		dev.ReplicationPort = *ds.replicationPort
+	}
+	if ds.device != nil {
+		dev.Device = *ds.device
+	}
+	if ds.meta != nil {
+		dev.Meta = *ds.meta
+	}
+}
+
+// SearchDevices returns the devices matching a swift-ring-builder style search value.
+func (b *RingBuilder) SearchDevices(value string) ([]*BuilderDevice, error) {
+	ds, err := parseDevSearch(value)
+	if err != nil {
+		return nil, err
+	}
+	var devs []*BuilderDevice
+	for _, dev := range b.Devs {
+		if dev != nil && ds.matches(dev) {
+			devs = append(devs, dev)
+		}
+	}
+	return devs, nil
+}
+
+// parseAddValue turns "r1z1-10.0.0.1:6000R10.1.0.1:6001/sdb_meta" into a new device.
+func parseAddValue(value string) (BuilderDevice, error) {
+	dev := BuilderDevice{Id: -1, Region: 1}
+	ds, err := parseDevSearch(value)
+	if err != nil {
+		return dev, err
+	}
+	if ds.zone == nil || ds.ip == nil || ds.port == nil || ds.device == nil {
+		return dev, fmt.Errorf("invalid device %q: need at least z<zone>-<ip>:<port>/<device>", value)
+	}
+	if ds.id != nil {
+		dev.Id = *ds.id
+	}
+	ds.apply(&dev)
+	if dev.ReplicationIp == "" {
+		dev.ReplicationIp = dev.Ip
+	}
+	if dev.ReplicationPort == 0 {
+		dev.ReplicationPort = dev.Port
+	}
+	return dev, nil
+}
+
+// parseChangeValue parses a set_info value, which is a search value that may leave off the leading "-" before the ip.
+func parseChangeValue(value string) (*devSearch, error) {
+	if value != "" && !strings.ContainsAny(value[:1], "rz-:R/_") {
+		value = "-" + value
+	}
+	ds, err := parseDevSearch(value)
+	if err != nil {
+		return nil, err
+	}
+	if ds.id != nil {
+		return nil, errors.New("a device's id can't be changed")
+	}
+	return ds, nil
+}
+
+func formatAddress(ip string, port int) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+func (b *RingBuilder) printDevices(devs []*BuilderDevice) {
+	fmt.Printf("Devices:   id region zone %22s %22s %10s %10s %10s %8s meta\n",
+		"ip address:port", "replication ip:port", "name", "weight", "partitions", "balance")
+	for _, dev := range devs {
+		balance := 0.0
+		if dev.PartsWanted > 0 {
+			balance = 100 * float64(dev.Parts-dev.PartsWanted) / float64(dev.PartsWanted)
+		}
+		fmt.Printf("         %5d %6d %4d %22s %22s %10s %10.2f %10d %8.2f %s\n", dev.Id, dev.Region, dev.Zone,
+			formatAddress(dev.Ip, dev.Port), formatAddress(dev.ReplicationIp, dev.ReplicationPort), dev.Device,
+			dev.Weight, dev.Parts, balance, dev.Meta)
+	}
+}
+
+func (b *RingBuilder) printSummary(path string) {
+	regions := make(map[int]bool)
+	zones := make(map[[2]int]bool)
+	var devs []*BuilderDevice
+	for _, dev := range b.Devs {
+		if dev != nil {
+			regions[dev.Region] = true
+			zones[[2]int{dev.Region, dev.Zone}] = true
+			devs = append(devs, dev)
+		}
+	}
+	fmt.Printf("%s, build version %d, id %s\n", path, b.Version, b.Id)
+	fmt.Printf("%d partitions, %.6f replicas, %d regions, %d zones, %d devices, %.2f balance, %.2f%% overload\n",
+		b.Parts, b.Replicas, len(regions), len(zones), len(devs), b.Balance(), b.Overload*100)
+	fmt.Printf("The minimum number of hours before a partition can be reassigned is %d\n", b.MinPartHours)
+	b.printDevices(devs)
+}
+
+func ringPathFor(builderPath string) string {
+	return strings.TrimSuffix(builderPath, ".builder") + ".ring.gz"
+}
+
+func builderUsage() {
+	fmt.Fprintf(os.Stderr, `USAGE: hummingbird ring <builder_file> [command] [args...]
+  With no command, prints a summary of the builder.
+  create <part_power> <replicas> <min_part_hours>
+  add <r<region>z<zone>-<ip>:<port>[R<repl_ip>:<repl_port>]/<device>[_<meta>]> <weight> [<value> <weight> ...]
+  remove <search-value> [...]
+  set_weight <search-value> <weight> [<search-value> <weight> ...]
+  set_info <search-value> <[r<region>][z<zone>][<ip>][:<port>][R<repl_ip>:<repl_port>][/<device>][_<meta>]>
+  search <search-value>
+  set_min_part_hours <hours>
+  set_overload <overload>[%%]
+  pretend_min_part_hours_passed
+  rebalance
+  write_ring
+Search values look like d<id>r<region>z<zone>-<ip>:<port>R<repl_ip>:<repl_port>/<device>_<meta>, where every
+part is optional.
+`)
+}
+
+// single returns the one device matching value, as changing several at once is almost always a mistake.
+func (b *RingBuilder) single(value string) (*BuilderDevice, error) {
+	devs, err := b.SearchDevices(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("no devices match %q", value)
+	} else if len(devs) > 1 {
+		return nil, fmt.Errorf("%d devices match %q; be more specific", len(devs), value)
+	}
+	return devs[0], nil
+}
+
+func runBuilderCommand(path string, args []string) error {
+	if len(args) > 0 && args[0] == "create" {
+		if len(args) != 4 {
+			return errors.New("create needs <part_power> <replicas> <min_part_hours>")
+		}
+		partPower, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid part_power: %v", err)
+		}
+		replicas, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return fmt.Errorf("invalid replicas: %v", err)
+		}
+		minPartHours, err := strconv.Atoi(args[3])
+		if err != nil {
+			return fmt.Errorf("invalid min_part_hours: %v", err)
+		}
+		b, err := NewRingBuilder(partPower, replicas, minPartHours)
+		if err != nil {
+			return err
+		}
+		if err := b.Backup(path); err != nil {
+			return err
+		}
+		return b.Save(path)
+	}
+	b, err := LoadRingBuilder(path)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		b.printSummary(path)
+		return nil
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errors.New("add needs pairs of <device> <weight>")
+		}
+		for i := 1; i < len(args); i += 2 {
+			dev, err := parseAddValue(args[i])
+			if err != nil {
+				return err
+			}
+			if dev.Weight, err = strconv.ParseFloat(args[i+1], 64); err != nil {
+				return fmt.Errorf("invalid weight %q", args[i+1])
+			}
+			id, err := b.AddDevice(dev)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Device d%dr%dz%d-%s/%s_%q with %.2f weight got id %d\n", id, dev.Region, dev.Zone,
+				formatAddress(dev.Ip, dev.Port), dev.Device, dev.Meta, dev.Weight, id)
+		}
+	case "remove":
+		if len(args) < 2 {
+			return errors.New("remove needs a search value")
+		}
+		for _, value := range args[1:] {
+			dev, err := b.single(value)
+			if err != nil {
+				return err
+			}
+			if err := b.RemoveDevice(dev.Id); err != nil {
+				return err
+			}
+			fmt.Printf("d%d %s/%s marked for removal and will be removed next rebalance.\n", dev.Id,
+				formatAddress(dev.Ip, dev.Port), dev.Device)
+		}
+	case "set_weight":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errors.New("set_weight needs pairs of <search-value> <weight>")
+		}
+		for i := 1; i < len(args); i += 2 {
+			dev, err := b.single(args[i])
+			if err != nil {
+				return err
+			}
+			weight, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				return fmt.Errorf("invalid weight %q", args[i+1])
+			}
+			if err := b.SetDeviceWeight(dev.Id, weight); err != nil {
+				return err
+			}
+			fmt.Printf("d%d %s/%s weight set to %.2f\n", dev.Id, formatAddress(dev.Ip, dev.Port), dev.Device, weight)
+		}
+	case "set_info":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errors.New("set_info needs pairs of <search-value> <change-value>")
+		}
+		for i := 1; i < len(args); i += 2 {
+			dev, err := b.single(args[i])
+			if err != nil {
+				return err
+			}
+			change, err := parseChangeValue(args[i+1])
+			if err != nil {
+				return err
+			}
+			info := *dev
+			change.apply(&info)
+			if err := b.SetDeviceInfo(dev.Id, info); err != nil {
+				return err
+			}
+			fmt.Printf("d%d is now r%dz%d-%s R%s /%s_%q\n", dev.Id, dev.Region, dev.Zone, formatAddress(dev.Ip, dev.Port),
+				formatAddress(dev.ReplicationIp, dev.ReplicationPort), dev.Device, dev.Meta)
+		}
+	case "search":
+		if len(args) != 2 {
+			return errors.New("search needs a search value")
+		}
+		devs, err := b.SearchDevices(args[1])
+		if err != nil {
+			return err
+		}
+		b.printDevices(devs)
+		return nil
+	case "set_min_part_hours":
+		if len(args) != 2 {
+			return errors.New("set_min_part_hours needs <hours>")
+		}
+		hours, err := strconv.Atoi(args[1])
+		if err != nil || hours < 0 {
+			return fmt.Errorf("invalid min_part_hours %q", args[1])
+		}
+		b.MinPartHours = hours
+		b.Version++
+		fmt.Printf("The minimum number of hours before a partition can be reassigned is now set to %d\n", hours)
+	case "set_overload":
+		if len(args) != 2 {
+			return errors.New("set_overload needs <overload>")
+		}
+		value := args[1]
+		percent := strings.HasSuffix(value, "%")
+		overload, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || overload < 0 {
+			return fmt.Errorf("invalid overload %q", args[1])
+		}
+		if percent {
+			overload /= 100
+		}
+		b.Overload = overload
+		b.Version++
+		fmt.Printf("The overload factor is now %.2f%% (%.6f)\n", overload*100, overload)
+	case "pretend_min_part_hours_passed":
+		b.PretendMinPartHoursPassed()
+	case "rebalance":
+		moved, balance, err := b.Rebalance()
+		if err != nil {
+			return err
+		}
+		if err := b.WriteRing(ringPathFor(path)); err != nil {
+			return err
+		}
+		fmt.Printf("Reassigned %d (%.2f%%) partitions. Balance is now %.2f.\n", moved,
+			100*float64(moved)/float64(b.Parts*b.replicaCount()), balance)
+		if balance > 5 {
+			fmt.Println("NOTE: Balance of", strconv.FormatFloat(balance, 'f', 2, 64),
+				"indicates you should push this ring, wait at least", b.MinPartHours, "hours, and rebalance/repush.")
+		}
+	case "write_ring":
+		if err := b.WriteRing(ringPathFor(path)); err != nil {
+			return err
+		}
+		return nil
+	default:
+		builderUsage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if err := b.Backup(path); err != nil {
+		return err
+	}
+	return b.Save(path)
+}
+
+// BuilderCmd implements "hummingbird ring", a work-alike of swift-ring-builder.
+func BuilderCmd(args []string) {
+	if len(args) < 1 || args[0] == "-h" || args[0] == "--help" {
+		builderUsage()
+		return
+	}
+	if err := runBuilderCommand(args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,72 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+type location struct {
+	dev     *Device
+	handoff bool
+}
+
+func (l location) suffix() string {
+	if l.handoff {
+		return " # [Handoff]"
+	}
+	return ""
+}
+
+// PrintLocations writes the primary and handoff nodes for a partition, along with curl commands to HEAD the path on
+// each of them and ssh commands to list its directory under datadir.  The policy header is left off if policy < 0.
+func PrintLocations(w io.Writer, r Ring, partition uint64, path string, datadir string, dirSuffix string, policy int) {
+	var locations []location
+	for _, dev := range r.GetNodes(partition) {
+		locations = append(locations, location{dev: dev})
+	}
+	if more := r.GetMoreNodes(partition); more != nil {
+		for i := uint64(0); i < r.ReplicaCount(); i++ {
+			dev := more.Next()
+			if dev == nil {
+				break
+			}
+			locations = append(locations, location{dev: dev, handoff: true})
+		}
+	}
+	fmt.Fprintf(w, "\nRing locations:\n")
+	for _, l := range locations {
+		fmt.Fprintf(w, "  %s - %s%s\n", net.JoinHostPort(l.dev.Ip, strconv.Itoa(l.dev.Port)), l.dev.Device, l.suffix())
+	}
+	header := ""
+	if policy >= 0 {
+		header = fmt.Sprintf(" -H \"X-Backend-Storage-Policy-Index: %d\"", policy)
+	}
+	fmt.Fprintf(w, "\n")
+	for _, l := range locations {
+		fmt.Fprintf(w, "curl -g -I -XHEAD \"http://%s/%s/%d/%s\"%s%s\n",
+			net.JoinHostPort(l.dev.Ip, strconv.Itoa(l.dev.Port)), l.dev.Device, partition, path, header, l.suffix())
+	}
+	fmt.Fprintf(w, "\nUse your own device location of servers, such as \"export DEVICE=/srv/node\"\n")
+	for _, l := range locations {
+		fmt.Fprintf(w, "ssh %s \"ls -lah ${DEVICE:-/srv/node*}/%s/%s/%d/%s\"%s\n",
+			l.dev.Ip, l.dev.Device, datadir, partition, dirSuffix, l.suffix())
+	}
+	fmt.Fprintf(w, "\nnote: `/srv/node*` is used as default value of `devices`, the real value is set in the config file on each storage node.\n")
+}
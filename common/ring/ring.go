@@ -111,7 +111,9 @@ func (r *hashRing) GetNodes(partition uint64) (response []*Device) {
 		return nil
 	}
 	for i := 0; i < d.ReplicaCount; i++ {
-		response = append(response, &d.Devs[d.replica2part2devId[i][partition]])
+		if partition < uint64(len(d.replica2part2devId[i])) {
+			response = append(response, &d.Devs[d.replica2part2devId[i][partition]])
+		}
 	}
 	for i := range response {
 		j := rand.Intn(i + 1)
@@ -126,7 +128,9 @@ func (r *hashRing) GetNodesInOrder(partition uint64) (response []*Device) {
 		return nil
 	}
 	for i := 0; i < d.ReplicaCount; i++ {
-		response = append(response, &d.Devs[d.replica2part2devId[i][partition]])
+		if partition < uint64(len(d.replica2part2devId[i])) {
+			response = append(response, &d.Devs[d.replica2part2devId[i][partition]])
+		}
 	}
 	return response
 }
@@ -138,6 +142,9 @@ func (r *hashRing) GetJobNodes(partition uint64, localDevice int) (response []*D
 		return nil, false
 	}
 	for i := 0; i < d.ReplicaCount; i++ {
+		if partition >= uint64(len(d.replica2part2devId[i])) {
+			continue
+		}
 		dev := &d.Devs[d.replica2part2devId[i][partition]]
 		if dev.Id == localDevice {
 			handoff = false
@@ -240,8 +247,13 @@ func (r *hashRing) reload() error {
 	}
 	partitionCount := 1 << (32 - data.PartShift)
 	for i := 0; i < data.ReplicaCount; i++ {
-		part2dev := make([]uint16, partitionCount)
-		binary.Read(gz, binary.LittleEndian, &part2dev)
+		// with a fractional replica count, the last replica only covers some of the partitions.
+		buf := make([]byte, 2*partitionCount)
+		n, _ := io.ReadFull(gz, buf)
+		part2dev := make([]uint16, n/2)
+		for j := range part2dev {
+			part2dev[j] = binary.LittleEndian.Uint16(buf[2*j:])
+		}
 		data.replica2part2devId = append(data.replica2part2devId, part2dev)
 	}
 	regionCount := make(map[int]bool)
@@ -282,7 +294,9 @@ func (m *hashMoreNodes) initialize() {
 	m.sameZones = make(map[regionZone]bool)
 	m.sameIpPorts = make(map[ipPort]bool)
 	for _, mp := range d.replica2part2devId {
-		m.addDevice(&d.Devs[mp[m.partition]])
+		if m.partition < uint64(len(mp)) {
+			m.addDevice(&d.Devs[mp[m.partition]])
+		}
 	}
 	hash := md5.New()
 	hash.Write([]byte(strconv.FormatUint(m.partition, 10)))
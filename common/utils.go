@@ -23,6 +23,7 @@ import (
 	"math/rand"
 	"net/http"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -443,3 +444,26 @@ func Headers2Map(headers http.Header) map[string]string {
 	}
 	return m
 }
+
+// PrintSyncTable writes out a database's incoming sync points by remote id, for the info commands.
+func PrintSyncTable(w io.Writer, localID string, syncPoints map[string]int64) {
+	ids := make([]string, 0, len(syncPoints))
+	for id := range syncPoints {
+		ids = append(ids, id)
+	}
+	// the sync table always has this database's own id and max row in it, which goes first.
+	sort.Slice(ids, func(i, j int) bool {
+		if (ids[i] == localID) != (ids[j] == localID) {
+			return ids[i] == localID
+		}
+		return ids[i] < ids[j]
+	})
+	fmt.Fprintf(w, "Sync Table:\n")
+	for _, id := range ids {
+		if id == localID {
+			fmt.Fprintf(w, "  %s: %d (local)\n", id, syncPoints[id])
+		} else {
+			fmt.Fprintf(w, "  %s: %d\n", id, syncPoints[id])
+		}
+	}
+}
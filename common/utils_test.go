@@ -265,3 +265,9 @@ func TestParseProxyPath(t *testing.T) {
 	assert.Equal(t, len(res), 0)
 	assert.NotEqual(t, err, nil)
 }
+
+func TestPrintSyncTable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	PrintSyncTable(buf, "b", map[string]int64{"c": 3, "b": 2, "a": 1})
+	require.Equal(t, "Sync Table:\n  b: 2 (local)\n  a: 1\n  c: 3\n", buf.String())
+}
@@ -74,8 +74,12 @@ type ObjectListingRecord struct {
 	Size         int64    `xml:"bytes" json:"bytes"`
 	ContentType  string   `xml:"content_type" json:"content_type"`
 	ETag         string   `xml:"hash" json:"hash"`
+	SymlinkPath  string   `xml:"symlink_path,omitempty" json:"symlink_path,omitempty"`
 }
 
+// symlinkPathParam is the content type parameter the symlink middleware uses to record a symlink's target path.
+const symlinkPathParam = ";symlink_path="
+
 // SubdirListingRecord is the struct used for serializing subdirs in json and xml container listings.
 type SubdirListingRecord struct {
 	XMLName xml.Name `xml:"subdir" json:"-"`
@@ -95,6 +99,38 @@ type ObjectRecord struct {
 	StoragePolicyIndex int    `json:"storage_policy_index"`
 }
 
+// ShardRange is a contiguous range of a container's object names whose rows are kept in a shard container.  A range
+// holds the names greater than Lower and less than or equal to Upper, with an empty bound leaving that end open.
+type ShardRange struct {
+	Name           string `json:"name"`
+	Lower          string `json:"lower"`
+	Upper          string `json:"upper"`
+	Timestamp      string `json:"timestamp"`
+	State          string `json:"state"`
+	ObjectCount    int64  `json:"object_count"`
+	BytesUsed      int64  `json:"bytes_used"`
+	StatsTimestamp string `json:"stats_timestamp"`
+}
+
+const (
+	// ShardRangeCreated is the state of a shard range that has been found, but whose rows still live in the root container.
+	ShardRangeCreated = "created"
+	// ShardRangeActive is the state of a shard range whose rows have been moved into its shard container.
+	ShardRangeActive = "active"
+	// ShardAccountPrefix is prepended to an account's name to get the hidden account its shard containers live in.
+	ShardAccountPrefix = ".shards_"
+)
+
+// Includes returns true if the object name falls within the shard range.
+func (r *ShardRange) Includes(name string) bool {
+	return (r.Lower == "" || name > r.Lower) && (r.Upper == "" || name <= r.Upper)
+}
+
+// ShardAccount returns the name of the hidden account that holds an account's shard containers.
+func ShardAccount(account string) string {
+	return ShardAccountPrefix + account
+}
+
 // SyncRecord represents a row in the incoming_sync table.  It is used by replication.
 type SyncRecord struct {
 	SyncPoint int64  `json:"sync_point"`
@@ -119,6 +155,10 @@ type Container interface {
 	PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int) error
 	// DeleteObject deletes an object from the container.
 	DeleteObject(name string, timestamp string, storagePolicyIndex int) error
+	// ShardRanges returns the container's shard ranges, ordered by their lower bounds.
+	ShardRanges() ([]*ShardRange, error)
+	// MergeShardRanges merges shard ranges into the container, keeping the newest version of each.
+	MergeShardRanges(ranges []*ShardRange) error
 	// ID returns a unique identifier for the container.
 	ID() string
 	// Close frees any resources associated with the container.
@@ -148,6 +188,11 @@ type ReplicableContainer interface {
 	CheckSyncLink() error
 	// RingHash returns the container's ring hash.
 	RingHash() string
+	// ItemsInRange returns up to count object records, including tombstones, in name order with names greater than lower
+	// and less than or equal to upper.  An empty bound leaves that end of the range open.
+	ItemsInRange(lower, upper string, count int) ([]*ObjectRecord, error)
+	// RemoveItems deletes the given object records, matching them by ROWID.
+	RemoveItems(records []*ObjectRecord) error
 }
 
 // ContainerEngine is the interface of an object that creates and returns containers.
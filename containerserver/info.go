@@ -0,0 +1,134 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// printContainerInfo writes out the container_stat row, metadata and sync table of a container database.  If
+// containerRing is nil, the ring locations are left out.
+func printContainerInfo(w io.Writer, dbFile string, containerRing ring.Ring) error {
+	db, err := sqliteOpenContainer(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	info, err := db.GetInfo()
+	if err != nil {
+		return fmt.Errorf("Unable to read container info from %s: %v", dbFile, err)
+	}
+	deleted, err := db.IsDeleted()
+	if err != nil {
+		return err
+	}
+	syncTable, err := db.SyncTable()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Path: /%s/%s\n", info.Account, info.Container)
+	fmt.Fprintf(w, "  Account: %s\n", info.Account)
+	fmt.Fprintf(w, "  Container: %s\n", info.Container)
+	fmt.Fprintf(w, "  Container Hash: %s\n", db.RingHash())
+	fmt.Fprintf(w, "Metadata:\n")
+	fmt.Fprintf(w, "  Created at: %s\n", info.CreatedAt)
+	fmt.Fprintf(w, "  Put Timestamp: %s\n", info.PutTimestamp)
+	fmt.Fprintf(w, "  Delete Timestamp: %s\n", info.DeleteTimestamp)
+	fmt.Fprintf(w, "  Status Timestamp: %s\n", info.StatusChangedAt)
+	fmt.Fprintf(w, "  Object Count: %d\n", info.ObjectCount)
+	fmt.Fprintf(w, "  Bytes Used: %d\n", info.BytesUsed)
+	fmt.Fprintf(w, "  Storage Policy Index: %d\n", info.StoragePolicyIndex)
+	fmt.Fprintf(w, "  Reported Put Timestamp: %s\n", info.ReportedPutTimestamp)
+	fmt.Fprintf(w, "  Reported Delete Timestamp: %s\n", info.ReportedDeleteTimestamp)
+	fmt.Fprintf(w, "  Reported Object Count: %d\n", info.ReportedObjectCount)
+	fmt.Fprintf(w, "  Reported Bytes Used: %d\n", info.ReportedBytesUsed)
+	fmt.Fprintf(w, "  Chexor: %s\n", info.Hash)
+	fmt.Fprintf(w, "  UUID: %s\n", info.ID)
+	fmt.Fprintf(w, "  X-Container-Sync-Point1: %s\n", info.XContainerSyncPoint1)
+	fmt.Fprintf(w, "  X-Container-Sync-Point2: %s\n", info.XContainerSyncPoint2)
+	fmt.Fprintf(w, "  Max Row: %d\n", info.MaxRow)
+	fmt.Fprintf(w, "  Deleted: %v\n", deleted)
+	keys := make([]string, 0, len(info.Metadata))
+	for k := range info.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "User Metadata:\n")
+	if len(keys) == 0 {
+		fmt.Fprintf(w, "  No metadata found\n")
+	}
+	for _, k := range keys {
+		if v := info.Metadata[k]; len(v) == 2 {
+			fmt.Fprintf(w, "  %s: %s (%s)\n", k, v[0], v[1])
+		}
+	}
+	syncPoints := make(map[string]int64, len(syncTable))
+	for _, rec := range syncTable {
+		syncPoints[rec.RemoteID] = rec.SyncPoint
+	}
+	common.PrintSyncTable(w, info.ID, syncPoints)
+	if containerRing == nil {
+		return nil
+	}
+	partition := containerRing.GetPartition(info.Account, info.Container, "")
+	hash := db.RingHash()
+	fmt.Fprintf(w, "Partition\t%d\n", partition)
+	fmt.Fprintf(w, "Hash     \t%s\n", hash)
+	path := common.Urlencode(info.Account) + "/" + common.Urlencode(info.Container)
+	suffix := filepath.Base(filepath.Dir(filepath.Dir(dbFile)))
+	ring.PrintLocations(w, containerRing, partition, path, "containers", suffix+"/"+hash, -1)
+	return nil
+}
+
+// ContainerInfoCmd prints the contents and ring locations of a container database.
+func ContainerInfoCmd(args []string) {
+	flags := flag.NewFlagSet("container-info", flag.ExitOnError)
+	noLocations := flags.Bool("n", false, "don't print the ring locations")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird container-info [path to .db file]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(flags.Args()) != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	var containerRing ring.Ring
+	if !*noLocations {
+		hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+		if err != nil {
+			fmt.Println("Unable to load hash path prefix and suffix:", err)
+			os.Exit(1)
+		}
+		if containerRing, err = ring.GetRing("container", hashPathPrefix, hashPathSuffix, 0); err != nil {
+			fmt.Println("Unable to load container ring:", err)
+			os.Exit(1)
+		}
+	}
+	if err := printContainerInfo(os.Stdout, flags.Arg(0), containerRing); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
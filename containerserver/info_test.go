@@ -0,0 +1,54 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestPrintContainerInfo(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("o", "100000001.00000", 10, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0))
+	require.Nil(t, db.UpdateMetadata(map[string][]string{"X-Container-Meta-Color": {"blue", "100000002.00000"}}, "100000002.00000"))
+	require.Nil(t, db.MergeSyncTable([]*SyncRecord{{RemoteID: "some-remote", SyncPoint: 7}}))
+
+	fakeRing := &test.FakeRing{MockDevices: []*ring.Device{
+		{Ip: "127.0.0.1", Port: 6011, Device: "sda"},
+		{Ip: "127.0.0.2", Port: 6011, Device: "sdb"},
+		{Ip: "127.0.0.3", Port: 6011, Device: "sdc"},
+	}}
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	out := &bytes.Buffer{}
+	require.Nil(t, printContainerInfo(out, dbFile, fakeRing))
+	assert.Contains(t, out.String(), "Path: /a/c\n")
+	assert.Contains(t, out.String(), "  Object Count: 1\n")
+	assert.Contains(t, out.String(), "  Bytes Used: 10\n")
+	assert.Contains(t, out.String(), "  Deleted: false\n")
+	assert.Contains(t, out.String(), "User Metadata:\n  X-Container-Meta-Color: blue (100000002.00000)\n")
+	assert.Contains(t, out.String(), fmt.Sprintf("Sync Table:\n  %s: 1 (local)\n  some-remote: 7\nPartition", info.ID))
+	assert.Contains(t, out.String(), `curl -g -I -XHEAD "http://127.0.0.3:6011/sdc/0/a/c"`+"\n")
+	assert.Contains(t, out.String(), `ssh 127.0.0.1 "ls -lah ${DEVICE:-/srv/node*}/sda/containers/0/000/db"`+"\n")
+}
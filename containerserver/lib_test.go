@@ -172,6 +172,18 @@ func (f fakeDatabase) PutObject(name string, timestamp string, size int64, conte
 func (f fakeDatabase) DeleteObject(name string, timestamp string, storagePolicyIndex int) error {
 	return errors.New("")
 }
+func (f fakeDatabase) ShardRanges() ([]*ShardRange, error) {
+	return nil, errors.New("")
+}
+func (f fakeDatabase) MergeShardRanges(ranges []*ShardRange) error {
+	return errors.New("")
+}
+func (f fakeDatabase) ItemsInRange(lower, upper string, count int) ([]*ObjectRecord, error) {
+	return nil, errors.New("")
+}
+func (f fakeDatabase) RemoveItems(records []*ObjectRecord) error {
+	return errors.New("")
+}
 
 type fakeContainerEngine struct{}
 
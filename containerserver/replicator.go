@@ -46,6 +46,7 @@ var (
 // Replicator is the container replicator daemon object
 type Replicator struct {
 	checkMounts    bool
+	failedDevices  *fs.FailedDevices
 	deviceRoot     string
 	reconCachePath string
 	logger         srv.LowLevelLogger
@@ -327,6 +328,10 @@ func (rd *replicationDevice) replicate() {
 		rd.r.LogError("Device not mounted: %s", devicePath)
 		return
 	}
+	if rd.r.failedDevices.IsFailed(rd.dev.Device) {
+		rd.r.LogError("Device marked failed: %s", devicePath)
+		return
+	}
 	results := make(chan string, 100)
 	go rd.i.findContainerDbs(devicePath, results)
 	for dbFile := range results {
@@ -564,6 +569,7 @@ func GetReplicator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, err
 		startRun:       make(chan string),
 		reconCachePath: serverconf.GetDefault("container-replicator", "recon_cache_path", "/var/cache/swift"),
 		checkMounts:    serverconf.GetBool("container-replicator", "mount_check", true),
+		failedDevices:  fs.NewFailedDevices(serverconf.GetDefault("container-replicator", "failed_devices_file", fs.DefaultFailedDevicesFile)),
 		deviceRoot:     serverconf.GetDefault("container-replicator", "devices", "/srv/node"),
 		serverPort:     int(serverconf.GetInt("container-replicator", "bind_port", 6000)),
 		reclaimAge:     serverconf.GetInt("container-replicator", "reclaim_age", 604800),
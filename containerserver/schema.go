@@ -172,6 +172,18 @@ const (
 				WHERE ROWID = new.ROWID;
 			END;`
 
+	shardRangeTableScript = `
+		CREATE TABLE shard_range (
+			name TEXT PRIMARY KEY,
+			lower TEXT DEFAULT '',
+			upper TEXT DEFAULT '',
+			timestamp TEXT DEFAULT '0',
+			state TEXT DEFAULT 'created',
+			object_count INTEGER DEFAULT 0,
+			bytes_used INTEGER DEFAULT 0,
+			stats_timestamp TEXT DEFAULT '0'
+		);`
+
 	policyMigrateColumns = `account, container, created_at, put_timestamp, delete_timestamp, reported_put_timestamp,
 		reported_object_count, reported_bytes_used, hash, id, status, status_changed_at, metadata,
 		x_container_sync_point1, x_container_sync_point2`
@@ -206,6 +218,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 	hasSyncPoints := false
 	hasMetadata := false
 	hasPolicyStat := false
+	hasShardRange := false
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -214,7 +227,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 	defer tx.Rollback()
 
 	// We just pull the schema out of sqlite_master and look at it to get the current state of the database.
-	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE name in ('policy_stat', 'ix_object_deleted_name', 'container_stat')")
+	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE name in ('policy_stat', 'ix_object_deleted_name', 'container_stat', 'shard_range')")
 	if err != nil {
 		return false, err
 	}
@@ -227,6 +240,8 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 			hasPolicyStat = true
 		} else if name == "ix_object_deleted_name" {
 			hasDeletedNameIndex = true
+		} else if name == "shard_range" {
+			hasShardRange = true
 		} else if name == "container_stat" {
 			hasSyncPoints = strings.Contains(sql, "x_container_sync_point1")
 			hasMetadata = strings.Contains(sql, "metadata")
@@ -239,7 +254,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 		return hasDeletedNameIndex, err
 	}
 
-	if hasSyncPoints && hasMetadata && hasPolicyStat {
+	if hasSyncPoints && hasMetadata && hasPolicyStat && hasShardRange {
 		return hasDeletedNameIndex, nil
 	}
 
@@ -258,5 +273,10 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 			return hasDeletedNameIndex, fmt.Errorf("Performing policy migration: %v", err)
 		}
 	}
+	if !hasShardRange {
+		if _, err = tx.Exec(shardRangeTableScript); err != nil {
+			return hasDeletedNameIndex, fmt.Errorf("Adding shard_range table: %v", err)
+		}
+	}
 	return hasDeletedNameIndex, tx.Commit()
 }
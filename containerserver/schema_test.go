@@ -171,4 +171,5 @@ func TestMigrateCruftyDatabase(t *testing.T) {
 	}
 	ensureColumnsExist("object", []string{"storage_policy_index"})
 	ensureColumnsExist("container_stat", []string{"metadata", "x_container_sync_point1", "x_container_sync_point2"})
+	ensureColumnsExist("shard_range", []string{"name", "lower", "upper", "state", "object_count", "bytes_used"})
 }
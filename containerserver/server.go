@@ -32,6 +32,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/middleware"
 )
@@ -54,7 +55,9 @@ type ContainerServer struct {
 	logLevel         string
 	diskInUse        *common.KeyedLimit
 	checkMounts      bool
+	failedDevices    *fs.FailedDevices
 	containerEngine  ContainerEngine
+	containerRing    ring.Ring
 	updateClient     *http.Client
 	autoCreatePrefix string
 	syncRealms       conf.SyncRealmList
@@ -139,6 +142,18 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 	for key, value := range metadata {
 		headers.Set(key, value)
 	}
+	shardRanges, err := db.ShardRanges()
+	if err != nil {
+		srv.GetLogger(request).LogError("Unable to get shard ranges: %v", err)
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	for _, r := range shardRanges {
+		if r.State == ShardRangeActive {
+			headers.Set("X-Backend-Sharded", "true")
+			break
+		}
+	}
 	if deleted, err := db.IsDeleted(); err != nil {
 		srv.GetLogger(request).LogError("Error calling IsDeleted: %v", err)
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -161,6 +176,21 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		writer.Write([]byte(""))
 		return
 	}
+	if request.Header.Get("X-Backend-Record-Type") == "shard" {
+		if shardRanges == nil {
+			shardRanges = []*ShardRange{}
+		}
+		output, err := json.Marshal(shardRanges)
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		headers.Set("Content-Type", "application/json; charset=utf-8")
+		headers.Set("Content-Length", strconv.Itoa(len(output)))
+		writer.WriteHeader(200)
+		writer.Write(output)
+		return
+	}
 	limit, _ := strconv.ParseInt(request.FormValue("limit"), 10, 64)
 	if limit <= 0 || limit > 10000 {
 		limit = 10000
@@ -239,8 +269,38 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 	}
 }
 
+// ShardRangesPutHandler merges the shard ranges in a PUT request's body into the container.
+func (server *ContainerServer) ShardRangesPutHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	var ranges []*ShardRange
+	if err := json.NewDecoder(request.Body).Decode(&ranges); err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	db, err := server.containerEngine.Get(vars)
+	if err == ErrorNoSuchContainer {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return
+	} else if err != nil {
+		srv.GetLogger(request).LogError("Unable to get container: %v", err)
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	defer server.containerEngine.Return(db)
+	if err := db.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).LogError("Unable to merge shard ranges: %v", err)
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	srv.StandardResponse(writer, http.StatusAccepted)
+}
+
 // ContainerPutHandler handles PUT requests for a container.
 func (server *ContainerServer) ContainerPutHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Header.Get("X-Backend-Record-Type") == "shard" {
+		server.ShardRangesPutHandler(writer, request)
+		return
+	}
 	vars := srv.GetVars(request)
 	timestamp, err := common.StandardizeTimestamp(request.Header.Get("X-Timestamp"))
 	if err != nil {
@@ -382,6 +442,40 @@ func (server *ContainerServer) ContainerPostHandler(writer http.ResponseWriter,
 	}
 }
 
+// redirectToShard responds with a redirect to the shard container if the object's record belongs to one of the
+// container's active shard ranges, returning true if it did.
+func (server *ContainerServer) redirectToShard(writer http.ResponseWriter, request *http.Request, db Container, vars map[string]string) bool {
+	if server.containerRing == nil {
+		return false
+	}
+	shardRanges, err := db.ShardRanges()
+	if err != nil {
+		srv.GetLogger(request).LogError("Unable to get shard ranges: %v", err)
+		return false
+	}
+	for _, r := range shardRanges {
+		if r.State != ShardRangeActive || !r.Includes(vars["obj"]) {
+			continue
+		}
+		account := ShardAccount(vars["account"])
+		partition := server.containerRing.GetPartition(account, r.Name, "")
+		var hosts, devices []string
+		for _, dev := range server.containerRing.GetNodes(partition) {
+			hosts = append(hosts, fmt.Sprintf("%s:%d", dev.Ip, dev.Port))
+			devices = append(devices, dev.Device)
+		}
+		headers := writer.Header()
+		headers.Set("X-Backend-Redirect-Account", account)
+		headers.Set("X-Backend-Redirect-Container", r.Name)
+		headers.Set("X-Backend-Redirect-Partition", strconv.FormatUint(partition, 10))
+		headers.Set("X-Backend-Redirect-Host", strings.Join(hosts, ","))
+		headers.Set("X-Backend-Redirect-Device", strings.Join(devices, ","))
+		srv.StandardResponse(writer, http.StatusMovedPermanently)
+		return true
+	}
+	return false
+}
+
 // ObjPutHandler handles the PUT of object records to a container.
 func (server *ContainerServer) ObjPutHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
@@ -419,6 +513,9 @@ func (server *ContainerServer) ObjPutHandler(writer http.ResponseWriter, request
 		return
 	}
 	defer server.containerEngine.Return(db)
+	if server.redirectToShard(writer, request, db, vars) {
+		return
+	}
 	if err := db.PutObject(vars["obj"], timestamp, size, contentType, etag, policyIndex); err != nil {
 		srv.GetLogger(request).LogError("Error adding object to container: %v", err)
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -457,6 +554,9 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 		return
 	}
 	defer server.containerEngine.Return(db)
+	if server.redirectToShard(writer, request, db, vars) {
+		return
+	}
 	if err := db.DeleteObject(vars["obj"], timestamp, policyIndex); err != nil {
 		srv.GetLogger(request).LogError("Error adding object to container: %v", err)
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -540,6 +640,11 @@ func (server *ContainerServer) AcquireDevice(next http.Handler) http.Handler {
 					return
 				}
 			}
+			if server.failedDevices.IsFailed(device) {
+				vars["Method"] = request.Method
+				srv.CustomErrorResponse(writer, 507, vars)
+				return
+			}
 
 			forceAcquire := request.Header.Get("X-Force-Acquire") == "true"
 			if concRequests := server.diskInUse.Acquire(device, forceAcquire); concRequests != 0 {
@@ -608,6 +713,7 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	server.autoCreatePrefix = serverconf.GetDefault("app:container-server", "auto_create_account_prefix", ".")
 	server.driveRoot = serverconf.GetDefault("app:container-server", "devices", "/srv/node")
 	server.checkMounts = serverconf.GetBool("app:container-server", "mount_check", true)
+	server.failedDevices = fs.NewFailedDevices(serverconf.GetDefault("app:container-server", "failed_devices_file", fs.DefaultFailedDevicesFile))
 	server.logLevel = serverconf.GetDefault("app:container-server", "log_level", "INFO")
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:container-server", "disk_limit", 25, 10000))
 	bindIP = serverconf.GetDefault("app:container-server", "bind_ip", "0.0.0.0")
@@ -616,6 +722,12 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 		return "", 0, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
 	server.containerEngine = newLRUEngine(server.driveRoot, server.hashPathPrefix, server.hashPathSuffix, 32)
+	// sharding needs the container ring to find shard containers, but a server without one can still serve everything else.
+	if containerRing, err := GetRing("container", server.hashPathPrefix, server.hashPathSuffix, 0); err != nil {
+		server.logger.Err(fmt.Sprintf("Error loading container ring, sharding disabled: %v", err))
+	} else {
+		server.containerRing = containerRing
+	}
 	connTimeout := time.Duration(serverconf.GetFloat("app:container-server", "conn_timeout", 1.0) * float64(time.Second))
 	nodeTimeout := time.Duration(serverconf.GetFloat("app:container-server", "node_timeout", 10.0) * float64(time.Second))
 	server.updateClient = &http.Client{
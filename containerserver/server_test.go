@@ -17,13 +17,16 @@ package containerserver
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/test"
 )
 
@@ -585,9 +588,11 @@ func TestDiskUsage(t *testing.T) {
 func TestGetServer(t *testing.T) {
 	oldgethash := GetHashPrefixAndSuffix
 	oldgetsync := GetSyncRealms
+	oldgetring := GetRing
 	defer func() {
 		GetHashPrefixAndSuffix = oldgethash
 		GetSyncRealms = oldgetsync
+		GetRing = oldgetring
 	}()
 	GetHashPrefixAndSuffix = func() (string, string, error) {
 		return "changeme", "changeme", nil
@@ -595,6 +600,9 @@ func TestGetServer(t *testing.T) {
 	GetSyncRealms = func() conf.SyncRealmList {
 		return conf.SyncRealmList(map[string]conf.SyncRealm{})
 	}
+	GetRing = func(ringType, prefix, suffix string, policy int) (ring.Ring, error) {
+		return &test.FakeRing{}, nil
+	}
 
 	configString := "[app:container-server]\ndevices=whatever\nmount_check=false\nbind_ip=127.0.0.2\nbind_port=1000\nlog_level=INFO\n"
 	conf, err := conf.StringConfig(configString)
@@ -611,6 +619,16 @@ func TestGetServer(t *testing.T) {
 	require.False(t, server.checkMounts)
 	require.NotNil(t, server.updateClient)
 	require.NotNil(t, server.containerEngine)
+	require.NotNil(t, server.containerRing)
+
+	GetRing = func(ringType, prefix, suffix string, policy int) (ring.Ring, error) {
+		return nil, errors.New("no ring")
+	}
+	_, _, s, _, err = GetServer(conf, &flag.FlagSet{})
+	require.Nil(t, err)
+	server, ok = s.(*ContainerServer)
+	require.True(t, ok)
+	require.Nil(t, server.containerRing)
 }
 
 func TestContainerAutoCreateOnPut(t *testing.T) {
@@ -726,3 +744,71 @@ func TestContainerVerifySync(t *testing.T) {
 	handler.ServeHTTP(rsp, req)
 	require.Equal(t, 204, rsp.Status)
 }
+
+func TestContainerShardRangesRedirect(t *testing.T) {
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+	server.containerRing = &test.FakeRing{MockDevices: []*ring.Device{
+		{Id: 0, Device: "sda", Ip: "127.0.0.1", Port: 6001},
+		{Id: 1, Device: "sdb", Ip: "127.0.0.2", Port: 6002},
+		{Id: 2, Device: "sdc", Ip: "127.0.0.3", Port: 6003},
+	}}
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("PUT", "/device/1/a/c", strings.NewReader(
+		`[{"name": "c-0", "lower": "", "upper": "m", "timestamp": "200000000.00000", "state": "active"},
+		  {"name": "c-1", "lower": "m", "upper": "", "timestamp": "200000000.00000", "state": "created"}]`))
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Backend-Record-Type", "shard")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 202, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Backend-Record-Type", "shard")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	require.Equal(t, "true", rsp.Header().Get("X-Backend-Sharded"))
+	var ranges []*ShardRange
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &ranges))
+	require.Equal(t, 2, len(ranges))
+	require.Equal(t, "c-0", ranges[0].Name)
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		rsp = test.MakeCaptureResponse()
+		req, err = http.NewRequest(method, "/device/1/a/c/f", nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Content-Type", "application/octet-stream")
+		req.Header.Set("X-Size", "2")
+		req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 301, rsp.Status)
+		require.Equal(t, ".shards_a", rsp.Header().Get("X-Backend-Redirect-Account"))
+		require.Equal(t, "c-0", rsp.Header().Get("X-Backend-Redirect-Container"))
+		require.Equal(t, "0", rsp.Header().Get("X-Backend-Redirect-Partition"))
+		require.Equal(t, "127.0.0.1:6001,127.0.0.2:6002,127.0.0.3:6003", rsp.Header().Get("X-Backend-Redirect-Host"))
+		require.Equal(t, "sda,sdb,sdc", rsp.Header().Get("X-Backend-Redirect-Device"))
+	}
+
+	// names in ranges that haven't been made active yet still go to the root container.
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("PUT", "/device/1/a/c/x", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Size", "2")
+	req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+}
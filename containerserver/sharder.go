@@ -0,0 +1,474 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// cleaveBatchSize is how many object records are moved into a shard container at a time.
+const cleaveBatchSize = 1000
+
+// listingPageSize is how many objects are listed at a time while looking for shard range bounds.
+const listingPageSize = 10000
+
+// Sharder is the container-sharder daemon, which splits containers with too many objects into shard containers.
+//
+// The first primary node for a container leads its sharding: it finds the shard ranges, moves each range's rows into a
+// shard container, marks the range active and keeps the ranges' stats up to date, pushing the ranges to the other
+// primaries as it goes.  Every primary moves any rows it has in active ranges out into the shards.
+type Sharder struct {
+	checkMounts    bool
+	failedDevices  *fs.FailedDevices
+	deviceRoot     string
+	logger         srv.LowLevelLogger
+	serverPort     int
+	Ring           ring.Ring
+	hashPathPrefix string
+	hashPathSuffix string
+	shardThreshold int64
+	shardSize      int
+	interval       time.Duration
+	client         *http.Client
+}
+
+// LogError formats and logs error messages to the underlying logger.
+func (s *Sharder) LogError(format string, args ...interface{}) {
+	s.logger.Err(fmt.Sprintf(format, args...))
+}
+
+// LogInfo formats and logs info messages to the underlying logger.
+func (s *Sharder) LogInfo(format string, args ...interface{}) {
+	s.logger.Info(fmt.Sprintf(format, args...))
+}
+
+// LogPanics logs any panic in progress, along with the message and a stack trace.
+func (s *Sharder) LogPanics(m string) {
+	if e := recover(); e != nil {
+		s.LogError("%s: %s: %s", m, e, debug.Stack())
+	}
+}
+
+// findShardRanges splits the container's objects, in listing order, into ranges of shardSize objects.  The last range is
+// left open-ended, so it picks up any objects added past the end of the current listing.
+func (s *Sharder) findShardRanges(c Container, info *ContainerInfo) ([]*ShardRange, error) {
+	timestamp := common.GetTimestamp()
+	var ranges []*ShardRange
+	lower := ""
+	for {
+		upper := lower
+		count := 0
+		for count < s.shardSize {
+			limit := s.shardSize - count
+			if limit > listingPageSize {
+				limit = listingPageSize
+			}
+			objects, err := c.ListObjects(limit, upper, "", "", "", nil, false, info.StoragePolicyIndex)
+			if err != nil {
+				return nil, err
+			}
+			if len(objects) == 0 {
+				break
+			}
+			last, ok := objects[len(objects)-1].(*ObjectListingRecord)
+			if !ok {
+				return nil, fmt.Errorf("Unexpected listing record %v", objects[len(objects)-1])
+			}
+			upper = last.Name
+			count += len(objects)
+			if len(objects) < limit {
+				break
+			}
+		}
+		r := &ShardRange{
+			Name:      fmt.Sprintf("%s-%s-%d", info.Container, timestamp, len(ranges)),
+			Lower:     lower,
+			Timestamp: timestamp,
+			State:     ShardRangeCreated,
+		}
+		ranges = append(ranges, r)
+		if count < s.shardSize {
+			return ranges, nil
+		}
+		r.Upper = upper
+		lower = upper
+	}
+}
+
+// sendShardRequest sends a request to one of a shard container's nodes, returning an error unless it succeeds.
+func (s *Sharder) sendShardRequest(req *http.Request) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// cleave copies the container's rows in a shard range into the range's shard container.  The shard container is created
+// on its primary nodes, which merge in the rows.  If remove is set, rows are removed from the local database once a
+// quorum of the primaries have them; that should only happen once the range is active, as until then listings are
+// still served from the local database.
+func (s *Sharder) cleave(c ReplicableContainer, info *ContainerInfo, r *ShardRange, remove bool) error {
+	records, err := c.ItemsInRange(r.Lower, r.Upper, cleaveBatchSize)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	account := ShardAccount(info.Account)
+	partition := s.Ring.GetPartition(account, r.Name, "")
+	nodes := s.Ring.GetNodes(partition)
+	quorum := len(nodes)/2 + 1
+	created := 0
+	for _, node := range nodes {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", node.Ip, node.Port, node.Device, partition,
+			common.Urlencode(account), common.Urlencode(r.Name)), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Timestamp", r.Timestamp)
+		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(info.StoragePolicyIndex))
+		if err := s.sendShardRequest(req); err != nil {
+			s.LogError("Error creating shard container %s/%s on %s/%s: %v", account, r.Name, node.Ip, node.Device, err)
+		} else {
+			created++
+		}
+	}
+	if created < quorum {
+		return fmt.Errorf("Unable to create shard container %s/%s on a quorum of nodes", account, r.Name)
+	}
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%s/%s%s", s.hashPathPrefix, account, r.Name, s.hashPathSuffix)
+	ringHash := fmt.Sprintf("%032x", h.Sum(nil))
+	for len(records) > 0 {
+		body, err := json.Marshal([]interface{}{"merge_items", records, ""})
+		if err != nil {
+			return err
+		}
+		merged := 0
+		for _, node := range nodes {
+			req, err := http.NewRequest("REPLICATE", fmt.Sprintf("http://%s:%d/%s/%d/%s",
+				node.ReplicationIp, node.ReplicationPort, node.Device, partition, ringHash), bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			if err := s.sendShardRequest(req); err != nil {
+				s.LogError("Error merging rows into shard container %s/%s on %s/%s: %v", account, r.Name, node.Ip, node.Device, err)
+			} else {
+				merged++
+			}
+		}
+		if merged < quorum {
+			return fmt.Errorf("Unable to merge rows into shard container %s/%s on a quorum of nodes", account, r.Name)
+		}
+		lower := r.Lower
+		if remove {
+			if err := c.RemoveItems(records); err != nil {
+				return err
+			}
+		} else {
+			lower = records[len(records)-1].Name
+		}
+		if records, err = c.ItemsInRange(lower, r.Upper, cleaveBatchSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardStats fetches the object count and bytes used of a shard range's container from its primary nodes.
+func (s *Sharder) shardStats(info *ContainerInfo, r *ShardRange) (int64, int64, bool) {
+	account := ShardAccount(info.Account)
+	partition := s.Ring.GetPartition(account, r.Name, "")
+	for _, dev := range s.Ring.GetNodes(partition) {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", dev.Ip, dev.Port, dev.Device, partition,
+			common.Urlencode(account), common.Urlencode(r.Name)), nil)
+		if err != nil {
+			continue
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			continue
+		}
+		objectCount, err1 := strconv.ParseInt(resp.Header.Get("X-Container-Object-Count"), 10, 64)
+		bytesUsed, err2 := strconv.ParseInt(resp.Header.Get("X-Container-Bytes-Used"), 10, 64)
+		if err1 == nil && err2 == nil {
+			return objectCount, bytesUsed, true
+		}
+	}
+	return 0, 0, false
+}
+
+// pushShardRanges sends the container's shard ranges to its other primary nodes, returning how many of the primaries,
+// counting this one, have them.
+func (s *Sharder) pushShardRanges(dev *ring.Device, info *ContainerInfo, partition uint64, nodes []*ring.Device, ranges []*ShardRange) int {
+	body, err := json.Marshal(ranges)
+	if err != nil {
+		s.LogError("Unable to serialize shard ranges: %v", err)
+		return 1
+	}
+	pushed := 1
+	for _, node := range nodes {
+		if node.Id == dev.Id {
+			continue
+		}
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", node.Ip, node.Port, node.Device, partition,
+			common.Urlencode(info.Account), common.Urlencode(info.Container)), bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("X-Backend-Record-Type", "shard")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			s.LogError("Error pushing shard ranges for %s/%s to %s/%s: %v", info.Account, info.Container, node.Ip, node.Device, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			s.LogError("Error pushing shard ranges for %s/%s to %s/%s: status %d", info.Account, info.Container, node.Ip, node.Device, resp.StatusCode)
+			continue
+		}
+		pushed++
+	}
+	return pushed
+}
+
+// shardDatabase does whatever sharding work the local copy of a container database needs.
+func (s *Sharder) shardDatabase(dev *ring.Device, dbFile string) error {
+	parts := filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(dbFile))))
+	partition, err := strconv.ParseUint(parts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Bad partition: %s", parts)
+	}
+	nodes := s.Ring.GetNodes(partition)
+	primary := false
+	for _, node := range nodes {
+		if node.Id == dev.Id {
+			primary = true
+		}
+	}
+	if !primary {
+		// handoffs are the replicator's business.
+		return nil
+	}
+	leader := nodes[0].Id == dev.Id
+	c, err := sqliteOpenContainer(dbFile)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	info, err := c.GetInfo()
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(info.Account, ShardAccountPrefix) || info.DeleteTimestamp > info.PutTimestamp {
+		return nil
+	}
+	ranges, err := c.ShardRanges()
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		if !leader || info.ObjectCount < s.shardThreshold {
+			return nil
+		}
+		if ranges, err = s.findShardRanges(c, info); err != nil {
+			return fmt.Errorf("Unable to find shard ranges: %v", err)
+		}
+		if err := c.MergeShardRanges(ranges); err != nil {
+			return err
+		}
+		s.LogInfo("Found %d shard ranges for %s/%s", len(ranges), info.Account, info.Container)
+	}
+	if leader {
+		// a new range's rows are copied into its shard while listings are still served from here, and the range is
+		// only made active, the point at which the proxy starts listing from the shard, once they're all there.
+		var activated []*ShardRange
+		for _, r := range ranges {
+			if r.State != ShardRangeCreated {
+				continue
+			}
+			if err := s.cleave(c, info, r, false); err != nil {
+				return err
+			}
+			active := *r
+			active.State = ShardRangeActive
+			active.Timestamp = common.GetTimestamp()
+			activated = append(activated, &active)
+		}
+		if len(activated) > 0 {
+			if err := c.MergeShardRanges(activated); err != nil {
+				return err
+			}
+			s.LogInfo("Activated %d shard ranges for %s/%s", len(activated), info.Account, info.Container)
+		}
+		if ranges, err = c.ShardRanges(); err != nil {
+			return err
+		}
+		// the other primaries need to know which ranges are active before the rows come out of the root, or they'd
+		// go on listing a range without its rows.
+		if pushed := s.pushShardRanges(dev, info, partition, nodes, ranges); pushed < len(nodes)/2+1 {
+			return fmt.Errorf("Unable to push shard ranges for %s/%s to a quorum of nodes", info.Account, info.Container)
+		}
+	}
+	var updated []*ShardRange
+	for _, r := range ranges {
+		if r.State != ShardRangeActive {
+			continue
+		}
+		// rows can still turn up in an active range from replication or updates the server took before it saw the
+		// range, so they're moved out on every pass.
+		if err := s.cleave(c, info, r, true); err != nil {
+			return err
+		}
+		if leader {
+			if objectCount, bytesUsed, ok := s.shardStats(info, r); ok && (objectCount != r.ObjectCount || bytesUsed != r.BytesUsed) {
+				stats := *r
+				stats.ObjectCount = objectCount
+				stats.BytesUsed = bytesUsed
+				stats.StatsTimestamp = common.GetTimestamp()
+				updated = append(updated, &stats)
+			}
+		}
+	}
+	if len(updated) > 0 {
+		if err := c.MergeShardRanges(updated); err != nil {
+			return err
+		}
+		if leader {
+			if ranges, err = c.ShardRanges(); err != nil {
+				return err
+			}
+			s.pushShardRanges(dev, info, partition, nodes, ranges)
+		}
+	}
+	return nil
+}
+
+func (s *Sharder) shardDevice(dev *ring.Device) {
+	devicePath := filepath.Join(s.deviceRoot, dev.Device)
+	if stat, err := os.Stat(devicePath); err != nil || !stat.IsDir() {
+		s.LogError("Device doesn't exist: %s", devicePath)
+		return
+	}
+	if mount, err := fs.IsMount(devicePath); s.checkMounts && (err != nil || !mount) {
+		s.LogError("Device not mounted: %s", devicePath)
+		return
+	}
+	if s.failedDevices.IsFailed(dev.Device) {
+		s.LogError("Device marked failed: %s", devicePath)
+		return
+	}
+	dbFiles, err := filepath.Glob(filepath.Join(devicePath, "containers", "[0-9]*", "[a-f0-9][a-f0-9][a-f0-9]", "*", "*.db"))
+	if err != nil {
+		s.LogError("Error listing databases in %s: %v", devicePath, err)
+		return
+	}
+	for _, dbFile := range dbFiles {
+		if err := s.shardDatabase(dev, dbFile); err != nil {
+			s.LogError("Error sharding database %s: %v", dbFile, err)
+		}
+	}
+}
+
+// Run runs a pass of the sharder once.
+func (s *Sharder) Run() {
+	defer s.LogPanics("PANIC SHARDING CONTAINERS")
+	devices, err := s.Ring.LocalDevices(s.serverPort)
+	if err != nil {
+		s.LogError("Error getting local devices from ring: %v", err)
+		return
+	}
+	start := time.Now()
+	for _, dev := range devices {
+		s.shardDevice(dev)
+	}
+	s.LogInfo("Sharding pass completed in %.5f seconds", time.Since(start).Seconds())
+}
+
+// RunForever runs sharder passes every interval.
+func (s *Sharder) RunForever() {
+	for {
+		s.Run()
+		time.Sleep(s.interval)
+	}
+}
+
+// GetSharder uses the config settings and command-line flags to configure and return a sharder daemon struct.
+func GetSharder(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, error) {
+	if !serverconf.HasSection("container-sharder") {
+		return nil, fmt.Errorf("Unable to find container-sharder config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := GetHashPrefixAndSuffix()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get hash prefix and suffix")
+	}
+	ring, err := GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading container ring")
+	}
+	threshold := serverconf.GetInt("container-sharder", "shard_container_threshold", 1000000)
+	if threshold < 2 {
+		return nil, fmt.Errorf("shard_container_threshold must be at least 2")
+	}
+	var logger srv.LowLevelLogger
+	if logger, err = srv.SetupLogger(serverconf, flags, "app:container-server", "container-sharder"); err != nil {
+		return nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	return &Sharder{
+		checkMounts:    serverconf.GetBool("container-sharder", "mount_check", true),
+		failedDevices:  fs.NewFailedDevices(serverconf.GetDefault("container-sharder", "failed_devices_file", fs.DefaultFailedDevicesFile)),
+		deviceRoot:     serverconf.GetDefault("container-sharder", "devices", "/srv/node"),
+		serverPort:     int(serverconf.GetInt("container-sharder", "bind_port", 6000)),
+		shardThreshold: threshold,
+		shardSize:      int(threshold / 2),
+		interval:       time.Duration(serverconf.GetInt("container-sharder", "interval", 30)) * time.Second,
+		logger:         logger,
+		Ring:           ring,
+		hashPathPrefix: hashPathPrefix,
+		hashPathSuffix: hashPathSuffix,
+		client: &http.Client{
+			Timeout:   time.Minute,
+			Transport: &http.Transport{Dial: (&net.Dialer{Timeout: time.Second}).Dial},
+		},
+	}, nil
+}
@@ -0,0 +1,260 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestSharderShardDatabase(t *testing.T) {
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	host, ports, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(ports)
+	require.Nil(t, err)
+	fakeRing := &test.FakeRing{}
+	for i, device := range []string{"sda", "sdb", "sdc"} {
+		require.Nil(t, os.Mkdir(filepath.Join(server.driveRoot, device), 0777))
+		fakeRing.MockDevices = append(fakeRing.MockDevices, &ring.Device{
+			Id: i, Device: device, Ip: host, Port: port, ReplicationIp: host, ReplicationPort: port})
+	}
+
+	timestamp := common.GetTimestamp()
+	for _, device := range []string{"sda", "sdb", "sdc"} {
+		req, err := http.NewRequest("PUT", ts.URL+"/"+device+"/0/a/c", nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", timestamp)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, 201, resp.StatusCode)
+	}
+	for _, name := range []string{"o1", "o2", "o3", "o4", "o5"} {
+		req, err := http.NewRequest("PUT", ts.URL+"/sda/0/a/c/"+name, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Content-Type", "text/plain")
+		req.Header.Set("X-Size", "1")
+		req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, 201, resp.StatusCode)
+	}
+
+	sharder := &Sharder{
+		deviceRoot:     server.driveRoot,
+		logger:         test.FakeLowLevelLogger{},
+		Ring:           fakeRing,
+		hashPathPrefix: "changeme",
+		hashPathSuffix: "changeme",
+		shardThreshold: 4,
+		shardSize:      2,
+		client:         http.DefaultClient,
+	}
+	dbFile := server.containerEngine.(*lruEngine).containerLocation(
+		map[string]string{"device": "sda", "partition": "0", "account": "a", "container": "c"})
+	require.Nil(t, sharder.shardDatabase(fakeRing.MockDevices[0], dbFile))
+
+	c, err := sqliteOpenContainer(dbFile)
+	require.Nil(t, err)
+	defer c.Close()
+	ranges, err := c.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(ranges))
+	require.Equal(t, "", ranges[0].Lower)
+	require.Equal(t, "o2", ranges[0].Upper)
+	require.Equal(t, "o2", ranges[1].Lower)
+	require.Equal(t, "o4", ranges[1].Upper)
+	require.Equal(t, "o4", ranges[2].Lower)
+	require.Equal(t, "", ranges[2].Upper)
+	for _, r := range ranges {
+		require.Equal(t, ShardRangeActive, r.State)
+	}
+	require.Equal(t, int64(1), ranges[2].ObjectCount)
+	records, err := c.ItemsInRange("", "", 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+	info, err := c.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(5), info.ObjectCount)
+	require.Equal(t, int64(5), info.BytesUsed)
+
+	listShard := func(device, shard string) []string {
+		resp, err := http.Get(ts.URL + "/" + device + "/0/.shards_a/" + shard + "?format=json")
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, 200, resp.StatusCode)
+		var listing []ObjectListingRecord
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&listing))
+		var names []string
+		for _, record := range listing {
+			names = append(names, record.Name)
+		}
+		return names
+	}
+	for _, device := range []string{"sda", "sdb", "sdc"} {
+		require.Equal(t, []string{"o1", "o2"}, listShard(device, ranges[0].Name))
+		require.Equal(t, []string{"o3", "o4"}, listShard(device, ranges[1].Name))
+		require.Equal(t, []string{"o5"}, listShard(device, ranges[2].Name))
+	}
+
+	// rows that turn up in an active range later, say from replication, are moved out on the next pass.
+	require.Nil(t, c.MergeItems([]*ObjectRecord{{Name: "o6", CreatedAt: common.GetTimestamp(), Size: 1}}, ""))
+	require.Nil(t, sharder.shardDatabase(fakeRing.MockDevices[0], dbFile))
+	records, err = c.ItemsInRange("", "", 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+	require.Equal(t, []string{"o5", "o6"}, listShard("sdb", ranges[2].Name))
+}
+
+func TestSharderKeepsRowsUntilActiveRangesArePushed(t *testing.T) {
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Backend-Record-Type") == "shard" {
+			w.WriteHeader(503)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	host, ports, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(ports)
+	require.Nil(t, err)
+	fakeRing := &test.FakeRing{}
+	for i, device := range []string{"sda", "sdb", "sdc"} {
+		require.Nil(t, os.Mkdir(filepath.Join(server.driveRoot, device), 0777))
+		fakeRing.MockDevices = append(fakeRing.MockDevices, &ring.Device{
+			Id: i, Device: device, Ip: host, Port: port, ReplicationIp: host, ReplicationPort: port})
+	}
+
+	req, err := http.NewRequest("PUT", ts.URL+"/sda/0/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 201, resp.StatusCode)
+	dbFile := server.containerEngine.(*lruEngine).containerLocation(
+		map[string]string{"device": "sda", "partition": "0", "account": "a", "container": "c"})
+	c, err := sqliteOpenContainer(dbFile)
+	require.Nil(t, err)
+	defer c.Close()
+	var records []*ObjectRecord
+	for _, name := range []string{"o1", "o2", "o3", "o4", "o5"} {
+		records = append(records, &ObjectRecord{Name: name, CreatedAt: common.GetTimestamp(), Size: 1})
+	}
+	require.Nil(t, c.MergeItems(records, ""))
+
+	sharder := &Sharder{
+		deviceRoot:     server.driveRoot,
+		logger:         test.FakeLowLevelLogger{},
+		Ring:           fakeRing,
+		hashPathPrefix: "changeme",
+		hashPathSuffix: "changeme",
+		shardThreshold: 4,
+		shardSize:      2,
+		client:         http.DefaultClient,
+	}
+	require.NotNil(t, sharder.shardDatabase(fakeRing.MockDevices[0], dbFile))
+
+	ranges, err := c.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(ranges))
+	for _, r := range ranges {
+		require.Equal(t, ShardRangeActive, r.State)
+	}
+	records, err = c.ItemsInRange("", "", 10)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(records))
+	resp, err = http.Get(ts.URL + "/sdb/0/.shards_a/" + ranges[0].Name + "?format=json")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	var listing []ObjectListingRecord
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&listing))
+	require.Equal(t, 2, len(listing))
+}
+
+func TestSharderLeavesSmallContainers(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase(common.GetTimestamp())
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
+	fakeRing := &test.FakeRing{MockDevices: []*ring.Device{{Id: 0, Device: "device"}, {Id: 1}, {Id: 2}}}
+	sharder := &Sharder{logger: test.FakeLowLevelLogger{}, Ring: fakeRing, shardThreshold: 4, shardSize: 2}
+	require.Nil(t, sharder.shardDatabase(fakeRing.MockDevices[0], dbFile))
+	ranges, err := db.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ranges))
+}
+
+func TestGetSharder(t *testing.T) {
+	oldGetRing := GetRing
+	oldGetHashes := GetHashPrefixAndSuffix
+	defer func() {
+		GetHashPrefixAndSuffix = oldGetHashes
+		GetRing = oldGetRing
+	}()
+	GetHashPrefixAndSuffix = func() (pfx string, sfx string, err error) {
+		return "changeme", "changeme", nil
+	}
+	GetRing = func(ringType, prefix, suffix string, policy int) (ring.Ring, error) {
+		return &test.FakeRing{}, nil
+	}
+	config, err := conf.StringConfig("[container-sharder]\nmount_check=false\nbind_port=1000\nshard_container_threshold=100")
+	require.Nil(t, err)
+	s, err := GetSharder(config, &flag.FlagSet{})
+	require.Nil(t, err)
+	sharder, ok := s.(*Sharder)
+	require.True(t, ok)
+	require.Equal(t, 1000, sharder.serverPort)
+	require.Equal(t, "/srv/node", sharder.deviceRoot)
+	require.Equal(t, int64(100), sharder.shardThreshold)
+	require.Equal(t, 50, sharder.shardSize)
+	require.False(t, sharder.checkMounts)
+
+	config, err = conf.StringConfig("[container-sharder]\nshard_container_threshold=1")
+	require.Nil(t, err)
+	_, err = GetSharder(config, &flag.FlagSet{})
+	require.NotNil(t, err)
+}
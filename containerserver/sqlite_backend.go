@@ -96,9 +96,15 @@ type sqliteContainer struct {
 	containerFile       string
 	hasDeletedNameIndex bool
 	infoCache           atomic.Value
+	shardCache          atomic.Value
 	ringhash            string
 }
 
+type shardRangeCache struct {
+	ranges  []*ShardRange
+	updated time.Time
+}
+
 var _ Container = &sqliteContainer{}
 
 func (db *sqliteContainer) connect() error {
@@ -135,22 +141,50 @@ func (db *sqliteContainer) GetInfo() (*ContainerInfo, error) {
 		return info, nil
 	}
 	info := &ContainerInfo{updated: time.Now()}
+	var shardObjectCount, shardBytesUsed, activeRanges int64
+	// objects that have been moved into active shards still count towards the container's totals.
 	row := db.QueryRow(`SELECT cs.account, cs.container, cs.created_at, cs.put_timestamp,
 							cs.delete_timestamp, cs.status_changed_at,
 							cs.object_count, cs.bytes_used,
 							cs.reported_put_timestamp, cs.reported_delete_timestamp,
 							cs.reported_object_count, cs.reported_bytes_used, cs.hash,
 							cs.id, cs.x_container_sync_point1, cs.x_container_sync_point2,
-							cs.storage_policy_index, cs.metadata, maxrowid.max
-						FROM container_stat cs, maxrowid`)
+							cs.storage_policy_index, cs.metadata, maxrowid.max,
+							(SELECT IFNULL(SUM(object_count), 0) FROM shard_range WHERE state = ?),
+							(SELECT IFNULL(SUM(bytes_used), 0) FROM shard_range WHERE state = ?),
+							(SELECT COUNT(*) FROM shard_range WHERE state = ?)
+						FROM container_stat cs, maxrowid`, ShardRangeActive, ShardRangeActive, ShardRangeActive)
 	if err := row.Scan(&info.Account, &info.Container, &info.CreatedAt, &info.PutTimestamp,
 		&info.DeleteTimestamp, &info.StatusChangedAt, &info.ObjectCount,
 		&info.BytesUsed, &info.ReportedPutTimestamp, &info.ReportedDeleteTimestamp,
 		&info.ReportedObjectCount, &info.ReportedBytesUsed, &info.Hash,
 		&info.ID, &info.XContainerSyncPoint1, &info.XContainerSyncPoint2,
-		&info.StoragePolicyIndex, &info.RawMetadata, &info.MaxRow); err != nil {
+		&info.StoragePolicyIndex, &info.RawMetadata, &info.MaxRow,
+		&shardObjectCount, &shardBytesUsed, &activeRanges); err != nil {
 		return nil, err
 	}
+	info.ObjectCount += shardObjectCount
+	info.BytesUsed += shardBytesUsed
+	// rows cleaved into an active shard stay here until they're removed, but they're counted by the shard's stats now.
+	if activeRanges > 0 {
+		ranges, err := db.ShardRanges()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ranges {
+			if r.State != ShardRangeActive {
+				continue
+			}
+			var count, size int64
+			wheres, args := shardRangeWheres(r.Lower, r.Upper)
+			if err := db.QueryRow("SELECT COUNT(*), IFNULL(SUM(size), 0) FROM object WHERE deleted = 0 AND storage_policy_index = ? AND "+wheres,
+				append([]interface{}{info.StoragePolicyIndex}, args...)...).Scan(&count, &size); err != nil {
+				return nil, err
+			}
+			info.ObjectCount -= count
+			info.BytesUsed -= size
+		}
+	}
 	if info.RawMetadata == "" {
 		info.Metadata = make(map[string][]string)
 	} else if err := json.Unmarshal([]byte(info.RawMetadata), &info.Metadata); err != nil {
@@ -162,6 +196,7 @@ func (db *sqliteContainer) GetInfo() (*ContainerInfo, error) {
 
 func (db *sqliteContainer) invalidateCache() {
 	db.infoCache.Store(&ContainerInfo{invalid: true})
+	db.shardCache.Store(&shardRangeCache{})
 }
 
 // IsDeleted returns true if the container is deleted - if its delete timestamp is later than its put timestamp.
@@ -415,6 +450,10 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 			if err := rows.Scan(&record.Name, &record.LastModified, &record.Size, &record.ContentType, &record.ETag); err != nil {
 				return nil, err
 			}
+			if i := strings.LastIndex(record.ContentType, symlinkPathParam); i >= 0 {
+				record.SymlinkPath = record.ContentType[i+len(symlinkPathParam):]
+				record.ContentType = record.ContentType[:i]
+			}
 			point = record.Name
 			if delimiter != "" {
 				if path != nil && record.Name == *path {
@@ -495,6 +534,139 @@ func (db *sqliteContainer) ItemsSince(start int64, count int) ([]*ObjectRecord,
 	return records, nil
 }
 
+// ItemsInRange returns (count) object records, including tombstones, with names in the range (lower, upper].
+func (db *sqliteContainer) ItemsInRange(lower, upper string, count int) ([]*ObjectRecord, error) {
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	wheres, args := shardRangeWheres(lower, upper)
+	rows, err := db.Query(`SELECT ROWID, name, created_at, size, content_type, etag, deleted, storage_policy_index
+						   FROM object WHERE `+wheres+` ORDER BY name LIMIT ?`, append(args, count)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []*ObjectRecord{}
+	for rows.Next() {
+		r := &ObjectRecord{}
+		if err := rows.Scan(&r.Rowid, &r.Name, &r.CreatedAt, &r.Size, &r.ContentType, &r.ETag, &r.Deleted, &r.StoragePolicyIndex); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// RemoveItems deletes the given object records, once they've been moved to a shard.  Records are matched by ROWID, so
+// any newer record for the same object is left alone.
+func (db *sqliteContainer) RemoveItems(records []*ObjectRecord) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	dst, err := tx.Prepare("DELETE FROM object WHERE ROWID = ?")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	for _, record := range records {
+		if _, err := dst.Exec(record.Rowid); err != nil {
+			return err
+		}
+	}
+	defer db.invalidateCache()
+	return tx.Commit()
+}
+
+func shardRangeWheres(lower, upper string) (string, []interface{}) {
+	wheres := []string{"1"}
+	args := []interface{}{}
+	if lower != "" {
+		wheres = append(wheres, "name > ?")
+		args = append(args, lower)
+	}
+	if upper != "" {
+		wheres = append(wheres, "name <= ?")
+		args = append(args, upper)
+	}
+	return strings.Join(wheres, " AND "), args
+}
+
+// ShardRanges returns the container's shard ranges, ordered by lower bound.  The returned ranges are shared with the
+// cache and must not be modified.
+func (db *sqliteContainer) ShardRanges() ([]*ShardRange, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	if cache, ok := db.shardCache.Load().(*shardRangeCache); ok && time.Since(cache.updated) < infoCacheTimeout {
+		return cache.ranges, nil
+	}
+	cache := &shardRangeCache{updated: time.Now()}
+	rows, err := db.Query(`SELECT name, lower, upper, timestamp, state, object_count, bytes_used, stats_timestamp
+						   FROM shard_range ORDER BY lower`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &ShardRange{}
+		if err := rows.Scan(&r.Name, &r.Lower, &r.Upper, &r.Timestamp, &r.State, &r.ObjectCount, &r.BytesUsed, &r.StatsTimestamp); err != nil {
+			return nil, err
+		}
+		cache.ranges = append(cache.ranges, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	db.shardCache.Store(cache)
+	return cache.ranges, nil
+}
+
+// MergeShardRanges merges shard ranges into the container.  A range's bounds and state are taken from whichever copy
+// has the newest timestamp, and its stats from whichever has the newest stats timestamp.
+func (db *sqliteContainer) MergeShardRanges(ranges []*ShardRange) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range ranges {
+		var timestamp, statsTimestamp string
+		err := tx.QueryRow("SELECT timestamp, stats_timestamp FROM shard_range WHERE name = ?", r.Name).Scan(&timestamp, &statsTimestamp)
+		if err == sql.ErrNoRows {
+			if _, err := tx.Exec(`INSERT INTO shard_range (name, lower, upper, timestamp, state, object_count, bytes_used, stats_timestamp)
+								  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				r.Name, r.Lower, r.Upper, r.Timestamp, r.State, r.ObjectCount, r.BytesUsed, r.StatsTimestamp); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if r.Timestamp > timestamp {
+			if _, err := tx.Exec("UPDATE shard_range SET lower = ?, upper = ?, timestamp = ?, state = ? WHERE name = ?",
+				r.Lower, r.Upper, r.Timestamp, r.State, r.Name); err != nil {
+				return err
+			}
+		}
+		if r.StatsTimestamp > statsTimestamp {
+			if _, err := tx.Exec("UPDATE shard_range SET object_count = ?, bytes_used = ?, stats_timestamp = ? WHERE name = ?",
+				r.ObjectCount, r.BytesUsed, r.StatsTimestamp, r.Name); err != nil {
+				return err
+			}
+		}
+	}
+	defer db.invalidateCache()
+	return tx.Commit()
+}
+
 // GetMetadata returns the current container metadata as a simple map[string]string, i.e. it leaves out tombstones and timestamps.
 func (db *sqliteContainer) GetMetadata() (map[string]string, error) {
 	info, err := db.GetInfo()
@@ -1005,7 +1177,7 @@ func sqliteCreateContainer(containerFile string, account string, container strin
 	}
 	defer tx.Rollback()
 	if _, err := tx.Exec(objectTableScript + policyStatTableScript + policyStatTriggerScript +
-		containerInfoTableScript + containerStatViewScript + syncTableScript); err != nil {
+		containerInfoTableScript + containerStatViewScript + syncTableScript + shardRangeTableScript); err != nil {
 		return err
 	}
 	if _, err := tx.Exec(`INSERT INTO container_info (account, container, created_at, id, put_timestamp,
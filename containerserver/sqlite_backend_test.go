@@ -180,6 +180,23 @@ func TestContainerMarkers(t *testing.T) {
 	require.Equal(t, "d", records[1].(*ObjectListingRecord).Name)
 }
 
+func TestContainerSymlinkPath(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.MergeItems([]*ObjectRecord{
+		{Name: "link", CreatedAt: common.GetTimestamp(), ContentType: "application/symlink;symlink_path=/v1/a/c/o%3B1"},
+		{Name: "obj", CreatedAt: common.GetTimestamp(), ContentType: "text/plain"},
+	}, ""))
+	records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "application/symlink", records[0].(*ObjectListingRecord).ContentType)
+	require.Equal(t, "/v1/a/c/o%3B1", records[0].(*ObjectListingRecord).SymlinkPath)
+	require.Equal(t, "text/plain", records[1].(*ObjectListingRecord).ContentType)
+	require.Equal(t, "", records[1].(*ObjectListingRecord).SymlinkPath)
+}
+
 func TestContainerReverse(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("100000000.00000")
 	require.Nil(t, err)
@@ -480,6 +497,88 @@ func TestItemsSince(t *testing.T) {
 	require.Equal(t, 7, len(objs))
 }
 
+func TestItemsInRangeAndRemoveItems(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c", "d", "e", "f"}))
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "c", CreatedAt: "20000000.00001", Deleted: 1}}, ""))
+
+	objs, err := db.ItemsInRange("b", "d", 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(objs))
+	require.Equal(t, "c", objs[0].Name)
+	require.Equal(t, 1, objs[0].Deleted)
+	require.Equal(t, "d", objs[1].Name)
+
+	objs, err = db.ItemsInRange("", "b", 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(objs))
+	objs, err = db.ItemsInRange("d", "", 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "e", objs[0].Name)
+
+	require.Nil(t, db.RemoveItems(objs))
+	objs, err = db.ItemsInRange("d", "", 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "f", objs[0].Name)
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(4), info.ObjectCount)
+}
+
+func TestMergeShardRanges(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+
+	ranges, err := db.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ranges))
+
+	require.Nil(t, db.MergeShardRanges([]*ShardRange{
+		{Name: "c-1", Lower: "m", Upper: "", Timestamp: "200000001.00000", State: ShardRangeCreated},
+		{Name: "c-0", Lower: "", Upper: "m", Timestamp: "200000001.00000", State: ShardRangeCreated},
+	}))
+	ranges, err = db.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ranges))
+	require.Equal(t, "c-0", ranges[0].Name)
+	require.Equal(t, "c-1", ranges[1].Name)
+	require.True(t, ranges[0].Includes("m"))
+	require.False(t, ranges[1].Includes("m"))
+	require.True(t, ranges[1].Includes("z"))
+
+	// an older state change is ignored, but newer stats are kept.
+	require.Nil(t, db.MergeShardRanges([]*ShardRange{
+		{Name: "c-0", Lower: "", Upper: "m", Timestamp: "200000002.00000", State: ShardRangeActive},
+		{Name: "c-1", Lower: "m", Upper: "", Timestamp: "200000000.00000", State: ShardRangeActive,
+			ObjectCount: 7, BytesUsed: 70, StatsTimestamp: "200000003.00000"},
+	}))
+	ranges, err = db.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, ShardRangeActive, ranges[0].State)
+	require.Equal(t, ShardRangeCreated, ranges[1].State)
+	require.Equal(t, int64(7), ranges[1].ObjectCount)
+
+	// only active shards count towards the container's totals, and rows already in an active shard aren't counted
+	// again while they wait to be removed.
+	require.Nil(t, mergeItemsByName(db, []string{"a", "n"}))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(1), info.ObjectCount)
+	require.Nil(t, db.MergeShardRanges([]*ShardRange{
+		{Name: "c-1", Lower: "m", Upper: "", Timestamp: "200000004.00000", State: ShardRangeActive},
+	}))
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(7), info.ObjectCount)
+	require.Equal(t, int64(70), info.BytesUsed)
+}
+
 func TestMergeSyncTable(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("200000000.00000")
 	require.Nil(t, err)
@@ -446,6 +446,13 @@ func ReconHandler(driveRoot string, writer http.ResponseWriter, request *http.Re
 			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+	case "failed":
+		var err error
+		content, err = fromReconCache("drive", "failed_devices")
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 	default:
 		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
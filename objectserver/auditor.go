@@ -42,6 +42,7 @@ type AuditorDaemon struct {
 	checkMounts       bool
 	driveRoot         string
 	policies          conf.PolicyList
+	objEngines        map[int]ObjectEngine
 	logger            srv.LowLevelLogger
 	bytesPerSecond    int64
 	logTime           int64
@@ -142,63 +143,40 @@ func auditHash(hashPath string, skipMd5 bool) (bytesProcessed int64, err error)
 	return bytesProcessed, nil
 }
 
-// auditSuffix directory.  Lists hash dirs, calls auditHash() for each, and quarantines any with errors.
-func (a *Auditor) auditSuffix(suffixDir string) {
-	hashes, err := fs.ReadDirNames(suffixDir)
+// auditPartition lists the objects in a partition, audits each one and quarantines any with errors.
+func (a *Auditor) auditPartition(engine ReplicationEngine, partitionDir string) {
+	hashDirs, err := engine.ListObjectHashes(partitionDir, a)
 	if err != nil {
 		a.errors++
 		a.totalErrors++
-		a.LogError("Error reading suffix dir %s", suffixDir)
+		a.LogError("Error reading partition dir %s", partitionDir)
 		return
 	}
-	for _, hash := range hashes {
-		_, hexErr := hex.DecodeString(hash)
-		hashDir := filepath.Join(suffixDir, hash)
-		if finfo, err := os.Stat(hashDir); err != nil || len(hash) != 32 || hexErr != nil || !finfo.Mode().IsDir() {
-			a.LogError("Skipping invalid file in suffix: %s", hashDir)
-			continue
-		}
+	for _, hashDir := range hashDirs {
 		a.passes++
 		a.totalPasses++
-		bytesProcessed, err := auditHash(hashDir, a.auditorType == "ZBF")
+		bytesProcessed, err := engine.AuditHash(hashDir, a.auditorType == "ZBF")
 		a.bytesProcessed += bytesProcessed
 		a.totalBytes += bytesProcessed
 		rateLimitSleep(a.passStart, a.totalPasses, a.filesPerSecond)
 		rateLimitSleep(a.passStart, a.totalBytes, a.bytesPerSecond)
 		if err != nil {
 			a.LogError("%s failed audit and is being quarantined: %v", hashDir, err)
-			QuarantineHash(hashDir)
-			InvalidateHash(hashDir)
+			engine.QuarantineHash(hashDir)
 			a.quarantines++
 			a.totalQuarantines++
 		}
-	}
-}
-
-// auditPartition directory.  Lists suffixes in the partition and calls auditSuffix() for each.
-func (a *Auditor) auditPartition(partitionDir string) {
-	suffixes, err := fs.ReadDirNames(partitionDir)
-	if err != nil {
-		a.errors++
-		a.totalErrors++
-		a.LogError("Error reading partition dir %s", partitionDir)
-		return
-	}
-	for _, suffix := range suffixes {
-		suffixDir := filepath.Join(partitionDir, suffix)
-		if suffix == ".lock" || suffix == "hashes.pkl" {
-			continue
-		}
-		_, hexErr := strconv.ParseInt(suffix, 16, 64)
-		if finfo, err := os.Stat(suffixDir); err != nil || len(suffix) != 3 || hexErr != nil || !finfo.Mode().IsDir() {
-			a.LogError("Skipping invalid file in partition: %s", suffixDir)
-			continue
-		}
-		a.auditSuffix(suffixDir)
 		if time.Since(a.lastLog) > (time.Duration(a.logTime) * time.Second) {
 			a.statsReport()
 		}
 	}
+	if compactor, ok := engine.(CompactingEngine); ok {
+		if err := compactor.Compact(partitionDir); err != nil {
+			a.errors++
+			a.totalErrors++
+			a.LogError("Error compacting partition %s: %v", partitionDir, err)
+		}
+	}
 }
 
 // auditDevice, checking for mount, list partitions, then call auditPartition() for each.
@@ -211,11 +189,12 @@ func (a *Auditor) auditDevice(devPath string) {
 	}
 
 	for _, policy := range a.policies {
-		if policy.Type != "replication" {
+		engine, ok := a.objEngines[policy.Index].(ReplicationEngine)
+		if policy.Type != "replication" || !ok {
 			continue
 		}
 		objPath := filepath.Join(devPath, PolicyDir(policy.Index))
-		partitions, err := fs.ReadDirNames(objPath)
+		partitions, err := engine.ListPartitions(objPath, a)
 		if err != nil {
 			a.errors++
 			a.totalErrors++
@@ -223,13 +202,7 @@ func (a *Auditor) auditDevice(devPath string) {
 			continue
 		}
 		for _, partition := range partitions {
-			_, intErr := strconv.ParseInt(partition, 10, 64)
-			partitionDir := filepath.Join(objPath, partition)
-			if finfo, err := os.Stat(partitionDir); err != nil || intErr != nil || !finfo.Mode().IsDir() {
-				a.LogError("Skipping invalid file in objects directory: %s", partitionDir)
-				continue
-			}
-			a.auditPartition(partitionDir)
+			a.auditPartition(engine, filepath.Join(objPath, partition))
 		}
 	}
 }
@@ -310,6 +283,11 @@ func (a *AuditorDaemon) LogInfo(format string, args ...interface{}) {
 	a.logger.Info(fmt.Sprintf(format, args...))
 }
 
+// LogDebug with AuditorDaemon
+func (a *AuditorDaemon) LogDebug(format string, args ...interface{}) {
+	a.logger.Debug(fmt.Sprintf(format, args...))
+}
+
 // LogPanics with AuditorDaemon
 func (a *AuditorDaemon) LogPanics(m string) {
 	if e := recover(); e != nil {
@@ -351,6 +329,9 @@ func NewAuditor(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, error)
 	}
 	d := &AuditorDaemon{}
 	d.policies = conf.LoadPolicies()
+	if d.objEngines, err = buildObjectEngines(serverconf, flags, d.policies); err != nil {
+		return nil, err
+	}
 	d.driveRoot = serverconf.GetDefault("object-auditor", "devices", "/srv/node")
 	d.checkMounts = serverconf.GetBool("object-auditor", "mount_check", true)
 	if d.logger, err = srv.SetupLogger(serverconf, flags, "app:object-auditor", "object-auditor"); err != nil {
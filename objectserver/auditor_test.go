@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -213,34 +214,7 @@ func TestFailsWithoutSection(t *testing.T) {
 	assert.True(t, strings.HasPrefix(err.Error(), "Unable to find object-auditor"))
 }
 
-func TestAuditSuffixNotDir(t *testing.T) {
-	auditor := makeAuditor()
-	auditor.logger = &auditLogSaver{}
-	file, _ := ioutil.TempFile("", "")
-	defer file.Close()
-	defer os.RemoveAll(file.Name())
-	errors := auditor.errors
-	auditor.auditSuffix(file.Name())
-	assert.True(t, strings.HasPrefix(auditor.logger.(*auditLogSaver).logged[0], "Error reading suffix dir"))
-	assert.True(t, auditor.errors > errors)
-}
-
-func TestAuditSuffixPasses(t *testing.T) {
-	dir, _ := ioutil.TempDir("", "")
-	defer os.RemoveAll(dir)
-	os.MkdirAll(filepath.Join(dir, "abc", "fffffffffffffffffffffffffffffabc"), 0777)
-	f, _ := os.Create(filepath.Join(dir, "abc", "fffffffffffffffffffffffffffffabc", "12345.data"))
-	defer f.Close()
-	WriteMetadata(f.Fd(), map[string]string{"Content-Length": "12", "ETag": "d3ac5112fe464b81184352ccba743001", "name": "", "Content-Type": "", "X-Timestamp": ""})
-	f.Write([]byte("testcontents"))
-	auditor := makeAuditor()
-	totalPasses := auditor.totalPasses
-	auditor.auditSuffix(filepath.Join(dir, "abc"))
-	assert.Equal(t, totalPasses+1, auditor.totalPasses)
-	assert.Equal(t, int64(12), auditor.totalBytes)
-}
-
-func TestAuditSuffixQuarantine(t *testing.T) {
+func TestAuditPartitionQuarantine(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(dir)
 	os.MkdirAll(filepath.Join(dir, "objects", "1", "abc", "fffffffffffffffffffffffffffffabc"), 0777)
@@ -248,20 +222,24 @@ func TestAuditSuffixQuarantine(t *testing.T) {
 	defer f.Close()
 	auditor := makeAuditor()
 	totalQuarantines := auditor.totalQuarantines
-	auditor.auditSuffix(filepath.Join(dir, "objects", "1", "abc"))
+	auditor.auditPartition(&SwiftObjectFactory{}, filepath.Join(dir, "objects", "1"))
 	assert.Equal(t, totalQuarantines+1, auditor.totalQuarantines)
 	quarfiles, err := ioutil.ReadDir(filepath.Join(dir, "quarantined"))
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(quarfiles))
 }
 
-func TestAuditSuffixSkipsBad(t *testing.T) {
+func TestAuditPartitionSkipsBadHash(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(dir)
 	os.MkdirAll(filepath.Join(dir, "objects", "1", "abc", "notavalidhash"), 0777)
 	auditor := makeAuditor()
-	auditor.auditSuffix(filepath.Join(dir, "objects", "1", "abc"))
-	assert.True(t, strings.HasPrefix(auditor.logger.(*auditLogSaver).logged[0], "Skipping invalid file in suffix"))
+	totalPasses := auditor.totalPasses
+	auditor.auditPartition(&SwiftObjectFactory{}, filepath.Join(dir, "objects", "1"))
+	assert.Equal(t, totalPasses, auditor.totalPasses)
+	assert.Equal(t, int64(0), auditor.totalQuarantines)
+	assert.Equal(t, []string{"Skipping invalid file in suffix: " + filepath.Join(dir, "objects", "1", "abc", "notavalidhash")},
+		auditor.logger.(*auditLogSaver).logged)
 }
 
 func TestAuditPartitionNotDir(t *testing.T) {
@@ -271,7 +249,7 @@ func TestAuditPartitionNotDir(t *testing.T) {
 	defer file.Close()
 	defer os.RemoveAll(file.Name())
 	errors := auditor.errors
-	auditor.auditPartition(file.Name())
+	auditor.auditPartition(&SwiftObjectFactory{}, file.Name())
 	assert.True(t, strings.HasPrefix(auditor.logger.(*auditLogSaver).logged[0], "Error reading partition dir"))
 	assert.True(t, auditor.errors > errors)
 }
@@ -286,7 +264,7 @@ func TestAuditPartitionPasses(t *testing.T) {
 	f.Write([]byte("testcontents"))
 	auditor := makeAuditor()
 	totalPasses := auditor.totalPasses
-	auditor.auditPartition(filepath.Join(dir, "1"))
+	auditor.auditPartition(&SwiftObjectFactory{}, filepath.Join(dir, "1"))
 	assert.Equal(t, totalPasses+1, auditor.totalPasses)
 	assert.Equal(t, int64(12), auditor.totalBytes)
 }
@@ -306,9 +284,35 @@ func TestAuditPartitionSkipsBadData(t *testing.T) {
 	f.Write([]byte("testcontents"))
 	auditor := makeAuditor()
 	totalPasses := auditor.totalPasses
-	auditor.auditPartition(filepath.Join(dir, "1"))
+	auditor.auditPartition(&SwiftObjectFactory{}, filepath.Join(dir, "1"))
 	assert.Equal(t, totalPasses+1, auditor.totalPasses)
 	assert.Equal(t, int64(12), auditor.totalBytes)
+	assert.Equal(t, "Skipping invalid file in partition: "+filepath.Join(dir, "1", "xyz"), auditor.logger.(*auditLogSaver).logged[0])
+}
+
+func TestAuditPartitionCompacts(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	f := newTestPackedFactory(driveRoot)
+	defer f.Close()
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	for _, timestamp := range []string{"1234567890.000000", "1234567891.000000"} {
+		var wg sync.WaitGroup
+		o, err := f.New(vars, false, &wg)
+		require.Nil(t, err)
+		w, err := o.SetData(12)
+		require.Nil(t, err)
+		w.Write([]byte("testcontents"))
+		require.Nil(t, o.Commit(map[string]string{"Content-Length": "12", "Content-Type": "text/plain", "name": "/a/c/o",
+			"ETag": "d3ac5112fe464b81184352ccba743001", "X-Timestamp": timestamp}))
+	}
+	before := volumeSize(t, f, "sda", "1")
+	auditor := makeAuditor()
+	auditor.auditPartition(f, filepath.Join(f.policyDir("sda"), "1"))
+	require.Equal(t, int64(0), auditor.totalQuarantines)
+	require.Equal(t, int64(1), auditor.totalPasses)
+	require.True(t, volumeSize(t, f, "sda", "1") < before)
 }
 
 func TestAuditDeviceNotDir(t *testing.T) {
@@ -352,6 +356,8 @@ func TestAuditDeviceSkipsBadData(t *testing.T) {
 	auditor.auditDevice(filepath.Join(dir, "sda"))
 	assert.Equal(t, totalPasses+1, auditor.totalPasses)
 	assert.Equal(t, int64(12), auditor.totalBytes)
+	assert.Contains(t, auditor.logger.(*auditLogSaver).logged,
+		"Skipping invalid file in objects directory: "+filepath.Join(dir, "sda", "objects", "X"))
 }
 
 func TestAuditDeviceUnmounted(t *testing.T) {
@@ -93,6 +93,10 @@ func ReadMetadata(fileNameOrFd interface{}) (map[string]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	return unpickleMetadata(pickledMetadata)
+}
+
+func unpickleMetadata(pickledMetadata []byte) (map[string]string, error) {
 	v, err := pickle.PickleLoads(pickledMetadata)
 	if err != nil {
 		return nil, err
@@ -353,10 +357,15 @@ func GetHashes(driveRoot string, device string, partition string, recalculate []
 	return hashes, nil
 }
 
-func ObjHashDir(vars map[string]string, driveRoot string, hashPathPrefix string, hashPathSuffix string, policy int) string {
+// ObjHash returns the hex md5 that identifies an object on disk, given its account, container and obj vars.
+func ObjHash(vars map[string]string, hashPathPrefix string, hashPathSuffix string) string {
 	h := md5.New()
 	io.WriteString(h, hashPathPrefix+"/"+vars["account"]+"/"+vars["container"]+"/"+vars["obj"]+hashPathSuffix)
-	hexHash := hex.EncodeToString(h.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func ObjHashDir(vars map[string]string, driveRoot string, hashPathPrefix string, hashPathSuffix string, policy int) string {
+	hexHash := ObjHash(vars, hashPathPrefix, hashPathSuffix)
 	suffix := hexHash[29:32]
 	return filepath.Join(driveRoot, vars["device"], PolicyDir(policy), vars["partition"], suffix, hexHash)
 }
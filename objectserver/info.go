@@ -0,0 +1,179 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// policyFromPath finds the policy from the objects directory in a data file's path, e.g. /srv/node/sda/objects-1/...
+func policyFromPath(dataFile string) int {
+	for _, part := range strings.Split(filepath.ToSlash(dataFile), "/") {
+		if strings.HasPrefix(part, "objects") {
+			if policy, err := UnPolicyDir(part); err == nil {
+				return policy
+			}
+		}
+	}
+	return 0
+}
+
+func formatTimestamp(timestamp string) string {
+	if t, err := strconv.ParseFloat(timestamp, 64); err == nil {
+		return fmt.Sprintf("%s (%s)", time.Unix(0, int64(t*float64(time.Second))).UTC().Format("2006-01-02T15:04:05.000000"), timestamp)
+	}
+	return timestamp
+}
+
+func printMetadataSection(w io.Writer, title string, metadata map[string]string) {
+	fmt.Fprintf(w, "%s:\n", title)
+	if len(metadata) == 0 {
+		fmt.Fprintf(w, "  No metadata found\n")
+		return
+	}
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s: %s\n", k, metadata[k])
+	}
+}
+
+// printObjectInfo writes out everything we know about a .data (or .ts or .meta) file.  If objRing is nil, the ring
+// locations are left out.
+func printObjectInfo(w io.Writer, dataFile string, objRing ring.Ring, hashPathPrefix, hashPathSuffix string, policy int) error {
+	metadata, err := ReadMetadata(dataFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read metadata from %s: %v", dataFile, err)
+	}
+	parts := strings.SplitN(metadata["name"], "/", 4)
+	if len(parts) != 4 || parts[0] != "" {
+		return fmt.Errorf("Invalid object name %q in metadata", metadata["name"])
+	}
+	vars := map[string]string{"account": parts[1], "container": parts[2], "obj": parts[3]}
+	hash := filepath.Base(ObjHashDir(vars, "", hashPathPrefix, hashPathSuffix, policy))
+
+	fmt.Fprintf(w, "Path: %s\n", metadata["name"])
+	fmt.Fprintf(w, "  Account: %s\n", vars["account"])
+	fmt.Fprintf(w, "  Container: %s\n", vars["container"])
+	fmt.Fprintf(w, "  Object: %s\n", vars["obj"])
+	fmt.Fprintf(w, "  Object hash: %s\n", hash)
+	if dirHash := filepath.Base(filepath.Dir(dataFile)); dirHash != hash {
+		fmt.Fprintf(w, "  !! File is in hash directory %s, which doesn't match the object name\n", dirHash)
+	}
+	fmt.Fprintf(w, "Content-Type: %s\n", metadata["Content-Type"])
+	fmt.Fprintf(w, "Timestamp: %s\n", formatTimestamp(metadata["X-Timestamp"]))
+	systemMeta := map[string]string{}
+	userMeta := map[string]string{}
+	otherMeta := map[string]string{}
+	for k, v := range metadata {
+		switch {
+		case k == "name" || k == "Content-Type" || k == "X-Timestamp" || k == "ETag" || k == "Content-Length":
+		case strings.HasPrefix(k, "X-Object-Sysmeta-"):
+			systemMeta[k] = v
+		case strings.HasPrefix(k, "X-Object-Meta-"):
+			userMeta[k] = v
+		default:
+			otherMeta[k] = v
+		}
+	}
+	printMetadataSection(w, "System Metadata", systemMeta)
+	printMetadataSection(w, "User Metadata", userMeta)
+	printMetadataSection(w, "Other Metadata", otherMeta)
+
+	if strings.HasSuffix(dataFile, ".data") {
+		fp, err := os.Open(dataFile)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		h := md5.New()
+		size, err := io.Copy(h, fp)
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %v", dataFile, err)
+		}
+		if etag := fmt.Sprintf("%x", h.Sum(nil)); etag == metadata["ETag"] {
+			fmt.Fprintf(w, "ETag: %s (valid)\n", etag)
+		} else {
+			fmt.Fprintf(w, "ETag: %s doesn't match file's computed ETag %s\n", metadata["ETag"], etag)
+		}
+		if length := strconv.FormatInt(size, 10); length == metadata["Content-Length"] {
+			fmt.Fprintf(w, "Content-Length: %s (valid)\n", length)
+		} else {
+			fmt.Fprintf(w, "Content-Length: %s doesn't match file length of %s\n", metadata["Content-Length"], length)
+		}
+	}
+
+	if objRing == nil {
+		return nil
+	}
+	partition := objRing.GetPartition(vars["account"], vars["container"], vars["obj"])
+	fmt.Fprintf(w, "Partition\t%d\n", partition)
+	fmt.Fprintf(w, "Hash     \t%s\n", hash)
+	path := common.Urlencode(vars["account"]) + "/" + common.Urlencode(vars["container"]) + "/" + common.Urlencode(vars["obj"])
+	ring.PrintLocations(w, objRing, partition, path, PolicyDir(policy), hash[29:32]+"/"+hash, policy)
+	return nil
+}
+
+// ObjectInfoCmd prints the decoded metadata of an object file, checks its ETag, and shows where the ring puts it.
+func ObjectInfoCmd(args []string) {
+	flags := flag.NewFlagSet("object-info", flag.ExitOnError)
+	policy := flags.Int("p", -1, "policy index to use (default: from the file's path)")
+	noLocations := flags.Bool("n", false, "don't print the ring locations")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird object-info [path to .data file]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(flags.Args()) != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *policy < 0 {
+		*policy = policyFromPath(flags.Arg(0))
+	}
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Println("Unable to load hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	var objRing ring.Ring
+	if !*noLocations {
+		if objRing, err = ring.GetRing("object", hashPathPrefix, hashPathSuffix, *policy); err != nil {
+			fmt.Println("Unable to load object ring:", err)
+			os.Exit(1)
+		}
+	}
+	if err := printObjectInfo(os.Stdout, flags.Arg(0), objRing, hashPathPrefix, hashPathSuffix, *policy); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,84 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestPrintObjectInfo(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda", "partition": "0"}
+	hashDir := ObjHashDir(vars, driveRoot, "prefix", "suffix", 1)
+	require.Nil(t, os.MkdirAll(hashDir, 0755))
+	dataFile := filepath.Join(hashDir, "1500000000.00000.data")
+	fp, err := os.Create(dataFile)
+	require.Nil(t, err)
+	fp.Write([]byte("testbody"))
+	require.Nil(t, WriteMetadata(fp.Fd(), map[string]string{
+		"name":                  "/a/c/o",
+		"Content-Type":          "text/plain",
+		"Content-Length":        "8",
+		"ETag":                  "d3c685489f2c3b2ba1f251ba5c9effff",
+		"X-Timestamp":           "1500000000.00000",
+		"X-Object-Meta-Color":   "blue",
+		"X-Object-Sysmeta-Test": "yes",
+	}))
+	fp.Close()
+	assert.Equal(t, 1, policyFromPath(dataFile))
+
+	devs := []*ring.Device{
+		{Ip: "127.0.0.1", Port: 6010, Device: "sda"},
+		{Ip: "127.0.0.2", Port: 6010, Device: "sdb"},
+		{Ip: "127.0.0.3", Port: 6010, Device: "sdc"},
+	}
+	fakeRing := &test.FakeRing{MockDevices: devs, MockMoreNodes: &ring.Device{Ip: "::1", Port: 6010, Device: "sdd"}}
+	out := &bytes.Buffer{}
+	require.Nil(t, printObjectInfo(out, dataFile, fakeRing, "prefix", "suffix", 1))
+	hash := filepath.Base(hashDir)
+	assert.Contains(t, out.String(), "Path: /a/c/o\n")
+	assert.Contains(t, out.String(), "Object hash: "+hash+"\n")
+	assert.NotContains(t, out.String(), "!!")
+	assert.Contains(t, out.String(), "Timestamp: 2017-07-14T02:40:00.000000 (1500000000.00000)\n")
+	assert.Contains(t, out.String(), "User Metadata:\n  X-Object-Meta-Color: blue\n")
+	assert.Contains(t, out.String(), "System Metadata:\n  X-Object-Sysmeta-Test: yes\n")
+	assert.Contains(t, out.String(), "ETag: d3c685489f2c3b2ba1f251ba5c9effff (valid)\n")
+	assert.Contains(t, out.String(), "Content-Length: 8 (valid)\n")
+	assert.Contains(t, out.String(), `curl -g -I -XHEAD "http://127.0.0.2:6010/sdb/0/a/c/o" -H "X-Backend-Storage-Policy-Index: 1"`+"\n")
+	assert.Contains(t, out.String(), `curl -g -I -XHEAD "http://[::1]:6010/sdd/0/a/c/o" -H "X-Backend-Storage-Policy-Index: 1" # [Handoff]`+"\n")
+	assert.Contains(t, out.String(), `ssh 127.0.0.1 "ls -lah ${DEVICE:-/srv/node*}/sda/objects-1/0/`+hash[29:32]+"/"+hash+`"`+"\n")
+
+	// corrupt the body and make sure we notice.
+	fp, err = os.OpenFile(dataFile, os.O_WRONLY, 0)
+	require.Nil(t, err)
+	fp.Write([]byte("TEST"))
+	fp.Close()
+	out.Reset()
+	require.Nil(t, printObjectInfo(out, dataFile, nil, "prefix", "suffix", 1))
+	assert.Contains(t, out.String(), "ETag: d3c685489f2c3b2ba1f251ba5c9effff doesn't match")
+	assert.NotContains(t, out.String(), "Ring locations")
+}
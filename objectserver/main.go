@@ -45,6 +45,7 @@ type ObjectServer struct {
 	hashPathSuffix   string
 	checkEtags       bool
 	checkMounts      bool
+	failedDevices    *fs.FailedDevices
 	allowedHeaders   map[string]bool
 	logger           srv.LowLevelLogger
 	logLevel         string
@@ -115,6 +116,10 @@ func (server *ObjectServer) ObjGetHandler(writer http.ResponseWriter, request *h
 	ifNoneMatches := parseIfMatch(request.Header.Get("If-None-Match"))
 
 	if !obj.Exists() {
+		// the tombstone's timestamp lets the proxy tell a newer delete from an older copy of the object.
+		if ts := obj.Tombstone(); ts != "" {
+			headers.Set("X-Backend-Timestamp", ts)
+		}
 		if ifMatches["*"] {
 			srv.StandardResponse(writer, http.StatusPreconditionFailed)
 		} else {
@@ -319,6 +324,12 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 			metadata[key] = request.Header.Get(key)
 		}
 	}
+	// the proxy can send sysmeta it only knows once the body has been sent, like an encrypted object's etag, as trailers.
+	for key := range request.Trailer {
+		if strings.HasPrefix(key, "X-Object-Sysmeta-") {
+			metadata[key] = request.Trailer.Get(key)
+		}
+	}
 	requestEtag := strings.ToLower(request.Header.Get("ETag"))
 	if requestEtag != "" && requestEtag != metadata["ETag"] {
 		http.Error(writer, "Unprocessable Entity", 422)
@@ -482,6 +493,11 @@ func (server *ObjectServer) AcquireDevice(next http.Handler) http.Handler {
 					return
 				}
 			}
+			if server.failedDevices.IsFailed(device) {
+				vars["Method"] = request.Method
+				srv.CustomErrorResponse(writer, 507, vars)
+				return
+			}
 
 			forceAcquire := request.Header.Get("X-Force-Acquire") == "true"
 			if concRequests := server.diskInUse.Acquire(device, forceAcquire); concRequests != 0 {
@@ -554,20 +570,13 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	if err != nil {
 		return "", 0, nil, nil, err
 	}
-	server.objEngines = make(map[int]ObjectEngine)
-	for _, policy := range conf.LoadPolicies() {
-		if newEngine, err := FindEngine(policy.Type); err != nil {
-			return "", 0, nil, nil, fmt.Errorf("Unable to find object engine type %s: %v", policy.Type, err)
-		} else {
-			server.objEngines[policy.Index], err = newEngine(serverconf, policy, flags)
-			if err != nil {
-				return "", 0, nil, nil, fmt.Errorf("Error instantiating object engine type %s: %v", policy.Type, err)
-			}
-		}
+	if server.objEngines, err = buildObjectEngines(serverconf, flags, conf.LoadPolicies()); err != nil {
+		return "", 0, nil, nil, err
 	}
 
 	server.driveRoot = serverconf.GetDefault("app:object-server", "devices", "/srv/node")
 	server.checkMounts = serverconf.GetBool("app:object-server", "mount_check", true)
+	server.failedDevices = fs.NewFailedDevices(serverconf.GetDefault("app:object-server", "failed_devices_file", fs.DefaultFailedDevicesFile))
 	server.checkEtags = serverconf.GetBool("app:object-server", "check_etags", false)
 	server.logLevel = serverconf.GetDefault("app:object-server", "log_level", "INFO")
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "disk_limit", 25, 0))
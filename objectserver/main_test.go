@@ -165,6 +165,27 @@ func TestBasicPutGet(t *testing.T) {
 	assert.Equal(t, "9", resp.Header.Get("Content-Length"))
 }
 
+func TestPutTrailers(t *testing.T) {
+	ts, err := makeObjectServer()
+	assert.Nil(t, err)
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), ioutil.NopCloser(strings.NewReader("SOME DATA")))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Trailer = http.Header{"X-Object-Sysmeta-Crypto-Etag": {"encrypted"}, "X-Something-Else": {"ignored"}}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	resp, err = ts.Do("HEAD", "/sda/0/a/c/o", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "encrypted", resp.Header.Get("X-Object-Sysmeta-Crypto-Etag"))
+	assert.Equal(t, "", resp.Header.Get("X-Something-Else"))
+}
+
 func TestBasicPutDelete(t *testing.T) {
 	ts, err := makeObjectServer()
 	assert.Nil(t, err)
@@ -191,6 +212,7 @@ func TestBasicPutDelete(t *testing.T) {
 	resp, err = ts.Do("GET", "/sda/0/a/c/o", nil)
 	assert.Nil(t, err)
 	assert.Equal(t, 404, resp.StatusCode)
+	assert.Equal(t, timestamp, resp.Header.Get("X-Backend-Timestamp"))
 }
 
 func TestGetRanges(t *testing.T) {
@@ -18,10 +18,12 @@ package objectserver
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"sync"
 
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
 )
 
 // DriveFullError can be returned by Object.SetData and Object.Delete if the disk is too full for the operation.
@@ -30,6 +32,8 @@ var DriveFullError = errors.New("Drive Full")
 type Object interface {
 	// Exists determines whether or not there is an object to serve. Deleted objects do not exist, even if there is a tombstone.
 	Exists() bool
+	// Tombstone returns the timestamp of the object's tombstone if its newest record is one, or "" otherwise.
+	Tombstone() string
 	// Quarantine removes the file's data, presumably after determining it's been corrupted.
 	Quarantine() error
 	// Metadata returns the object's metadata.  Will be nil if the object doesn't exist.
@@ -58,6 +62,48 @@ type ObjectEngine interface {
 	New(vars map[string]string, needData bool, asyncWG *sync.WaitGroup) (Object, error)
 }
 
+// ReplicationEngine is an ObjectEngine whose objects can be replicated and audited.  Object files are named by the
+// path they'd have in the swift engine's layout, driveRoot/device/objects-N/partition/suffix/hash/timestamp.ext, which is
+// also how they're identified in the RepConn protocol.  Engines that don't keep a file per object just treat those
+// paths as names.
+type ReplicationEngine interface {
+	ObjectEngine
+	// ListPartitions returns the partitions in objPath, a device's directory for the engine's policy.  Anything there
+	// that isn't a partition is skipped, and logged if logger isn't nil.
+	ListPartitions(objPath string, logger srv.LoggingContext) ([]string, error)
+	// GetHashes returns the suffix hashes for a partition, recalculating any suffixes in recalculate.
+	GetHashes(driveRoot string, device string, partition string, recalculate []string, reclaimAge int64, logger srv.LoggingContext) (map[string]string, error)
+	// ListObjectFiles sends the object files in a partition to objChan, skipping any suffixes needSuffix returns false
+	// for.  It closes objChan when it's done or canceled, and errors listing the partition are logged to logger.
+	ListObjectFiles(objChan chan string, cancel chan struct{}, partitionDir string, needSuffix func(string) bool, logger srv.LoggingContext)
+	// ListObjectHashes returns the hash paths of the objects in a partition.  Anything invalid is skipped, and logged
+	// if logger isn't nil.
+	ListObjectHashes(partitionDir string, logger srv.LoggingContext) ([]string, error)
+	// OpenObjectFile opens an object file to be sent to another server, returning its raw metadata and size.  If the
+	// file fails a quick audit, the error is a quarantineFileError.
+	OpenObjectFile(objFile string) (io.ReadCloser, []byte, int64, error)
+	// CheckObjectFile reports whether an object file, or a newer file for the same object, already exists.
+	CheckObjectFile(objFile string) (exists bool, newerExists bool)
+	// SaveObjectFile stores an object file received from another server, given its raw metadata and size.  Space is
+	// only used if it leaves reserve bytes free, and older tombstones are reclaimed after reclaimAge seconds.
+	SaveObjectFile(objFile string, xattrs []byte, size int64, data io.Reader, reserve int64, reclaimAge int64) error
+	// RemoveObjectFile removes an object file that has been superseded or handed off.
+	RemoveObjectFile(objFile string) error
+	// AuditHash verifies an object's files against their metadata, checking the etag unless skipMd5 is set, and
+	// returns the number of bytes read.
+	AuditHash(hashPath string, skipMd5 bool) (int64, error)
+	// QuarantineHash moves an object's files out of the way, presumably after they've failed an audit.
+	QuarantineHash(hashPath string) error
+}
+
+// CompactingEngine is a ReplicationEngine that leaves the space of removed or superseded objects in place until its
+// partitions are compacted.  The auditor compacts each partition it audits.
+type CompactingEngine interface {
+	ReplicationEngine
+	// Compact reclaims the space of a partition's removed objects.
+	Compact(partitionDir string) error
+}
+
 // ObjectEngineConstructor> is a function that, given configs and flags, returns an ObjectEngine
 type ObjectEngineConstructor func(conf.Config, *conf.Policy, *flag.FlagSet) (ObjectEngine, error)
 
@@ -70,9 +116,9 @@ var engineFactories = []engineFactoryEntry{}
 
 // RegisterObjectEngine lets you tell hummingbird about a new object engine.
 func RegisterObjectEngine(name string, newEngine ObjectEngineConstructor) {
-	for _, e := range engineFactories {
-		if e.name == name {
-			e.constructor = newEngine
+	for i := range engineFactories {
+		if engineFactories[i].name == name {
+			engineFactories[i].constructor = newEngine
 			return
 		}
 	}
@@ -88,3 +134,18 @@ func FindEngine(name string) (ObjectEngineConstructor, error) {
 	}
 	return nil, errors.New("Not found")
 }
+
+// buildObjectEngines creates the object engine for each of the policies, as named by the policy's engine setting.
+func buildObjectEngines(config conf.Config, flags *flag.FlagSet, policies conf.PolicyList) (map[int]ObjectEngine, error) {
+	engines := make(map[int]ObjectEngine)
+	for _, policy := range policies {
+		newEngine, err := FindEngine(policy.Engine)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find object engine %s: %v", policy.Engine, err)
+		}
+		if engines[policy.Index], err = newEngine(config, policy, flags); err != nil {
+			return nil, fmt.Errorf("Error instantiating object engine %s: %v", policy.Engine, err)
+		}
+	}
+	return engines, nil
+}
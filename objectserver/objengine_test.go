@@ -42,3 +42,32 @@ func TestObjectEngineRegistry(t *testing.T) {
 	require.Nil(t, fconstructor)
 	require.NotNil(t, err)
 }
+
+func TestObjectEngineReregister(t *testing.T) {
+	testErr := errors.New("Not implemented")
+	RegisterObjectEngine("test-reregister", func(conf.Config, *conf.Policy, *flag.FlagSet) (ObjectEngine, error) {
+		return nil, nil
+	})
+	RegisterObjectEngine("test-reregister", func(conf.Config, *conf.Policy, *flag.FlagSet) (ObjectEngine, error) {
+		return nil, testErr
+	})
+	fconstructor, err := FindEngine("test-reregister")
+	require.Nil(t, err)
+	_, err = fconstructor(conf.Config{}, nil, nil)
+	require.Equal(t, testErr, err)
+}
+
+func TestBuildObjectEngines(t *testing.T) {
+	policies := conf.PolicyList{
+		0: {Index: 0, Type: "replication", Engine: "swift"},
+		1: {Index: 1, Type: "replication", Engine: "packed", Config: map[string]string{"engine": "packed"}},
+	}
+	engines, err := buildObjectEngines(conf.Config{}, nil, policies)
+	require.Nil(t, err)
+	require.IsType(t, &SwiftObjectFactory{}, engines[0])
+	require.IsType(t, &PackedObjectFactory{}, engines[1])
+
+	policies[1].Engine = "hopefullynotfound"
+	_, err = buildObjectEngines(conf.Config{}, nil, policies)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,1306 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/pickle"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// The packed engine keeps small objects out of the filesystem's inode tables.  Each partition gets a single
+// append-only volume file, and each record in it is a packedHeader followed by the pickled metadata and the object's
+// body.  A sqlite index per device (and policy) maps each object hash and timestamp to its record, so a volume is only
+// ever read at known offsets.  Older records and reclaimed tombstones are left in place until Compact, which the
+// auditor runs on each partition it audits, rewrites the volume.
+//
+// Objects larger than the policy's packed_max_object_size (16KiB by default) are stored the way the swift engine
+// would store them, in hash directories alongside the partition's volume.  Whichever layout has an object's newest
+// record wins, and writing to one layout removes the object's older records from the other.
+//
+// For replication, each record is presented as the file it would have been in the swift engine's layout, e.g.
+// objects-N/partition/suffix/hash/timestamp.data, so suffix hashes and RepConn paths are the same for both engines.
+
+const (
+	packedIndexName         = "packed.db"
+	packedHeaderSize        = 48
+	packedMaxObjectSizeDflt = 16 * 1024
+)
+
+var packedMagic = [4]byte{'H', 'B', 'P', 'K'}
+
+type packedHeader struct {
+	Magic   [4]byte
+	Hash    [32]byte
+	MetaLen uint32
+	DataLen uint64
+}
+
+var packedSchema = `
+	CREATE TABLE IF NOT EXISTS volumes (
+		partition TEXT PRIMARY KEY,
+		volume TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS objects (
+		hash TEXT NOT NULL,
+		partition TEXT NOT NULL,
+		suffix TEXT NOT NULL,
+		timestamp TEXT NOT NULL,
+		deleted INTEGER NOT NULL,
+		offset INTEGER NOT NULL,
+		meta_length INTEGER NOT NULL,
+		data_length INTEGER NOT NULL,
+		metadata BLOB NOT NULL,
+		PRIMARY KEY (hash, timestamp)
+	);
+	CREATE INDEX IF NOT EXISTS objects_partition ON objects (partition, suffix, hash);
+`
+
+// packedRecord is an object's row in the index.
+type packedRecord struct {
+	hash       string
+	timestamp  string
+	deleted    bool
+	offset     int64
+	metaLength int64
+	dataLength int64
+	metadata   []byte
+	volume     string
+}
+
+func (r *packedRecord) length() int64 {
+	return packedHeaderSize + r.metaLength + r.dataLength
+}
+
+// PackedObject implements an Object that is stored in a partition's volume file, or in the swift engine's layout if
+// it's too large for that.
+type PackedObject struct {
+	factory   *PackedObjectFactory
+	vars      map[string]string
+	asyncWG   *sync.WaitGroup
+	objPath   string
+	partition string
+	hash      string
+	record    *packedRecord
+	metadata  map[string]string
+	volume    *os.File
+	data      *io.SectionReader
+	large     *SwiftObject
+	buf       *bytes.Buffer
+	spill     *SwiftObject
+	spillTo   io.Writer
+	deleting  bool
+}
+
+// Metadata returns the object's metadata.
+func (o *PackedObject) Metadata() map[string]string {
+	if o.large != nil {
+		return o.large.Metadata()
+	}
+	return o.metadata
+}
+
+// ContentLength parses and returns the Content-Length for the object.
+func (o *PackedObject) ContentLength() int64 {
+	if o.large != nil {
+		return o.large.ContentLength()
+	}
+	if contentLength, err := strconv.ParseInt(o.metadata["Content-Length"], 10, 64); err != nil {
+		return -1
+	} else {
+		return contentLength
+	}
+}
+
+// Quarantine drops the object from the index and copies its record out to the device's quarantined directory.
+func (o *PackedObject) Quarantine() error {
+	if o.large != nil {
+		return o.large.Quarantine()
+	}
+	o.Close()
+	if o.record == nil {
+		return nil
+	}
+	return o.factory.quarantine(o.objPath, o.partition, o.record)
+}
+
+// Exists returns true if the object exists, that is if its newest record isn't a tombstone.
+func (o *PackedObject) Exists() bool {
+	if o.large != nil {
+		return o.large.Exists()
+	}
+	return o.record != nil && !o.record.deleted
+}
+
+// Tombstone returns the timestamp of the object's newest record if it's a tombstone.
+func (o *PackedObject) Tombstone() string {
+	if o.large != nil {
+		return o.large.Tombstone()
+	}
+	if o.record != nil && o.record.deleted {
+		return o.record.timestamp
+	}
+	return ""
+}
+
+// Copy copies all of the object's data to the given writers.
+func (o *PackedObject) Copy(dsts ...io.Writer) (written int64, err error) {
+	if o.large != nil {
+		return o.large.Copy(dsts...)
+	}
+	if _, err := o.data.Seek(0, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	if len(dsts) == 1 {
+		return io.Copy(dsts[0], o.data)
+	} else {
+		return common.Copy(o.data, dsts...)
+	}
+}
+
+// CopyRange copies data in the range of start to end from the object's data to the writer.
+func (o *PackedObject) CopyRange(w io.Writer, start int64, end int64) (int64, error) {
+	if o.large != nil {
+		return o.large.CopyRange(w, start, end)
+	}
+	if _, err := o.data.Seek(start, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	return common.CopyN(o.data, end-start, w)
+}
+
+// Repr returns a string that identifies the object in some useful way, used for logging.
+func (o *PackedObject) Repr() string {
+	if o.large != nil {
+		return o.large.Repr()
+	}
+	if o.record != nil {
+		return fmt.Sprintf("PackedObject(%s/%s/%s, %s)", o.objPath, o.partition, o.hash, o.record.timestamp)
+	}
+	return fmt.Sprintf("PackedObject(%s/%s/%s)", o.objPath, o.partition, o.hash)
+}
+
+// Write buffers the object's data until Commit appends it to the volume, or passes it on to the swift layout once
+// it's grown past the size limit.
+func (o *PackedObject) Write(p []byte) (int, error) {
+	if o.spillTo == nil && int64(o.buf.Len()+len(p)) > o.factory.maxObjectSize {
+		var err error
+		if o.spillTo, err = o.spillLarge(-1); err != nil {
+			return 0, err
+		}
+		if _, err := o.spillTo.Write(o.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		o.buf = nil
+	}
+	if o.spillTo != nil {
+		return o.spillTo.Write(p)
+	}
+	return o.buf.Write(p)
+}
+
+// spillLarge starts writing the object in the swift layout.
+func (o *PackedObject) spillLarge(size int64) (io.Writer, error) {
+	so, err := o.factory.swift.New(o.vars, false, o.asyncWG)
+	if err != nil {
+		return nil, err
+	}
+	o.spill = so.(*SwiftObject)
+	return o.spill.SetData(size)
+}
+
+// SetData is called to set the object's data.  Objects no larger than the factory's maxObjectSize are held in memory
+// and appended to the volume in one write by Commit, and anything larger is written in the swift layout.
+func (o *PackedObject) SetData(size int64) (io.Writer, error) {
+	o.Close()
+	o.deleting = false
+	if size > o.factory.maxObjectSize {
+		var err error
+		o.spillTo, err = o.spillLarge(size)
+		return o.spillTo, err
+	}
+	if size > 0 && !o.factory.hasSpace(filepath.Dir(o.objPath), size, o.factory.reserve) {
+		return nil, DriveFullError
+	}
+	o.buf = &bytes.Buffer{}
+	return o, nil
+}
+
+// Commit appends the data started with SetData to the partition's volume and indexes it, or saves it in the swift
+// layout if it was too large.  Either way, the object's older records in the other layout are removed.
+func (o *PackedObject) Commit(metadata map[string]string) error {
+	defer o.Close()
+	timestamp, ok := metadata["X-Timestamp"]
+	if !ok {
+		return errors.New("No timestamp in metadata")
+	}
+	if o.spill != nil {
+		if err := o.spill.Commit(metadata); err != nil {
+			return err
+		}
+		return o.factory.removeOlderRecords(o.objPath, o.hash, timestamp+".data")
+	}
+	var data io.Reader
+	var size int64
+	if o.buf != nil {
+		data, size = o.buf, int64(o.buf.Len())
+	} else if !o.deleting {
+		return errors.New("Commit called without SetData")
+	}
+	record := &packedRecord{timestamp: timestamp, deleted: o.deleting}
+	if err := o.factory.append(o.objPath, o.partition, o.hash, timestamp, o.deleting, pickle.PickleDumps(metadata), data, size); err != nil {
+		return err
+	}
+	o.factory.removeOlderFiles(o.objPath, o.partition, o.hash, record.fileName())
+	return nil
+}
+
+// Delete writes a tombstone for the object.
+func (o *PackedObject) Delete(metadata map[string]string) error {
+	o.Close()
+	if !o.factory.hasSpace(filepath.Dir(o.objPath), 0, o.factory.reserve) {
+		return DriveFullError
+	}
+	o.deleting = true
+	return o.Commit(metadata)
+}
+
+// Close releases any resources used by the instance of PackedObject.
+func (o *PackedObject) Close() error {
+	o.buf = nil
+	if o.spill != nil {
+		o.spill.Close()
+		o.spill = nil
+		o.spillTo = nil
+	}
+	if o.large != nil {
+		o.large.Close()
+	}
+	if o.volume != nil {
+		o.volume.Close()
+		o.volume = nil
+		o.data = nil
+	}
+	return nil
+}
+
+// parsePackedFile splits an object file's path into the policy directory, partition and hash, and the timestamp and
+// type of the record it names.
+func parsePackedFile(objFile string) (objPath, partition, hash, timestamp string, deleted bool, err error) {
+	hashDir := filepath.Dir(objFile)
+	partitionDir := filepath.Dir(filepath.Dir(hashDir))
+	objPath, partition, hash = filepath.Dir(partitionDir), filepath.Base(partitionDir), filepath.Base(hashDir)
+	name := filepath.Base(objFile)
+	switch filepath.Ext(name) {
+	case ".data":
+		timestamp = strings.TrimSuffix(name, ".data")
+	case ".ts":
+		timestamp, deleted = strings.TrimSuffix(name, ".ts"), true
+	default:
+		err = fmt.Errorf("Unsupported object file: %s", name)
+	}
+	if len(hash) != 32 {
+		err = fmt.Errorf("Invalid object file path: %s", objFile)
+	}
+	return
+}
+
+func (r *packedRecord) fileName() string {
+	if r.deleted {
+		return r.timestamp + ".ts"
+	}
+	return r.timestamp + ".data"
+}
+
+type packedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// PackedObjectFactory creates PackedObjects, and owns the volume files and indexes they're stored in.
+type PackedObjectFactory struct {
+	driveRoot      string
+	hashPathPrefix string
+	hashPathSuffix string
+	reserve        int64
+	reclaimAge     int64
+	policy         int
+	maxObjectSize  int64
+	swift          *SwiftObjectFactory
+
+	lock    sync.Mutex
+	indexes map[string]*sql.DB
+	volumes map[string]*sync.RWMutex
+}
+
+func (f *PackedObjectFactory) policyDir(device string) string {
+	return filepath.Join(f.driveRoot, device, PolicyDir(f.policy))
+}
+
+func (f *PackedObjectFactory) hasSpace(dir string, size int64, reserve int64) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return true
+	}
+	return int64(st.Bavail)*int64(st.Bsize)-size-packedHeaderSize >= reserve
+}
+
+// index returns the index for objPath, a device's directory for the policy, opening and creating it if needed.
+func (f *PackedObjectFactory) index(objPath string) (*sql.DB, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if db, ok := f.indexes[objPath]; ok {
+		return db, nil
+	}
+	if err := os.MkdirAll(objPath, 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(objPath, packedIndexName)+"?psow=1&_txlock=immediate&mode=rwc")
+	if err != nil {
+		return nil, err
+	}
+	// one connection keeps the pragmas in effect and serializes access to the index, so rows have to be read in full
+	// before the index is used again.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA journal_mode = WAL; PRAGMA synchronous = NORMAL;" + packedSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating index: %v", err)
+	}
+	f.indexes[objPath] = db
+	return db, nil
+}
+
+// volumeLock returns the lock that guards a partition's volume.  Appends and compaction hold it exclusively, and
+// readers hold it while they look up a record and open the volume it's in.
+func (f *PackedObjectFactory) volumeLock(objPath, partition string) *sync.RWMutex {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := filepath.Join(objPath, partition)
+	if l, ok := f.volumes[key]; ok {
+		return l
+	}
+	l := &sync.RWMutex{}
+	f.volumes[key] = l
+	return l
+}
+
+func (f *PackedObjectFactory) volumeName(db *sql.DB, partition string) (string, error) {
+	var volume string
+	err := db.QueryRow("SELECT volume FROM volumes WHERE partition = ?", partition).Scan(&volume)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return volume, err
+}
+
+func (f *PackedObjectFactory) newest(db *sql.DB, hash string) (*packedRecord, error) {
+	records, err := f.records(db, hash)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// records returns all of the records for a hash, newest first, along with the volume they're in.  The volume is read
+// with the offsets so they agree even if another process's Compact swaps the volume in between.
+func (f *PackedObjectFactory) records(db *sql.DB, hash string) ([]*packedRecord, error) {
+	rows, err := db.Query(`SELECT objects.timestamp, objects.deleted, objects.offset, objects.meta_length,
+						   objects.data_length, objects.metadata, volumes.volume FROM objects
+						   JOIN volumes ON volumes.partition = objects.partition
+						   WHERE objects.hash = ? ORDER BY objects.timestamp DESC, objects.deleted DESC`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []*packedRecord
+	for rows.Next() {
+		r := &packedRecord{hash: hash}
+		if err := rows.Scan(&r.timestamp, &r.deleted, &r.offset, &r.metaLength, &r.dataLength, &r.metadata, &r.volume); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// openRecords returns a hash's records and opens the volume they're in.  If a Compact in another process has
+// replaced the volume and unlinked the old one since the records were read, they're read again.
+func (f *PackedObjectFactory) openRecords(db *sql.DB, objPath, partition, hash string) ([]*packedRecord, *os.File, error) {
+	for attempt := 0; ; attempt++ {
+		records, err := f.records(db, hash)
+		if err != nil || len(records) == 0 {
+			return records, nil, err
+		}
+		volume, err := os.Open(filepath.Join(objPath, partition, records[0].volume))
+		if os.IsNotExist(err) && attempt < 3 {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		return records, volume, nil
+	}
+}
+
+// append writes a record to the end of the partition's volume, then indexes it in place of any older records for the
+// same hash.  The record is put together in memory first, so the volume's lock is only held for a single write.
+func (f *PackedObjectFactory) append(objPath, partition, hash, timestamp string, deleted bool, pickledMetadata []byte, data io.Reader, size int64) error {
+	db, err := f.index(objPath)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, packedHeaderSize+int64(len(pickledMetadata))+size))
+	header := packedHeader{Magic: packedMagic, MetaLen: uint32(len(pickledMetadata)), DataLen: uint64(size)}
+	copy(header.Hash[:], hash)
+	binary.Write(buf, binary.LittleEndian, &header)
+	buf.Write(pickledMetadata)
+	if data != nil {
+		if written, err := common.CopyN(data, size, buf); err != nil {
+			return fmt.Errorf("Error reading record: %v", err)
+		} else if written != size {
+			return fmt.Errorf("Short read of record: %d of %d", written, size)
+		}
+	}
+	record := buf.Bytes()
+	partitionDir := filepath.Join(objPath, partition)
+	l := f.volumeLock(objPath, partition)
+	l.Lock()
+	defer l.Unlock()
+	partitionLock, err := fs.LockPath(partitionDir, 10*time.Second)
+	if err != nil {
+		return LockPathError
+	}
+	defer partitionLock.Close()
+
+	volumeName, err := f.volumeName(db, partition)
+	if err != nil {
+		return err
+	}
+	if volumeName == "" {
+		volumeName = "volume-" + common.UUID()
+		if _, err := db.Exec("INSERT INTO volumes (partition, volume) VALUES (?, ?)", partition, volumeName); err != nil {
+			return err
+		}
+	}
+	volume, err := os.OpenFile(filepath.Join(partitionDir, volumeName), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	defer volume.Close()
+	offset, err := volume.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if _, err := volume.Write(record); err != nil {
+		return fmt.Errorf("Error writing record: %v", err)
+	}
+	if err := volume.Sync(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO objects (hash, partition, suffix, timestamp, deleted, offset, meta_length,
+						  data_length, metadata) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hash, partition, hash[29:32], timestamp, deleted, offset, len(pickledMetadata), size, pickledMetadata); err != nil {
+		return err
+	}
+	newest := &packedRecord{}
+	if err := tx.QueryRow(`SELECT timestamp, deleted FROM objects WHERE hash = ?
+						   ORDER BY timestamp DESC, deleted DESC LIMIT 1`, hash).Scan(&newest.timestamp, &newest.deleted); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM objects WHERE hash = ? AND NOT (timestamp = ? AND deleted = ?)",
+		hash, newest.timestamp, newest.deleted); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// open looks up an object's newest record, and opens its volume if needData is set.
+func (f *PackedObjectFactory) open(o *PackedObject, needData bool) error {
+	db, err := f.index(o.objPath)
+	if err != nil {
+		return err
+	}
+	l := f.volumeLock(o.objPath, o.partition)
+	l.RLock()
+	defer l.RUnlock()
+	if !needData {
+		o.record, err = f.newest(db, o.hash)
+		return err
+	}
+	records, volume, err := f.openRecords(db, o.objPath, o.partition, o.hash)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	if o.record = records[0]; o.record.deleted {
+		volume.Close()
+		return nil
+	}
+	o.volume = volume
+	o.data = io.NewSectionReader(o.volume, o.record.offset+packedHeaderSize+o.record.metaLength, o.record.dataLength)
+	return nil
+}
+
+// quarantine removes a record from the index, saving its data and metadata the way QuarantineHash would have.
+func (f *PackedObjectFactory) quarantine(objPath, partition string, r *packedRecord) error {
+	db, err := f.index(objPath)
+	if err != nil {
+		return err
+	}
+	l := f.volumeLock(objPath, partition)
+	l.Lock()
+	defer l.Unlock()
+	quarantineDir := filepath.Join(filepath.Dir(objPath), "quarantined", filepath.Base(objPath), r.hash+"-"+common.UUID())
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return err
+	}
+	if fp, err := os.Create(filepath.Join(quarantineDir, r.fileName())); err == nil {
+		defer fp.Close()
+		if volume, err := os.Open(filepath.Join(objPath, partition, r.volume)); err == nil {
+			defer volume.Close()
+			common.CopyN(io.NewSectionReader(volume, r.offset+packedHeaderSize+r.metaLength, r.dataLength), r.dataLength, fp)
+		}
+		RawWriteMetadata(fp.Fd(), r.metadata)
+	}
+	_, err = db.Exec("DELETE FROM objects WHERE hash = ? AND timestamp = ? AND deleted = ?", r.hash, r.timestamp, r.deleted)
+	return err
+}
+
+func reclaimed(timestamp string, reclaimAge int64) bool {
+	if strings.Contains(timestamp, "_") {
+		timestamp = strings.Split(timestamp, "_")[0]
+	}
+	t, _ := strconv.ParseFloat(timestamp, 64)
+	return time.Now().Unix()-int64(t) > reclaimAge
+}
+
+// reclaim drops tombstones older than reclaimAge from a partition's index.
+func (f *PackedObjectFactory) reclaim(db *sql.DB, partition string, reclaimAge int64) error {
+	rows, err := db.Query("SELECT hash, timestamp FROM objects WHERE partition = ? AND deleted", partition)
+	if err != nil {
+		return err
+	}
+	var expired []*packedRecord
+	for rows.Next() {
+		r := &packedRecord{}
+		if err := rows.Scan(&r.hash, &r.timestamp); err != nil {
+			rows.Close()
+			return err
+		}
+		if reclaimed(r.timestamp, reclaimAge) {
+			expired = append(expired, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range expired {
+		if _, err := db.Exec("DELETE FROM objects WHERE hash = ? AND timestamp = ? AND deleted", r.hash, r.timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionRecords returns the hash, timestamp and type of every record in a partition, ordered by suffix and hash.
+func (f *PackedObjectFactory) partitionRecords(db *sql.DB, partition string) ([]*packedRecord, error) {
+	rows, err := db.Query("SELECT hash, timestamp, deleted FROM objects WHERE partition = ? ORDER BY suffix, hash", partition)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []*packedRecord
+	for rows.Next() {
+		r := &packedRecord{}
+		if err := rows.Scan(&r.hash, &r.timestamp, &r.deleted); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// removePartition drops an empty partition's volume, so it stops being listed.  The partition directory goes too,
+// unless there are objects in it in the swift layout.
+func (f *PackedObjectFactory) removePartition(db *sql.DB, objPath, partition string) {
+	l := f.volumeLock(objPath, partition)
+	l.Lock()
+	defer l.Unlock()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM objects WHERE partition = ?", partition).Scan(&count); err != nil || count > 0 {
+		return
+	}
+	volumeName, err := f.volumeName(db, partition)
+	if err != nil || volumeName == "" {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM volumes WHERE partition = ?", partition); err != nil {
+		return
+	}
+	partitionDir := filepath.Join(objPath, partition)
+	os.Remove(filepath.Join(partitionDir, volumeName))
+	if len(suffixDirs(partitionDir)) == 0 {
+		os.Remove(filepath.Join(partitionDir, ".lock"))
+		os.Remove(filepath.Join(partitionDir, "hashes.invalid"))
+		os.Remove(partitionDir)
+	}
+}
+
+// suffixDirs returns the suffix directories of the objects in a partition that are in the swift layout.
+func suffixDirs(partitionDir string) []string {
+	dirs, _ := filepath.Glob(filepath.Join(partitionDir, "[a-f0-9][a-f0-9][a-f0-9]"))
+	return dirs
+}
+
+// removeOlderRecords drops an object's records older than fileName from the index, once a newer copy of it has been
+// written in the swift layout.
+func (f *PackedObjectFactory) removeOlderRecords(objPath, hash, fileName string) error {
+	db, err := f.index(objPath)
+	if err != nil {
+		return err
+	}
+	records, err := f.records(db, hash)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.fileName() < fileName {
+			if _, err := db.Exec("DELETE FROM objects WHERE hash = ? AND timestamp = ? AND deleted = ?", r.hash, r.timestamp, r.deleted); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeOlderFiles removes an object's files older than fileName from its hash directory, once a newer record for it
+// has been appended to the volume.
+func (f *PackedObjectFactory) removeOlderFiles(objPath, partition, hash, fileName string) {
+	hashDir := filepath.Join(objPath, partition, hash[29:32], hash)
+	names, err := fs.ReadDirNames(hashDir)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if name < fileName {
+			os.Remove(filepath.Join(hashDir, name))
+		}
+	}
+	os.Remove(hashDir)
+	os.Remove(filepath.Dir(hashDir))
+}
+
+// ListPartitions returns the partitions that have volumes or objects in the swift layout in objPath.
+func (f *PackedObjectFactory) ListPartitions(objPath string, logger srv.LoggingContext) ([]string, error) {
+	// the index's files would be logged as invalid partitions.
+	partitions, err := f.swift.ListPartitions(objPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !fs.Exists(filepath.Join(objPath, packedIndexName)) {
+		return partitions, nil
+	}
+	db, err := f.index(objPath)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT partition FROM volumes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := make(map[string]bool, len(partitions))
+	for _, partition := range partitions {
+		seen[partition] = true
+	}
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			return nil, err
+		}
+		if !seen[partition] {
+			partitions = append(partitions, partition)
+		}
+	}
+	return partitions, rows.Err()
+}
+
+// GetHashes returns the suffix hashes for a partition, computed from the index and any hash directories.  They match
+// what GetHashes would return for the same objects stored as files in hash directories, so partitions can be compared
+// across engines.
+func (f *PackedObjectFactory) GetHashes(driveRoot string, device string, partition string, recalculate []string, reclaimAge int64, logger srv.LoggingContext) (map[string]string, error) {
+	objPath := filepath.Join(driveRoot, device, PolicyDir(f.policy))
+	db, err := f.index(objPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.reclaim(db, partition, reclaimAge); err != nil {
+		return nil, err
+	}
+	records, err := f.partitionRecords(db, partition)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]map[string][]string)
+	for _, r := range records {
+		suffix := r.hash[29:32]
+		if names[suffix] == nil {
+			names[suffix] = make(map[string][]string)
+		}
+		names[suffix][r.hash] = append(names[suffix][r.hash], r.fileName())
+	}
+	for _, suffixDir := range suffixDirs(filepath.Join(objPath, partition)) {
+		suffix := filepath.Base(suffixDir)
+		if names[suffix] == nil {
+			names[suffix] = make(map[string][]string)
+		}
+		hashList, err := fs.ReadDirNames(suffixDir)
+		if err != nil {
+			continue
+		}
+		for _, hash := range hashList {
+			hashPath := filepath.Join(suffixDir, hash)
+			fileList, err := HashCleanupListDir(hashPath, reclaimAge)
+			if err == PathNotDirError {
+				QuarantineHash(hashPath)
+				continue
+			} else if err != nil {
+				return nil, err
+			} else if len(fileList) == 0 {
+				os.Remove(hashPath)
+				continue
+			}
+			names[suffix][hash] = append(names[suffix][hash], fileList...)
+		}
+	}
+	hashes := make(map[string]string, len(names))
+	for suffix, hashNames := range names {
+		hashList := make([]string, 0, len(hashNames))
+		for hash := range hashNames {
+			hashList = append(hashList, hash)
+		}
+		sort.Strings(hashList)
+		h := md5.New()
+		for _, hash := range hashList {
+			fileNames := hashNames[hash]
+			sort.Sort(sort.Reverse(sort.StringSlice(fileNames)))
+			for _, fileName := range fileNames {
+				io.WriteString(h, fileName)
+			}
+		}
+		hashes[suffix] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// ListObjectFiles sends the partition's records to objChan as object file paths, followed by the files of any objects
+// in the swift layout.  A partition with nothing left in it is removed.
+func (f *PackedObjectFactory) ListObjectFiles(objChan chan string, cancel chan struct{}, partitionDir string, needSuffix func(string) bool, logger srv.LoggingContext) {
+	defer close(objChan)
+	objPath, partition := filepath.Dir(partitionDir), filepath.Base(partitionDir)
+	db, err := f.index(objPath)
+	if err != nil {
+		logger.LogError("[listObjFiles] %v", err)
+		return
+	}
+	records, err := f.partitionRecords(db, partition)
+	if err != nil {
+		logger.LogError("[listObjFiles] %v", err)
+		return
+	}
+	hasLarge := len(suffixDirs(partitionDir)) > 0
+	if len(records) == 0 && !hasLarge {
+		f.removePartition(db, objPath, partition)
+		return
+	}
+	for _, r := range records {
+		suffix := r.hash[29:32]
+		if !needSuffix(suffix) {
+			continue
+		}
+		select {
+		case objChan <- filepath.Join(partitionDir, suffix, r.hash, r.fileName()):
+		case <-cancel:
+			return
+		}
+	}
+	if !hasLarge {
+		return
+	}
+	largeChan := make(chan string)
+	go f.swift.ListObjectFiles(largeChan, cancel, partitionDir, needSuffix, logger)
+	for objFile := range largeChan {
+		select {
+		case objChan <- objFile:
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// ListObjectHashes returns a hash path for each object in the partition.
+func (f *PackedObjectFactory) ListObjectHashes(partitionDir string, logger srv.LoggingContext) ([]string, error) {
+	db, err := f.index(filepath.Dir(partitionDir))
+	if err != nil {
+		return nil, err
+	}
+	records, err := f.partitionRecords(db, filepath.Base(partitionDir))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var hashDirs []string
+	for _, r := range records {
+		hashDir := filepath.Join(partitionDir, r.hash[29:32], r.hash)
+		if !seen[hashDir] {
+			seen[hashDir] = true
+			hashDirs = append(hashDirs, hashDir)
+		}
+	}
+	if len(suffixDirs(partitionDir)) > 0 {
+		// the volume and lock files would be logged as invalid suffixes.
+		largeDirs, err := f.swift.ListObjectHashes(partitionDir, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, hashDir := range largeDirs {
+			if !seen[hashDir] {
+				seen[hashDir] = true
+				hashDirs = append(hashDirs, hashDir)
+			}
+		}
+	}
+	return hashDirs, nil
+}
+
+// verify checks a record's metadata, returning a quarantineFileError if it's not valid.
+func (r *packedRecord) verify() (map[string]string, error) {
+	metadata, err := unpickleMetadata(r.metadata)
+	if err != nil {
+		return nil, quarantineFileError{"error unpickling metadata"}
+	}
+	if r.deleted {
+		for _, reqEntry := range []string{"name", "X-Timestamp"} {
+			if _, ok := metadata[reqEntry]; !ok {
+				return nil, quarantineFileError{".ts missing required metadata"}
+			}
+		}
+		return metadata, nil
+	}
+	for _, reqEntry := range []string{"Content-Length", "Content-Type", "name", "ETag", "X-Timestamp"} {
+		if _, ok := metadata[reqEntry]; !ok {
+			return nil, quarantineFileError{".data missing required metadata"}
+		}
+	}
+	if contentLength, err := strconv.ParseInt(metadata["Content-Length"], 10, 64); err != nil || contentLength != r.dataLength {
+		return nil, quarantineFileError{"invalid content-length"}
+	}
+	return metadata, nil
+}
+
+// OpenObjectFile opens the record named by objFile, after checking its metadata, or the file itself if the object is
+// in the swift layout.
+func (f *PackedObjectFactory) OpenObjectFile(objFile string) (io.ReadCloser, []byte, int64, error) {
+	objPath, partition, hash, timestamp, deleted, err := parsePackedFile(objFile)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	db, err := f.index(objPath)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	l := f.volumeLock(objPath, partition)
+	l.RLock()
+	defer l.RUnlock()
+	records, volume, err := f.openRecords(db, objPath, partition, hash)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for _, r := range records {
+		if r.timestamp != timestamp || r.deleted != deleted {
+			continue
+		}
+		if _, err := r.verify(); err != nil {
+			volume.Close()
+			return nil, nil, 0, err
+		}
+		data := io.NewSectionReader(volume, r.offset+packedHeaderSize+r.metaLength, r.dataLength)
+		return packedReadCloser{data, volume}, r.metadata, r.dataLength, nil
+	}
+	if volume != nil {
+		volume.Close()
+	}
+	if fs.Exists(objFile) {
+		return f.swift.OpenObjectFile(objFile)
+	}
+	return nil, nil, 0, fmt.Errorf("Object file not found: %s", objFile)
+}
+
+// CheckObjectFile reports whether the record named by objFile exists, or if there's a newer one for the object, in
+// either layout.
+func (f *PackedObjectFactory) CheckObjectFile(objFile string) (bool, bool) {
+	exists, newerExists := f.swift.CheckObjectFile(objFile)
+	objPath, _, hash, _, _, err := parsePackedFile(objFile)
+	if err != nil {
+		return exists, newerExists
+	}
+	db, err := f.index(objPath)
+	if err != nil {
+		return exists, newerExists
+	}
+	newest, err := f.newest(db, hash)
+	if err != nil || newest == nil {
+		return exists, newerExists
+	}
+	name := filepath.Base(objFile)
+	return exists || newest.fileName() == name, newerExists || name < newest.fileName()
+}
+
+// SaveObjectFile appends a record received from another server to the partition's volume, or saves it in the swift
+// layout if it's too large.
+func (f *PackedObjectFactory) SaveObjectFile(objFile string, xattrs []byte, size int64, data io.Reader, reserve int64, reclaimAge int64) error {
+	objPath, partition, hash, timestamp, deleted, err := parsePackedFile(objFile)
+	if err != nil {
+		return err
+	}
+	if size > f.maxObjectSize {
+		if err := f.swift.SaveObjectFile(objFile, xattrs, size, data, reserve, reclaimAge); err != nil {
+			return err
+		}
+		return f.removeOlderRecords(objPath, hash, filepath.Base(objFile))
+	}
+	if !f.hasSpace(filepath.Dir(objPath), size, reserve) {
+		return DriveFullError
+	}
+	if err := f.append(objPath, partition, hash, timestamp, deleted, xattrs, data, size); err != nil {
+		return err
+	}
+	f.removeOlderFiles(objPath, partition, hash, filepath.Base(objFile))
+	return nil
+}
+
+// RemoveObjectFile drops the record named by objFile from the index, or removes the file if the object is in the
+// swift layout.  A record's space is reclaimed by the next Compact.
+func (f *PackedObjectFactory) RemoveObjectFile(objFile string) error {
+	if fs.Exists(objFile) {
+		return f.swift.RemoveObjectFile(objFile)
+	}
+	objPath, _, hash, timestamp, deleted, err := parsePackedFile(objFile)
+	if err != nil {
+		return err
+	}
+	db, err := f.index(objPath)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM objects WHERE hash = ? AND timestamp = ? AND deleted = ?", hash, timestamp, deleted)
+	return err
+}
+
+// AuditHash checks the metadata of each of an object's records, and the data against its etag unless skipMd5 is set,
+// along with any of its files in the swift layout.
+func (f *PackedObjectFactory) AuditHash(hashPath string, skipMd5 bool) (int64, error) {
+	partitionDir := filepath.Dir(filepath.Dir(hashPath))
+	objPath, partition, hash := filepath.Dir(partitionDir), filepath.Base(partitionDir), filepath.Base(hashPath)
+	db, err := f.index(objPath)
+	if err != nil {
+		return 0, err
+	}
+	var bytesProcessed int64
+	if fs.Exists(hashPath) {
+		if bytesProcessed, err = f.swift.AuditHash(hashPath, skipMd5); err != nil {
+			return bytesProcessed, err
+		}
+	}
+	l := f.volumeLock(objPath, partition)
+	l.RLock()
+	defer l.RUnlock()
+	records, volume, err := f.openRecords(db, objPath, partition, hash)
+	if err != nil {
+		return bytesProcessed, err
+	}
+	if volume != nil {
+		defer volume.Close()
+	}
+	for _, r := range records {
+		metadata, err := r.verify()
+		if err != nil {
+			return bytesProcessed, err
+		}
+		if r.deleted || skipMd5 {
+			continue
+		}
+		h := md5.New()
+		bytes, err := common.Copy(io.NewSectionReader(volume, r.offset+packedHeaderSize+r.metaLength, r.dataLength), h)
+		bytesProcessed += bytes
+		if err != nil {
+			return bytesProcessed, fmt.Errorf("Error reading record")
+		}
+		if bytes != r.dataLength || hex.EncodeToString(h.Sum(nil)) != metadata["ETag"] {
+			return bytesProcessed, fmt.Errorf("Record contents don't match etag")
+		}
+	}
+	return bytesProcessed, nil
+}
+
+// QuarantineHash moves all of an object's records out to the device's quarantined directory, along with its hash
+// directory if it has one.
+func (f *PackedObjectFactory) QuarantineHash(hashPath string) error {
+	partitionDir := filepath.Dir(filepath.Dir(hashPath))
+	objPath, partition := filepath.Dir(partitionDir), filepath.Base(partitionDir)
+	db, err := f.index(objPath)
+	if err != nil {
+		return err
+	}
+	if fs.Exists(hashPath) {
+		if err := f.swift.QuarantineHash(hashPath); err != nil {
+			return err
+		}
+	}
+	records, err := f.records(db, filepath.Base(hashPath))
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := f.quarantine(objPath, partition, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites a partition's volume with only the records still in the index, after reclaiming old tombstones.
+// The new volume is written alongside the old one and swapped in with the index update, so a crash at any point
+// leaves the index pointing at a complete volume.
+func (f *PackedObjectFactory) Compact(partitionDir string) error {
+	objPath, partition := filepath.Dir(partitionDir), filepath.Base(partitionDir)
+	db, err := f.index(objPath)
+	if err != nil {
+		return err
+	}
+	l := f.volumeLock(objPath, partition)
+	l.Lock()
+	defer l.Unlock()
+	partitionLock, err := fs.LockPath(partitionDir, 10*time.Second)
+	if err != nil {
+		return LockPathError
+	}
+	defer partitionLock.Close()
+
+	if err := f.reclaim(db, partition, f.reclaimAge); err != nil {
+		return err
+	}
+	volumeName, err := f.volumeName(db, partition)
+	if err != nil || volumeName == "" {
+		return err
+	}
+	rows, err := db.Query("SELECT hash, timestamp, offset, meta_length, data_length FROM objects WHERE partition = ? ORDER BY offset", partition)
+	if err != nil {
+		return err
+	}
+	var records []*packedRecord
+	var live int64
+	for rows.Next() {
+		r := &packedRecord{}
+		if err := rows.Scan(&r.hash, &r.timestamp, &r.offset, &r.metaLength, &r.dataLength); err != nil {
+			rows.Close()
+			return err
+		}
+		records = append(records, r)
+		live += r.length()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	oldVolume, err := os.Open(filepath.Join(partitionDir, volumeName))
+	if err != nil {
+		return err
+	}
+	defer oldVolume.Close()
+	if stat, err := oldVolume.Stat(); err != nil {
+		return err
+	} else if stat.Size() == live {
+		return nil
+	}
+
+	newVolumeName := "volume-" + common.UUID()
+	newVolume, err := os.OpenFile(filepath.Join(partitionDir, newVolumeName), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	defer newVolume.Close()
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(newVolume.Name())
+		}
+	}()
+	offsets := make([]int64, len(records))
+	var offset int64
+	for i, r := range records {
+		if _, err := common.CopyN(io.NewSectionReader(oldVolume, r.offset, r.length()), r.length(), newVolume); err != nil {
+			return fmt.Errorf("Error copying record: %v", err)
+		}
+		offsets[i] = offset
+		offset += r.length()
+	}
+	if err := newVolume.Sync(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, r := range records {
+		if _, err := tx.Exec("UPDATE objects SET offset = ? WHERE hash = ? AND timestamp = ?", offsets[i], r.hash, r.timestamp); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE volumes SET volume = ? WHERE partition = ?", newVolumeName, partition); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	os.Remove(oldVolume.Name())
+	return nil
+}
+
+// Close closes any open indexes.
+func (f *PackedObjectFactory) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for objPath, db := range f.indexes {
+		db.Close()
+		delete(f.indexes, objPath)
+	}
+	return nil
+}
+
+// New returns an instance of PackedObject with the given parameters.  The object's newest record is looked up, and if
+// needData is true, its volume is opened.  If the object has a newer copy in the swift layout, that's used instead.
+func (f *PackedObjectFactory) New(vars map[string]string, needData bool, asyncWG *sync.WaitGroup) (Object, error) {
+	o := &PackedObject{
+		factory:   f,
+		vars:      vars,
+		asyncWG:   asyncWG,
+		objPath:   f.policyDir(vars["device"]),
+		partition: vars["partition"],
+		hash:      ObjHash(vars, f.hashPathPrefix, f.hashPathSuffix),
+	}
+	if err := f.open(o, needData); err != nil {
+		o.Close()
+		return nil, err
+	}
+	large, err := f.swift.New(vars, needData, asyncWG)
+	if err != nil {
+		o.Close()
+		return nil, err
+	}
+	if so := large.(*SwiftObject); so.dataFile != "" && (o.record == nil || o.record.fileName() < filepath.Base(so.dataFile)) {
+		o.Close()
+		o.large = so
+		return o, nil
+	}
+	large.Close()
+	if o.Exists() {
+		var err error
+		if o.metadata, err = unpickleMetadata(o.record.metadata); err != nil {
+			o.Quarantine()
+			return nil, fmt.Errorf("Error getting metadata: %v", err)
+		}
+		if contentLength, err := strconv.ParseInt(o.metadata["Content-Length"], 10, 64); err != nil {
+			o.Quarantine()
+			return nil, fmt.Errorf("Unable to parse content-length: %s", o.metadata["Content-Length"])
+		} else if o.record.dataLength != contentLength {
+			o.Quarantine()
+			return nil, fmt.Errorf("Record size doesn't match content-length: %d vs %d", o.record.dataLength, contentLength)
+		}
+	}
+	return o, nil
+}
+
+// PackedEngineConstructor creates a PackedObjectFactory given the object server configs.
+func PackedEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.FlagSet) (ObjectEngine, error) {
+	driveRoot := config.GetDefault("app:object-server", "devices", "/srv/node")
+	reserve := config.GetInt("app:object-server", "fallocate_reserve", 0)
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		return nil, errors.New("Unable to load hashpath prefix and suffix")
+	}
+	reclaimAge := int64(config.GetInt("app:object-server", "reclaim_age", int64(common.ONE_WEEK)))
+	maxObjectSize := int64(packedMaxObjectSizeDflt)
+	if value, ok := policy.Config["packed_max_object_size"]; ok {
+		if maxObjectSize, err = strconv.ParseInt(value, 10, 64); err != nil || maxObjectSize < 0 {
+			return nil, fmt.Errorf("Invalid packed_max_object_size for policy %d: %q", policy.Index, value)
+		}
+	}
+	swift, err := SwiftEngineConstructor(config, policy, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &PackedObjectFactory{
+		driveRoot:      driveRoot,
+		hashPathPrefix: hashPathPrefix,
+		hashPathSuffix: hashPathSuffix,
+		reserve:        reserve,
+		reclaimAge:     reclaimAge,
+		policy:         policy.Index,
+		maxObjectSize:  maxObjectSize,
+		swift:          swift.(*SwiftObjectFactory),
+		indexes:        make(map[string]*sql.DB),
+		volumes:        make(map[string]*sync.RWMutex)}, nil
+}
+
+func init() {
+	RegisterObjectEngine("packed", PackedEngineConstructor)
+}
+
+// make sure these things satisfy interfaces at compile time
+var _ ObjectEngineConstructor = PackedEngineConstructor
+var _ Object = &PackedObject{}
+var _ ObjectEngine = &PackedObjectFactory{}
+var _ CompactingEngine = &PackedObjectFactory{}
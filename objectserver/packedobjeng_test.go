@@ -0,0 +1,446 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func newTestPackedFactory(driveRoot string) *PackedObjectFactory {
+	return &PackedObjectFactory{driveRoot: driveRoot, hashPathPrefix: "prefix", hashPathSuffix: "suffix",
+		reclaimAge: int64(common.ONE_WEEK), maxObjectSize: packedMaxObjectSizeDflt,
+		swift:   &SwiftObjectFactory{driveRoot: driveRoot, hashPathPrefix: "prefix", hashPathSuffix: "suffix", reclaimAge: int64(common.ONE_WEEK)},
+		indexes: make(map[string]*sql.DB), volumes: make(map[string]*sync.RWMutex)}
+}
+
+func putPackedObject(t *testing.T, f *PackedObjectFactory, vars map[string]string, body string, timestamp string) {
+	var wg sync.WaitGroup
+	o, err := f.New(vars, false, &wg)
+	require.Nil(t, err)
+	defer o.Close()
+	w, err := o.SetData(int64(len(body)))
+	require.Nil(t, err)
+	w.Write([]byte(body))
+	require.Nil(t, o.Commit(map[string]string{"Content-Length": strconv.Itoa(len(body)), "Content-Type": "text/plain", "X-Timestamp": timestamp}))
+}
+
+func volumeSize(t *testing.T, f *PackedObjectFactory, device string, partition string) int64 {
+	db, err := f.index(f.policyDir(device))
+	require.Nil(t, err)
+	volumeName, err := f.volumeName(db, partition)
+	require.Nil(t, err)
+	stat, err := os.Stat(filepath.Join(f.policyDir(device), partition, volumeName))
+	require.Nil(t, err)
+	return stat.Size()
+}
+
+func TestPackedObjectRoundtrip(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	f := newTestPackedFactory(driveRoot)
+	defer f.Close()
+
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	putPackedObject(t, f, vars, "hello", "1234567890.123456")
+	putPackedObject(t, f, map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o2", "partition": "1"}, "there", "1234567890.123456")
+
+	var wg sync.WaitGroup
+	o, err := f.New(vars, true, &wg)
+	require.Nil(t, err)
+	defer o.Close()
+	require.True(t, o.Exists())
+	require.Equal(t, map[string]string{"Content-Length": "5", "Content-Type": "text/plain", "X-Timestamp": "1234567890.123456"}, o.Metadata())
+	require.Equal(t, int64(5), o.ContentLength())
+	buf1 := &bytes.Buffer{}
+	buf2 := &bytes.Buffer{}
+	_, err = o.Copy(buf1, buf2)
+	require.Nil(t, err)
+	require.Equal(t, "hello", buf1.String())
+	require.Equal(t, "hello", buf2.String())
+	buf := &bytes.Buffer{}
+	_, err = o.CopyRange(buf, 1, 4)
+	require.Nil(t, err)
+	require.Equal(t, "ell", buf.String())
+
+	// both objects went into the one volume file
+	names, err := fs.ReadDirNames(filepath.Join(driveRoot, "sda", "objects", "1"))
+	require.Nil(t, err)
+	volumes := 0
+	for _, name := range names {
+		if name != ".lock" {
+			volumes++
+		}
+	}
+	require.Equal(t, 1, volumes)
+}
+
+func TestPackedObjectDelete(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	f := newTestPackedFactory(driveRoot)
+	defer f.Close()
+
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	putPackedObject(t, f, vars, "hello", "1234567890.123456")
+	var wg sync.WaitGroup
+	o, err := f.New(vars, false, &wg)
+	require.Nil(t, err)
+	require.Nil(t, o.Delete(map[string]string{"X-Timestamp": "1234567891.123456"}))
+
+	o, err = f.New(vars, true, &wg)
+	require.Nil(t, err)
+	defer o.Close()
+	require.False(t, o.Exists())
+	require.Nil(t, o.Metadata())
+	require.Equal(t, "1234567891.123456", o.Tombstone())
+
+	// an older write doesn't bring it back
+	putPackedObject(t, f, vars, "hello", "1234567890.000000")
+	o, err = f.New(vars, false, &wg)
+	require.Nil(t, err)
+	require.False(t, o.Exists())
+}
+
+func TestPackedObjectCompact(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	f := newTestPackedFactory(driveRoot)
+	defer f.Close()
+
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	vars2 := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o2", "partition": "1"}
+	putPackedObject(t, f, vars, "first", "1234567890.000000")
+	putPackedObject(t, f, vars2, "other", "1234567890.000000")
+	putPackedObject(t, f, vars, "second", "1234567891.000000")
+	before := volumeSize(t, f, "sda", "1")
+
+	require.Nil(t, f.Compact(filepath.Join(f.policyDir("sda"), "1")))
+	after := volumeSize(t, f, "sda", "1")
+	require.True(t, after < before)
+	// nothing left to reclaim, so this is a no-op
+	require.Nil(t, f.Compact(filepath.Join(f.policyDir("sda"), "1")))
+	require.Equal(t, after, volumeSize(t, f, "sda", "1"))
+
+	for v, body := range map[string]string{"o": "second", "o2": "other"} {
+		var wg sync.WaitGroup
+		o, err := f.New(map[string]string{"device": "sda", "account": "a", "container": "c", "obj": v, "partition": "1"}, true, &wg)
+		require.Nil(t, err)
+		buf := &bytes.Buffer{}
+		_, err = o.Copy(buf)
+		o.Close()
+		require.Nil(t, err)
+		require.Equal(t, body, buf.String())
+	}
+}
+
+func TestPackedObjectReclaimTombstones(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	f := newTestPackedFactory(driveRoot)
+	defer f.Close()
+
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	var wg sync.WaitGroup
+	o, err := f.New(vars, false, &wg)
+	require.Nil(t, err)
+	require.Nil(t, o.Delete(map[string]string{"X-Timestamp": "1234567890.000000"}))
+	hashes, err := f.GetHashes(driveRoot, "sda", "1", nil, int64(common.ONE_WEEK), nil)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(hashes))
+
+	require.Nil(t, f.Compact(filepath.Join(f.policyDir("sda"), "1")))
+	require.Equal(t, int64(0), volumeSize(t, f, "sda", "1"))
+}
+
+func TestPackedObjectQuarantine(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	f := newTestPackedFactory(driveRoot)
+	defer f.Close()
+
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "3"}
+	putPackedObject(t, f, vars, "hello", "1234567890.123456")
+	var wg sync.WaitGroup
+	o, err := f.New(vars, true, &wg)
+	require.Nil(t, err)
+	require.Nil(t, o.Quarantine())
+	require.True(t, fs.Exists(filepath.Join(driveRoot, "sda", "quarantined", "objects")))
+
+	o, err = f.New(vars, false, &wg)
+	require.Nil(t, err)
+	require.False(t, o.Exists())
+}
+
+func TestPackedObjectGetHashesMatchesSwift(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		os.RemoveAll(driveRoot)
+	}()
+	f := newTestPackedFactory(driveRoot)
+	f.policy = 1
+	f.swift.policy = 1
+	defer f.Close()
+	swcon := &SwiftObjectFactory{driveRoot: driveRoot, hashPathPrefix: "prefix", hashPathSuffix: "suffix", reclaimAge: int64(common.ONE_WEEK)}
+
+	timestamp := common.GetTimestamp()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": name, "partition": "1"}
+		putPackedObject(t, f, vars, name, timestamp)
+		o, err := swcon.New(vars, false, &wg)
+		require.Nil(t, err)
+		w, err := o.SetData(1)
+		require.Nil(t, err)
+		w.Write([]byte(name))
+		require.Nil(t, o.Commit(map[string]string{"Content-Length": "1", "Content-Type": "text/plain", "X-Timestamp": timestamp}))
+		if name == "c" {
+			po, err := f.New(vars, false, &wg)
+			require.Nil(t, err)
+			require.Nil(t, po.Delete(map[string]string{"X-Timestamp": timestamp + "_00000001"}))
+			require.Nil(t, o.Delete(map[string]string{"X-Timestamp": timestamp + "_00000001"}))
+		}
+	}
+	wg.Wait()
+
+	expected, err := GetHashes(driveRoot, "sda", "1", nil, int64(common.ONE_WEEK), 0, nil)
+	require.Nil(t, err)
+	hashes, err := f.GetHashes(driveRoot, "sda", "1", nil, int64(common.ONE_WEEK), nil)
+	require.Nil(t, err)
+	require.Equal(t, expected, hashes)
+}
+
+func TestPackedObjectReplicationFiles(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	f := newTestPackedFactory(driveRoot)
+	defer f.Close()
+
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	var wg sync.WaitGroup
+	o, err := f.New(vars, false, &wg)
+	require.Nil(t, err)
+	w, err := o.SetData(5)
+	require.Nil(t, err)
+	w.Write([]byte("hello"))
+	require.Nil(t, o.Commit(map[string]string{"Content-Length": "5", "Content-Type": "text/plain", "name": "/a/c/o",
+		"ETag": "5d41402abc4b2a76b9719d911017c592", "X-Timestamp": "1234567890.123456"}))
+	partitionDir := filepath.Join(f.policyDir("sda"), "1")
+	partitions, err := f.ListPartitions(f.policyDir("sda"), nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"1"}, partitions)
+
+	objChan := make(chan string)
+	go f.ListObjectFiles(objChan, make(chan struct{}), partitionDir, func(string) bool { return true }, test.FakeLogger{})
+	var objFiles []string
+	for objFile := range objChan {
+		objFiles = append(objFiles, objFile)
+	}
+	require.Equal(t, 1, len(objFiles))
+	require.Equal(t, "1234567890.123456.data", filepath.Base(objFiles[0]))
+
+	rc, xattrs, size, err := f.OpenObjectFile(objFiles[0])
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(body))
+	require.Equal(t, int64(5), size)
+
+	// save it to another device the way the replication server would
+	rel, err := filepath.Rel(partitionDir, objFiles[0])
+	require.Nil(t, err)
+	dst := filepath.Join(f.policyDir("sdb"), "1", rel)
+	exists, newerExists := f.CheckObjectFile(dst)
+	require.False(t, exists)
+	require.False(t, newerExists)
+	require.Nil(t, f.SaveObjectFile(dst, xattrs, size, bytes.NewBufferString("hello"), 0, int64(common.ONE_WEEK)))
+	exists, newerExists = f.CheckObjectFile(dst)
+	require.True(t, exists)
+	require.False(t, newerExists)
+	exists, newerExists = f.CheckObjectFile(filepath.Join(filepath.Dir(dst), "1234567889.000000.data"))
+	require.False(t, exists)
+	require.True(t, newerExists)
+
+	vars["device"] = "sdb"
+	o, err = f.New(vars, true, &wg)
+	require.Nil(t, err)
+	buf := &bytes.Buffer{}
+	_, err = o.Copy(buf)
+	o.Close()
+	require.Nil(t, err)
+	require.Equal(t, "hello", buf.String())
+
+	require.Nil(t, f.RemoveObjectFile(objFiles[0]))
+	objChan = make(chan string)
+	go f.ListObjectFiles(objChan, make(chan struct{}), partitionDir, func(string) bool { return true }, test.FakeLogger{})
+	for range objChan {
+		t.Fatal("expected no object files")
+	}
+	partitions, err = f.ListPartitions(f.policyDir("sda"), nil)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(partitions))
+}
+
+func TestPackedObjectLargeObjects(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		os.RemoveAll(driveRoot)
+	}()
+	f := newTestPackedFactory(driveRoot)
+	f.maxObjectSize = 8
+	defer f.Close()
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	hashDir := ObjHashDir(vars, driveRoot, "prefix", "suffix", 0)
+
+	putPackedObject(t, f, vars, "small", "1234567890.000000")
+	require.False(t, fs.Exists(hashDir))
+
+	// a larger version goes to the swift layout and replaces the packed record.
+	putPackedObject(t, f, vars, "large object", "1234567891.000000")
+	wg.Wait()
+	require.True(t, fs.Exists(filepath.Join(hashDir, "1234567891.000000.data")))
+	db, err := f.index(f.policyDir("sda"))
+	require.Nil(t, err)
+	records, err := f.records(db, ObjHash(vars, "prefix", "suffix"))
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+	o, err := f.New(vars, true, &wg)
+	require.Nil(t, err)
+	require.True(t, o.Exists())
+	require.Equal(t, int64(12), o.ContentLength())
+	buf := &bytes.Buffer{}
+	_, err = o.Copy(buf)
+	o.Close()
+	require.Nil(t, err)
+	require.Equal(t, "large object", buf.String())
+
+	// data of unknown length is buffered until it's too large for the volume.
+	o, err = f.New(vars, false, &wg)
+	require.Nil(t, err)
+	w, err := o.SetData(-1)
+	require.Nil(t, err)
+	w.Write([]byte("chunked "))
+	w.Write([]byte("upload"))
+	require.Nil(t, o.Commit(map[string]string{"Content-Length": "14", "Content-Type": "text/plain", "X-Timestamp": "1234567892.000000"}))
+	wg.Wait()
+	require.True(t, fs.Exists(filepath.Join(hashDir, "1234567892.000000.data")))
+
+	// a tombstone is always packed, and removes the older files.
+	o, err = f.New(vars, false, &wg)
+	require.Nil(t, err)
+	require.Nil(t, o.Delete(map[string]string{"X-Timestamp": "1234567893.000000"}))
+	require.False(t, fs.Exists(hashDir))
+	o, err = f.New(vars, false, &wg)
+	require.Nil(t, err)
+	require.False(t, o.Exists())
+	require.Equal(t, "1234567893.000000", o.Tombstone())
+}
+
+func TestPackedObjectLargeReplicationFiles(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		os.RemoveAll(driveRoot)
+	}()
+	f := newTestPackedFactory(driveRoot)
+	f.maxObjectSize = 8
+	defer f.Close()
+	swcon := &SwiftObjectFactory{driveRoot: driveRoot, hashPathPrefix: "prefix", hashPathSuffix: "suffix", reclaimAge: int64(common.ONE_WEEK), policy: 1}
+
+	timestamp := common.GetTimestamp()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		body := name
+		if name == "b" || name == "d" {
+			body = "large object " + name
+		}
+		vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": name, "partition": "1"}
+		putPackedObject(t, f, vars, body, timestamp)
+		vars["device"] = "sdb"
+		o, err := swcon.New(vars, false, &wg)
+		require.Nil(t, err)
+		w, err := o.SetData(int64(len(body)))
+		require.Nil(t, err)
+		w.Write([]byte(body))
+		require.Nil(t, o.Commit(map[string]string{"Content-Length": strconv.Itoa(len(body)), "Content-Type": "text/plain", "X-Timestamp": timestamp}))
+	}
+	wg.Wait()
+
+	expected, err := GetHashes(driveRoot, "sdb", "1", nil, int64(common.ONE_WEEK), 1, nil)
+	require.Nil(t, err)
+	hashes, err := f.GetHashes(driveRoot, "sda", "1", nil, int64(common.ONE_WEEK), nil)
+	require.Nil(t, err)
+	require.Equal(t, expected, hashes)
+
+	partitionDir := filepath.Join(f.policyDir("sda"), "1")
+	objChan := make(chan string)
+	go f.ListObjectFiles(objChan, make(chan struct{}), partitionDir, func(string) bool { return true }, test.FakeLogger{})
+	var objFiles []string
+	for objFile := range objChan {
+		objFiles = append(objFiles, objFile)
+	}
+	require.Equal(t, 5, len(objFiles))
+	for _, objFile := range objFiles {
+		exists, newerExists := f.CheckObjectFile(objFile)
+		require.True(t, exists)
+		require.False(t, newerExists)
+	}
+	hashDirs, err := f.ListObjectHashes(partitionDir, nil)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(hashDirs))
+	partitions, err := f.ListPartitions(f.policyDir("sda"), nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"1"}, partitions)
+}
+
+func TestPackedEngineConstructorMaxObjectSize(t *testing.T) {
+	config, err := conf.StringConfig("[app:object-server]\ndevices=/srv/node\n")
+	require.Nil(t, err)
+	engine, err := PackedEngineConstructor(config, &conf.Policy{Index: 1, Config: map[string]string{}}, &flag.FlagSet{})
+	require.Nil(t, err)
+	require.Equal(t, int64(16*1024), engine.(*PackedObjectFactory).maxObjectSize)
+	engine, err = PackedEngineConstructor(config, &conf.Policy{Index: 1, Config: map[string]string{"packed_max_object_size": "1024"}}, &flag.FlagSet{})
+	require.Nil(t, err)
+	require.Equal(t, int64(1024), engine.(*PackedObjectFactory).maxObjectSize)
+	_, err = PackedEngineConstructor(config, &conf.Policy{Index: 1, Config: map[string]string{"packed_max_object_size": "lots"}}, &flag.FlagSet{})
+	require.NotNil(t, err)
+}
@@ -124,22 +124,13 @@ func doPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client) {
 // getPartMoveJobs takes two rings and creates a list of jobs for any partition moves between them.
 func getPartMoveJobs(oldRing, newRing ring.Ring) []*PriorityRepJob {
 	jobs := make([]*PriorityRepJob, 0)
-	for partition := uint64(0); true; partition++ {
-		olddevs := oldRing.GetNodesInOrder(partition)
-		newdevs := newRing.GetNodesInOrder(partition)
-		if olddevs == nil || newdevs == nil {
-			break
-		}
-		for i := range olddevs {
-			if olddevs[i].Id != newdevs[i].Id {
-				// TODO: handle if a node just changes positions, which doesn't happen, but isn't against the contract.
-				jobs = append(jobs, &PriorityRepJob{
-					Partition:  partition,
-					FromDevice: olddevs[i],
-					ToDevices:  []*ring.Device{newdevs[i]},
-				})
-			}
-		}
+	for _, move := range ring.MovedPartitions(oldRing, newRing) {
+		// TODO: handle if a node just changes positions, which doesn't happen, but isn't against the contract.
+		jobs = append(jobs, &PriorityRepJob{
+			Partition:  move.Partition,
+			FromDevice: move.From,
+			ToDevices:  []*ring.Device{move.To},
+		})
 	}
 	return jobs
 }
@@ -166,6 +166,7 @@ type replicationDevice struct {
 	r      *Replicator
 	dev    *ring.Device
 	policy int
+	engine ReplicationEngine
 	cancel chan struct{}
 	priRep chan PriorityRepJob
 	stats  ReplicationDeviceStats
@@ -193,55 +194,7 @@ type beginReplicationResponse struct {
 }
 
 func (rd *replicationDevice) listObjFiles(objChan chan string, cancel chan struct{}, partdir string, needSuffix func(string) bool) {
-	defer close(objChan)
-	suffixDirs, err := filepath.Glob(filepath.Join(partdir, "[a-f0-9][a-f0-9][a-f0-9]"))
-	if err != nil {
-		rd.r.LogError("[listObjFiles] %v", err)
-		return
-	}
-	if len(suffixDirs) == 0 {
-		os.Remove(filepath.Join(partdir, ".lock"))
-		os.Remove(filepath.Join(partdir, "hashes.pkl"))
-		os.Remove(filepath.Join(partdir, "hashes.invalid"))
-		os.Remove(partdir)
-		return
-	}
-	for i := len(suffixDirs) - 1; i > 0; i-- { // shuffle suffixDirs list
-		j := rand.Intn(i + 1)
-		suffixDirs[j], suffixDirs[i] = suffixDirs[i], suffixDirs[j]
-	}
-	for _, suffDir := range suffixDirs {
-		if !needSuffix(filepath.Base(suffDir)) {
-			continue
-		}
-		hashDirs, err := filepath.Glob(filepath.Join(suffDir, "????????????????????????????????"))
-		if err != nil {
-			rd.r.LogError("[listObjFiles] %v", err)
-			return
-		}
-		if len(hashDirs) == 0 {
-			os.Remove(suffDir)
-			continue
-		}
-		for _, hashDir := range hashDirs {
-			fileList, err := filepath.Glob(filepath.Join(hashDir, "*.[tdm]*"))
-			if len(fileList) == 0 {
-				os.Remove(hashDir)
-				continue
-			}
-			if err != nil {
-				rd.r.LogError("[listObjFiles] %v", err)
-				return
-			}
-			for _, objFile := range fileList {
-				select {
-				case objChan <- objFile:
-				case <-cancel:
-					return
-				}
-			}
-		}
-	}
+	rd.engine.ListObjectFiles(objChan, cancel, partdir, needSuffix, rd.r)
 }
 
 type syncFileArg struct {
@@ -254,11 +207,11 @@ func (rd *replicationDevice) syncFile(objFile string, dst []*syncFileArg, handof
 	var wrs []*syncFileArg
 	lst := strings.Split(objFile, string(os.PathSeparator))
 	relPath := filepath.Join(lst[len(lst)-5:]...)
-	fp, xattrs, fileSize, err := getFile(objFile)
+	fp, xattrs, fileSize, err := rd.engine.OpenObjectFile(objFile)
 	if _, ok := err.(quarantineFileError); ok {
 		hashDir := filepath.Dir(objFile)
 		rd.r.LogError("[syncFile] %s failed audit and is being quarantined: %s", hashDir, err.Error())
-		QuarantineHash(hashDir)
+		rd.engine.QuarantineHash(hashDir)
 		return 0, 0, nil
 	} else if err != nil {
 		return 0, 0, nil
@@ -287,9 +240,7 @@ func (rd *replicationDevice) syncFile(objFile string, dst []*syncFileArg, handof
 			}
 		} else if sfr.NewerExists {
 			insync++
-			if os.Remove(objFile) == nil {
-				InvalidateHash(filepath.Dir(objFile))
-			}
+			rd.engine.RemoveObjectFile(objFile)
 		} else if sfr.Exists {
 			insync++
 		}
@@ -383,7 +334,7 @@ func (rd *replicationDevice) replicateLocal(partition string, nodes []*ring.Devi
 	startGetHashesLocal := time.Now()
 
 	recalc := []string{}
-	hashes, err := GetHashes(rd.r.deviceRoot, rd.dev.Device, partition, recalc, rd.r.reclaimAge, rd.policy, rd.r)
+	hashes, err := rd.engine.GetHashes(rd.r.deviceRoot, rd.dev.Device, partition, recalc, rd.r.reclaimAge, rd.r)
 	if err != nil {
 		rd.r.LogError("[replicateLocal] error getting local hashes: %v", err)
 		return
@@ -396,7 +347,7 @@ func (rd *replicationDevice) replicateLocal(partition string, nodes []*ring.Devi
 			}
 		}
 	}
-	hashes, err = GetHashes(rd.r.deviceRoot, rd.dev.Device, partition, recalc, rd.r.reclaimAge, rd.policy, rd.r)
+	hashes, err = rd.engine.GetHashes(rd.r.deviceRoot, rd.dev.Device, partition, recalc, rd.r.reclaimAge, rd.r)
 	if err != nil {
 		rd.r.LogError("[replicateLocal] error recalculating local hashes: %v", err)
 		return
@@ -487,8 +438,7 @@ func (rd *replicationDevice) replicateHandoff(partition string, nodes []*ring.De
 				success = insync >= len(nodes)/2+1
 			}
 			if success {
-				os.Remove(objFile)
-				os.Remove(filepath.Dir(objFile))
+				rd.engine.RemoveObjectFile(objFile)
 			}
 		} else {
 			rd.r.LogError("[syncFile] %v", err)
@@ -540,19 +490,16 @@ func (rd *replicationDevice) replicatePartition(partition string) {
 
 func (rd *replicationDevice) listPartitions() ([]string, error) {
 	objPath := filepath.Join(rd.r.deviceRoot, rd.dev.Device, PolicyDir(rd.policy))
-	partitions, err := filepath.Glob(filepath.Join(objPath, "[0-9]*"))
+	partitions, err := rd.engine.ListPartitions(objPath, nil)
 	if err != nil {
 		return nil, err
 	}
 	partitionList := make([]string, 0, len(partitions))
 	for _, partition := range partitions {
-		partition = filepath.Base(partition)
 		if len(rd.r.partitions) > 0 && !rd.r.partitions[partition] {
 			continue
 		}
-		if _, err := strconv.ParseUint(partition, 10, 64); err == nil {
-			partitionList = append(partitionList, partition)
-		}
+		partitionList = append(partitionList, partition)
 	}
 	for i := len(partitionList) - 1; i > 0; i-- { // shuffle partition list
 		j := rand.Intn(i + 1)
@@ -568,6 +515,10 @@ func (rd *replicationDevice) Replicate() {
 		rd.r.LogError("[replicateDevice] Drive not mounted: %s", rd.dev.Device)
 		return
 	}
+	if rd.r.failedDevices.IsFailed(rd.dev.Device) {
+		rd.r.LogError("[replicateDevice] Drive marked failed: %s", rd.dev.Device)
+		return
+	}
 	if fs.Exists(filepath.Join(rd.r.deviceRoot, rd.dev.Device, "lock_device")) {
 		return
 	}
@@ -668,11 +619,16 @@ func (rd *replicationDevice) processPriorityJobs() {
 	}
 }
 
-var newReplicationDevice = func(dev *ring.Device, policy int, r *Replicator) *replicationDevice {
+var newReplicationDevice = func(dev *ring.Device, policy int, r *Replicator) (*replicationDevice, error) {
+	engine, ok := r.objEngines[policy].(ReplicationEngine)
+	if !ok {
+		return nil, fmt.Errorf("policy %d's object engine doesn't support replication", policy)
+	}
 	rd := &replicationDevice{
 		r:      r,
 		dev:    dev,
 		policy: policy,
+		engine: engine,
 		cancel: make(chan struct{}),
 		priRep: make(chan PriorityRepJob),
 		stats: ReplicationDeviceStats{
@@ -688,12 +644,13 @@ var newReplicationDevice = func(dev *ring.Device, policy int, r *Replicator) *re
 		},
 	}
 	rd.i = rd
-	return rd
+	return rd, nil
 }
 
 // Object replicator daemon object
 type Replicator struct {
 	checkMounts        bool
+	failedDevices      *fs.FailedDevices
 	deviceRoot         string
 	reconCachePath     string
 	logger             srv.LowLevelLogger
@@ -701,6 +658,7 @@ type Replicator struct {
 	port               int
 	bindIp             string
 	Rings              map[int]replicationRing
+	objEngines         map[int]ObjectEngine
 	runningDevices     map[string]ReplicationDevice
 	cancelCounts       map[string]int64
 	runningDevicesLock sync.Mutex
@@ -750,8 +708,13 @@ func (r *Replicator) verifyRunningDevices() {
 				continue
 			}
 			if _, ok := r.runningDevices[deviceKey(dev, policy)]; !ok {
-				r.runningDevices[deviceKey(dev, policy)] = newReplicationDevice(dev, policy, r)
-				go r.runningDevices[deviceKey(dev, policy)].ReplicateLoop()
+				rd, err := newReplicationDevice(dev, policy, r)
+				if err != nil {
+					r.LogError("Error starting replication of %s: %v", dev.Device, err)
+					continue
+				}
+				r.runningDevices[deviceKey(dev, policy)] = rd
+				go rd.ReplicateLoop()
 			}
 		}
 	}
@@ -897,7 +860,11 @@ func (r *Replicator) Run() {
 			return
 		}
 		for _, dev := range devices {
-			rd := newReplicationDevice(dev, policy, r)
+			rd, err := newReplicationDevice(dev, policy, r)
+			if err != nil {
+				r.LogError("Error starting replication of %s: %v", dev.Device, err)
+				continue
+			}
 			key := rd.Key()
 			r.runningDevices[key] = rd
 			r.onceWaiting++
@@ -945,6 +912,7 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, err
 		replicateTimeout: time.Minute, // TODO(redbo): does this need to be configurable?
 		reconCachePath:   serverconf.GetDefault("object-replicator", "recon_cache_path", "/var/cache/swift"),
 		checkMounts:      serverconf.GetBool("object-replicator", "mount_check", true),
+		failedDevices:    fs.NewFailedDevices(serverconf.GetDefault("object-replicator", "failed_devices_file", fs.DefaultFailedDevicesFile)),
 		deviceRoot:       serverconf.GetDefault("object-replicator", "devices", "/srv/node"),
 		port:             int(serverconf.GetInt("object-replicator", "bind_port", 6500)),
 		bindIp:           serverconf.GetDefault("object-replicator", "bind_ip", "0.0.0.0"),
@@ -966,8 +934,12 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, err
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get hash prefix and suffix")
 	}
-	for _, policy := range conf.LoadPolicies() {
-		if policy.Type != "replication" {
+	policies := conf.LoadPolicies()
+	if replicator.objEngines, err = buildObjectEngines(serverconf, flags, policies); err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		if _, ok := replicator.objEngines[policy.Index].(ReplicationEngine); policy.Type != "replication" || !ok {
 			continue
 		}
 		if replicator.Rings[policy.Index], err = GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index); err != nil {
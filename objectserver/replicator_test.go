@@ -233,8 +233,9 @@ func (d *patchableReplicationDevice) cleanTemp() {
 	d.replicationDevice.cleanTemp()
 }
 
-func newPatchableReplicationDevice(r *Replicator) *patchableReplicationDevice {
-	rd := newReplicationDevice(&ring.Device{}, 0, r)
+func newPatchableReplicationDevice(t *testing.T, r *Replicator) *patchableReplicationDevice {
+	rd, err := newReplicationDevice(&ring.Device{}, 0, r)
+	require.Nil(t, err)
 	prd := &patchableReplicationDevice{replicationDevice: rd}
 	rd.i = prd
 	return prd
@@ -388,7 +389,8 @@ func TestListObjFiles(t *testing.T) {
 	}
 	repl, err := newTestReplicator()
 	require.Nil(t, err)
-	rd := newReplicationDevice(&ring.Device{}, 0, repl)
+	rd, err := newReplicationDevice(&ring.Device{}, 0, repl)
+	require.Nil(t, err)
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
@@ -446,7 +448,8 @@ func TestCancelListObjFiles(t *testing.T) {
 	}
 	repl, err := newTestReplicator()
 	require.Nil(t, err)
-	rd := newReplicationDevice(&ring.Device{}, 0, repl)
+	rd, err := newReplicationDevice(&ring.Device{}, 0, repl)
+	require.Nil(t, err)
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
@@ -522,7 +525,7 @@ func TestSyncFile(t *testing.T) {
 		"name":           "/a/c/o",
 	})
 	dataReceived := 0
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			if sfr, ok := v.(*SyncFileResponse); ok {
@@ -574,7 +577,7 @@ func TestSyncFileExists(t *testing.T) {
 		"name":           "/a/c/o",
 	})
 	dataReceived := 0
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			if sfr, ok := v.(*SyncFileResponse); ok {
@@ -623,7 +626,7 @@ func TestSyncFileNewerExists(t *testing.T) {
 		"Content-Length": "9",
 		"name":           "/a/c/o",
 	})
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			if sfr, ok := v.(*SyncFileResponse); ok {
@@ -661,7 +664,7 @@ func TestReplicateLocal(t *testing.T) {
 	remoteDev := &ring.Device{Device: "sda"}
 	filename := filepath.Join(objPath, partition, "aaa", "00000000000000000000000000000000", "1472940619.68559")
 	syncFileCalled := false
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rd._beginReplication = func(dev *ring.Device, partition string, hashes bool, rChan chan beginReplicationResponse) {
 		fakeHashes := make(map[string]string)
 		fakeHashes["aaa"] = "hey"
@@ -704,7 +707,7 @@ func TestReplicateHandoff(t *testing.T) {
 	require.Nil(t, err)
 	defer file.Close()
 	syncFileCalled := false
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rd._beginReplication = func(dev *ring.Device, partition string, hashes bool, rChan chan beginReplicationResponse) {
 		rChan <- beginReplicationResponse{dev: remoteDev, hashes: make(map[string]string), conn: &mockRepConn{}}
 	}
@@ -737,7 +740,7 @@ func TestCleanTemp(t *testing.T) {
 	defer os.RemoveAll(deviceRoot)
 	replicator, err := newTestReplicator("bind_port", "1234", "check_mounts", "no", "devices", deviceRoot)
 	require.Nil(t, err)
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rd.dev.Device = "sda"
 	tmpDir := filepath.Join(deviceRoot, "sda", "tmp")
 	require.Nil(t, os.MkdirAll(tmpDir, 0777))
@@ -765,7 +768,7 @@ func TestReplicate(t *testing.T) {
 	}
 	replicator, err := newTestReplicator("bind_port", "1234", "check_mounts", "no")
 	require.Nil(t, err)
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rd._listPartitions = func() ([]string, error) {
 		return []string{"1", "2", "3"}, nil
 	}
@@ -788,7 +791,7 @@ func TestCancelReplicate(t *testing.T) {
 	}
 	replicator, err := newTestReplicator("bind_port", "1234", "check_mounts", "no")
 	require.Nil(t, err)
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rd._listPartitions = func() ([]string, error) {
 		return []string{"1", "2", "3"}, nil
 	}
@@ -823,7 +826,7 @@ func TestListPartitions(t *testing.T) {
 	require.Nil(t, os.MkdirAll(filepath.Join(objPath, "X"), 0777))
 	require.Nil(t, os.MkdirAll(filepath.Join(objPath, "Y"), 0777))
 	require.Nil(t, os.MkdirAll(filepath.Join(objPath, "Z"), 0777))
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rd.dev = &ring.Device{Device: "sda"}
 	partitions, err := rd.listPartitions()
 	require.Nil(t, err)
@@ -852,7 +855,7 @@ func TestReplicatePartition(t *testing.T) {
 	replicator, err := newTestReplicator("bind_port", "1234", "check_mounts", "no", "devices", deviceRoot)
 	require.Nil(t, err)
 	require.Nil(t, err)
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	replicateLocalCalled := false
 	replicateHandoffCalled := false
 	rd._replicateLocal = func(partition string, nodes []*ring.Device, moreNodes ring.MoreNodes) {
@@ -889,7 +892,7 @@ func TestProcessPriorityJobs(t *testing.T) {
 	defer os.RemoveAll(deviceRoot)
 	replicator, err := newTestReplicator()
 	require.Nil(t, err)
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rd.priRep = make(chan PriorityRepJob, 1)
 	rd.priRep <- PriorityRepJob{
 		Partition:  1,
@@ -989,7 +992,7 @@ func TestVerifyDevices(t *testing.T) {
 		newReplicationDevice = oldNewReplicationDevice
 	}()
 	newrdcalled := false
-	newReplicationDevice = func(dev *ring.Device, policy int, r *Replicator) *replicationDevice {
+	newReplicationDevice = func(dev *ring.Device, policy int, r *Replicator) (*replicationDevice, error) {
 		newrdcalled = true
 		require.Equal(t, "sda", dev.Device)
 		return oldNewReplicationDevice(dev, policy, r)
@@ -1425,7 +1428,7 @@ func TestAllDifferentRegionsSync(t *testing.T) {
 		"name":           "/a/c/o",
 	})
 	dataReceived := 0
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			if sfr, ok := v.(*SyncFileResponse); ok {
@@ -1480,7 +1483,7 @@ func TestAllSameRegionsSync(t *testing.T) {
 		"name":           "/a/c/o",
 	})
 	dataReceived := 0
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			if sfr, ok := v.(*SyncFileResponse); ok {
@@ -1535,7 +1538,7 @@ func TestHalfSameRegionsSync(t *testing.T) {
 		"name":           "/a/c/o",
 	})
 	dataReceived := 0
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			sfr, ok := v.(*SyncFileResponse)
@@ -1598,7 +1601,7 @@ func TestHalfSameRegionsSyncHandoffNotExists(t *testing.T) {
 	})
 	dataReceived := 0
 	gotACheck := false
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			sfr, ok := v.(*SyncFileResponse)
@@ -1665,7 +1668,7 @@ func TestHalfSameRegionsSyncHandoffYesExists(t *testing.T) {
 	})
 	dataReceived := 0
 	gotACheck := false
-	rd := newPatchableReplicationDevice(replicator)
+	rd := newPatchableReplicationDevice(t, replicator)
 	rc := &mockRepConn{
 		_RecvMessage: func(v interface{}, sfrq *SyncFileRequest) error {
 			sfr, ok := v.(*SyncFileResponse)
@@ -1701,3 +1704,20 @@ func TestHalfSameRegionsSyncHandoffYesExists(t *testing.T) {
 	require.Equal(t, 3, insync)
 	require.Equal(t, 18, dataReceived)
 }
+
+func TestReplicatorOwnReserve(t *testing.T) {
+	replicator, err := newTestReplicator("fallocate_reserve", "1234", "reclaim_age", "5678")
+	require.Nil(t, err)
+	require.Equal(t, int64(1234), replicator.reserve)
+	require.Equal(t, int64(5678), replicator.reclaimAge)
+}
+
+func TestNewReplicationDeviceNeedsReplicationEngine(t *testing.T) {
+	replicator, err := newTestReplicator()
+	require.Nil(t, err)
+	replicator.objEngines[7] = struct{ ObjectEngine }{}
+	_, err = newReplicationDevice(&ring.Device{}, 7, replicator)
+	require.NotNil(t, err)
+	_, err = newReplicationDevice(&ring.Device{}, 8, replicator)
+	require.NotNil(t, err)
+}
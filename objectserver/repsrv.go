@@ -142,11 +142,12 @@ func (r *Replicator) objReplicateHandler(writer http.ResponseWriter, request *ht
 	if len(vars["suffixes"]) > 0 {
 		recalculate = strings.Split(vars["suffixes"], "-")
 	}
-	policy, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
-	if err != nil {
-		policy = 0
+	engine, ok := r.replicationEngine(request)
+	if !ok {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
 	}
-	hashes, err := GetHashes(r.deviceRoot, vars["device"], vars["partition"], recalculate, r.reclaimAge, policy, srv.GetLogger(request))
+	hashes, err := engine.GetHashes(r.deviceRoot, vars["device"], vars["partition"], recalculate, r.reclaimAge, srv.GetLogger(request))
 	if err != nil {
 		srv.GetLogger(request).LogError("Unable to get hashes for %s/%s", vars["device"], vars["partition"])
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -162,11 +163,10 @@ func (r *Replicator) objRepConnHandler(writer http.ResponseWriter, request *http
 	var err error
 	var brr BeginReplicationRequest
 
-	vars := srv.GetVars(request)
-
-	policy, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
-	if err != nil {
-		policy = 0
+	engine, ok := r.replicationEngine(request)
+	if !ok {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
 	}
 
 	writer.WriteHeader(http.StatusOK)
@@ -195,7 +195,7 @@ func (r *Replicator) objRepConnHandler(writer http.ResponseWriter, request *http
 	defer r.replicationMan.Done(brr.Device)
 	var hashes map[string]string
 	if brr.NeedHashes {
-		hashes, err = GetHashes(r.deviceRoot, brr.Device, brr.Partition, nil, r.reclaimAge, policy, srv.GetLogger(request))
+		hashes, err = engine.GetHashes(r.deviceRoot, brr.Device, brr.Partition, nil, r.reclaimAge, srv.GetLogger(request))
 		if err != nil {
 			srv.GetLogger(request).LogError("[ObjRepConnHandler] Error getting hashes: %v", err)
 			writer.WriteHeader(http.StatusInternalServerError)
@@ -219,49 +219,31 @@ func (r *Replicator) objRepConnHandler(writer http.ResponseWriter, request *http
 			if sfr.Ping {
 				return "ping", rc.SendMessage(SyncFileResponse{Msg: "pong"})
 			}
-			tempDir := TempDirPath(r.deviceRoot, vars["device"])
 			fileName := filepath.Join(r.deviceRoot, sfr.Path)
-			hashDir := filepath.Dir(fileName)
 
 			if ext := filepath.Ext(fileName); (ext != ".data" && ext != ".ts" && ext != ".meta") || len(filepath.Base(filepath.Dir(fileName))) != 32 {
 				return "invalid file path", rc.SendMessage(SyncFileResponse{Msg: "bad file path"})
 			}
-			if fs.Exists(fileName) {
+			exists, newerExists := engine.CheckObjectFile(fileName)
+			if exists {
 				return "file exists", rc.SendMessage(SyncFileResponse{Exists: true, Msg: "exists"})
 			}
-			dataFile, metaFile := ObjectFiles(hashDir)
-			if filepath.Base(fileName) < filepath.Base(dataFile) || filepath.Base(fileName) < filepath.Base(metaFile) {
+			if newerExists {
 				return "newer file exists", rc.SendMessage(SyncFileResponse{NewerExists: true, Msg: "newer exists"})
 			}
 			if sfr.Check {
 				return "just check", rc.SendMessage(SyncFileResponse{Exists: false, Msg: "doesn't exist"})
 			}
-			tempFile, err := fs.NewAtomicFileWriter(tempDir, hashDir)
-			if err != nil {
-				return "creating file writer", err
-			}
-			defer tempFile.Abandon()
-			if err := tempFile.Preallocate(sfr.Size, r.reserve); err != nil {
-				return "preallocating space", err
-			}
-			if xattrs, err := hex.DecodeString(sfr.Xattrs); err != nil || len(xattrs) == 0 {
+			xattrs, err := hex.DecodeString(sfr.Xattrs)
+			if err != nil || len(xattrs) == 0 {
 				return "parsing xattrs", rc.SendMessage(SyncFileResponse{Msg: "bad xattrs"})
-			} else if err := RawWriteMetadata(tempFile.Fd(), xattrs); err != nil {
-				return "writing metadata", err
 			}
 			if err := rc.SendMessage(SyncFileResponse{GoAhead: true, Msg: "go ahead"}); err != nil {
 				return "sending go ahead", err
 			}
-			if _, err := common.CopyN(rc, sfr.Size, tempFile); err != nil {
-				return "copying data", err
-			}
-			if err := tempFile.Save(fileName); err != nil {
+			if err := engine.SaveObjectFile(fileName, xattrs, sfr.Size, rc, r.reserve, r.reclaimAge); err != nil {
 				return "saving file", err
 			}
-			if dataFile != "" || metaFile != "" {
-				HashCleanupListDir(hashDir, r.reclaimAge)
-			}
-			InvalidateHash(hashDir)
 			err = rc.SendMessage(FileUploadResponse{Success: true, Msg: "YAY"})
 			return "file done", err
 		}()
@@ -275,6 +257,16 @@ func (r *Replicator) objRepConnHandler(writer http.ResponseWriter, request *http
 	}
 }
 
+// replicationEngine returns the engine for the request's storage policy, if it can be replicated.
+func (r *Replicator) replicationEngine(request *http.Request) (ReplicationEngine, bool) {
+	policy, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		policy = 0
+	}
+	engine, ok := r.objEngines[policy].(ReplicationEngine)
+	return engine, ok
+}
+
 func (r *Replicator) LogRequest(next http.Handler) http.Handler {
 	fn := func(writer http.ResponseWriter, request *http.Request) {
 		newWriter := &srv.WebWriter{ResponseWriter: writer, Status: 500, ResponseStarted: false}
@@ -16,10 +16,12 @@
 package objectserver
 
 import (
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -29,6 +31,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/srv"
 )
 
 // SwiftObject implements an Object that is compatible with Swift's object server.
@@ -74,6 +77,14 @@ func (o *SwiftObject) Exists() bool {
 	return strings.HasSuffix(o.dataFile, ".data")
 }
 
+// Tombstone returns the timestamp from the name of the object's .ts file, if that's its newest file.
+func (o *SwiftObject) Tombstone() string {
+	if strings.HasSuffix(o.dataFile, ".ts") {
+		return strings.TrimSuffix(filepath.Base(o.dataFile), ".ts")
+	}
+	return ""
+}
+
 // Copy copies all data from the underlying .data file to the given writers.
 func (o *SwiftObject) Copy(dsts ...io.Writer) (written int64, err error) {
 	if len(dsts) == 1 {
@@ -219,6 +230,198 @@ func (f *SwiftObjectFactory) New(vars map[string]string, needData bool, asyncWG
 	return sor, nil
 }
 
+// ListPartitions returns the partition directories in objPath.
+func (f *SwiftObjectFactory) ListPartitions(objPath string, logger srv.LoggingContext) ([]string, error) {
+	names, err := fs.ReadDirNames(objPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	partitions := make([]string, 0, len(names))
+	for _, name := range names {
+		_, intErr := strconv.ParseUint(name, 10, 64)
+		if finfo, err := os.Stat(filepath.Join(objPath, name)); err != nil || intErr != nil || !finfo.Mode().IsDir() {
+			if logger != nil {
+				logger.LogError("Skipping invalid file in objects directory: %s", filepath.Join(objPath, name))
+			}
+			continue
+		}
+		partitions = append(partitions, name)
+	}
+	return partitions, nil
+}
+
+// GetHashes returns the partition's suffix hashes, from its hashes.pkl where they're still valid.
+func (f *SwiftObjectFactory) GetHashes(driveRoot string, device string, partition string, recalculate []string, reclaimAge int64, logger srv.LoggingContext) (map[string]string, error) {
+	return GetHashes(driveRoot, device, partition, recalculate, reclaimAge, f.policy, logger)
+}
+
+// ListObjectFiles sends the files in the partition's hash directories to objChan, removing any empty directories it
+// finds along the way.
+func (f *SwiftObjectFactory) ListObjectFiles(objChan chan string, cancel chan struct{}, partitionDir string, needSuffix func(string) bool, logger srv.LoggingContext) {
+	defer close(objChan)
+	suffixDirs, err := filepath.Glob(filepath.Join(partitionDir, "[a-f0-9][a-f0-9][a-f0-9]"))
+	if err != nil {
+		logger.LogError("[listObjFiles] %v", err)
+		return
+	}
+	if len(suffixDirs) == 0 {
+		os.Remove(filepath.Join(partitionDir, ".lock"))
+		os.Remove(filepath.Join(partitionDir, "hashes.pkl"))
+		os.Remove(filepath.Join(partitionDir, "hashes.invalid"))
+		os.Remove(partitionDir)
+		return
+	}
+	for i := len(suffixDirs) - 1; i > 0; i-- { // shuffle suffixDirs list
+		j := rand.Intn(i + 1)
+		suffixDirs[j], suffixDirs[i] = suffixDirs[i], suffixDirs[j]
+	}
+	for _, suffDir := range suffixDirs {
+		if !needSuffix(filepath.Base(suffDir)) {
+			continue
+		}
+		hashDirs, err := filepath.Glob(filepath.Join(suffDir, "????????????????????????????????"))
+		if err != nil {
+			logger.LogError("[listObjFiles] %v", err)
+			return
+		}
+		if len(hashDirs) == 0 {
+			os.Remove(suffDir)
+			continue
+		}
+		for _, hashDir := range hashDirs {
+			fileList, err := filepath.Glob(filepath.Join(hashDir, "*.[tdm]*"))
+			if len(fileList) == 0 {
+				os.Remove(hashDir)
+				continue
+			}
+			if err != nil {
+				logger.LogError("[listObjFiles] %v", err)
+				return
+			}
+			for _, objFile := range fileList {
+				select {
+				case objChan <- objFile:
+				case <-cancel:
+					return
+				}
+			}
+		}
+	}
+}
+
+// ListObjectHashes returns the hash directories in a partition, skipping anything that doesn't look like one.
+func (f *SwiftObjectFactory) ListObjectHashes(partitionDir string, logger srv.LoggingContext) ([]string, error) {
+	suffixes, err := fs.ReadDirNames(partitionDir)
+	if err != nil {
+		return nil, err
+	}
+	var hashDirs []string
+	for _, suffix := range suffixes {
+		suffixDir := filepath.Join(partitionDir, suffix)
+		if suffix == ".lock" || suffix == "hashes.pkl" || suffix == "hashes.invalid" {
+			continue
+		}
+		_, hexErr := strconv.ParseInt(suffix, 16, 64)
+		if finfo, err := os.Stat(suffixDir); err != nil || len(suffix) != 3 || hexErr != nil || !finfo.Mode().IsDir() {
+			if logger != nil {
+				logger.LogError("Skipping invalid file in partition: %s", suffixDir)
+			}
+			continue
+		}
+		hashes, err := fs.ReadDirNames(suffixDir)
+		if err != nil {
+			if logger != nil {
+				logger.LogError("Error reading suffix dir %s", suffixDir)
+			}
+			continue
+		}
+		for _, hash := range hashes {
+			hashDir := filepath.Join(suffixDir, hash)
+			_, hexErr := hex.DecodeString(hash)
+			if finfo, err := os.Stat(hashDir); err != nil || len(hash) != 32 || hexErr != nil || !finfo.Mode().IsDir() {
+				if logger != nil {
+					logger.LogError("Skipping invalid file in suffix: %s", hashDir)
+				}
+				continue
+			}
+			hashDirs = append(hashDirs, hashDir)
+		}
+	}
+	return hashDirs, nil
+}
+
+// OpenObjectFile opens an object file and reads its xattrs, doing a mini-audit on the way.
+func (f *SwiftObjectFactory) OpenObjectFile(objFile string) (io.ReadCloser, []byte, int64, error) {
+	fp, xattrs, size, err := getFile(objFile)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return fp, xattrs, size, nil
+}
+
+// CheckObjectFile reports whether the file exists, or if the hash directory has a newer .data, .ts or .meta file.
+func (f *SwiftObjectFactory) CheckObjectFile(objFile string) (bool, bool) {
+	if fs.Exists(objFile) {
+		return true, false
+	}
+	dataFile, metaFile := ObjectFiles(filepath.Dir(objFile))
+	return false, filepath.Base(objFile) < filepath.Base(dataFile) || filepath.Base(objFile) < filepath.Base(metaFile)
+}
+
+// SaveObjectFile atomically writes an object file with the given xattrs, then cleans up its hash directory.
+func (f *SwiftObjectFactory) SaveObjectFile(objFile string, xattrs []byte, size int64, data io.Reader, reserve int64, reclaimAge int64) error {
+	hashDir := filepath.Dir(objFile)
+	//                                        suffix       partition    objects      device
+	tempDir := filepath.Join(filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(hashDir)))), "tmp")
+	dataFile, metaFile := ObjectFiles(hashDir)
+	tempFile, err := fs.NewAtomicFileWriter(tempDir, hashDir)
+	if err != nil {
+		return err
+	}
+	defer tempFile.Abandon()
+	if err := tempFile.Preallocate(size, reserve); err != nil {
+		return err
+	}
+	if err := RawWriteMetadata(tempFile.Fd(), xattrs); err != nil {
+		return err
+	}
+	if _, err := common.CopyN(data, size, tempFile); err != nil {
+		return err
+	}
+	if err := tempFile.Save(objFile); err != nil {
+		return err
+	}
+	if dataFile != "" || metaFile != "" {
+		HashCleanupListDir(hashDir, reclaimAge)
+	}
+	return InvalidateHash(hashDir)
+}
+
+// RemoveObjectFile removes an object file, and its hash directory if that leaves it empty.
+func (f *SwiftObjectFactory) RemoveObjectFile(objFile string) error {
+	if err := os.Remove(objFile); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(objFile))
+	return InvalidateHash(filepath.Dir(objFile))
+}
+
+// AuditHash audits the files in a hash directory.
+func (f *SwiftObjectFactory) AuditHash(hashPath string, skipMd5 bool) (int64, error) {
+	return auditHash(hashPath, skipMd5)
+}
+
+// QuarantineHash moves a hash directory to the device's quarantined directory.
+func (f *SwiftObjectFactory) QuarantineHash(hashPath string) error {
+	if err := QuarantineHash(hashPath); err != nil {
+		return err
+	}
+	return InvalidateHash(hashPath)
+}
+
 var replicationDone = fmt.Errorf("Replication done")
 
 // SwiftEngineConstructor creates a SwiftObjectFactory given the object server configs.
@@ -240,10 +443,11 @@ func SwiftEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag
 }
 
 func init() {
-	RegisterObjectEngine("replication", SwiftEngineConstructor)
+	RegisterObjectEngine("swift", SwiftEngineConstructor)
 }
 
 // make sure these things satisfy interfaces at compile time
 var _ ObjectEngineConstructor = SwiftEngineConstructor
 var _ Object = &SwiftObject{}
 var _ ObjectEngine = &SwiftObjectFactory{}
+var _ ReplicationEngine = &SwiftObjectFactory{}
@@ -9,7 +9,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/pickle"
 )
 
 func TestSwiftObjectRoundtrip(t *testing.T) {
@@ -162,6 +164,7 @@ func TestSwiftObjectDelete(t *testing.T) {
 	require.Nil(t, err)
 	defer swo.Close()
 	require.True(t, swo.Exists())
+	require.Equal(t, "", swo.Tombstone())
 	err = swo.Delete(map[string]string{"X-Timestamp": "1234567891.123456"})
 	require.Nil(t, err)
 
@@ -169,4 +172,19 @@ func TestSwiftObjectDelete(t *testing.T) {
 	require.Nil(t, err)
 	defer swo.Close()
 	require.False(t, swo.Exists())
+	require.Equal(t, "1234567891.123456", swo.Tombstone())
+}
+
+func TestSwiftObjectSaveObjectFileReserve(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	// the caller's reserve applies, not the factory's.
+	swcon := &SwiftObjectFactory{driveRoot: driveRoot, hashPathPrefix: "prefix", hashPathSuffix: "suffix", reserve: 1 << 62}
+	objFile := filepath.Join(driveRoot, "sda", "objects", "1", "fff", "00000000000000000000000000000fff", "1234567890.12345.data")
+	xattrs := pickle.PickleDumps(map[string]string{"Content-Length": "1", "X-Timestamp": "1234567890.12345"})
+	require.NotNil(t, swcon.SaveObjectFile(objFile, xattrs, 1, bytes.NewBufferString("!"), 1<<62, int64(common.ONE_WEEK)))
+	require.False(t, fs.Exists(objFile))
+	require.Nil(t, swcon.SaveObjectFile(objFile, xattrs, 1, bytes.NewBufferString("!"), 0, int64(common.ONE_WEEK)))
+	require.True(t, fs.Exists(objFile))
 }
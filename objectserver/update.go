@@ -74,7 +74,11 @@ func (server *ObjectServer) expirerContainer(deleteAt time.Time, account, contai
 	return fmt.Sprintf("%010d", timestamp)
 }
 
-func (server *ObjectServer) sendContainerUpdate(host, device, method, partition, account, container, obj string, headers http.Header) bool {
+// maxUpdateRedirects is how many times a container update follows redirects to shard containers before it's given up
+// on, so a redirect loop leaves an async pending instead of recursing forever.
+const maxUpdateRedirects = 4
+
+func (server *ObjectServer) sendContainerUpdate(host, device, method, partition, account, container, obj string, headers http.Header, redirects int) bool {
 	obj_url := fmt.Sprintf("http://%s/%s/%s/%s/%s/%s", host, device, partition,
 		common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 	if req, err := http.NewRequest(method, obj_url, nil); err == nil {
@@ -83,12 +87,33 @@ func (server *ObjectServer) sendContainerUpdate(host, device, method, partition,
 			resp.Body.Close()
 			if resp.StatusCode/100 == 2 {
 				return true
+			} else if resp.StatusCode == http.StatusMovedPermanently && redirects < maxUpdateRedirects {
+				return server.sendRedirectedUpdate(method, obj, headers, resp.Header, redirects+1)
 			}
 		}
 	}
 	return false
 }
 
+// sendRedirectedUpdate sends a container update on to the shard container that a sharded container redirected it to.
+func (server *ObjectServer) sendRedirectedUpdate(method, obj string, headers http.Header, redirect http.Header, redirects int) bool {
+	account := redirect.Get("X-Backend-Redirect-Account")
+	container := redirect.Get("X-Backend-Redirect-Container")
+	partition := redirect.Get("X-Backend-Redirect-Partition")
+	hosts := splitHeader(redirect.Get("X-Backend-Redirect-Host"))
+	devices := splitHeader(redirect.Get("X-Backend-Redirect-Device"))
+	if account == "" || container == "" || partition == "" || len(hosts) != len(devices) {
+		return false
+	}
+	successes := 0
+	for index := range hosts {
+		if server.sendContainerUpdate(hosts[index], devices[index], method, partition, account, container, obj, headers, redirects) {
+			successes++
+		}
+	}
+	return successes > 0
+}
+
 func (server *ObjectServer) saveAsync(method, account, container, obj, localDevice string, headers http.Header) {
 	hash := server.hashPath(account, container, obj)
 	asyncFile := filepath.Join(server.driveRoot, localDevice, "async_pending", hash[29:32], hash+"-"+headers.Get("X-Timestamp"))
@@ -128,10 +153,18 @@ func (server *ObjectServer) updateContainer(metadata map[string]string, request
 		requestHeaders.Add("X-Content-Type", metadata["Content-Type"])
 		requestHeaders.Add("X-Size", metadata["Content-Length"])
 		requestHeaders.Add("X-Etag", metadata["ETag"])
+		// middleware can replace the values sent to the container, e.g. to record a symlink's target in listings.
+		for _, header := range []http.Header{request.Header, request.Trailer} {
+			for key := range header {
+				if strings.HasPrefix(key, "X-Backend-Container-Update-Override-") && header.Get(key) != "" {
+					requestHeaders.Set("X-"+strings.TrimPrefix(key, "X-Backend-Container-Update-Override-"), header.Get(key))
+				}
+			}
+		}
 	}
 	failures := 0
 	for index := range hosts {
-		if !server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, vars["account"], vars["container"], vars["obj"], requestHeaders) {
+		if !server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, vars["account"], vars["container"], vars["obj"], requestHeaders, 0) {
 			logger.LogError("ERROR container update failed with %s/%s (saving for async update later)", hosts[index], devices[index])
 			failures++
 		}
@@ -168,7 +201,7 @@ func (server *ObjectServer) updateDeleteAt(request *http.Request, deleteAtStr st
 	}
 	failures := 0
 	for index := range hosts {
-		if !server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, deleteAtAccount, container, obj, requestHeaders) {
+		if !server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, deleteAtAccount, container, obj, requestHeaders, 0) {
 			logger.LogError("ERROR container update failed with %s/%s (saving for async update later)", hosts[index], devices[index])
 			failures++
 		}
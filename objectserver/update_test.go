@@ -193,6 +193,41 @@ func TestUpdateContainer(t *testing.T) {
 	require.Equal(t, asyncData["obj"], "o")
 }
 
+func TestUpdateContainerOverride(t *testing.T) {
+	ts, err := makeObjectServer()
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+
+	requestSent := false
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/symlink;symlink_path=/v1/a/c/o2", r.Header.Get("X-Content-Type"))
+		require.Equal(t, "0", r.Header.Get("X-Size"))
+		require.Equal(t, "", r.Header.Get("X-Backend-Container-Update-Override-Content-Type"))
+		requestSent = true
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", u.Host)
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	req.Header.Add("X-Backend-Container-Update-Override-Content-Type", "application/symlink;symlink_path=/v1/a/c/o2")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{
+		"X-Timestamp":    "12345.789",
+		"Content-Type":   "application/octet-stream",
+		"Content-Length": "0",
+		"ETag":           "d41d8cd98f00b204e9800998ecf8427e",
+	}
+	server.updateContainer(metadata, req, vars, &DummyLogger{})
+	require.True(t, requestSent)
+}
+
 func TestUpdateContainerNoHeaders(t *testing.T) {
 	ts, err := makeObjectServer()
 	require.Nil(t, err)
@@ -227,3 +262,100 @@ func TestUpdateContainerNoHeaders(t *testing.T) {
 	expectedFile := filepath.Join(ts.root, "sda", "async_pending", "099", "2f714cd91b0e5d803cde2012b01d7099-12345.6789")
 	require.False(t, fs.Exists(expectedFile))
 }
+
+func TestUpdateContainerRedirect(t *testing.T) {
+	ts, err := makeObjectServer()
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+	server.hashPathPrefix = ""
+	server.hashPathSuffix = "changeme"
+
+	shardRequestSent := false
+	shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/sdc/2/.shards_a/c-1/o", r.URL.Path)
+		require.Equal(t, "30", r.Header.Get("X-Size"))
+		shardRequestSent = true
+	}))
+	defer shard.Close()
+	su, err := url.Parse(shard.URL)
+	require.Nil(t, err)
+	root := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/sdb/1/a/c/o", r.URL.Path)
+		w.Header().Set("X-Backend-Redirect-Account", ".shards_a")
+		w.Header().Set("X-Backend-Redirect-Container", "c-1")
+		w.Header().Set("X-Backend-Redirect-Partition", "2")
+		w.Header().Set("X-Backend-Redirect-Host", su.Host)
+		w.Header().Set("X-Backend-Redirect-Device", "sdc")
+		w.WriteHeader(http.StatusMovedPermanently)
+	}))
+	defer root.Close()
+	u, err := url.Parse(root.URL)
+	require.Nil(t, err)
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", u.Host)
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{
+		"X-Timestamp":    "12345.789",
+		"Content-Type":   "text/plain",
+		"Content-Length": "30",
+		"ETag":           "ffffffffffffffffffffffffffffffff",
+	}
+	dl := DummyLogger{}
+	server.updateContainer(metadata, req, vars, &dl)
+	require.True(t, shardRequestSent)
+	expectedFile := filepath.Join(ts.root, "sda", "async_pending", "099", "2f714cd91b0e5d803cde2012b01d7099-12345.6789")
+	require.False(t, fs.Exists(expectedFile))
+
+	shard.Close()
+	server.updateContainer(metadata, req, vars, &dl)
+	require.True(t, fs.Exists(expectedFile))
+}
+
+func TestUpdateContainerRedirectLoop(t *testing.T) {
+	ts, err := makeObjectServer()
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+	server.hashPathPrefix = ""
+	server.hashPathSuffix = "changeme"
+
+	requests := 0
+	var host string
+	loop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-Backend-Redirect-Account", ".shards_a")
+		w.Header().Set("X-Backend-Redirect-Container", "c-1")
+		w.Header().Set("X-Backend-Redirect-Partition", "2")
+		w.Header().Set("X-Backend-Redirect-Host", host)
+		w.Header().Set("X-Backend-Redirect-Device", "sdc")
+		w.WriteHeader(http.StatusMovedPermanently)
+	}))
+	defer loop.Close()
+	u, err := url.Parse(loop.URL)
+	require.Nil(t, err)
+	host = u.Host
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", u.Host)
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{
+		"X-Timestamp":    "12345.789",
+		"Content-Type":   "text/plain",
+		"Content-Length": "30",
+		"ETag":           "ffffffffffffffffffffffffffffffff",
+	}
+	dl := DummyLogger{}
+	server.updateContainer(metadata, req, vars, &dl)
+	require.Equal(t, maxUpdateRedirects+1, requests)
+	require.True(t, fs.Exists(filepath.Join(ts.root, "sda", "async_pending", "099", "2f714cd91b0e5d803cde2012b01d7099-12345.6789")))
+}
@@ -144,6 +144,7 @@ func NewEnvironment(settings ...string) *Environment {
 			0: {
 				Index:      0,
 				Type:       "replication",
+				Engine:     "swift",
 				Name:       "Policy-0",
 				Aliases:    nil,
 				Default:    false,
@@ -152,6 +153,7 @@ func NewEnvironment(settings ...string) *Environment {
 			1: {
 				Index:      1,
 				Type:       "replication",
+				Engine:     "swift",
 				Name:       "Policy-1",
 				Aliases:    nil,
 				Default:    false,
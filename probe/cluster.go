@@ -0,0 +1,579 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package probe
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/troubling/hummingbird/accountserver"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/containerserver"
+	"github.com/troubling/hummingbird/objectserver"
+	"github.com/troubling/hummingbird/proxyserver"
+)
+
+// The servers run by each node of a Cluster.
+const (
+	accountServer    = "account"
+	containerServer  = "container"
+	objectServer     = "object"
+	objectReplicator = "object-replicator"
+)
+
+var nodeServers = []string{accountServer, containerServer, objectServer, objectReplicator}
+
+// clusterDevice is the one device on each of a Cluster's nodes, shared by its account, container and object servers.
+const clusterDevice = "sda"
+
+// clusterAccount is the account the Cluster's client uses, set up in the proxy's tempauth section.
+const clusterAccount = "AUTH_test"
+
+// clusterServer is a server that stays at the same address in the rings while it's killed and restarted.
+type clusterServer struct {
+	addr   string
+	build  func() (http.Handler, error)
+	server *httptest.Server
+}
+
+// start builds a fresh handler and serves it, on listener if it's given or else on a new listener at the server's
+// address.
+func (s *clusterServer) start(listener net.Listener) error {
+	if s.server != nil {
+		return nil
+	}
+	handler, err := s.build()
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return err
+	}
+	if listener == nil {
+		if listener, err = net.Listen("tcp", s.addr); err != nil {
+			return err
+		}
+	}
+	s.server = httptest.NewUnstartedServer(handler)
+	s.server.Listener.Close()
+	s.server.Listener = listener
+	s.server.Start()
+	return nil
+}
+
+func (s *clusterServer) stop() {
+	if s.server != nil {
+		s.server.Close()
+		s.server = nil
+	}
+}
+
+func (s *clusterServer) port() int {
+	_, port, _ := net.SplitHostPort(s.addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// clusterNode is one storage node of a Cluster, like a SAIO node: an account, container and object server and
+// their replicators, all sharing a single device.
+type clusterNode struct {
+	driveRoot   string
+	config      conf.Config
+	servers     map[string]*clusterServer
+	lock        sync.Mutex
+	replicators map[string]srv.Daemon
+	unmounted   bool
+}
+
+// mountCheck stands in for the servers' mount checks, which can't be used without real mount points.
+func (n *clusterNode) mountCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		n.lock.Lock()
+		unmounted := n.unmounted
+		n.lock.Unlock()
+		if unmounted && strings.HasPrefix(request.URL.Path, "/"+clusterDevice+"/") {
+			srv.StandardResponse(writer, 507)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func (n *clusterNode) replicator(serverType string) srv.Daemon {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.replicators[serverType]
+}
+
+func (n *clusterNode) setReplicator(serverType string, replicator srv.Daemon) {
+	n.lock.Lock()
+	n.replicators[serverType] = replicator
+	n.lock.Unlock()
+}
+
+func (n *clusterNode) buildAccountServer() (http.Handler, error) {
+	_, _, server, _, err := accountserver.GetServer(n.config, &flag.FlagSet{})
+	if err != nil {
+		return nil, err
+	}
+	return n.mountCheck(server.GetHandler(n.config)), nil
+}
+
+func (n *clusterNode) buildContainerServer() (http.Handler, error) {
+	_, _, server, _, err := containerserver.GetServer(n.config, &flag.FlagSet{})
+	if err != nil {
+		return nil, err
+	}
+	return n.mountCheck(server.GetHandler(n.config)), nil
+}
+
+func (n *clusterNode) buildObjectServer() (http.Handler, error) {
+	_, _, server, _, err := objectserver.GetServer(n.config, &flag.FlagSet{})
+	if err != nil {
+		return nil, err
+	}
+	return n.mountCheck(server.GetHandler(n.config)), nil
+}
+
+// buildObjectReplicator replaces the node's object replicator, since it's also the server that the other nodes'
+// replicators talk to.
+func (n *clusterNode) buildObjectReplicator() (http.Handler, error) {
+	replicator, err := objectserver.NewReplicator(n.config, &flag.FlagSet{})
+	if err != nil {
+		return nil, err
+	}
+	n.setReplicator(objectServer, replicator)
+	return n.mountCheck(replicator.(*objectserver.Replicator).GetHandler()), nil
+}
+
+// Cluster is a temporary SAIO-style cluster: a proxy in front of a number of nodes that each run an account,
+// container and object server and their replicators, all on httptest listeners.  The rings are real rings, built
+// in a temp dir with one device per node.
+//
+// The package-level GetRing functions of the account, container and object servers and the proxy's client and
+// memcache constructors are overridden until the Cluster is closed, so only one Cluster should be open at a time.
+type Cluster struct {
+	root                                   string
+	hashPrefix, hashSuffix                 string
+	accountRing, containerRing, objectRing ring.Ring
+	nodes                                  []*clusterNode
+	proxy                                  *clusterServer
+	cache                                  *memoryCache
+	client                                 client.Client
+	restore                                func()
+}
+
+// Close stops all of the servers and removes the cluster's rings and devices.
+func (c *Cluster) Close() {
+	if c.proxy != nil {
+		c.proxy.stop()
+	}
+	for _, n := range c.nodes {
+		for _, s := range n.servers {
+			s.stop()
+		}
+	}
+	if c.restore != nil {
+		c.restore()
+	}
+	os.RemoveAll(c.root)
+}
+
+func (c *Cluster) getRing(ringType, prefix, suffix string, policy int) (ring.Ring, error) {
+	switch ringType {
+	case "account":
+		return c.accountRing, nil
+	case "container":
+		return c.containerRing, nil
+	case "object":
+		return c.objectRing, nil
+	}
+	return nil, fmt.Errorf("Error loading %s:%d ring", ringType, policy)
+}
+
+// override points the servers and the proxy at the cluster's rings and cache, and remembers how to undo it.
+func (c *Cluster) override() {
+	oldAccountGetRing := accountserver.GetRing
+	oldContainerGetRing := containerserver.GetRing
+	oldObjectGetRing := objectserver.GetRing
+	oldNewProxyDirectClient := proxyserver.NewProxyDirectClient
+	oldNewMemcacheRing := proxyserver.NewMemcacheRing
+	c.restore = func() {
+		accountserver.GetRing = oldAccountGetRing
+		containerserver.GetRing = oldContainerGetRing
+		objectserver.GetRing = oldObjectGetRing
+		proxyserver.NewProxyDirectClient = oldNewProxyDirectClient
+		proxyserver.NewMemcacheRing = oldNewMemcacheRing
+	}
+	accountserver.GetRing = c.getRing
+	containerserver.GetRing = c.getRing
+	objectserver.GetRing = c.getRing
+	proxyserver.NewProxyDirectClient = func(config conf.Section) (client.ProxyClient, error) {
+		return client.NewProxyDirectClientWithRings(c.accountRing, c.containerRing, c.objectRing)
+	}
+	proxyserver.NewMemcacheRing = func(serverconf conf.Config) (ring.MemcacheRing, error) {
+		return c.cache, nil
+	}
+}
+
+// buildRing writes a ring with one device per node, on the port of the given server, and loads it.
+func (c *Cluster) buildRing(ringType string, serverType, replicationServerType string) (ring.Ring, error) {
+	builder, err := ring.NewRingBuilder(6, 3, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range c.nodes {
+		if _, err := builder.AddDevice(ring.BuilderDevice{
+			Id: i, Region: 1, Zone: i + 1, Ip: "127.0.0.1", Port: n.servers[serverType].port(),
+			ReplicationIp: "127.0.0.1", ReplicationPort: n.servers[replicationServerType].port(),
+			Device: clusterDevice, Weight: 100,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := builder.Rebalance(); err != nil {
+		return nil, err
+	}
+	ringFile := filepath.Join(c.root, ringType+".ring.gz")
+	if err := builder.WriteRing(ringFile); err != nil {
+		return nil, err
+	}
+	return ring.LoadRing(ringFile, c.hashPrefix, c.hashSuffix)
+}
+
+func (c *Cluster) ringFor(serverType string) ring.Ring {
+	switch serverType {
+	case accountServer:
+		return c.accountRing
+	case containerServer:
+		return c.containerRing
+	}
+	return c.objectRing
+}
+
+// Kill stops one of a node's servers: "account", "container", "object" or "object-replicator".
+func (c *Cluster) Kill(node int, serverType string) {
+	c.nodes[node].servers[serverType].stop()
+}
+
+// Restart starts a killed server back up on the same port, with fresh state.
+func (c *Cluster) Restart(node int, serverType string) error {
+	return c.nodes[node].servers[serverType].start(nil)
+}
+
+// KillNode stops all of a node's servers.
+func (c *Cluster) KillNode(node int) {
+	for _, s := range c.nodes[node].servers {
+		s.stop()
+	}
+}
+
+// RestartNode starts all of a node's killed servers back up.
+func (c *Cluster) RestartNode(node int) error {
+	for _, serverType := range nodeServers {
+		if err := c.Restart(node, serverType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmountDevice makes a node's device look unmounted: its contents are moved out of the way, leaving an empty mount
+// point, and the node's servers respond to requests for it with 507s.
+func (c *Cluster) UnmountDevice(node int) error {
+	n := c.nodes[node]
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.unmounted {
+		return nil
+	}
+	devicePath := filepath.Join(n.driveRoot, clusterDevice)
+	if err := os.Rename(devicePath, devicePath+".unmounted"); err != nil {
+		return err
+	}
+	n.unmounted = true
+	return os.MkdirAll(devicePath, 0755)
+}
+
+// MountDevice puts back a device that was unmounted with UnmountDevice.
+func (c *Cluster) MountDevice(node int) error {
+	n := c.nodes[node]
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.unmounted {
+		return nil
+	}
+	devicePath := filepath.Join(n.driveRoot, clusterDevice)
+	if err := os.RemoveAll(devicePath); err != nil {
+		return err
+	}
+	if err := os.Rename(devicePath+".unmounted", devicePath); err != nil {
+		return err
+	}
+	n.unmounted = false
+	return nil
+}
+
+// Replicate runs one pass of a node's "account", "container" or "object" replicator.
+func (c *Cluster) Replicate(node int, serverType string) {
+	if replicator := c.nodes[node].replicator(serverType); replicator != nil {
+		replicator.Run()
+	}
+}
+
+// PrimaryNodes returns the nodes that hold the account, container or object (depending on which of them are given) in
+// the serverType's ring, in replica order, followed by the first handoff node.
+func (c *Cluster) PrimaryNodes(serverType, account, container, obj string) (primaries []int, handoff int) {
+	r := c.ringFor(serverType)
+	partition := r.GetPartition(account, container, obj)
+	for _, dev := range r.GetNodesInOrder(partition) {
+		primaries = append(primaries, dev.Id)
+	}
+	handoff = -1
+	if dev := r.GetMoreNodes(partition).Next(); dev != nil {
+		handoff = dev.Id
+	}
+	return primaries, handoff
+}
+
+// backendRequest sends a request straight to one of a node's servers.
+func (c *Cluster) backendRequest(node int, serverType, method, account, container, obj, query string) (*http.Response, error) {
+	partition := c.ringFor(serverType).GetPartition(account, container, obj)
+	path := "/" + common.Urlencode(account)
+	if container != "" {
+		path += "/" + common.Urlencode(container)
+	}
+	if obj != "" {
+		path += "/" + common.Urlencode(obj)
+	}
+	url := fmt.Sprintf("http://%s/%s/%d%s", c.nodes[node].servers[serverType].addr, clusterDevice, partition, path)
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	return http.DefaultClient.Do(req)
+}
+
+// ObjectExists returns whether the node's object server has the object.
+func (c *Cluster) ObjectExists(node int, account, container, obj string) bool {
+	resp, err := c.backendRequest(node, objectServer, "HEAD", account, container, obj, "")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == 200
+}
+
+// AccountListing returns the container names in the node's copy of the account.
+func (c *Cluster) AccountListing(node int, account string) ([]string, error) {
+	resp, err := c.backendRequest(node, accountServer, "GET", account, "", "", "format=json")
+	if err != nil {
+		return nil, err
+	}
+	return listingNames(resp, "Account")
+}
+
+// ContainerListing returns the object names in the node's copy of the container.
+func (c *Cluster) ContainerListing(node int, account, container string) ([]string, error) {
+	resp, err := c.backendRequest(node, containerServer, "GET", account, container, "", "format=json")
+	if err != nil {
+		return nil, err
+	}
+	return listingNames(resp, "Container")
+}
+
+// listingNames reads the names out of a json account or container listing response.
+func listingNames(resp *http.Response, kind string) ([]string, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s GET returned %d", kind, resp.StatusCode)
+	}
+	var listing []struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, l := range listing {
+		names = append(names, l.Name)
+	}
+	return names, nil
+}
+
+// ObjectHashDir returns the object's hash directory on the node.
+func (c *Cluster) ObjectHashDir(node int, account, container, obj string) string {
+	partition := c.objectRing.GetPartition(account, container, obj)
+	vars := map[string]string{"account": account, "container": container, "obj": obj,
+		"partition": strconv.FormatUint(partition, 10), "device": clusterDevice}
+	return objectserver.ObjHashDir(vars, c.nodes[node].driveRoot, c.hashPrefix, c.hashSuffix, 0)
+}
+
+// AsyncPendings returns how many container updates the node's object server has saved for later.
+func (c *Cluster) AsyncPendings(node int) int {
+	count := 0
+	filepath.Walk(filepath.Join(c.nodes[node].driveRoot, clusterDevice, "async_pending"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// NewCluster creates and starts a cluster of the given number of nodes, which should be at least four so that
+// there's a handoff node for every partition.  Settings are key, value pairs added to the DEFAULT section of every
+// node's configuration.  If the cluster can't be started, whatever was set up is closed again.
+func NewCluster(nodeCount int, settings ...string) (*Cluster, error) {
+	c := &Cluster{cache: newMemoryCache()}
+	if err := c.start(nodeCount, settings); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cluster) start(nodeCount int, settings []string) (err error) {
+	if c.root, err = ioutil.TempDir("", "probe"); err != nil {
+		return err
+	}
+	if c.hashPrefix, c.hashSuffix, err = conf.GetHashPrefixAndSuffix(); err != nil {
+		return err
+	}
+	c.override()
+
+	// listen first, so the rings can be built before any of the servers.  Listeners that never got a server are
+	// closed if something goes wrong.
+	var listeners []net.Listener
+	defer func() {
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}()
+	listen := func() (net.Listener, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			listeners = append(listeners, l)
+		}
+		return l, err
+	}
+	nodeListeners := make([]map[string]net.Listener, nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		n := &clusterNode{
+			driveRoot:   filepath.Join(c.root, fmt.Sprintf("node%d", i)),
+			servers:     make(map[string]*clusterServer),
+			replicators: make(map[string]srv.Daemon),
+		}
+		if err := os.MkdirAll(filepath.Join(n.driveRoot, clusterDevice), 0755); err != nil {
+			return err
+		}
+		nodeListeners[i] = make(map[string]net.Listener)
+		for _, serverType := range nodeServers {
+			if nodeListeners[i][serverType], err = listen(); err != nil {
+				return err
+			}
+			n.servers[serverType] = &clusterServer{addr: nodeListeners[i][serverType].Addr().String()}
+		}
+		n.servers[accountServer].build = n.buildAccountServer
+		n.servers[containerServer].build = n.buildContainerServer
+		n.servers[objectServer].build = n.buildObjectServer
+		n.servers[objectReplicator].build = n.buildObjectReplicator
+		c.nodes = append(c.nodes, n)
+	}
+	if c.accountRing, err = c.buildRing("account", accountServer, accountServer); err != nil {
+		return err
+	}
+	if c.containerRing, err = c.buildRing("container", containerServer, containerServer); err != nil {
+		return err
+	}
+	if c.objectRing, err = c.buildRing("object", objectServer, objectReplicator); err != nil {
+		return err
+	}
+
+	for i, n := range c.nodes {
+		configString := "[DEFAULT]\nmount_check=false\nbind_ip=127.0.0.1\n"
+		configString += fmt.Sprintf("devices=%s\n", n.driveRoot)
+		configString += fmt.Sprintf("recon_cache_path=%s\n", n.driveRoot)
+		for j := 0; j < len(settings); j += 2 {
+			configString += fmt.Sprintf("%s=%s\n", settings[j], settings[j+1])
+		}
+		configString += fmt.Sprintf("[app:account-server]\nbind_port=%d\n", n.servers[accountServer].port())
+		configString += fmt.Sprintf("[account-replicator]\nbind_port=%d\n", n.servers[accountServer].port())
+		configString += fmt.Sprintf("[app:container-server]\nbind_port=%d\n", n.servers[containerServer].port())
+		configString += fmt.Sprintf("[container-replicator]\nbind_port=%d\n", n.servers[containerServer].port())
+		configString += fmt.Sprintf("[app:object-server]\nbind_port=%d\n", n.servers[objectServer].port())
+		configString += fmt.Sprintf("[object-replicator]\nbind_port=%d\n", n.servers[objectReplicator].port())
+		if n.config, err = conf.StringConfig(configString); err != nil {
+			return err
+		}
+		replicator, err := accountserver.GetReplicator(n.config, &flag.FlagSet{})
+		if err != nil {
+			return err
+		}
+		n.setReplicator(accountServer, replicator)
+		if replicator, err = containerserver.GetReplicator(n.config, &flag.FlagSet{}); err != nil {
+			return err
+		}
+		n.setReplicator(containerServer, replicator)
+		for _, serverType := range nodeServers {
+			if err := n.servers[serverType].start(nodeListeners[i][serverType]); err != nil {
+				return err
+			}
+		}
+	}
+
+	proxyListener, err := listen()
+	if err != nil {
+		return err
+	}
+	c.proxy = &clusterServer{addr: proxyListener.Addr().String()}
+	proxyConfig, err := conf.StringConfig("[DEFAULT]\n[app:proxy-server]\n[filter:tempauth]\nuser_test_tester=testing .admin\n")
+	if err != nil {
+		return err
+	}
+	c.proxy.build = func() (http.Handler, error) {
+		_, _, server, _, err := proxyserver.GetServer(proxyConfig, &flag.FlagSet{})
+		if err != nil {
+			return nil, err
+		}
+		return server.GetHandler(proxyConfig), nil
+	}
+	if err := c.proxy.start(proxyListener); err != nil {
+		return err
+	}
+	c.client, err = client.NewClient("", "test:tester", "", "testing", "", "http://"+c.proxy.addr+"/auth/v1.0", false)
+	return err
+}
@@ -0,0 +1,241 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package probe
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventually polls f for a few seconds, since the proxy returns as soon as it has a quorum and the last backend
+// request may still be finishing.
+func eventually(f func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if f() {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func listingIs(c *Cluster, node int, container string, names ...string) func() bool {
+	return func() bool {
+		listing, err := c.ContainerListing(node, clusterAccount, container)
+		if err != nil || len(listing) != len(names) {
+			return false
+		}
+		for i := range names {
+			if listing[i] != names[i] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestClusterContainerUpdates(t *testing.T) {
+	c, err := NewCluster(4)
+	require.Nil(t, err)
+	defer c.Close()
+
+	require.Nil(t, c.client.PutContainer("c", nil))
+	require.Nil(t, c.client.PutObject("c", "o", map[string]string{"Content-Length": "1"}, strings.NewReader("X")))
+
+	// every copy of the container lists the object
+	containerNodes, _ := c.PrimaryNodes(containerServer, clusterAccount, "c", "")
+	for _, node := range containerNodes {
+		assert.True(t, eventually(listingIs(c, node, "c", "o")), "node %d", node)
+	}
+	objects, _, err := c.client.GetContainer("c", "", "", 0, "", "", nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(objects))
+	assert.Equal(t, "o", objects[0].Name)
+
+	// and the account lists the container
+	containers, _, err := c.client.GetAccount("", "", 0, "", "", nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(containers))
+	assert.Equal(t, "c", containers[0].Name)
+
+	// deletes are sent along too
+	require.Nil(t, c.client.DeleteObject("c", "o", nil))
+	for _, node := range containerNodes {
+		assert.True(t, eventually(listingIs(c, node, "c")), "node %d", node)
+	}
+}
+
+func TestClusterAsyncPending(t *testing.T) {
+	c, err := NewCluster(4)
+	require.Nil(t, err)
+	defer c.Close()
+
+	require.Nil(t, c.client.PutContainer("c", nil))
+	containerNodes, _ := c.PrimaryNodes(containerServer, clusterAccount, "c", "")
+	for _, node := range containerNodes {
+		require.True(t, eventually(listingIs(c, node, "c")), "node %d", node)
+	}
+	down := containerNodes[0]
+	c.Kill(down, containerServer)
+
+	require.Nil(t, c.client.PutObject("c", "o", map[string]string{"Content-Length": "1"}, strings.NewReader("X")))
+
+	// the proxy pairs each object server with a container server, so just one of them saves the update for later
+	objectNodes, _ := c.PrimaryNodes(objectServer, clusterAccount, "c", "o")
+	assert.True(t, eventually(func() bool {
+		asyncs := 0
+		for _, node := range objectNodes {
+			asyncs += c.AsyncPendings(node)
+		}
+		return asyncs == 1
+	}))
+
+	// the container servers that were up have the object
+	for _, node := range containerNodes[1:] {
+		assert.True(t, eventually(listingIs(c, node, "c", "o")), "node %d", node)
+	}
+
+	// the one that was down doesn't, until the container replicator catches it up
+	require.Nil(t, c.Restart(down, containerServer))
+	assert.True(t, listingIs(c, down, "c")())
+	c.Replicate(containerNodes[1], containerServer)
+	assert.True(t, listingIs(c, down, "c", "o")())
+}
+
+func TestClusterHandoffRecovery(t *testing.T) {
+	c, err := NewCluster(4)
+	require.Nil(t, err)
+	defer c.Close()
+
+	require.Nil(t, c.client.PutContainer("c", nil))
+	require.Nil(t, c.client.PutObject("c", "o", map[string]string{"Content-Length": "1"}, strings.NewReader("X")))
+	primaries, handoff := c.PrimaryNodes(objectServer, clusterAccount, "c", "o")
+	for _, node := range primaries {
+		assert.True(t, eventually(func() bool { return c.ObjectExists(node, clusterAccount, "c", "o") }), "node %d", node)
+	}
+	assert.False(t, c.ObjectExists(handoff, clusterAccount, "c", "o"))
+
+	// lose the object off of one primary and unmount its device
+	require.Nil(t, os.RemoveAll(c.ObjectHashDir(primaries[0], clusterAccount, "c", "o")))
+	require.Nil(t, c.UnmountDevice(primaries[0]))
+
+	// a replicator that can't reach the unmounted primary pushes to the handoff instead
+	c.Replicate(primaries[1], objectServer)
+	assert.True(t, c.ObjectExists(handoff, clusterAccount, "c", "o"))
+
+	// once the device is back, the handoff's replicator moves the object back where it belongs
+	require.Nil(t, c.MountDevice(primaries[0]))
+	assert.False(t, c.ObjectExists(primaries[0], clusterAccount, "c", "o"))
+	c.Replicate(handoff, objectServer)
+	assert.False(t, c.ObjectExists(handoff, clusterAccount, "c", "o"))
+	for _, node := range primaries {
+		assert.True(t, c.ObjectExists(node, clusterAccount, "c", "o"), "node %d", node)
+	}
+}
+
+func TestClusterKillAndRestart(t *testing.T) {
+	c, err := NewCluster(4)
+	require.Nil(t, err)
+	defer c.Close()
+
+	require.Nil(t, c.client.PutContainer("c", nil))
+	require.Nil(t, c.client.PutObject("c", "o", map[string]string{"Content-Length": "1"}, strings.NewReader("X")))
+	primaries, _ := c.PrimaryNodes(objectServer, clusterAccount, "c", "o")
+	require.True(t, eventually(func() bool { return c.ObjectExists(primaries[0], clusterAccount, "c", "o") }))
+
+	c.KillNode(primaries[0])
+	assert.False(t, c.ObjectExists(primaries[0], clusterAccount, "c", "o"))
+	// the proxy still serves the object from the other primaries
+	_, headers, err := c.client.GetObject("c", "o", nil)
+	require.Nil(t, err)
+	assert.Equal(t, "1", headers["Content-Length"])
+
+	require.Nil(t, c.RestartNode(primaries[0]))
+	assert.True(t, c.ObjectExists(primaries[0], clusterAccount, "c", "o"))
+}
+
+func TestClusterAccountReplication(t *testing.T) {
+	c, err := NewCluster(4)
+	require.Nil(t, err)
+	defer c.Close()
+
+	// create the account, then take one of its copies down
+	require.Nil(t, c.client.PutContainer("c1", nil))
+	accountNodes, _ := c.PrimaryNodes(accountServer, clusterAccount, "", "")
+	for _, node := range accountNodes {
+		require.True(t, eventually(func() bool {
+			listing, err := c.AccountListing(node, clusterAccount)
+			return err == nil && len(listing) == 1
+		}), "node %d", node)
+	}
+	down := accountNodes[0]
+	c.Kill(down, accountServer)
+
+	// the container servers can't tell the down account server about the new container
+	require.Nil(t, c.client.PutContainer("c2", nil))
+	for _, node := range accountNodes[1:] {
+		assert.True(t, eventually(func() bool {
+			listing, err := c.AccountListing(node, clusterAccount)
+			return err == nil && len(listing) == 2
+		}), "node %d", node)
+	}
+	require.Nil(t, c.Restart(down, accountServer))
+	listing, err := c.AccountListing(down, clusterAccount)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"c1"}, listing)
+
+	// until the account replicator catches it up
+	c.Replicate(accountNodes[1], accountServer)
+	listing, err = c.AccountListing(down, clusterAccount)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"c1", "c2"}, listing)
+}
+
+func TestClusterContainerReplication(t *testing.T) {
+	c, err := NewCluster(4)
+	require.Nil(t, err)
+	defer c.Close()
+
+	// the container is created while one of its primaries is down, so that primary has no database at all
+	containerNodes, _ := c.PrimaryNodes(containerServer, clusterAccount, "c", "")
+	down := containerNodes[0]
+	c.Kill(down, containerServer)
+	require.Nil(t, c.client.PutContainer("c", nil))
+	require.Nil(t, c.Restart(down, containerServer))
+	_, err = c.ContainerListing(down, clusterAccount, "c")
+	require.NotNil(t, err)
+
+	// the replicator sends it a whole copy of the database
+	c.Replicate(containerNodes[1], containerServer)
+	listing, err := c.ContainerListing(down, clusterAccount, "c")
+	require.Nil(t, err)
+	assert.Equal(t, []string{}, listing)
+
+	// and from then on, new rows are merged in
+	c.Kill(down, containerServer)
+	require.Nil(t, c.client.PutObject("c", "o", map[string]string{"Content-Length": "1"}, strings.NewReader("X")))
+	require.Nil(t, c.Restart(down, containerServer))
+	for _, node := range containerNodes[1:] {
+		require.True(t, eventually(listingIs(c, node, "c", "o")), "node %d", node)
+	}
+	c.Replicate(containerNodes[2], containerServer)
+	assert.True(t, listingIs(c, down, "c", "o")())
+}
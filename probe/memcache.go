@@ -0,0 +1,141 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package probe
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+type cacheItem struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryCache is an in-process ring.MemcacheRing, so a Cluster's proxy doesn't need a memcached to hold its auth
+// tokens and account and container info.  Values are stored as JSON, the same as the real memcache ring does.
+type memoryCache struct {
+	lock  sync.Mutex
+	items map[string]cacheItem
+}
+
+var _ ring.MemcacheRing = &memoryCache{}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{items: make(map[string]cacheItem)}
+}
+
+func (mc *memoryCache) get(key string) ([]byte, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	item, ok := mc.items[key]
+	if !ok {
+		return nil, ring.CacheMiss
+	}
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		delete(mc.items, key)
+		return nil, ring.CacheMiss
+	}
+	return item.value, nil
+}
+
+func (mc *memoryCache) set(key string, value []byte, timeout int) {
+	item := cacheItem{value: value}
+	if timeout > 0 {
+		item.expires = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	mc.lock.Lock()
+	mc.items[key] = item
+	mc.lock.Unlock()
+}
+
+func (mc *memoryCache) Decr(key string, delta int64, timeout int) (int64, error) {
+	return mc.Incr(key, -delta, timeout)
+}
+
+func (mc *memoryCache) Delete(key string) error {
+	mc.lock.Lock()
+	delete(mc.items, key)
+	mc.lock.Unlock()
+	return nil
+}
+
+func (mc *memoryCache) Get(key string) (interface{}, error) {
+	data, err := mc.get(key)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return data, nil
+	}
+	return value, nil
+}
+
+func (mc *memoryCache) GetStructured(key string, val interface{}) error {
+	data, err := mc.get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, val)
+}
+
+func (mc *memoryCache) GetMulti(serverKey string, keys []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, key := range keys {
+		if value, err := mc.Get(key); err == nil {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// Incr works like memcached's: a missing counter starts at delta, and counters don't go below zero.
+func (mc *memoryCache) Incr(key string, delta int64, timeout int) (int64, error) {
+	var count int64
+	if data, err := mc.get(key); err == nil {
+		count, _ = strconv.ParseInt(string(data), 10, 64)
+	} else if delta < 0 {
+		delta = 0
+	}
+	if count += delta; count < 0 {
+		count = 0
+	}
+	mc.set(key, []byte(strconv.FormatInt(count, 10)), timeout)
+	return count, nil
+}
+
+func (mc *memoryCache) Set(key string, value interface{}, timeout int) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	mc.set(key, data, timeout)
+	return nil
+}
+
+func (mc *memoryCache) SetMulti(serverKey string, values map[string]interface{}, timeout int) error {
+	for key, value := range values {
+		if err := mc.Set(key, value, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -21,6 +21,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/troubling/hummingbird/proxyserver/middleware"
 )
 
 const (
@@ -46,20 +48,24 @@ func CheckMetadata(req *http.Request, targetType string) (int, string) {
 		if len(key) > MAX_HEADER_SIZE {
 			return http.StatusBadRequest, fmt.Sprintf("Header value too long: %s", key[:MAX_META_NAME_LENGTH])
 		}
-		if !strings.HasPrefix(key, metaPrefix) {
+		valueLength := len(req.Header.Get(key))
+		if targetType == "Object" && strings.HasPrefix(key, middleware.CryptoMetaPrefix) {
+			// user metadata the encrypter has already moved into sysmeta is held to the limits for its plaintext.
+			valueLength = middleware.EncryptedValueLength(req.Header.Get(key))
+			key = metaPrefix + "-" + key[len(middleware.CryptoMetaPrefix):]
+		} else if !strings.HasPrefix(key, metaPrefix) {
 			continue
 		}
-		value := req.Header.Get(key)
 		key = key[len(metaPrefix):]
 		metaCount += 1
-		metaSize += len(key) + len(value)
+		metaSize += len(key) + valueLength
 		if key == "" {
 			return http.StatusBadRequest, "Metadata name cannot be empty"
 		}
 		if len(key) > MAX_META_NAME_LENGTH {
 			return http.StatusBadRequest, fmt.Sprintf("Metadata name too long: %s%s", metaPrefix, key)
 		}
-		if len(value) > MAX_META_VALUE_LENGTH {
+		if valueLength > MAX_META_VALUE_LENGTH {
 			return http.StatusBadRequest, fmt.Sprintf("Metadata value longer than %d: %s%s", MAX_META_VALUE_LENGTH, metaPrefix, key)
 		}
 		if metaCount > MAX_META_COUNT {
@@ -16,6 +16,7 @@
 package proxyserver
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"strings"
@@ -154,3 +155,19 @@ func TestTooMuchMeta(t *testing.T) {
 	status, _ := CheckMetadata(req, "Object")
 	require.Equal(t, status, http.StatusBadRequest)
 }
+
+func TestEncryptedMetadataLength(t *testing.T) {
+	encrypted := func(length int) string {
+		return base64.StdEncoding.EncodeToString(make([]byte, length)) + "; swift_meta=%7B%7D"
+	}
+	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Object-Sysmeta-Crypto-Meta-Color", encrypted(MAX_META_VALUE_LENGTH))
+	status, _ := CheckMetadata(req, "Object")
+	require.Equal(t, http.StatusOK, status)
+
+	req.Header.Set("X-Object-Sysmeta-Crypto-Meta-Color", encrypted(MAX_META_VALUE_LENGTH+1))
+	status, msg := CheckMetadata(req, "Object")
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, fmt.Sprintf("Metadata value longer than %d: X-Object-Meta-Color", MAX_META_VALUE_LENGTH), msg)
+}
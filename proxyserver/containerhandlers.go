@@ -47,6 +47,13 @@ func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, reque
 		"delimiter":  request.FormValue("delimiter"),
 	}
 	r, headers, code := server.C.GetContainer(vars["account"], vars["container"], options, request.Header)
+	if code/100 == 2 && headers.Get("X-Backend-Sharded") == "true" {
+		if r != nil {
+			r.Close()
+		}
+		server.shardedContainerGet(writer, request, vars["account"], vars["container"], options, headers)
+		return
+	}
 	for k := range headers {
 		writer.Header().Set(k, headers.Get(k))
 	}
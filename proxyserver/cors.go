@@ -0,0 +1,183 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	hbmiddleware "github.com/troubling/hummingbird/middleware"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+var corsAllowedMethods = []string{"HEAD", "GET", "PUT", "POST", "DELETE", "OPTIONS"}
+
+var corsExposeHeaders = []string{"cache-control", "content-language", "content-type", "expires", "last-modified",
+	"pragma", "etag", "x-timestamp", "x-trans-id"}
+
+// corsWriter adds the CORS headers to a response once its status is known.
+type corsWriter struct {
+	http.ResponseWriter
+	origin        string
+	allowOrigin   string
+	exposeHeaders string
+	wroteHeader   bool
+}
+
+func (w *corsWriter) Write(b []byte) (int, error) {
+	// handlers that never call WriteHeader get an implicit 200, which needs the headers too.
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corsWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	if w.Header().Get("Access-Control-Expose-Headers") == "" {
+		expose := make(map[string]bool)
+		for _, h := range corsExposeHeaders {
+			expose[h] = true
+		}
+		for k := range w.Header() {
+			if strings.HasPrefix(k, "X-Container-Meta-") || strings.HasPrefix(k, "X-Object-Meta-") {
+				expose[strings.ToLower(k)] = true
+			}
+		}
+		for _, h := range strings.Fields(w.exposeHeaders) {
+			expose[h] = true
+		}
+		headers := make([]string, 0, len(expose))
+		for h := range expose {
+			headers = append(headers, h)
+		}
+		sort.Strings(headers)
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(headers, ", "))
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") == "" {
+		if strings.TrimSpace(w.allowOrigin) == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", w.origin)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (server *ProxyServer) containerCorsInfo(request *http.Request) *middleware.ContainerInfo {
+	ctx := middleware.GetProxyContext(request)
+	if ctx == nil {
+		return nil
+	}
+	pathParts, err := common.ParseProxyPath(request.URL.Path)
+	if err != nil || pathParts["vrs"] != "v1" || pathParts["account"] == "" || pathParts["container"] == "" {
+		return nil
+	}
+	return ctx.GetContainerInfo(pathParts["account"], pathParts["container"])
+}
+
+// isOriginAllowed checks the origin against the container's allowed origins and the cors_allow_origin setting.
+func (server *ProxyServer) isOriginAllowed(ci *middleware.ContainerInfo, origin string) bool {
+	allowed := server.corsAllowOrigin
+	if ci != nil {
+		allowed = append(strings.Fields(ci.Metadata["Access-Control-Allow-Origin"]), allowed...)
+	}
+	for _, o := range allowed {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// CorsHandler adds CORS headers to responses for requests that carry an allowed Origin header.
+func (server *ProxyServer) CorsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		if origin == "" || (request.Method != "GET" && request.Method != "HEAD" && request.Method != "PUT" && request.Method != "DELETE") {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		ci := server.containerCorsInfo(request)
+		if server.strictCorsMode && !server.isOriginAllowed(ci, origin) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		cw := &corsWriter{ResponseWriter: writer, origin: origin}
+		if ci != nil {
+			cw.allowOrigin = ci.Metadata["Access-Control-Allow-Origin"]
+			cw.exposeHeaders = ci.Metadata["Access-Control-Expose-Headers"]
+		}
+		next.ServeHTTP(cw, request)
+	})
+}
+
+// OptionsHandler answers CORS preflight requests, or describes the allowed methods if there's no Origin.
+func (server *ProxyServer) OptionsHandler(writer http.ResponseWriter, request *http.Request) {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		hbmiddleware.OptionsHandler("proxy-server", writer, request)
+		return
+	}
+	method := request.Header.Get("Access-Control-Request-Method")
+	methodAllowed := false
+	for _, m := range corsAllowedMethods {
+		if m == method {
+			methodAllowed = true
+		}
+	}
+	ci := server.containerCorsInfo(request)
+	if !methodAllowed || !server.isOriginAllowed(ci, origin) {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+	allowOrigin := ""
+	allowHeaders := make(map[string]bool)
+	if ci != nil {
+		if maxAge := ci.Metadata["Access-Control-Max-Age"]; maxAge != "" {
+			writer.Header().Set("Access-Control-Max-Age", maxAge)
+		}
+		for _, h := range strings.Fields(ci.Metadata["Access-Control-Allow-Headers"]) {
+			allowHeaders[strings.ToLower(h)] = true
+		}
+		allowOrigin = ci.Metadata["Access-Control-Allow-Origin"]
+	}
+	for _, h := range strings.Split(request.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			allowHeaders[strings.ToLower(h)] = true
+		}
+	}
+	if len(allowHeaders) > 0 {
+		headers := make([]string, 0, len(allowHeaders))
+		for h := range allowHeaders {
+			headers = append(headers, h)
+		}
+		sort.Strings(headers)
+		writer.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	writer.Header().Set("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+	if strings.TrimSpace(allowOrigin) == "*" {
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	writer.Header().Set("Allow", strings.Join(corsAllowedMethods, ", "))
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,178 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/test"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+type corsProxyClient struct {
+	client.ProxyClient
+	containerHeaders http.Header
+}
+
+func (c *corsProxyClient) HeadAccount(account string, headers http.Header) (http.Header, int) {
+	return http.Header{
+		"X-Account-Container-Count": []string{"1"},
+		"X-Account-Object-Count":    []string{"1"},
+		"X-Account-Bytes-Used":      []string{"1"},
+	}, 204
+}
+
+func (c *corsProxyClient) HeadContainer(account string, container string, headers http.Header) (http.Header, int) {
+	h := http.Header{
+		"X-Container-Object-Count": []string{"1"},
+		"X-Container-Bytes-Used":   []string{"1"},
+	}
+	for k, v := range c.containerHeaders {
+		h[k] = v
+	}
+	return h, 204
+}
+
+func corsHandler(server *ProxyServer, containerHeaders http.Header, next http.Handler) http.Handler {
+	pc := &corsProxyClient{containerHeaders: containerHeaders}
+	return middleware.NewContext(&test.FakeMemcacheRing{}, pc, test.FakeLowLevelLogger{})(next)
+}
+
+func TestCorsPreflight(t *testing.T) {
+	server := &ProxyServer{strictCorsMode: true}
+	h := corsHandler(server, http.Header{
+		"X-Container-Meta-Access-Control-Allow-Origin": []string{"http://a.com http://b.com"},
+		"X-Container-Meta-Access-Control-Max-Age":      []string{"5"},
+	}, http.HandlerFunc(server.OptionsHandler))
+
+	req := httptest.NewRequest("OPTIONS", "/v1/a/c/o", nil)
+	req.Header.Set("Origin", "http://b.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "X-Auth-Token, Content-Type")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "http://b.com", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "5", w.Header().Get("Access-Control-Max-Age"))
+	require.Equal(t, "content-type, x-auth-token", w.Header().Get("Access-Control-Allow-Headers"))
+	require.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "PUT")
+
+	req = httptest.NewRequest("OPTIONS", "/v1/a/c/o", nil)
+	req.Header.Set("Origin", "http://c.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 401, w.Code)
+
+	req = httptest.NewRequest("OPTIONS", "/v1/a/c/o", nil)
+	req.Header.Set("Origin", "http://a.com")
+	req.Header.Set("Access-Control-Request-Method", "TRACE")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 401, w.Code)
+
+	req = httptest.NewRequest("OPTIONS", "/v1/a/c/o", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.NotEqual(t, "", w.Header().Get("Allow"))
+	require.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCorsPreflightGlobalOrigin(t *testing.T) {
+	server := &ProxyServer{strictCorsMode: true, corsAllowOrigin: []string{"http://global.com"}}
+	h := corsHandler(server, nil, http.HandlerFunc(server.OptionsHandler))
+	req := httptest.NewRequest("OPTIONS", "/v1/a/c", nil)
+	req.Header.Set("Origin", "http://global.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "http://global.com", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCorsActualResponse(t *testing.T) {
+	server := &ProxyServer{strictCorsMode: true}
+	backend := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Object-Meta-Color", "blue")
+		writer.WriteHeader(200)
+	})
+	h := corsHandler(server, http.Header{
+		"X-Container-Meta-Access-Control-Allow-Origin":   []string{"*"},
+		"X-Container-Meta-Access-Control-Expose-Headers": []string{"x-custom"},
+	}, server.CorsHandler(backend))
+
+	req := httptest.NewRequest("GET", "/v1/a/c/o", nil)
+	req.Header.Set("Origin", "http://a.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	expose := w.Header().Get("Access-Control-Expose-Headers")
+	require.Contains(t, expose, "etag")
+	require.Contains(t, expose, "x-object-meta-color")
+	require.Contains(t, expose, "x-custom")
+
+	req = httptest.NewRequest("GET", "/v1/a/c/o", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+
+	req = httptest.NewRequest("POST", "/v1/a/c/o", nil)
+	req.Header.Set("Origin", "http://a.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCorsStrictMode(t *testing.T) {
+	backend := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(200)
+	})
+	server := &ProxyServer{strictCorsMode: true}
+	h := corsHandler(server, nil, server.CorsHandler(backend))
+	req := httptest.NewRequest("GET", "/v1/a/c/o", nil)
+	req.Header.Set("Origin", "http://a.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+
+	server.strictCorsMode = false
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, "http://a.com", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCorsImplicitStatus(t *testing.T) {
+	backend := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Object-Meta-Color", "blue")
+		writer.Write([]byte("hello"))
+	})
+	server := &ProxyServer{}
+	h := corsHandler(server, nil, server.CorsHandler(backend))
+	req := httptest.NewRequest("GET", "/v1/a/c/o", nil)
+	req.Header.Set("Origin", "http://a.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "hello", w.Body.String())
+	require.Equal(t, "http://a.com", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "x-object-meta-color")
+}
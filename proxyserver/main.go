@@ -19,8 +19,10 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
@@ -29,10 +31,21 @@ import (
 	"github.com/justinas/alice"
 )
 
+var (
+	// NewProxyDirectClient is a local pointer to the client function, for overriding in tests.
+	NewProxyDirectClient = client.NewProxyDirectClient
+	// NewMemcacheRing is a local pointer to the ring function, for overriding in tests.
+	NewMemcacheRing = func(serverconf conf.Config) (ring.MemcacheRing, error) {
+		return ring.NewMemcacheRingFromConfig(serverconf)
+	}
+)
+
 type ProxyServer struct {
-	C      client.ProxyClient
-	logger srv.LowLevelLogger
-	mc     ring.MemcacheRing
+	C               client.ProxyClient
+	logger          srv.LowLevelLogger
+	mc              ring.MemcacheRing
+	corsAllowOrigin []string
+	strictCorsMode  bool
 }
 
 func (server *ProxyServer) Finalize() {
@@ -49,6 +62,12 @@ func (server *ProxyServer) GetHandler(config conf.Config) http.Handler {
 	router := srv.NewRouter()
 	router.Get("/healthcheck", http.HandlerFunc(server.HealthcheckHandler))
 
+	router.Options("/v1/:account/:container/*obj", http.HandlerFunc(server.OptionsHandler))
+	router.Options("/v1/:account/:container", http.HandlerFunc(server.OptionsHandler))
+	router.Options("/v1/:account/:container/", http.HandlerFunc(server.OptionsHandler))
+	router.Options("/v1/:account", http.HandlerFunc(server.OptionsHandler))
+	router.Options("/v1/:account/", http.HandlerFunc(server.OptionsHandler))
+
 	router.Get("/v1/:account/:container/*obj", http.HandlerFunc(server.ObjectGetHandler))
 	router.Head("/v1/:account/:container/*obj", http.HandlerFunc(server.ObjectHeadHandler))
 	router.Put("/v1/:account/:container/*obj", http.HandlerFunc(server.ObjectPutHandler))
@@ -84,8 +103,14 @@ func (server *ProxyServer) GetHandler(config conf.Config) http.Handler {
 		{middleware.NewHealthcheck, "filter:healthcheck"},
 		{middleware.NewRequestLogger, "filter:proxy-logging"},
 		{middleware.NewTempURL, "filter:tempurl"},
+		{middleware.NewFormPost, "filter:formpost"},
+		{middleware.NewStaticWeb, "filter:staticweb"},
 		{middleware.NewTempAuth, "filter:tempauth"},
+		{middleware.NewS3API, "filter:s3api"},
 		{middleware.NewRatelimiter, "filter:ratelimit"},
+		{middleware.NewKeymaster, "filter:keymaster"},
+		{middleware.NewEncryption, "filter:encryption"},
+		{middleware.NewSymlink, "filter:symlink"},
 	}
 	pipeline := alice.New(middleware.NewContext(server.mc, server.C, server.logger))
 	for _, m := range middlewares {
@@ -96,26 +121,43 @@ func (server *ProxyServer) GetHandler(config conf.Config) http.Handler {
 		}
 		pipeline = pipeline.Append(mid)
 	}
-	return pipeline.Then(router)
+	return pipeline.Then(server.CorsHandler(router))
 }
 
 func GetServer(serverconf conf.Config, flags *flag.FlagSet) (string, int, srv.Server, srv.LowLevelLogger, error) {
 	var err error
 	server := &ProxyServer{}
-	server.C, err = client.NewProxyDirectClient()
+	server.C, err = NewProxyDirectClient(serverconf.GetSection("app:proxy-server"))
 	if err != nil {
 		return "", 0, nil, nil, err
 	}
-	server.mc, err = ring.NewMemcacheRingFromConfig(serverconf)
+	server.mc, err = NewMemcacheRing(serverconf)
 	if err != nil {
 		return "", 0, nil, nil, err
 	}
 
+	for _, origin := range strings.Split(serverconf.GetDefault("app:proxy-server", "cors_allow_origin", ""), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			server.corsAllowOrigin = append(server.corsAllowOrigin, origin)
+		}
+	}
+	server.strictCorsMode = serverconf.GetBool("app:proxy-server", "strict_cors_mode", true)
+
 	bindIP := serverconf.GetDefault("DEFAULT", "bind_ip", "0.0.0.0")
 	bindPort := serverconf.GetInt("DEFAULT", "bind_port", 8080)
 	if server.logger, err = srv.SetupLogger(serverconf, flags, "app:proxy-server", "proxy-server"); err != nil {
 		return "", 0, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
 
+	statsdHost := serverconf.GetDefault("app:proxy-server", "log_statsd_host", "")
+	if statsdHost != "" {
+		statsdPort := serverconf.GetInt("app:proxy-server", "log_statsd_port", 8125)
+		// Go metrics collection pause interval in seconds
+		statsdPause := serverconf.GetInt("app:proxy-server", "statsd_collection_pause", 10)
+		basePrefix := serverconf.GetDefault("app:proxy-server", "log_statsd_metric_prefix", "")
+		prefix := basePrefix + ".go.proxyserver"
+		go common.CollectRuntimeMetrics(statsdHost, statsdPort, statsdPause, prefix)
+	}
+
 	return bindIP, int(bindPort), server, server.logger, nil
 }
@@ -67,6 +67,7 @@ type AccountInfo struct {
 type ContainerInfo struct {
 	ObjectCount int64
 	ObjectBytes int64
+	ReadACL     string
 	Metadata    map[string]string
 	SysMetadata map[string]string
 }
@@ -107,6 +108,7 @@ func (w *proxyWriter) Response() (bool, int) {
 type ProxyContext struct {
 	*ProxyContextMiddleware
 	Authorize          AuthorizeFunc
+	KeyProvider        KeyProvider
 	Logger             srv.LoggingContext
 	containerInfoCache map[string]*ContainerInfo
 	accountInfoCache   map[string]*AccountInfo
@@ -134,11 +136,13 @@ func (ctx *ProxyContext) GetContainerInfo(account, container string) *ContainerI
 		}
 	}
 	if ci == nil {
-		headers, code := ctx.c.HeadContainer(account, container, nil)
+		// info gets cached, so it's worth asking every replica rather than risk caching a stale one.
+		headers, code := ctx.c.HeadContainer(account, container, http.Header{"X-Newest": []string{"true"}})
 		if code/100 != 2 {
 			return nil
 		}
 		ci = &ContainerInfo{
+			ReadACL:     headers.Get("X-Container-Read"),
 			Metadata:    make(map[string]string),
 			SysMetadata: make(map[string]string),
 		}
@@ -189,10 +193,10 @@ func (ctx *ProxyContext) GetAccountInfo(account string) *AccountInfo {
 		}
 	}
 	if ai == nil {
-		headers, code := ctx.c.HeadAccount(account, nil)
+		headers, code := ctx.c.HeadAccount(account, http.Header{"X-Newest": []string{"true"}})
 		if code == 404 && autoCreateAccounts {
 			ctx.c.PutAccount(account, http.Header{"X-Timestamp": []string{common.GetTimestamp()}})
-			headers, code = ctx.c.HeadAccount(account, nil)
+			headers, code = ctx.c.HeadAccount(account, http.Header{"X-Newest": []string{"true"}})
 		}
 		if code/100 != 2 {
 			return nil
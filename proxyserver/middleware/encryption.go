@@ -0,0 +1,757 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+const (
+	// CryptoMetaPrefix is where the encrypter keeps an object's encrypted user metadata.
+	CryptoMetaPrefix     = "X-Object-Sysmeta-Crypto-Meta-"
+	cryptoBodyMetaHeader = "X-Object-Sysmeta-Crypto-Body-Meta"
+	cryptoEtagHeader     = "X-Object-Sysmeta-Crypto-Etag"
+	cryptoListingEtag    = "X-Backend-Container-Update-Override-Etag"
+	cryptoCipher         = "AES_CTR_256"
+	cryptoMetaParam      = "; swift_meta="
+)
+
+var errBadCryptoMeta = errors.New("invalid crypto meta")
+
+// cryptoMeta describes how a value was encrypted.  For object bodies it also carries the body key, wrapped with the
+// object's key, and the path the object's key was derived from.
+type cryptoMeta struct {
+	Cipher  string            `json:"cipher"`
+	IV      []byte            `json:"iv"`
+	BodyKey *wrappedKey       `json:"body_key,omitempty"`
+	KeyID   map[string]string `json:"key_id,omitempty"`
+}
+
+type wrappedKey struct {
+	Key []byte `json:"key"`
+	IV  []byte `json:"iv"`
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
+
+// newCTR returns an AES-CTR stream positioned offset bytes into the keystream for key and iv.
+func newCTR(key, iv []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errBadCryptoMeta
+	}
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	blocks := uint64(offset / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && blocks > 0; i-- {
+		sum := uint64(counter[i]) + blocks&0xff
+		counter[i] = byte(sum)
+		blocks = blocks>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream, nil
+}
+
+func ctrCrypt(key, iv, data []byte) ([]byte, error) {
+	stream, err := newCTR(key, iv, 0)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	stream.XORKeyStream(out, data)
+	return out, nil
+}
+
+// encryptHeaderValue encrypts value with key, returning the ciphertext and its crypto meta as a single header value.
+func encryptHeaderValue(key []byte, value string, keyID map[string]string) (string, error) {
+	iv, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := ctrCrypt(key, iv, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(&cryptoMeta{Cipher: cryptoCipher, IV: iv, KeyID: keyID})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext) + cryptoMetaParam + common.Urlencode(string(meta)), nil
+}
+
+// splitEncryptedValue separates a value from encryptHeaderValue into its ciphertext and crypto meta.
+func splitEncryptedValue(value string) ([]byte, *cryptoMeta, error) {
+	i := strings.LastIndex(value, cryptoMetaParam)
+	if i < 0 {
+		return nil, nil, errBadCryptoMeta
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(value[:i])
+	if err != nil {
+		return nil, nil, err
+	}
+	rawMeta, err := url.PathUnescape(value[i+len(cryptoMetaParam):])
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &cryptoMeta{}
+	if err := json.Unmarshal([]byte(rawMeta), meta); err != nil {
+		return nil, nil, err
+	}
+	if meta.Cipher != cryptoCipher {
+		return nil, nil, fmt.Errorf("unsupported cipher %q", meta.Cipher)
+	}
+	return ciphertext, meta, nil
+}
+
+// EncryptedValueLength returns the length of the plaintext in a header value encrypted by the encrypter, which
+// CTR mode keeps the same as the ciphertext's.
+func EncryptedValueLength(value string) int {
+	if i := strings.LastIndex(value, cryptoMetaParam); i >= 0 {
+		if ciphertext, err := base64.StdEncoding.DecodeString(value[:i]); err == nil {
+			return len(ciphertext)
+		}
+	}
+	return len(value)
+}
+
+// decryptHeaderValue decrypts a header value from encryptHeaderValue, using the key for the path in its key id if
+// it has one and defaultPath otherwise.
+func decryptHeaderValue(provider KeyProvider, defaultPath string, value string) (string, error) {
+	ciphertext, meta, err := splitEncryptedValue(value)
+	if err != nil {
+		return "", err
+	}
+	path := defaultPath
+	if meta.KeyID["path"] != "" {
+		path = meta.KeyID["path"]
+	}
+	key, err := provider.Key(path)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := ctrCrypt(key, meta.IV, ciphertext)
+	return string(plaintext), err
+}
+
+// encryptingReader encrypts an object body as it's read, filling in the encrypted etags as trailers at EOF.
+type encryptingReader struct {
+	io.ReadCloser
+	stream       cipher.Stream
+	hash         hash.Hash
+	trailer      http.Header
+	objectKey    []byte
+	containerKey []byte
+	objectPath   string
+	listingPath  string
+	listingEtag  string
+	expectEtag   string
+	mismatch     bool
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	n, err := e.ReadCloser.Read(p)
+	if n > 0 {
+		e.hash.Write(p[:n])
+		e.stream.XORKeyStream(p[:n], p[:n])
+	}
+	if err == io.EOF {
+		etag := hex.EncodeToString(e.hash.Sum(nil))
+		if e.expectEtag != "" && e.expectEtag != etag {
+			// failing the read aborts the backend requests, so the object isn't stored.
+			e.mismatch = true
+			return n, errors.New("etag mismatch")
+		}
+		objectEtag, ierr := encryptHeaderValue(e.objectKey, etag, map[string]string{"path": e.objectPath})
+		if ierr != nil {
+			return n, ierr
+		}
+		listed := etag
+		if e.listingEtag != "" {
+			listed = e.listingEtag
+		}
+		listingEtag, ierr := encryptHeaderValue(e.containerKey, listed, map[string]string{"path": e.listingPath})
+		if ierr != nil {
+			return n, ierr
+		}
+		e.trailer.Set(cryptoEtagHeader, objectEtag)
+		e.trailer.Set(cryptoListingEtag, listingEtag)
+		e.expectEtag = etag
+	}
+	return n, err
+}
+
+func (e *encryptingReader) Trailer() http.Header {
+	return e.trailer
+}
+
+// encryptWriter reports the plaintext etag of an encrypted PUT, or a 422 if it didn't match the client's.
+type encryptWriter struct {
+	http.ResponseWriter
+	reader  *encryptingReader
+	swallow bool
+}
+
+func (w *encryptWriter) WriteHeader(status int) {
+	if w.reader.mismatch {
+		w.swallow = true
+		srv.StandardResponse(w.ResponseWriter, 422)
+		return
+	}
+	if status/100 == 2 {
+		w.Header().Set("Etag", w.reader.expectEtag)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *encryptWriter) Write(b []byte) (int, error) {
+	if w.swallow {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decryptWriter decrypts an object GET or HEAD response on its way to the client.  Conditional requests are
+// evaluated here, against the plaintext etag, since the object servers only know the ciphertext's.
+type decryptWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	logger      srv.LoggingContext
+	provider    KeyProvider
+	path        string
+	header      http.Header
+	ifMatch     string
+	ifNoneMatch string
+	status      int
+	stream      cipher.Stream
+	swallow     bool
+	pipe        *io.PipeWriter
+	done        chan struct{}
+}
+
+func (w *decryptWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *decryptWriter) fail(err error) {
+	w.logger.LogError("Unable to decrypt %s: %v", w.path, err)
+	w.swallow = true
+	srv.StandardResponse(w.ResponseWriter, 500)
+}
+
+// bodyKey unwraps the object's body key, returning it with the body's crypto meta.
+func (w *decryptWriter) bodyKey(value string) ([]byte, *cryptoMeta, error) {
+	meta := &cryptoMeta{}
+	if err := json.Unmarshal([]byte(value), meta); err != nil {
+		return nil, nil, err
+	}
+	if meta.Cipher != cryptoCipher || meta.BodyKey == nil {
+		return nil, nil, errBadCryptoMeta
+	}
+	path := w.path
+	if meta.KeyID["path"] != "" {
+		path = meta.KeyID["path"]
+	}
+	objectKey, err := w.provider.Key(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ctrCrypt(objectKey, meta.BodyKey.IV, meta.BodyKey.Key)
+	return key, meta, err
+}
+
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.Trim(strings.TrimSpace(tag), "\"")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *decryptWriter) WriteHeader(status int) {
+	w.status = status
+	bodyMeta := w.header.Get(cryptoBodyMetaHeader)
+	if bodyMeta != "" && status/100 == 2 {
+		if w.provider == nil {
+			w.fail(errors.New("no keys available"))
+			return
+		}
+		bodyKey, meta, err := w.bodyKey(bodyMeta)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		keyPath := w.path
+		if meta.KeyID["path"] != "" {
+			keyPath = meta.KeyID["path"]
+		}
+		for key := range w.header {
+			if strings.HasPrefix(key, CryptoMetaPrefix) {
+				value, err := decryptHeaderValue(w.provider, keyPath, w.header.Get(key))
+				if err != nil {
+					w.fail(err)
+					return
+				}
+				w.header.Set("X-Object-Meta-"+key[len(CryptoMetaPrefix):], value)
+				delete(w.header, key)
+			}
+		}
+		if encrypted := w.header.Get(cryptoEtagHeader); encrypted != "" {
+			etag, err := decryptHeaderValue(w.provider, keyPath, encrypted)
+			if err != nil {
+				w.fail(err)
+				return
+			}
+			w.header.Set("Etag", etag)
+		}
+		if w.request.Method == "GET" {
+			if err := w.decryptBody(status, bodyKey, meta.IV); err != nil {
+				w.fail(err)
+				return
+			}
+		}
+		delete(w.header, cryptoBodyMetaHeader)
+		delete(w.header, cryptoEtagHeader)
+	}
+	if status == 200 || status == 206 {
+		etag := strings.Trim(w.header.Get("Etag"), "\"")
+		if w.ifMatch != "" && !etagMatches(w.ifMatch, etag) {
+			w.swallow = true
+			srv.StandardResponse(w.ResponseWriter, 412)
+			return
+		}
+		if w.ifNoneMatch != "" && etagMatches(w.ifNoneMatch, etag) {
+			w.swallow = true
+			w.ResponseWriter.Header().Set("Etag", etag)
+			w.ResponseWriter.WriteHeader(304)
+			return
+		}
+	}
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// decryptBody sets up decryption of a response body, which for range requests starts at the range's offset.
+func (w *decryptWriter) decryptBody(status int, key, iv []byte) error {
+	var offset int64
+	if status == 206 {
+		mediaType, params, _ := mime.ParseMediaType(w.header.Get("Content-Type"))
+		if mediaType == "multipart/byteranges" {
+			pr, pw := io.Pipe()
+			w.pipe = pw
+			w.done = make(chan struct{})
+			delete(w.header, "Content-Length")
+			go w.decryptMultipart(pr, params["boundary"], key, iv)
+			return nil
+		}
+		var err error
+		if offset, err = rangeStart(w.header.Get("Content-Range")); err != nil {
+			return err
+		}
+	}
+	var err error
+	w.stream, err = newCTR(key, iv, offset)
+	return err
+}
+
+func rangeStart(contentRange string) (int64, error) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, fmt.Errorf("unparseable Content-Range %q", contentRange)
+	}
+	return start, nil
+}
+
+// decryptMultipart decrypts each part of a multipart/byteranges body from its own offset.
+func (w *decryptWriter) decryptMultipart(src *io.PipeReader, boundary string, key, iv []byte) {
+	defer close(w.done)
+	defer src.Close()
+	mr := multipart.NewReader(src, boundary)
+	mw := multipart.NewWriter(w.ResponseWriter)
+	mw.SetBoundary(boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		offset, err := rangeStart(part.Header.Get("Content-Range"))
+		if err != nil {
+			break
+		}
+		stream, err := newCTR(key, iv, offset)
+		if err != nil {
+			break
+		}
+		dst, err := mw.CreatePart(part.Header)
+		if err != nil {
+			break
+		}
+		if _, err := io.Copy(dst, &cipher.StreamReader{S: stream, R: part}); err != nil {
+			break
+		}
+	}
+	mw.Close()
+	io.Copy(ioutil.Discard, src)
+}
+
+func (w *decryptWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	if w.swallow {
+		return len(b), nil
+	}
+	if w.pipe != nil {
+		return w.pipe.Write(b)
+	}
+	if w.stream != nil {
+		out := make([]byte, len(b))
+		w.stream.XORKeyStream(out, b)
+		return w.ResponseWriter.Write(out)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish waits for any multipart body to be written out.
+func (w *decryptWriter) finish() {
+	if w.pipe != nil {
+		w.pipe.Close()
+		<-w.done
+	}
+}
+
+// listingWriter holds on to a json or xml container listing so its etags can be decrypted.
+type listingWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	format string
+	body   bytes.Buffer
+}
+
+func (w *listingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *listingWriter) WriteHeader(status int) {
+	w.status = status
+	if status == 200 {
+		contentType := w.header.Get("Content-Type")
+		if strings.HasPrefix(contentType, "application/json") {
+			w.format = "json"
+		} else if strings.HasPrefix(contentType, "application/xml") || strings.HasPrefix(contentType, "text/xml") {
+			w.format = "xml"
+		}
+	}
+	if w.format == "" {
+		for k, v := range w.header {
+			w.ResponseWriter.Header()[k] = v
+		}
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *listingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	if w.format != "" {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *listingWriter) decryptEtag(provider KeyProvider, path, etag string) (string, error) {
+	if !strings.Contains(etag, cryptoMetaParam) {
+		return etag, nil
+	}
+	if provider == nil {
+		return "", errors.New("no keys available")
+	}
+	return decryptHeaderValue(provider, path, etag)
+}
+
+func (w *listingWriter) decryptJSON(provider KeyProvider, path string) ([]byte, error) {
+	var records []map[string]json.RawMessage
+	if err := json.Unmarshal(w.body.Bytes(), &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		raw, ok := record["hash"]
+		if !ok {
+			continue
+		}
+		var etag string
+		if err := json.Unmarshal(raw, &etag); err != nil {
+			return nil, err
+		}
+		etag, err := w.decryptEtag(provider, path, etag)
+		if err != nil {
+			return nil, err
+		}
+		if record["hash"], err = json.Marshal(etag); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(records)
+}
+
+func (w *listingWriter) decryptXML(provider KeyProvider, path string) ([]byte, error) {
+	var out bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(w.body.Bytes()))
+	encoder := xml.NewEncoder(&out)
+	inHash := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			inHash = t.Name.Local == "hash"
+		case xml.EndElement:
+			inHash = false
+		case xml.CharData:
+			if inHash {
+				etag, err := w.decryptEtag(provider, path, string(t))
+				if err != nil {
+					return nil, err
+				}
+				token = xml.CharData(etag)
+			}
+		case xml.ProcInst:
+			// the encoder only writes the declaration if it's handed a copy.
+			token = t.Copy()
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// finish decrypts and writes out the held listing.
+func (w *listingWriter) finish(provider KeyProvider, path string, logger srv.LoggingContext) {
+	if w.format == "" {
+		return
+	}
+	var body []byte
+	var err error
+	if w.format == "json" {
+		body, err = w.decryptJSON(provider, path)
+	} else {
+		body, err = w.decryptXML(provider, path)
+	}
+	if err != nil {
+		logger.LogError("Unable to decrypt listing of %s: %v", path, err)
+		srv.StandardResponse(w.ResponseWriter, 500)
+		return
+	}
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+type encryption struct {
+	next    http.Handler
+	disable bool
+}
+
+func (e *encryption) encryptPut(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, container, obj string) {
+	objectPath := fmt.Sprintf("/%s/%s/%s", account, container, obj)
+	listingPath := fmt.Sprintf("/%s/%s", account, container)
+	objectKey, err := ctx.KeyProvider.Key(objectPath)
+	if err != nil {
+		ctx.Logger.LogError("Unable to get key for %s: %v", objectPath, err)
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	containerKey, err := ctx.KeyProvider.Key(listingPath)
+	if err != nil {
+		ctx.Logger.LogError("Unable to get key for %s: %v", listingPath, err)
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	bodyKey, err := randomBytes(32)
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	bodyIV, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	wrapIV, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	wrapped, err := ctrCrypt(objectKey, wrapIV, bodyKey)
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	bodyMeta, err := json.Marshal(&cryptoMeta{
+		Cipher:  cryptoCipher,
+		IV:      bodyIV,
+		BodyKey: &wrappedKey{Key: wrapped, IV: wrapIV},
+		KeyID:   map[string]string{"path": objectPath},
+	})
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	for key := range request.Header {
+		if strings.HasPrefix(key, "X-Object-Meta-") {
+			value, err := encryptHeaderValue(objectKey, request.Header.Get(key), nil)
+			if err != nil {
+				srv.StandardResponse(writer, 500)
+				return
+			}
+			request.Header.Set(CryptoMetaPrefix+key[len("X-Object-Meta-"):], value)
+			delete(request.Header, key)
+		}
+	}
+	stream, err := newCTR(bodyKey, bodyIV, 0)
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	request.Header.Set(cryptoBodyMetaHeader, string(bodyMeta))
+	body := request.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	reader := &encryptingReader{
+		ReadCloser:   body,
+		stream:       stream,
+		hash:         md5.New(),
+		trailer:      http.Header{cryptoEtagHeader: {""}, cryptoListingEtag: {""}},
+		objectKey:    objectKey,
+		containerKey: containerKey,
+		objectPath:   objectPath,
+		listingPath:  listingPath,
+		listingEtag:  request.Header.Get(cryptoListingEtag),
+		expectEtag:   strings.ToLower(strings.Trim(request.Header.Get("Etag"), "\"")),
+	}
+	// the object servers only see the ciphertext, so the client's etag is checked here instead.
+	request.Header.Del("Etag")
+	// an etag for listings given by an earlier middleware, like a multipart upload's, is encrypted like the body's.
+	request.Header.Del(cryptoListingEtag)
+	request.Body = reader
+	e.next.ServeHTTP(&encryptWriter{ResponseWriter: writer, reader: reader}, request)
+}
+
+func (e *encryption) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, obj := getPathParts(request)
+	ctx := GetProxyContext(request)
+	if !apiReq || container == "" || ctx == nil {
+		e.next.ServeHTTP(writer, request)
+		return
+	}
+	if obj == "" {
+		if request.Method != "GET" || ctx.KeyProvider == nil {
+			e.next.ServeHTTP(writer, request)
+			return
+		}
+		w := &listingWriter{ResponseWriter: writer, header: make(http.Header)}
+		e.next.ServeHTTP(w, request)
+		w.finish(ctx.KeyProvider, fmt.Sprintf("/%s/%s", account, container), ctx.Logger)
+		return
+	}
+	switch request.Method {
+	case "PUT":
+		if ctx.KeyProvider == nil || e.disable {
+			e.next.ServeHTTP(writer, request)
+			return
+		}
+		e.encryptPut(writer, request, ctx, account, container, obj)
+	case "GET", "HEAD":
+		w := &decryptWriter{
+			ResponseWriter: writer,
+			request:        request,
+			logger:         ctx.Logger,
+			provider:       ctx.KeyProvider,
+			path:           fmt.Sprintf("/%s/%s/%s", account, container, obj),
+			header:         make(http.Header),
+		}
+		if ctx.KeyProvider != nil {
+			w.ifMatch, w.ifNoneMatch = request.Header.Get("If-Match"), request.Header.Get("If-None-Match")
+			request.Header.Del("If-Match")
+			request.Header.Del("If-None-Match")
+		}
+		e.next.ServeHTTP(w, request)
+		w.finish()
+	default:
+		e.next.ServeHTTP(writer, request)
+	}
+}
+
+// NewEncryption returns the encrypter and decrypter middleware.  It encrypts object bodies and user metadata with
+// keys from the keymaster, and decrypts them along with container listing etags.  With disable_encryption set,
+// new objects are stored unencrypted but existing ones can still be read.
+func NewEncryption(config conf.Section) (func(http.Handler) http.Handler, error) {
+	disable := config.GetBool("disable_encryption", false)
+	return func(next http.Handler) http.Handler {
+		return &encryption{next: next, disable: disable}
+	}, nil
+}
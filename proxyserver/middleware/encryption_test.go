@@ -0,0 +1,291 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+type storedObject struct {
+	headers http.Header
+	body    []byte
+}
+
+// encryptionBackend stands in for the object and container servers, keeping what PUTs send it including trailers.
+type encryptionBackend struct {
+	objects map[string]*storedObject
+}
+
+func (b *encryptionBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	_, account, container, obj := getPathParts(request)
+	if obj == "" {
+		var listing []map[string]interface{}
+		for path, o := range b.objects {
+			if strings.HasPrefix(path, account+"/"+container+"/") {
+				listing = append(listing, map[string]interface{}{"name": path[len(account+"/"+container+"/"):],
+					"bytes": len(o.body), "hash": o.headers.Get("X-Backend-Container-Update-Override-Etag")})
+			}
+		}
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		data, _ := json.Marshal(listing)
+		writer.WriteHeader(200)
+		writer.Write(data)
+		return
+	}
+	path := account + "/" + container + "/" + obj
+	switch request.Method {
+	case "PUT":
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(499)
+			return
+		}
+		headers := http.Header{}
+		for k, v := range request.Header {
+			headers[k] = v
+		}
+		if tr, ok := request.Body.(client.TrailerReader); ok {
+			for k, v := range tr.Trailer() {
+				headers[k] = v
+			}
+		}
+		hash := md5.Sum(body)
+		headers.Set("Etag", hex.EncodeToString(hash[:]))
+		b.objects[path] = &storedObject{headers: headers, body: body}
+		writer.WriteHeader(201)
+	case "GET", "HEAD":
+		o, ok := b.objects[path]
+		if !ok {
+			writer.WriteHeader(404)
+			return
+		}
+		if request.Header.Get("If-None-Match") != "" || request.Header.Get("If-Match") != "" {
+			writer.WriteHeader(500)
+			return
+		}
+		for k, v := range o.headers {
+			if strings.HasPrefix(k, "X-Object-") || k == "Etag" || k == "Content-Type" {
+				writer.Header()[k] = v
+			}
+		}
+		http.ServeContent(writer, request, obj, time.Time{}, bytes.NewReader(o.body))
+	}
+}
+
+func encryptionRequest(method, path string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, path, body)
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{},
+		Logger:                 test.FakeLogger{},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
+
+// newTestEncryption chains the keymaster in front of encryption, like the proxy pipeline does.
+func newTestEncryption(t *testing.T, provider KeyProvider, backend http.Handler) http.Handler {
+	mid, err := NewEncryption(conf.Section{})
+	require.Nil(t, err)
+	if provider == nil {
+		return mid(backend)
+	}
+	return NewKeymasterFromProvider(provider)(mid(backend))
+}
+
+func TestCTROffset(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	iv := bytes.Repeat([]byte{0xff}, 16)
+	plaintext := bytes.Repeat([]byte("0123456789"), 100)
+	ciphertext, err := ctrCrypt(key, iv, plaintext)
+	require.Nil(t, err)
+	for _, offset := range []int64{0, 1, 15, 16, 17, 500, 999} {
+		stream, err := newCTR(key, iv, offset)
+		require.Nil(t, err)
+		out := make([]byte, len(ciphertext)-int(offset))
+		stream.XORKeyStream(out, ciphertext[offset:])
+		require.Equal(t, plaintext[offset:], out)
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	backend := &encryptionBackend{objects: map[string]*storedObject{}}
+	provider := NewRootSecretKeyProvider(bytes.Repeat([]byte("s"), 32))
+	h := newTestEncryption(t, provider, backend)
+	plaintext := []byte(strings.Repeat("The quick brown fox. ", 50))
+	etag := fmt.Sprintf("%x", md5.Sum(plaintext))
+
+	w := httptest.NewRecorder()
+	req := encryptionRequest("PUT", "/v1/a/c/o", bytes.NewReader(plaintext))
+	req.Header.Set("X-Object-Meta-Color", "blue")
+	req.Header.Set("Etag", etag)
+	h.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, etag, w.Header().Get("Etag"))
+
+	stored := backend.objects["a/c/o"]
+	require.Equal(t, len(plaintext), len(stored.body))
+	require.NotEqual(t, plaintext, stored.body)
+	require.Equal(t, "", stored.headers.Get("X-Object-Meta-Color"))
+	require.NotContains(t, stored.headers.Get("X-Object-Sysmeta-Crypto-Meta-Color"), "blue")
+	require.NotEqual(t, "", stored.headers.Get("X-Object-Sysmeta-Crypto-Body-Meta"))
+	require.NotContains(t, stored.headers.Get("X-Object-Sysmeta-Crypto-Etag"), etag)
+	require.NotContains(t, stored.headers.Get("X-Backend-Container-Update-Override-Etag"), etag)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, encryptionRequest("GET", "/v1/a/c/o", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, plaintext, w.Body.Bytes())
+	require.Equal(t, etag, w.Header().Get("Etag"))
+	require.Equal(t, "blue", w.Header().Get("X-Object-Meta-Color"))
+	require.Equal(t, "", w.Header().Get("X-Object-Sysmeta-Crypto-Body-Meta"))
+
+	w = httptest.NewRecorder()
+	req = encryptionRequest("GET", "/v1/a/c/o", nil)
+	req.Header.Set("Range", "bytes=100-349")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 206, w.Code)
+	require.Equal(t, plaintext[100:350], w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	req = encryptionRequest("GET", "/v1/a/c/o", nil)
+	req.Header.Set("Range", "bytes=3-9,517-600")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 206, w.Code)
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	require.Nil(t, err)
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, r := range [][2]int{{3, 10}, {517, 601}} {
+		part, err := mr.NextPart()
+		require.Nil(t, err)
+		data, err := ioutil.ReadAll(part)
+		require.Nil(t, err)
+		require.Equal(t, plaintext[r[0]:r[1]], data)
+	}
+
+	w = httptest.NewRecorder()
+	req = encryptionRequest("HEAD", "/v1/a/c/o", nil)
+	req.Header.Set("If-None-Match", "\""+etag+"\"")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 304, w.Code)
+
+	w = httptest.NewRecorder()
+	req = encryptionRequest("GET", "/v1/a/c/o", nil)
+	req.Header.Set("If-Match", "nope")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 412, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, encryptionRequest("GET", "/v1/a/c?format=json", nil))
+	require.Equal(t, 200, w.Code)
+	var listing []map[string]interface{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &listing))
+	require.Equal(t, 1, len(listing))
+	require.Equal(t, etag, listing[0]["hash"])
+	require.Equal(t, float64(len(plaintext)), listing[0]["bytes"])
+
+	// without keys, encrypted objects can't be read.
+	w = httptest.NewRecorder()
+	newTestEncryption(t, nil, backend).ServeHTTP(w, encryptionRequest("GET", "/v1/a/c/o", nil))
+	require.Equal(t, 500, w.Code)
+	require.NotContains(t, w.Body.String(), "quick")
+}
+
+func TestEncryptionEtagMismatch(t *testing.T) {
+	backend := &encryptionBackend{objects: map[string]*storedObject{}}
+	provider := NewRootSecretKeyProvider(bytes.Repeat([]byte("s"), 32))
+	h := newTestEncryption(t, provider, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if _, err := ioutil.ReadAll(request.Body); err != nil {
+			writer.WriteHeader(503)
+			return
+		}
+		backend.ServeHTTP(writer, request)
+	}))
+	w := httptest.NewRecorder()
+	req := encryptionRequest("PUT", "/v1/a/c/o", strings.NewReader("data"))
+	req.Header.Set("Etag", "d41d8cd98f00b204e9800998ecf8427e")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 422, w.Code)
+	require.Equal(t, 0, len(backend.objects))
+}
+
+func TestEncryptionListingEtagOverride(t *testing.T) {
+	backend := &encryptionBackend{objects: map[string]*storedObject{}}
+	provider := NewRootSecretKeyProvider(bytes.Repeat([]byte("s"), 32))
+	h := newTestEncryption(t, provider, backend)
+	w := httptest.NewRecorder()
+	req := encryptionRequest("PUT", "/v1/a/c/o", strings.NewReader("[]"))
+	req.Header.Set("X-Backend-Container-Update-Override-Etag", "0123456789abcdef0123456789abcdef-3")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+	require.NotContains(t, backend.objects["a/c/o"].headers.Get("X-Backend-Container-Update-Override-Etag"), "0123456789abcdef")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, encryptionRequest("GET", "/v1/a/c?format=json", nil))
+	require.Equal(t, 200, w.Code)
+	var listing []map[string]interface{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &listing))
+	require.Equal(t, "0123456789abcdef0123456789abcdef-3", listing[0]["hash"])
+}
+
+func TestEncryptionWithoutKeys(t *testing.T) {
+	backend := &encryptionBackend{objects: map[string]*storedObject{}}
+	h := newTestEncryption(t, nil, backend)
+	w := httptest.NewRecorder()
+	req := encryptionRequest("PUT", "/v1/a/c/o", strings.NewReader("plain"))
+	req.Header.Set("X-Object-Meta-Color", "blue")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, []byte("plain"), backend.objects["a/c/o"].body)
+	require.Equal(t, "blue", backend.objects["a/c/o"].headers.Get("X-Object-Meta-Color"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, encryptionRequest("GET", "/v1/a/c/o", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "plain", w.Body.String())
+}
+
+func TestEncryptedHeaderValues(t *testing.T) {
+	provider := NewRootSecretKeyProvider(bytes.Repeat([]byte("s"), 32))
+	key, err := provider.Key("/a/c")
+	require.Nil(t, err)
+	value, err := encryptHeaderValue(key, "some value", map[string]string{"path": "/a/c"})
+	require.Nil(t, err)
+	require.Equal(t, len("some value"), EncryptedValueLength(value))
+	plaintext, err := decryptHeaderValue(provider, "/other", value)
+	require.Nil(t, err)
+	require.Equal(t, "some value", plaintext)
+	_, err = decryptHeaderValue(provider, "/a/c", base64.StdEncoding.EncodeToString([]byte("x"))+"; swift_meta=%7B%22cipher%22%3A%22ROT13%22%7D")
+	require.NotNil(t, err)
+}
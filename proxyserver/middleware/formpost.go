@@ -0,0 +1,276 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+const formPostMaxValueLength = 4096
+
+var errFormPostFileTooLarge = errors.New("max_file_size exceeded")
+
+type formPostError struct {
+	status  int
+	message string
+}
+
+// formPostWriter records the status of an upload subrequest and discards its body.
+type formPostWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *formPostWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *formPostWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *formPostWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return len(b), nil
+}
+
+// formPostFileReader fails the read once more than max bytes have come through, so an oversized upload is aborted instead of stored.
+type formPostFileReader struct {
+	r        io.Reader
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func (f *formPostFileReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.read += int64(n)
+	if f.max > 0 && f.read > f.max {
+		f.exceeded = true
+		return 0, errFormPostFileTooLarge
+	}
+	return n, err
+}
+
+type formPostHandler struct {
+	next           http.Handler
+	allowedDigests map[string]bool
+}
+
+type formPost struct {
+	*formPostHandler
+	ctx          *ProxyContext
+	request      *http.Request
+	account      string
+	container    string
+	attributes   map[string]string
+	maxFileSize  int64
+	maxFileCount int64
+	fileCount    int64
+}
+
+func (f *formPost) validate() *formPostError {
+	expires, err := strconv.ParseInt(f.attributes["expires"], 10, 64)
+	if err != nil {
+		return &formPostError{401, "expired not an integer"}
+	} else if time.Now().Unix() > expires {
+		return &formPostError{401, "form expired"}
+	}
+	if f.maxFileSize, err = strconv.ParseInt(f.attributes["max_file_size"], 10, 64); err != nil {
+		return &formPostError{400, "max_file_size not an integer"}
+	}
+	if f.maxFileCount, err = strconv.ParseInt(f.attributes["max_file_count"], 10, 64); err != nil {
+		return &formPostError{400, "max_file_count not an integer"}
+	}
+	sig, err := parseSignature(f.attributes["signature"], f.allowedDigests)
+	if err != nil {
+		return &formPostError{401, "invalid signature"}
+	}
+	message := fmt.Sprintf("%s\n%s\n%s\n%s\n%s", f.request.URL.Path, f.attributes["redirect"],
+		f.attributes["max_file_size"], f.attributes["max_file_count"], f.attributes["expires"])
+	scope := tempURLKeyScope(f.ctx, f.account, f.container, func(key []byte) bool {
+		return checkhmacMessage(key, sig, message)
+	})
+	if scope == SCOPE_INVALID {
+		return &formPostError{401, "invalid signature"}
+	}
+	account, container := f.account, f.container
+	f.ctx.Authorize = func(r *http.Request) bool {
+		ar, a, c, _ := getPathParts(r)
+		return ar && r.Method == "PUT" && ((scope == SCOPE_ACCOUNT && a == account) || (scope == SCOPE_CONTAINER && a == account && c == container))
+	}
+	return nil
+}
+
+func (f *formPost) upload(part *multipart.Part) *formPostError {
+	f.fileCount++
+	if f.fileCount > f.maxFileCount {
+		return &formPostError{400, "max file count exceeded"}
+	}
+	path := f.request.URL.Path
+	if !strings.HasSuffix(path, "/") && strings.Count(path, "/") < 4 {
+		path += "/"
+	}
+	path += part.FileName()
+	body := &formPostFileReader{r: part, max: f.maxFileSize}
+	sub, err := http.NewRequest("PUT", "/", body)
+	if err != nil {
+		return &formPostError{500, ""}
+	}
+	sub.URL.Path = path
+	sub = sub.WithContext(f.request.Context())
+	sub.RemoteAddr = f.request.RemoteAddr
+	sub.ContentLength = -1
+	sub.TransferEncoding = []string{"chunked"}
+	sub.Header.Set("Transfer-Encoding", "chunked")
+	sub.Header.Set("X-Trans-Id", f.request.Header.Get("X-Trans-Id"))
+	sub.Header.Set("X-Timestamp", f.request.Header.Get("X-Timestamp"))
+	sub.Header.Set("Content-Type", part.Header.Get("Content-Type"))
+	if sub.Header.Get("Content-Type") == "" {
+		sub.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if xda := f.attributes["x_delete_at"]; xda != "" {
+		sub.Header.Set("X-Delete-At", xda)
+	} else if xda := f.attributes["x_delete_after"]; xda != "" {
+		sub.Header.Set("X-Delete-After", xda)
+	}
+	w := &formPostWriter{header: make(http.Header)}
+	f.next.ServeHTTP(w, sub)
+	if body.exceeded {
+		return &formPostError{400, "max_file_size exceeded"}
+	} else if w.status/100 != 2 {
+		return &formPostError{w.status, ""}
+	}
+	return nil
+}
+
+func (f *formPost) process(reader *multipart.Reader) *formPostError {
+	validated := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return &formPostError{400, "invalid form"}
+		}
+		if part.FileName() == "" {
+			if name := part.FormName(); name != "" {
+				value, err := ioutil.ReadAll(io.LimitReader(part, formPostMaxValueLength))
+				if err != nil {
+					return &formPostError{400, "invalid form"}
+				}
+				f.attributes[name] = strings.TrimSpace(string(value))
+			}
+			continue
+		}
+		if !validated {
+			if ferr := f.validate(); ferr != nil {
+				return ferr
+			}
+			validated = true
+		}
+		if ferr := f.upload(part); ferr != nil {
+			return ferr
+		}
+	}
+	if f.fileCount == 0 {
+		return &formPostError{400, "no files to process"}
+	}
+	return nil
+}
+
+func (f *formPost) respond(writer http.ResponseWriter, status int, message string) {
+	redirect := f.attributes["redirect"]
+	if redirect == "" {
+		body := fmt.Sprintf("%d %s", status, http.StatusText(status))
+		if message != "" {
+			body += "\r\nFormPost: " + strings.Title(message)
+		}
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		writer.WriteHeader(status)
+		writer.Write([]byte(body))
+		return
+	}
+	if strings.Contains(redirect, "?") {
+		redirect += "&"
+	} else {
+		redirect += "?"
+	}
+	redirect += fmt.Sprintf("status=%d&message=%s", status, url.QueryEscape(message))
+	body := fmt.Sprintf("<html><body><p><a href=\"%s\">Click to continue...</a></p></body></html>", html.EscapeString(redirect))
+	writer.Header().Set("Location", redirect)
+	writer.Header().Set("Content-Type", "text/html")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(303)
+	writer.Write([]byte(body))
+}
+
+func (fh *formPostHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		fh.next.ServeHTTP(writer, request)
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		fh.next.ServeHTTP(writer, request)
+		return
+	}
+	apiReq, account, container, _ := getPathParts(request)
+	if !apiReq || account == "" || container == "" {
+		fh.next.ServeHTTP(writer, request)
+		return
+	}
+	f := &formPost{
+		formPostHandler: fh,
+		ctx:             GetProxyContext(request),
+		request:         request,
+		account:         account,
+		container:       container,
+		attributes:      make(map[string]string),
+	}
+	if ferr := f.process(multipart.NewReader(request.Body, params["boundary"])); ferr != nil {
+		f.respond(writer, ferr.status, ferr.message)
+		return
+	}
+	f.respond(writer, 201, "")
+}
+
+func NewFormPost(config conf.Section) (func(http.Handler) http.Handler, error) {
+	digests, allowedDigests, err := configDigests(config, "formpost")
+	if err != nil {
+		return nil, err
+	}
+	RegisterInfo("formpost", map[string]interface{}{"allowed_digests": digests})
+	return func(next http.Handler) http.Handler {
+		return &formPostHandler{next: next, allowedDigests: allowedDigests}
+	}, nil
+}
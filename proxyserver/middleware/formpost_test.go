@@ -0,0 +1,216 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func formPostRequest(t *testing.T, path string, fields [][2]string, files map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, field := range fields {
+		require.Nil(t, mw.WriteField(field[0], field[1]))
+	}
+	for name, contents := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+		h.Set("Content-Type", "text/plain")
+		w, err := mw.CreatePart(h)
+		require.Nil(t, err)
+		w.Write([]byte(contents))
+	}
+	require.Nil(t, mw.Close())
+	r := httptest.NewRequest("POST", path, body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	ctx := &ProxyContext{
+		containerInfoCache: map[string]*ContainerInfo{
+			"container/a/c": {Metadata: map[string]string{"Temp-Url-Key": "mykey"}},
+		},
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
+
+type formPostUploads struct {
+	objects map[string]string
+}
+
+func (u *formPostUploads) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx.Authorize == nil || !ctx.Authorize(request) {
+		writer.WriteHeader(401)
+		return
+	}
+	data, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writer.WriteHeader(499)
+		return
+	}
+	u.objects[request.URL.Path] = string(data)
+	writer.WriteHeader(201)
+}
+
+func newTestFormPost(t *testing.T, next http.Handler) http.Handler {
+	fp, err := NewFormPost(conf.Section{})
+	require.Nil(t, err)
+	return fp(next)
+}
+
+func TestFormPostPassthrough(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/a/c/o", nil)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	served := false
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		served = true
+	})
+	newTestFormPost(t, handler).ServeHTTP(w, r)
+	require.True(t, served)
+}
+
+func TestFormPostUpload(t *testing.T) {
+	r := formPostRequest(t, "/v1/a/c/prefix_", [][2]string{
+		{"redirect", ""},
+		{"max_file_size", "100"},
+		{"max_file_count", "2"},
+		{"expires", "9999999999"},
+		{"signature", "79f4eabb81e8d67c42e9873ab6d3f3f748a00ae8"},
+	}, map[string]string{"one.txt": "file one", "two.txt": "file two"})
+	uploads := &formPostUploads{objects: map[string]string{}}
+	w := httptest.NewRecorder()
+	newTestFormPost(t, uploads).ServeHTTP(w, r)
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, "file one", uploads.objects["/v1/a/c/prefix_one.txt"])
+	require.Equal(t, "file two", uploads.objects["/v1/a/c/prefix_two.txt"])
+}
+
+func TestFormPostRedirect(t *testing.T) {
+	r := formPostRequest(t, "/v1/a/c", [][2]string{
+		{"redirect", "http://x.com/done"},
+		{"max_file_size", "5"},
+		{"max_file_count", "1"},
+		{"expires", "9999999999"},
+		{"signature", "affde4ae53948c6d0790a8e42c68950ce7e02aad"},
+	}, map[string]string{"f.txt": "tiny"})
+	uploads := &formPostUploads{objects: map[string]string{}}
+	w := httptest.NewRecorder()
+	newTestFormPost(t, uploads).ServeHTTP(w, r)
+	require.Equal(t, 303, w.Code)
+	require.Equal(t, "http://x.com/done?status=201&message=", w.Header().Get("Location"))
+	require.Equal(t, "tiny", uploads.objects["/v1/a/c/f.txt"])
+}
+
+func TestFormPostTooLarge(t *testing.T) {
+	r := formPostRequest(t, "/v1/a/c", [][2]string{
+		{"redirect", "http://x.com/done"},
+		{"max_file_size", "5"},
+		{"max_file_count", "1"},
+		{"expires", "9999999999"},
+		{"signature", "affde4ae53948c6d0790a8e42c68950ce7e02aad"},
+	}, map[string]string{"f.txt": "this is too large"})
+	uploads := &formPostUploads{objects: map[string]string{}}
+	w := httptest.NewRecorder()
+	newTestFormPost(t, uploads).ServeHTTP(w, r)
+	require.Equal(t, 303, w.Code)
+	require.Equal(t, "http://x.com/done?status=400&message=max_file_size+exceeded", w.Header().Get("Location"))
+	require.Equal(t, 0, len(uploads.objects))
+}
+
+func TestFormPostBadSignature(t *testing.T) {
+	r := formPostRequest(t, "/v1/a/c", [][2]string{
+		{"redirect", ""},
+		{"max_file_size", "5"},
+		{"max_file_count", "1"},
+		{"expires", "9999999999"},
+		{"signature", "affde4ae53948c6d0790a8e42c68950ce7e02aad"},
+	}, map[string]string{"f.txt": "tiny"})
+	uploads := &formPostUploads{objects: map[string]string{}}
+	w := httptest.NewRecorder()
+	newTestFormPost(t, uploads).ServeHTTP(w, r)
+	require.Equal(t, 401, w.Code)
+	require.Contains(t, w.Body.String(), "FormPost: Invalid Signature")
+	require.Equal(t, 0, len(uploads.objects))
+}
+
+func TestFormPostExpired(t *testing.T) {
+	r := formPostRequest(t, "/v1/a/c", [][2]string{
+		{"redirect", ""},
+		{"max_file_size", "5"},
+		{"max_file_count", "1"},
+		{"expires", "1"},
+		{"signature", "affde4ae53948c6d0790a8e42c68950ce7e02aad"},
+	}, map[string]string{"f.txt": "tiny"})
+	w := httptest.NewRecorder()
+	(&formPostHandler{next: &formPostUploads{objects: map[string]string{}}}).ServeHTTP(w, r)
+	require.Equal(t, 401, w.Code)
+	require.Contains(t, w.Body.String(), "FormPost: Form Expired")
+}
+
+func TestFormPostTooManyFiles(t *testing.T) {
+	r := formPostRequest(t, "/v1/a/c", [][2]string{
+		{"redirect", "http://x.com/done"},
+		{"max_file_size", "5"},
+		{"max_file_count", "1"},
+		{"expires", "9999999999"},
+		{"signature", "affde4ae53948c6d0790a8e42c68950ce7e02aad"},
+	}, map[string]string{"a.txt": "a", "b.txt": "b"})
+	uploads := &formPostUploads{objects: map[string]string{}}
+	w := httptest.NewRecorder()
+	newTestFormPost(t, uploads).ServeHTTP(w, r)
+	require.Equal(t, 303, w.Code)
+	require.Equal(t, "http://x.com/done?status=400&message=max+file+count+exceeded", w.Header().Get("Location"))
+	require.Equal(t, 1, len(uploads.objects))
+}
+
+func TestFormPostAllowedDigests(t *testing.T) {
+	config, err := conf.StringConfig("[filter:formpost]\nallowed_digests = sha256\n")
+	require.Nil(t, err)
+	fp, err := NewFormPost(config.GetSection("filter:formpost"))
+	require.Nil(t, err)
+	for sig, code := range map[string]int{
+		"79f4eabb81e8d67c42e9873ab6d3f3f748a00ae8":                         401,
+		"7f5642705d6b700c25513791a6518e2867c35d601e7dfbab407caecacbc5d5cc": 201,
+	} {
+		r := formPostRequest(t, "/v1/a/c/prefix_", [][2]string{
+			{"redirect", ""},
+			{"max_file_size", "100"},
+			{"max_file_count", "2"},
+			{"expires", "9999999999"},
+			{"signature", sig},
+		}, map[string]string{"one.txt": "file one"})
+		uploads := &formPostUploads{objects: map[string]string{}}
+		w := httptest.NewRecorder()
+		fp(uploads).ServeHTTP(w, r)
+		require.Equal(t, code, w.Code)
+	}
+
+	_, err = NewFormPost(conf.Section{})
+	require.Nil(t, err)
+	config, _ = conf.StringConfig("[filter:formpost]\nallowed_digests = md5\n")
+	_, err = NewFormPost(config.GetSection("filter:formpost"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,85 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+// KeyProvider supplies the keys the encryption middleware encrypts objects and listings with.
+type KeyProvider interface {
+	// Key returns the 32 byte key for a container or object path, such as "/a/c" or "/a/c/o".
+	Key(path string) ([]byte, error)
+}
+
+type rootSecretKeyProvider struct {
+	secret []byte
+}
+
+// NewRootSecretKeyProvider returns a KeyProvider that derives each path's key from a root secret with HMAC-SHA256.
+func NewRootSecretKeyProvider(secret []byte) KeyProvider {
+	return &rootSecretKeyProvider{secret: secret}
+}
+
+func (p *rootSecretKeyProvider) Key(path string) ([]byte, error) {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write([]byte(path))
+	return h.Sum(nil), nil
+}
+
+type keymaster struct {
+	next     http.Handler
+	provider KeyProvider
+}
+
+func (km *keymaster) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if ctx := GetProxyContext(request); ctx != nil {
+		ctx.KeyProvider = km.provider
+	}
+	km.next.ServeHTTP(writer, request)
+}
+
+// NewKeymasterFromProvider returns a keymaster middleware that hands out keys from provider.
+func NewKeymasterFromProvider(provider KeyProvider) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return &keymaster{next: next, provider: provider}
+	}
+}
+
+// NewKeymaster returns a keymaster using the base64 encoded encryption_root_secret.  Without a root secret it
+// provides no keys, which leaves encryption off.
+func NewKeymaster(config conf.Section) (func(http.Handler) http.Handler, error) {
+	encoded := config.GetDefault("encryption_root_secret", "")
+	if encoded == "" {
+		return func(next http.Handler) http.Handler {
+			return next
+		}, nil
+	}
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("encryption_root_secret is not valid base64: %v", err)
+	}
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("encryption_root_secret must be at least 32 bytes")
+	}
+	return NewKeymasterFromProvider(NewRootSecretKeyProvider(secret)), nil
+}
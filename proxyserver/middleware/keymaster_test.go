@@ -0,0 +1,80 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestRootSecretKeyProvider(t *testing.T) {
+	provider := NewRootSecretKeyProvider(bytes.Repeat([]byte("s"), 32))
+	key1, err := provider.Key("/a/c")
+	require.Nil(t, err)
+	require.Equal(t, 32, len(key1))
+	key2, err := provider.Key("/a/c/o")
+	require.Nil(t, err)
+	require.NotEqual(t, key1, key2)
+	again, err := provider.Key("/a/c")
+	require.Nil(t, err)
+	require.Equal(t, key1, again)
+	other, err := NewRootSecretKeyProvider(bytes.Repeat([]byte("t"), 32)).Key("/a/c")
+	require.Nil(t, err)
+	require.NotEqual(t, key1, other)
+}
+
+func TestKeymasterSetsProvider(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("s"), 32))
+	config, err := conf.StringConfig("[filter:keymaster]\nencryption_root_secret=" + secret)
+	require.Nil(t, err)
+	mid, err := NewKeymaster(config.GetSection("filter:keymaster"))
+	require.Nil(t, err)
+	var provider KeyProvider
+	h := mid(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		provider = GetProxyContext(request).KeyProvider
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), encryptionRequest("GET", "/v1/a/c/o", nil))
+	require.NotNil(t, provider)
+	key, err := provider.Key("/a/c")
+	require.Nil(t, err)
+	expected, err := NewRootSecretKeyProvider(bytes.Repeat([]byte("s"), 32)).Key("/a/c")
+	require.Nil(t, err)
+	require.Equal(t, expected, key)
+}
+
+func TestKeymasterConfig(t *testing.T) {
+	mid, err := NewKeymaster(conf.Section{})
+	require.Nil(t, err)
+	var provider KeyProvider
+	h := mid(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		provider = GetProxyContext(request).KeyProvider
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), encryptionRequest("GET", "/v1/a/c/o", nil))
+	require.Nil(t, provider)
+
+	for _, secret := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		config, err := conf.StringConfig("[filter:keymaster]\nencryption_root_secret=" + secret)
+		require.Nil(t, err)
+		_, err = NewKeymaster(config.GetSection("filter:keymaster"))
+		require.NotNil(t, err)
+	}
+}
@@ -16,34 +16,239 @@
 package middleware
 
 import (
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/cactus/go-statsd-client/statsd"
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 )
 
+// statsdClient is the part of statsd.Statter the request logger uses.
+type statsdClient interface {
+	Inc(stat string, value int64, rate float32) error
+	Timing(stat string, delta int64, rate float32) error
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// loggingWriter counts the bytes sent and notes when the response started and which policy served it.
+type loggingWriter struct {
+	http.ResponseWriter
+	count       int64
+	firstByte   time.Time
+	policyIndex string
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+		// the context middleware strips backend headers on the way out, so grab this first.
+		w.policyIndex = w.Header().Get("X-Backend-Storage-Policy-Index")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingWriter) Write(b []byte) (int, error) {
+	if w.firstByte.IsZero() {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.count += int64(n)
+	return n, err
+}
+
+type requestLogger struct {
+	next         http.Handler
+	statsd       statsdClient
+	sampleRate   float32
+	validMethods map[string]bool
+	logHeaders   bool
+	headersOnly  map[string]bool
+	revealPrefix int
+}
+
+func logField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return common.Urlencode(value)
+}
+
+func clientIP(request *http.Request) string {
+	if xff := request.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	} else if ccip := request.Header.Get("X-Cluster-Client-Ip"); ccip != "" {
+		return ccip
+	}
+	return remoteHost(request)
+}
+
+func remoteHost(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+// metricType returns the part of the statsd metric name for the kind of thing being requested, or "" if it isn't an api request.
+func metricType(request *http.Request) string {
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || account == "" {
+		return ""
+	} else if container == "" {
+		return "account"
+	} else if obj == "" {
+		return "container"
+	}
+	return "object"
+}
+
+func (l *requestLogger) obscureToken(token string) string {
+	if l.revealPrefix >= 0 && len(token) > l.revealPrefix {
+		return token[:l.revealPrefix] + "..."
+	}
+	return token
+}
+
+func (l *requestLogger) headerField(request *http.Request) string {
+	if !l.logHeaders {
+		return "-"
+	}
+	headers := make([]string, 0, len(request.Header))
+	for k := range request.Header {
+		if len(l.headersOnly) > 0 && !l.headersOnly[k] {
+			continue
+		}
+		if k == "X-Auth-Token" || k == "X-Storage-Token" {
+			headers = append(headers, k+": "+l.obscureToken(request.Header.Get(k)))
+		} else {
+			headers = append(headers, k+": "+request.Header.Get(k))
+		}
+	}
+	sort.Strings(headers)
+	return logField(strings.Join(headers, "\n"))
+}
+
+func (l *requestLogger) sendMetrics(request *http.Request, status int, start, end time.Time, lw *loggingWriter, bytesIn int64) {
+	if l.statsd == nil {
+		return
+	}
+	stype := metricType(request)
+	if stype == "" {
+		return
+	}
+	method := request.Method
+	if !l.validMethods[method] {
+		method = "BAD_METHOD"
+	}
+	prefixes := []string{fmt.Sprintf("%s.%s.%d", stype, method, status)}
+	if stype == "object" && lw.policyIndex != "" {
+		prefixes = append(prefixes, fmt.Sprintf("%s.policy.%s.%s.%d", stype, lw.policyIndex, method, status))
+	}
+	for _, prefix := range prefixes {
+		l.statsd.Timing(prefix+".timing", int64(end.Sub(start)/time.Millisecond), l.sampleRate)
+		l.statsd.Inc(prefix+".xfer", bytesIn+lw.count, l.sampleRate)
+		if method == "GET" && !lw.firstByte.IsZero() {
+			l.statsd.Timing(prefix+".first-byte.timing", int64(lw.firstByte.Sub(start)/time.Millisecond), l.sampleRate)
+		}
+	}
+}
+
+func (l *requestLogger) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	body := &countingReader{ReadCloser: request.Body}
+	if request.Body != nil {
+		request.Body = body
+	}
+	lw := &loggingWriter{ResponseWriter: writer}
+	// capture these before the rest of the pipeline has a chance to rewrite them.
+	path := request.URL.RequestURI()
+	authToken := request.Header.Get("X-Auth-Token")
+	headers := l.headerField(request)
+
+	l.next.ServeHTTP(lw, request)
+
+	end := time.Now()
+	ctx := GetProxyContext(request)
+	_, status := ctx.Response()
+	ctx.log.Info(fmt.Sprintf("%s %s %s %s %s %s %d %s %s %s %d %d %s %s %s %.4f %s %s %.9f %.9f %s",
+		logField(clientIP(request)),
+		logField(remoteHost(request)),
+		end.UTC().Format("02/Jan/2006/15/04/05"),
+		request.Method,
+		logField(path),
+		request.Proto,
+		status,
+		logField(request.Referer()),
+		logField(request.UserAgent()),
+		logField(l.obscureToken(authToken)),
+		body.count,
+		lw.count,
+		logField(request.Header.Get("Etag")),
+		logField(request.Header.Get("X-Trans-Id")),
+		headers,
+		end.Sub(start).Seconds(),
+		"-", // source and log_info are only set on Swift's internal subrequests, which we don't log
+		"-",
+		float64(start.UnixNano())/1e9,
+		float64(end.UnixNano())/1e9,
+		logField(lw.policyIndex)))
+	l.sendMetrics(request, status, start, end, lw, body.count)
+}
+
+// NewRequestLogger logs each request in the same format as Swift's proxy-logging middleware, and sends timing and
+// transfer metrics to statsd if log_statsd_host is set.
 func NewRequestLogger(config conf.Section) (func(http.Handler) http.Handler, error) {
+	var client statsdClient
+	if host := config.GetDefault("log_statsd_host", ""); host != "" {
+		prefix := "proxy-server"
+		if basePrefix := config.GetDefault("log_statsd_metric_prefix", ""); basePrefix != "" {
+			prefix = basePrefix + "." + prefix
+		}
+		address := fmt.Sprintf("%s:%d", host, config.GetInt("log_statsd_port", 8125))
+		c, err := statsd.NewClient(address, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to statsd at %s: %v", address, err)
+		}
+		client = c
+	}
+	validMethods := map[string]bool{}
+	for _, m := range strings.Split(config.GetDefault("log_statsd_valid_http_methods", "GET,HEAD,POST,PUT,DELETE,COPY,OPTIONS"), ",") {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			validMethods[m] = true
+		}
+	}
+	headersOnly := map[string]bool{}
+	for _, h := range strings.Split(config.GetDefault("access_log_headers_only", ""), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headersOnly[http.CanonicalHeaderKey(h)] = true
+		}
+	}
 	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(
-			func(writer http.ResponseWriter, request *http.Request) {
-				start := time.Now()
-				next.ServeHTTP(writer, request)
-				ctx := GetProxyContext(request)
-				_, status := ctx.Response()
-				ctx.Logger.LogInfo("%s - - [%s] \"%s %s\" %d %s \"%s\" \"%s\" \"%s\" %.4f \"%s\"",
-					request.RemoteAddr,
-					time.Now().Format("02/Jan/2006:15:04:05 -0700"),
-					request.Method,
-					common.Urlencode(request.URL.Path),
-					status,
-					common.GetDefault(writer.Header(), "Content-Length", "-"),
-					common.GetDefault(request.Header, "Referer", "-"),
-					common.GetDefault(request.Header, "X-Trans-Id", "-"),
-					common.GetDefault(request.Header, "User-Agent", "-"),
-					time.Since(start).Seconds(),
-					"-") // TODO: "additional info"?
-			},
-		)
+		return &requestLogger{
+			next:         next,
+			statsd:       client,
+			sampleRate:   float32(config.GetFloat("log_statsd_default_sample_rate", 1.0)),
+			validMethods: validMethods,
+			logHeaders:   config.GetBool("access_log_headers", false),
+			revealPrefix: int(config.GetInt("reveal_sensitive_prefix", 16)),
+			headersOnly:  headersOnly,
+		}
 	}, nil
 }
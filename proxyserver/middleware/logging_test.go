@@ -0,0 +1,148 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+type captureLogger struct {
+	lines []string
+}
+
+func (l *captureLogger) Err(s string) error   { return nil }
+func (l *captureLogger) Debug(s string) error { return nil }
+func (l *captureLogger) Info(s string) error {
+	l.lines = append(l.lines, s)
+	return nil
+}
+
+type fakeStatsd struct {
+	incs    map[string]int64
+	timings map[string]int64
+}
+
+func (s *fakeStatsd) Inc(stat string, value int64, rate float32) error {
+	s.incs[stat] += value
+	return nil
+}
+
+func (s *fakeStatsd) Timing(stat string, delta int64, rate float32) error {
+	s.timings[stat] = delta
+	return nil
+}
+
+func loggingConfig(t *testing.T, settings string) conf.Section {
+	config, err := conf.StringConfig("[filter:proxy-logging]\n" + settings)
+	require.Nil(t, err)
+	return config.GetSection("filter:proxy-logging")
+}
+
+func loggedRequest(method, path, body string, logger *captureLogger) (*http.Request, *proxyWriter) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := &proxyWriter{ResponseWriter: httptest.NewRecorder(), Status: 501}
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{log: logger},
+		capWriter:              w,
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx)), w
+}
+
+func TestRequestLoggerLine(t *testing.T) {
+	logger := &captureLogger{}
+	r, w := loggedRequest("PUT", "/v1/a/c/o%20x?multipart-manifest=put", "hello", logger)
+	r.RemoteAddr = "10.0.0.1:4567"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.1")
+	r.Header.Set("X-Auth-Token", "AUTH_tk0123456789abcdef0123")
+	r.Header.Set("User-Agent", "curl/7.0")
+	r.Header.Set("X-Trans-Id", "tx123")
+	mid, err := NewRequestLogger(loggingConfig(t, ""))
+	require.Nil(t, err)
+	mid(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, _ := ioutil.ReadAll(request.Body)
+		require.Equal(t, "hello", string(data))
+		writer.WriteHeader(201)
+		writer.Write([]byte("created"))
+	})).ServeHTTP(w, r)
+	require.Equal(t, 1, len(logger.lines))
+	fields := strings.Split(logger.lines[0], " ")
+	require.Equal(t, 21, len(fields))
+	require.Equal(t, "1.2.3.4", fields[0])
+	require.Equal(t, "10.0.0.1", fields[1])
+	require.Equal(t, "PUT", fields[3])
+	require.Equal(t, "/v1/a/c/o%2520x%3Fmultipart-manifest%3Dput", fields[4])
+	require.Equal(t, "HTTP/1.1", fields[5])
+	require.Equal(t, "201", fields[6])
+	require.Equal(t, "-", fields[7])
+	require.Equal(t, "curl/7.0", fields[8])
+	require.Equal(t, "AUTH_tk012345678...", fields[9])
+	require.Equal(t, "5", fields[10])
+	require.Equal(t, "7", fields[11])
+	require.Equal(t, "tx123", fields[13])
+	require.Equal(t, "-", fields[14])
+}
+
+func TestRequestLoggerMetrics(t *testing.T) {
+	logger := &captureLogger{}
+	stats := &fakeStatsd{incs: map[string]int64{}, timings: map[string]int64{}}
+	l := &requestLogger{statsd: stats, validMethods: map[string]bool{"GET": true}, sampleRate: 1.0}
+	l.next = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Backend-Storage-Policy-Index", "1")
+		writer.WriteHeader(200)
+		writer.Write([]byte("1234567890"))
+	})
+	r, w := loggedRequest("GET", "/v1/a/c/o", "", logger)
+	l.ServeHTTP(w, r)
+	require.Equal(t, int64(10), stats.incs["object.GET.200.xfer"])
+	require.Equal(t, int64(10), stats.incs["object.policy.1.GET.200.xfer"])
+	require.Contains(t, stats.timings, "object.GET.200.timing")
+	require.Contains(t, stats.timings, "object.GET.200.first-byte.timing")
+	require.Contains(t, stats.timings, "object.policy.1.GET.200.first-byte.timing")
+
+	l.next = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(204)
+	})
+	r, w = loggedRequest("PATCH", "/v1/a/c", "", logger)
+	l.ServeHTTP(w, r)
+	require.Contains(t, stats.timings, "container.BAD_METHOD.204.timing")
+
+	r, w = loggedRequest("GET", "/healthcheck", "", logger)
+	before := len(stats.timings)
+	l.ServeHTTP(w, r)
+	require.Equal(t, before, len(stats.timings))
+}
+
+func TestRequestLoggerHeaders(t *testing.T) {
+	logger := &captureLogger{}
+	r, w := loggedRequest("GET", "/v1/a", "", logger)
+	r.Header.Set("X-Auth-Token", "AUTH_tk0123456789abcdef0123")
+	r.Header.Set("X-Foo", "bar")
+	mid, err := NewRequestLogger(loggingConfig(t, "access_log_headers = true\naccess_log_headers_only = x-auth-token, x-foo"))
+	require.Nil(t, err)
+	mid(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(204)
+	})).ServeHTTP(w, r)
+	fields := strings.Split(logger.lines[0], " ")
+	require.Equal(t, "X-Auth-Token%3A%20AUTH_tk012345678...%0AX-Foo%3A%20bar", fields[14])
+}
@@ -0,0 +1,1292 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+const (
+	s3SegmentsSuffix    = "+segments"
+	s3UploadEtagHeader  = "X-Object-Sysmeta-S3api-Etag"
+	s3MaxKeys           = 1000
+	s3MaxParts          = 10000
+	s3MaxManifestSize   = 2 * 1024 * 1024
+	s3CreationDate      = "2009-02-03T16:45:09.000Z"
+	s3LastModifiedParse = "2006-01-02T15:04:05.999999"
+	s3LastModified      = "2006-01-02T15:04:05.000Z"
+)
+
+// '+' can't appear in bucket names, so the segment containers can't be reached as buckets.
+var s3BucketName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{1,61}[A-Za-z0-9]$`)
+
+// headers that are stored with objects and returned on GET and HEAD.
+var s3ObjectHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Cache-Control", "Expires"}
+
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	s3AccessDenied                      = &s3Error{403, "AccessDenied", "Access Denied."}
+	s3AuthorizationHeaderMalformed      = &s3Error{400, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	s3AuthorizationQueryParametersError = &s3Error{400, "AuthorizationQueryParametersError", "The query string authorization parameters are invalid."}
+	s3BadDigest                         = &s3Error{400, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	s3BucketAlreadyOwnedByYou           = &s3Error{409, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it."}
+	s3BucketNotEmpty                    = &s3Error{409, "BucketNotEmpty", "The bucket you tried to delete is not empty."}
+	s3EntityTooLarge                    = &s3Error{400, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	s3EntityTooSmall                    = &s3Error{400, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size."}
+	s3InternalError                     = &s3Error{500, "InternalError", "We encountered an internal error. Please try again."}
+	s3InvalidAccessKeyID                = &s3Error{403, "InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records."}
+	s3InvalidArgument                   = &s3Error{400, "InvalidArgument", "Invalid Argument."}
+	s3InvalidBucketName                 = &s3Error{400, "InvalidBucketName", "The specified bucket is not valid."}
+	s3InvalidDigest                     = &s3Error{400, "InvalidDigest", "The Content-MD5 you specified is not valid."}
+	s3InvalidPart                       = &s3Error{400, "InvalidPart", "One or more of the specified parts could not be found."}
+	s3InvalidPartOrder                  = &s3Error{400, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	s3InvalidRange                      = &s3Error{416, "InvalidRange", "The requested range is not satisfiable."}
+	s3MalformedXML                      = &s3Error{400, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."}
+	s3MethodNotAllowed                  = &s3Error{405, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	s3MissingContentLength              = &s3Error{411, "MissingContentLength", "You must provide the Content-Length HTTP header."}
+	s3NoSuchBucket                      = &s3Error{404, "NoSuchBucket", "The specified bucket does not exist."}
+	s3NoSuchKey                         = &s3Error{404, "NoSuchKey", "The specified key does not exist."}
+	s3NoSuchUpload                      = &s3Error{404, "NoSuchUpload", "The specified multipart upload does not exist."}
+	s3NotImplemented                    = &s3Error{501, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	s3PreconditionFailed                = &s3Error{412, "PreconditionFailed", "At least one of the preconditions you specified did not hold."}
+	s3RequestExpired                    = &s3Error{403, "AccessDenied", "Request has expired."}
+	s3RequestTimeTooSkewed              = &s3Error{403, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	s3ServiceUnavailable                = &s3Error{503, "ServiceUnavailable", "Please reduce your request rate."}
+	s3SignatureDoesNotMatch             = &s3Error{403, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	s3ContentSHA256Mismatch             = &s3Error{400, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+)
+
+func s3InvalidRequest(message string) *s3Error {
+	return &s3Error{400, "InvalidRequest", message}
+}
+
+// s3StatusError translates a backend status code into an S3 error, using notFound for 404s.
+func s3StatusError(code int, notFound *s3Error) *s3Error {
+	switch code {
+	case 400:
+		return s3InvalidArgument
+	case 404:
+		return notFound
+	case 401, 403:
+		return s3AccessDenied
+	case 412:
+		return s3PreconditionFailed
+	case 413:
+		return s3EntityTooLarge
+	case 416:
+		return s3InvalidRange
+	case 422:
+		return s3BadDigest
+	case 498, 503:
+		return s3ServiceUnavailable
+	}
+	return s3InternalError
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	Owner        *s3Owner `xml:",omitempty"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3LocationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type s3Part struct {
+	PartNumber   int
+	LastModified string `xml:",omitempty"`
+	ETag         string
+	Size         int64 `xml:",omitempty"`
+}
+
+type s3ListPartsResult struct {
+	XMLName              xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string
+	Key                  string
+	UploadID             string `xml:"UploadId"`
+	Initiator            s3Owner
+	Owner                s3Owner
+	StorageClass         string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Parts                []s3Part `xml:"Part"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []s3Part `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// s3ListingEntry is an entry in a json account or container listing.
+type s3ListingEntry struct {
+	Name         string `json:"name"`
+	Subdir       string `json:"subdir"`
+	Hash         string `json:"hash"`
+	Bytes        int64  `json:"bytes"`
+	LastModified string `json:"last_modified"`
+}
+
+// s3ManifestSegment is an entry in an SLO-style manifest of a completed multipart upload.
+type s3ManifestSegment struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+func s3ListingTime(lastModified string) string {
+	t, err := time.Parse(s3LastModifiedParse, lastModified)
+	if err != nil {
+		return lastModified
+	}
+	return t.UTC().Format(s3LastModified)
+}
+
+func s3WriteXML(writer http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		writer.WriteHeader(500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(data)))
+	writer.WriteHeader(status)
+	writer.Write([]byte(xml.Header))
+	writer.Write(data)
+}
+
+type s3api struct {
+	next          http.Handler
+	credentials   S3Credentials
+	storageDomain string
+	location      string
+	minPartSize   int64
+}
+
+func (s *s3api) writeError(writer http.ResponseWriter, request *http.Request, err *s3Error) {
+	if request.Method == "HEAD" {
+		writer.WriteHeader(err.status)
+		return
+	}
+	s3WriteXML(writer, err.status, &s3ErrorResponse{
+		Code:      err.code,
+		Message:   err.message,
+		Resource:  request.URL.Path,
+		RequestID: request.Header.Get("X-Trans-Id"),
+	})
+}
+
+// bucketAndKey splits the request into a bucket and key, taking the bucket from the Host header for
+// virtual-hosted style requests.  The virtual-hosted bucket is also returned, since v2 signatures include it.
+func (s *s3api) bucketAndKey(request *http.Request) (string, string, string) {
+	host := request.Host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	if s.storageDomain != "" && strings.HasSuffix(host, "."+s.storageDomain) {
+		bucket := strings.TrimSuffix(host, "."+s.storageDomain)
+		return bucket, strings.TrimPrefix(request.URL.Path, "/"), bucket
+	}
+	parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], "", ""
+	}
+	return parts[0], parts[1], ""
+}
+
+func (s *s3api) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx == nil || !isS3Request(request) {
+		s.next.ServeHTTP(writer, request)
+		return
+	}
+	writer.Header().Set("X-Amz-Request-Id", request.Header.Get("X-Trans-Id"))
+	bucket, key, virtualBucket := s.bucketAndKey(request)
+	account, err := s.authenticate(request, virtualBucket)
+	if err != nil {
+		s.writeError(writer, request, err)
+		return
+	}
+	if bucket != "" && !s3BucketName.MatchString(bucket) {
+		s.writeError(writer, request, s3InvalidBucketName)
+		return
+	}
+	// the subrequests made for this request may only touch the account the credentials belong to.
+	ctx.Authorize = func(r *http.Request) bool {
+		ar, a, _, _ := getPathParts(r)
+		return ar && a == account
+	}
+	query := request.URL.Query()
+	for param := range query {
+		if s3V2SubResources[param] && !strings.HasPrefix(param, "response-") &&
+			param != "location" && param != "uploads" && param != "uploadId" && param != "partNumber" {
+			s.writeError(writer, request, s3NotImplemented)
+			return
+		}
+	}
+	switch {
+	case bucket == "":
+		if request.Method != "GET" {
+			err = s3MethodNotAllowed
+		} else {
+			err = s.listBuckets(writer, request, ctx, account)
+		}
+	case key == "":
+		switch {
+		case request.Method == "GET" && query["location"] != nil:
+			err = s.getBucketLocation(writer, request, ctx, account, bucket)
+		case query["uploads"] != nil:
+			err = s3NotImplemented
+		case request.Method == "GET":
+			err = s.listObjects(writer, request, ctx, account, bucket)
+		case request.Method == "HEAD":
+			err = s.headBucket(writer, request, ctx, account, bucket)
+		case request.Method == "PUT":
+			err = s.createBucket(writer, request, ctx, account, bucket)
+		case request.Method == "DELETE":
+			err = s.deleteBucket(writer, request, ctx, account, bucket)
+		default:
+			err = s3MethodNotAllowed
+		}
+	case query["uploads"] != nil:
+		if request.Method != "POST" {
+			err = s3MethodNotAllowed
+		} else {
+			err = s.initiateUpload(writer, request, ctx, account, bucket, key)
+		}
+	case query.Get("uploadId") != "":
+		switch request.Method {
+		case "PUT":
+			err = s.uploadPart(writer, request, ctx, account, bucket, key, query.Get("uploadId"))
+		case "GET":
+			err = s.listParts(writer, request, ctx, account, bucket, key, query.Get("uploadId"))
+		case "POST":
+			err = s.completeUpload(writer, request, ctx, account, bucket, key, query.Get("uploadId"))
+		case "DELETE":
+			err = s.abortUpload(writer, request, ctx, account, bucket, key, query.Get("uploadId"))
+		default:
+			err = s3MethodNotAllowed
+		}
+	default:
+		switch request.Method {
+		case "GET", "HEAD":
+			err = s.getObject(writer, request, ctx, account, bucket, key)
+		case "PUT":
+			if request.Header.Get("X-Amz-Copy-Source") != "" {
+				err = s.copyObject(writer, request, ctx, account, bucket, key)
+			} else {
+				err = s.putObject(writer, request, ctx, account, bucket, key)
+			}
+		case "DELETE":
+			err = s.deleteObject(writer, request, ctx, account, bucket, key)
+		default:
+			err = s3MethodNotAllowed
+		}
+	}
+	if err != nil {
+		s.writeError(writer, request, err)
+	}
+}
+
+// s3SubrequestWriter captures the response to a subrequest.  The body is buffered unless stream returns a writer
+// for it, which lets object bodies go straight through without being held in memory.
+type s3SubrequestWriter struct {
+	header  http.Header
+	status  int
+	body    bytes.Buffer
+	stream  func(status int, header http.Header) io.Writer
+	out     io.Writer
+	written int64
+}
+
+func (w *s3SubrequestWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *s3SubrequestWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if w.stream != nil {
+		w.out = w.stream(status, w.header)
+	}
+}
+
+func (w *s3SubrequestWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	if w.out != nil {
+		n, err := w.out.Write(b)
+		w.written += int64(n)
+		return n, err
+	}
+	return w.body.Write(b)
+}
+
+// s3SwiftPath returns the Swift API path of an account, container or object.
+func s3SwiftPath(account string, names ...string) string {
+	path := "/v1/" + account
+	for _, name := range names {
+		path += "/" + name
+	}
+	return path
+}
+
+// subrequest builds a Swift API request made on behalf of an S3 request.  These go through the rest of the
+// pipeline, so they get the same checks and handling as a Swift client's requests.
+func (s *s3api) subrequest(request *http.Request, method, path string, query url.Values, headers http.Header, body io.Reader, length int64) *http.Request {
+	r := request.WithContext(request.Context())
+	u := *request.URL
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = query.Encode()
+	r.URL = &u
+	r.RequestURI = u.RequestURI()
+	r.Method = method
+	r.Form, r.PostForm, r.MultipartForm = nil, nil, nil
+	r.TransferEncoding = nil
+	r.Header = http.Header{}
+	for k, v := range headers {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-Trans-Id", request.Header.Get("X-Trans-Id"))
+	r.Body, r.ContentLength = http.NoBody, 0
+	if body != nil {
+		r.Body, r.ContentLength = ioutil.NopCloser(body), length
+		r.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	return r
+}
+
+// serve sends a subrequest through the rest of the pipeline.
+func (s *s3api) serve(r *http.Request, stream func(status int, header http.Header) io.Writer) *s3SubrequestWriter {
+	w := &s3SubrequestWriter{header: make(http.Header), stream: stream}
+	s.next.ServeHTTP(w, r)
+	return w
+}
+
+// call sends a subrequest without a body, buffering the response.
+func (s *s3api) call(request *http.Request, method, path string, headers http.Header) *s3SubrequestWriter {
+	return s.serve(s.subrequest(request, method, path, nil, headers, nil, 0), nil)
+}
+
+// listing fetches one page of a json account or container listing.
+func (s *s3api) listing(request *http.Request, account, container string, options url.Values) ([]s3ListingEntry, int) {
+	options.Set("format", "json")
+	path := s3SwiftPath(account)
+	if container != "" {
+		path = s3SwiftPath(account, container)
+	}
+	w := s.serve(s.subrequest(request, "GET", path, options, nil, nil, 0), nil)
+	if w.status/100 != 2 {
+		return nil, w.status
+	}
+	var entries []s3ListingEntry
+	if w.body.Len() > 0 {
+		if err := json.Unmarshal(w.body.Bytes(), &entries); err != nil {
+			return nil, 500
+		}
+	}
+	return entries, w.status
+}
+
+func (s *s3api) listBuckets(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account string) *s3Error {
+	result := &s3ListAllMyBucketsResult{Owner: s3Owner{ID: account, DisplayName: account}}
+	marker := ""
+	for {
+		entries, code := s.listing(request, account, "", url.Values{"marker": {marker}})
+		if code == 404 {
+			break
+		} else if code/100 != 2 {
+			return s3StatusError(code, s3InternalError)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name, s3SegmentsSuffix) {
+				result.Buckets = append(result.Buckets, s3Bucket{Name: entry.Name, CreationDate: s3CreationDate})
+			}
+		}
+		marker = entries[len(entries)-1].Name
+	}
+	s3WriteXML(writer, 200, result)
+	return nil
+}
+
+func (s *s3api) getBucketLocation(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket string) *s3Error {
+	if ctx.GetContainerInfo(account, bucket) == nil {
+		return s3NoSuchBucket
+	}
+	location := s.location
+	if location == "us-east-1" {
+		location = ""
+	}
+	s3WriteXML(writer, 200, &s3LocationConstraint{Location: location})
+	return nil
+}
+
+func (s *s3api) headBucket(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket string) *s3Error {
+	if w := s.call(request, "HEAD", s3SwiftPath(account, bucket), nil); w.status/100 != 2 {
+		return s3StatusError(w.status, s3NoSuchBucket)
+	}
+	writer.WriteHeader(200)
+	return nil
+}
+
+func (s *s3api) createBucket(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket string) *s3Error {
+	code := s.call(request, "PUT", s3SwiftPath(account, bucket), nil).status
+	if code == 202 {
+		return s3BucketAlreadyOwnedByYou
+	} else if code/100 != 2 {
+		return s3StatusError(code, s3InternalError)
+	}
+	writer.Header().Set("Location", "/"+bucket)
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(200)
+	return nil
+}
+
+func (s *s3api) deleteBucket(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket string) *s3Error {
+	code := s.call(request, "DELETE", s3SwiftPath(account, bucket), nil).status
+	if code == 409 {
+		return s3BucketNotEmpty
+	} else if code/100 != 2 {
+		return s3StatusError(code, s3NoSuchBucket)
+	}
+	// clean up the segments container too, which only works once any uploads have been completed or aborted.
+	s.call(request, "DELETE", s3SwiftPath(account, bucket+s3SegmentsSuffix), nil)
+	writer.WriteHeader(204)
+	return nil
+}
+
+func (s *s3api) listObjects(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket string) *s3Error {
+	query := request.URL.Query()
+	maxKeys := s3MaxKeys
+	if mk := query.Get("max-keys"); mk != "" {
+		var err error
+		if maxKeys, err = strconv.Atoi(mk); err != nil || maxKeys < 0 {
+			return s3InvalidArgument
+		} else if maxKeys > s3MaxKeys {
+			maxKeys = s3MaxKeys
+		}
+	}
+	encode := func(s string) string { return s }
+	if et := query.Get("encoding-type"); et == "url" {
+		encode = func(s string) string { return s3URIEncode(s, false) }
+	} else if et != "" {
+		return s3InvalidArgument
+	}
+	result := &s3ListBucketResult{
+		Name:         bucket,
+		Prefix:       encode(query.Get("prefix")),
+		MaxKeys:      maxKeys,
+		Delimiter:    encode(query.Get("delimiter")),
+		EncodingType: query.Get("encoding-type"),
+	}
+	v2 := query.Get("list-type") == "2"
+	marker := query.Get("marker")
+	if v2 {
+		result.StartAfter = encode(query.Get("start-after"))
+		marker = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return s3InvalidArgument
+			}
+			result.ContinuationToken = token
+			marker = string(decoded)
+		}
+	} else {
+		m := encode(marker)
+		result.Marker = &m
+	}
+	entries, code := s.listing(request, account, bucket, url.Values{
+		"prefix":    {query.Get("prefix")},
+		"delimiter": {query.Get("delimiter")},
+		"marker":    {marker},
+		"limit":     {strconv.Itoa(maxKeys + 1)},
+	})
+	if code/100 != 2 {
+		return s3StatusError(code, s3NoSuchBucket)
+	}
+	if len(entries) > maxKeys {
+		result.IsTruncated = true
+		entries = entries[:maxKeys]
+	}
+	var last string
+	for _, entry := range entries {
+		if entry.Subdir != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry.Subdir)})
+			last = entry.Subdir
+			continue
+		}
+		obj := s3Object{
+			Key:          encode(entry.Name),
+			LastModified: s3ListingTime(entry.LastModified),
+			ETag:         "\"" + entry.Hash + "\"",
+			Size:         entry.Bytes,
+			StorageClass: "STANDARD",
+		}
+		if !v2 || query.Get("fetch-owner") == "true" {
+			obj.Owner = &s3Owner{ID: account, DisplayName: account}
+		}
+		result.Contents = append(result.Contents, obj)
+		last = entry.Name
+	}
+	if v2 {
+		count := len(entries)
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+		}
+	} else if result.IsTruncated && result.Delimiter != "" {
+		result.NextMarker = encode(last)
+	}
+	s3WriteXML(writer, 200, result)
+	return nil
+}
+
+// s3RequestObjectHeaders builds the backend headers for storing an object from an S3 request.
+func s3RequestObjectHeaders(request *http.Request) http.Header {
+	headers := http.Header{}
+	for _, h := range s3ObjectHeaders {
+		if v := request.Header.Get(h); v != "" {
+			headers.Set(h, v)
+		}
+	}
+	for k, v := range request.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			headers["X-Object-Meta-"+k[len("X-Amz-Meta-"):]] = v
+		}
+	}
+	return headers
+}
+
+// storeObject streams the request body into an object, returning the body's etag.
+func (s *s3api) storeObject(request *http.Request, account, container, obj string, headers http.Header) (string, *s3Error) {
+	if request.ContentLength < 0 {
+		return "", s3MissingContentLength
+	}
+	if contentMD5 := request.Header.Get("Content-MD5"); contentMD5 != "" {
+		digest, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(digest) != md5.Size {
+			return "", s3InvalidDigest
+		}
+		headers.Set("Etag", hex.EncodeToString(digest))
+	}
+	hash := md5.New()
+	code := s.serve(s.subrequest(request, "PUT", s3SwiftPath(account, container, obj), nil, headers,
+		io.TeeReader(request.Body, hash), request.ContentLength), nil).status
+	if s3PayloadMismatch(request) {
+		return "", s3ContentSHA256Mismatch
+	} else if code/100 != 2 {
+		return "", s3StatusError(code, s3NoSuchBucket)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *s3api) putObject(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key string) *s3Error {
+	etag, err := s.storeObject(request, account, bucket, key, s3RequestObjectHeaders(request))
+	if err != nil {
+		return err
+	}
+	writer.Header().Set("Etag", "\""+etag+"\"")
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(200)
+	return nil
+}
+
+// readManifest fetches and parses the manifest of a completed multipart upload.
+func (s *s3api) readManifest(request *http.Request, ctx *ProxyContext, account, bucket, key string) ([]s3ManifestSegment, http.Header, *s3Error) {
+	w := s.call(request, "GET", s3SwiftPath(account, bucket, key), nil)
+	if w.status/100 != 2 {
+		return nil, nil, s3StatusError(w.status, s3NoSuchKey)
+	}
+	var segments []s3ManifestSegment
+	if w.body.Len() > s3MaxManifestSize || json.Unmarshal(w.body.Bytes(), &segments) != nil {
+		ctx.Logger.LogError("Unable to read manifest of /%s/%s/%s", account, bucket, key)
+		return nil, nil, s3InternalError
+	}
+	return segments, w.header, nil
+}
+
+// openObject returns a reader for the object's whole body, following the manifest of a completed upload.  The
+// body is read by another goroutine, so the container info it needs is loaded here first; that way the
+// subrequests running alongside the caller's only read the context's caches.
+func (s *s3api) openObject(request *http.Request, ctx *ProxyContext, account, bucket, key string) (io.ReadCloser, http.Header, int64, *s3Error) {
+	path := s3SwiftPath(account, bucket, key)
+	head := s.call(request, "HEAD", path, nil)
+	if head.status/100 != 2 {
+		return nil, nil, 0, s3StatusError(head.status, s3NoSuchKey)
+	}
+	r, w := io.Pipe()
+	if head.header.Get(s3UploadEtagHeader) == "" {
+		size, _ := strconv.ParseInt(head.header.Get("Content-Length"), 10, 64)
+		headers := http.Header{}
+		if etag := head.header.Get("Etag"); etag != "" {
+			// makes sure the body is from the same object as the headers.
+			headers.Set("If-Match", etag)
+		}
+		go func() {
+			get := s.serve(s.subrequest(request, "GET", path, nil, headers, nil, 0), func(status int, header http.Header) io.Writer {
+				if status/100 != 2 {
+					return nil
+				}
+				return w
+			})
+			if get.status/100 != 2 {
+				w.CloseWithError(fmt.Errorf("%s returned %d", path, get.status))
+			} else if get.written != size {
+				w.CloseWithError(fmt.Errorf("%s was %d bytes, expected %d", path, get.written, size))
+			} else {
+				w.Close()
+			}
+		}()
+		return r, head.header, size, nil
+	}
+	segments, headers, err := s.readManifest(request, ctx, account, bucket, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var size int64
+	for _, seg := range segments {
+		size += seg.Bytes
+		if parts := strings.SplitN(strings.TrimPrefix(seg.Name, "/"), "/", 2); len(parts) == 2 {
+			ctx.GetContainerInfo(account, parts[0])
+		}
+	}
+	go func() {
+		w.CloseWithError(s.copySegments(w, request, account, segments, 0, size))
+	}()
+	return r, headers, size, nil
+}
+
+// copySegments writes the bytes in [start, end) of the segments to writer.
+func (s *s3api) copySegments(writer io.Writer, request *http.Request, account string, segments []s3ManifestSegment, start, end int64) error {
+	var offset int64
+	for _, seg := range segments {
+		segStart, segEnd := offset, offset+seg.Bytes
+		offset = segEnd
+		if segEnd <= start || segStart >= end || seg.Bytes == 0 {
+			continue
+		}
+		from, to := int64(0), seg.Bytes
+		if start > segStart {
+			from = start - segStart
+		}
+		if end < segEnd {
+			to = end - segStart
+		}
+		parts := strings.SplitN(strings.TrimPrefix(seg.Name, "/"), "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid segment name %q", seg.Name)
+		}
+		headers := http.Header{}
+		if from != 0 || to != seg.Bytes {
+			headers.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to-1))
+		}
+		w := s.serve(s.subrequest(request, "GET", s3SwiftPath(account, parts[0], parts[1]), nil, headers, nil, 0),
+			func(status int, header http.Header) io.Writer {
+				if status/100 != 2 {
+					return nil
+				}
+				return writer
+			})
+		if w.status/100 != 2 {
+			return fmt.Errorf("segment %s returned %d", seg.Name, w.status)
+		} else if w.written != to-from {
+			return fmt.Errorf("segment %s was %d bytes, expected %d", seg.Name, w.written, to-from)
+		}
+	}
+	return nil
+}
+
+// s3CheckPreconditions evaluates conditional request headers against an object, returning the status to respond
+// with when one fails.
+func s3CheckPreconditions(request *http.Request, etag string, lastModified string) int {
+	matches := func(header string) bool {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.Trim(strings.TrimSpace(tag), "\"")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	modified, modifiedErr := common.ParseDate(lastModified)
+	if im := request.Header.Get("If-Match"); im != "" && !matches(im) {
+		return 412
+	} else if ius := request.Header.Get("If-Unmodified-Since"); im == "" && ius != "" && modifiedErr == nil {
+		if t, err := common.ParseDate(ius); err == nil && modified.After(t) {
+			return 412
+		}
+	}
+	if inm := request.Header.Get("If-None-Match"); inm != "" && matches(inm) {
+		return 304
+	} else if ims := request.Header.Get("If-Modified-Since"); inm == "" && ims != "" && modifiedErr == nil {
+		if t, err := common.ParseDate(ims); err == nil && !modified.After(t) {
+			return 304
+		}
+	}
+	return 0
+}
+
+// s3WriteObjectHeaders copies an object's backend headers onto an S3 response.
+func s3WriteObjectHeaders(writer http.ResponseWriter, request *http.Request, headers http.Header, etag string) {
+	for _, h := range append(s3ObjectHeaders, "Content-Length", "Content-Range", "Last-Modified", "Accept-Ranges") {
+		if v := headers.Get(h); v != "" {
+			writer.Header().Set(h, v)
+		}
+	}
+	for k, v := range headers {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			writer.Header()["X-Amz-Meta-"+k[len("X-Object-Meta-"):]] = v
+		}
+	}
+	writer.Header().Set("Etag", "\""+etag+"\"")
+	if request.Method == "GET" {
+		for k, v := range request.URL.Query() {
+			if strings.HasPrefix(k, "response-") && s3V2SubResources[k] {
+				writer.Header().Set(strings.TrimPrefix(k, "response-"), v[0])
+			}
+		}
+	}
+}
+
+func (s *s3api) getObject(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key string) *s3Error {
+	headers := http.Header{}
+	for _, h := range []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if v := request.Header.Get(h); v != "" {
+			headers.Set(h, v)
+		}
+	}
+	// a plain object's response goes straight to the client; errors and manifests are dealt with below.
+	w := s.serve(s.subrequest(request, request.Method, s3SwiftPath(account, bucket, key), nil, headers, nil, 0),
+		func(status int, header http.Header) io.Writer {
+			if status/100 != 2 || header.Get(s3UploadEtagHeader) != "" {
+				return nil
+			}
+			s3WriteObjectHeaders(writer, request, header, strings.Trim(header.Get("Etag"), "\""))
+			writer.WriteHeader(status)
+			return writer
+		})
+	if w.out != nil {
+		return nil
+	}
+	if w.header.Get(s3UploadEtagHeader) != "" {
+		return s.getManifest(writer, request, ctx, account, bucket, key)
+	}
+	if w.status == 304 {
+		writer.WriteHeader(304)
+		return nil
+	}
+	if w.status == 404 && ctx.GetContainerInfo(account, bucket) == nil {
+		return s3NoSuchBucket
+	}
+	return s3StatusError(w.status, s3NoSuchKey)
+}
+
+// getManifest serves a completed multipart upload by streaming its segments.
+func (s *s3api) getManifest(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key string) *s3Error {
+	segments, headers, err := s.readManifest(request, ctx, account, bucket, key)
+	if err != nil {
+		return err
+	}
+	etag := headers.Get(s3UploadEtagHeader)
+	if status := s3CheckPreconditions(request, etag, headers.Get("Last-Modified")); status == 412 {
+		return s3PreconditionFailed
+	} else if status == 304 {
+		writer.WriteHeader(304)
+		return nil
+	}
+	var size int64
+	for _, seg := range segments {
+		size += seg.Bytes
+	}
+	start, end, status := int64(0), size, 200
+	if rangeHeader := request.Header.Get("Range"); rangeHeader != "" {
+		ranges, err := common.ParseRange(rangeHeader, size)
+		if err != nil {
+			writer.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return s3InvalidRange
+		}
+		// like S3, multiple ranges get the whole object.
+		if len(ranges) == 1 {
+			start, end, status = ranges[0].Start, ranges[0].End, 206
+			headers.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+		}
+	}
+	headers.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	headers.Set("Accept-Ranges", "bytes")
+	s3WriteObjectHeaders(writer, request, headers, etag)
+	writer.WriteHeader(status)
+	if request.Method == "HEAD" {
+		return nil
+	}
+	if err := s.copySegments(writer, request, account, segments, start, end); err != nil {
+		// too late for an error response, so the client will see a short read.
+		ctx.Logger.LogError("Error streaming /%s/%s/%s: %v", account, bucket, key, err)
+	}
+	return nil
+}
+
+func (s *s3api) copyObject(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key string) *s3Error {
+	source, err := url.PathUnescape(request.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return s3InvalidArgument
+	}
+	if i := strings.Index(source, "?versionId="); i >= 0 {
+		if source[i+len("?versionId="):] != "null" {
+			return s3NotImplemented
+		}
+		source = source[:i]
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" || !s3BucketName.MatchString(parts[0]) {
+		return s3InvalidRequest("Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+	}
+	directive := request.Header.Get("X-Amz-Metadata-Directive")
+	if directive != "" && directive != "COPY" && directive != "REPLACE" {
+		return s3InvalidArgument
+	}
+	if parts[0] == bucket && parts[1] == key && directive != "REPLACE" {
+		return s3InvalidRequest("This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.")
+	}
+	if ctx.GetContainerInfo(account, bucket) == nil {
+		return s3NoSuchBucket
+	}
+	body, srcHeaders, size, s3err := s.openObject(request, ctx, account, parts[0], parts[1])
+	if s3err != nil {
+		return s3err
+	}
+	defer body.Close()
+	headers := s3RequestObjectHeaders(request)
+	if directive != "REPLACE" {
+		headers = http.Header{}
+		for k, v := range srcHeaders {
+			if strings.HasPrefix(k, "X-Object-Meta-") {
+				headers[k] = v
+			}
+		}
+		for _, h := range s3ObjectHeaders {
+			if v := srcHeaders.Get(h); v != "" {
+				headers.Set(h, v)
+			}
+		}
+	}
+	hash := md5.New()
+	w := s.serve(s.subrequest(request, "PUT", s3SwiftPath(account, bucket, key), nil, headers, io.TeeReader(body, hash), size), nil)
+	if w.status/100 != 2 {
+		return s3StatusError(w.status, s3NoSuchBucket)
+	}
+	s3WriteXML(writer, 200, &s3CopyObjectResult{
+		LastModified: time.Now().UTC().Format(s3LastModified),
+		ETag:         "\"" + hex.EncodeToString(hash.Sum(nil)) + "\"",
+	})
+	return nil
+}
+
+func (s *s3api) deleteObject(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key string) *s3Error {
+	if ctx.GetContainerInfo(account, bucket) == nil {
+		return s3NoSuchBucket
+	}
+	path := s3SwiftPath(account, bucket, key)
+	var segments []s3ManifestSegment
+	if w := s.call(request, "HEAD", path, nil); w.status/100 == 2 && w.header.Get(s3UploadEtagHeader) != "" {
+		var err *s3Error
+		if segments, _, err = s.readManifest(request, ctx, account, bucket, key); err != nil {
+			return err
+		}
+	}
+	if code := s.call(request, "DELETE", path, nil).status; code/100 != 2 && code != 404 {
+		return s3StatusError(code, s3NoSuchKey)
+	}
+	for _, seg := range segments {
+		if parts := strings.SplitN(strings.TrimPrefix(seg.Name, "/"), "/", 2); len(parts) == 2 {
+			s.call(request, "DELETE", s3SwiftPath(account, parts[0], parts[1]), nil)
+		}
+	}
+	writer.WriteHeader(204)
+	return nil
+}
+
+// uploadMarker returns the headers of an in-progress upload's marker object, which holds the headers the
+// completed object will get.
+func (s *s3api) uploadMarker(request *http.Request, account, bucket, key, uploadID string) (http.Header, *s3Error) {
+	w := s.call(request, "HEAD", s3SwiftPath(account, bucket+s3SegmentsSuffix, key+"/"+uploadID), nil)
+	if w.status/100 != 2 {
+		return nil, s3StatusError(w.status, s3NoSuchUpload)
+	}
+	return w.header, nil
+}
+
+// uploadParts lists the parts uploaded so far, in part number order.
+func (s *s3api) uploadParts(request *http.Request, account, bucket, key, uploadID string) ([]s3ListingEntry, *s3Error) {
+	prefix := key + "/" + uploadID + "/"
+	var parts []s3ListingEntry
+	marker := ""
+	for {
+		entries, code := s.listing(request, account, bucket+s3SegmentsSuffix, url.Values{"prefix": {prefix}, "marker": {marker}})
+		if code/100 != 2 {
+			return nil, s3StatusError(code, s3NoSuchUpload)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if n, err := strconv.Atoi(strings.TrimPrefix(entry.Name, prefix)); err == nil && n > 0 && n <= s3MaxParts {
+				parts = append(parts, entry)
+			}
+		}
+		marker = entries[len(entries)-1].Name
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return s3PartNumber(parts[i].Name) < s3PartNumber(parts[j].Name)
+	})
+	return parts, nil
+}
+
+func s3PartNumber(name string) int {
+	n, _ := strconv.Atoi(name[strings.LastIndex(name, "/")+1:])
+	return n
+}
+
+func (s *s3api) initiateUpload(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key string) *s3Error {
+	if ctx.GetContainerInfo(account, bucket) == nil {
+		return s3NoSuchBucket
+	}
+	if code := s.call(request, "PUT", s3SwiftPath(account, bucket+s3SegmentsSuffix), nil).status; code/100 != 2 {
+		return s3StatusError(code, s3InternalError)
+	}
+	uploadID := common.UUID()
+	sub := s.subrequest(request, "PUT", s3SwiftPath(account, bucket+s3SegmentsSuffix, key+"/"+uploadID), nil,
+		s3RequestObjectHeaders(request), bytes.NewReader(nil), 0)
+	if code := s.serve(sub, nil).status; code/100 != 2 {
+		return s3StatusError(code, s3InternalError)
+	}
+	s3WriteXML(writer, 200, &s3InitiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: uploadID})
+	return nil
+}
+
+func (s *s3api) uploadPart(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key, uploadID string) *s3Error {
+	partNumber, err := strconv.Atoi(request.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		return &s3Error{400, "InvalidArgument", fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive", s3MaxParts)}
+	}
+	if request.Header.Get("X-Amz-Copy-Source") != "" {
+		return s3NotImplemented
+	}
+	if _, err := s.uploadMarker(request, account, bucket, key, uploadID); err != nil {
+		return err
+	}
+	etag, s3err := s.storeObject(request, account, bucket+s3SegmentsSuffix, fmt.Sprintf("%s/%s/%d", key, uploadID, partNumber), http.Header{})
+	if s3err != nil {
+		return s3err
+	}
+	writer.Header().Set("Etag", "\""+etag+"\"")
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(200)
+	return nil
+}
+
+func (s *s3api) listParts(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key, uploadID string) *s3Error {
+	query := request.URL.Query()
+	maxParts, marker := 1000, 0
+	var err error
+	if mp := query.Get("max-parts"); mp != "" {
+		if maxParts, err = strconv.Atoi(mp); err != nil || maxParts < 0 {
+			return s3InvalidArgument
+		} else if maxParts > 1000 {
+			maxParts = 1000
+		}
+	}
+	if pm := query.Get("part-number-marker"); pm != "" {
+		if marker, err = strconv.Atoi(pm); err != nil || marker < 0 {
+			return s3InvalidArgument
+		}
+	}
+	if _, err := s.uploadMarker(request, account, bucket, key, uploadID); err != nil {
+		return err
+	}
+	parts, s3err := s.uploadParts(request, account, bucket, key, uploadID)
+	if s3err != nil {
+		return s3err
+	}
+	result := &s3ListPartsResult{
+		Bucket:           bucket,
+		Key:              key,
+		UploadID:         uploadID,
+		Initiator:        s3Owner{ID: account, DisplayName: account},
+		Owner:            s3Owner{ID: account, DisplayName: account},
+		StorageClass:     "STANDARD",
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	for _, part := range parts {
+		n := s3PartNumber(part.Name)
+		if n <= marker {
+			continue
+		}
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, s3Part{
+			PartNumber:   n,
+			LastModified: s3ListingTime(part.LastModified),
+			ETag:         "\"" + part.Hash + "\"",
+			Size:         part.Bytes,
+		})
+		result.NextPartNumberMarker = n
+	}
+	s3WriteXML(writer, 200, result)
+	return nil
+}
+
+func (s *s3api) completeUpload(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key, uploadID string) *s3Error {
+	markerHeaders, s3err := s.uploadMarker(request, account, bucket, key, uploadID)
+	if s3err != nil {
+		return s3err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(request.Body, s3MaxManifestSize))
+	if s3PayloadMismatch(request) {
+		return s3ContentSHA256Mismatch
+	} else if err != nil {
+		return s3InvalidRequest("Unable to read the request body.")
+	}
+	var complete s3CompleteMultipartUpload
+	if err := xml.Unmarshal(data, &complete); err != nil || len(complete.Parts) == 0 {
+		return s3MalformedXML
+	}
+	uploaded, s3err := s.uploadParts(request, account, bucket, key, uploadID)
+	if s3err != nil {
+		return s3err
+	}
+	byNumber := map[int]s3ListingEntry{}
+	for _, part := range uploaded {
+		byNumber[s3PartNumber(part.Name)] = part
+	}
+	var manifest []s3ManifestSegment
+	var size int64
+	hashes := md5.New()
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			return s3InvalidPartOrder
+		}
+		entry, ok := byNumber[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, "\"") != entry.Hash {
+			return s3InvalidPart
+		}
+		if i < len(complete.Parts)-1 && entry.Bytes < s.minPartSize {
+			return s3EntityTooSmall
+		}
+		digest, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			return s3InvalidPart
+		}
+		hashes.Write(digest)
+		manifest = append(manifest, s3ManifestSegment{Name: "/" + bucket + s3SegmentsSuffix + "/" + entry.Name, Hash: entry.Hash, Bytes: entry.Bytes})
+		size += entry.Bytes
+		delete(byNumber, part.PartNumber)
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(hashes.Sum(nil)), len(manifest))
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return s3InternalError
+	}
+	headers := http.Header{
+		"X-Static-Large-Object":                    []string{"True"},
+		s3UploadEtagHeader:                         []string{etag},
+		"X-Backend-Container-Update-Override-Etag": []string{etag},
+		"X-Backend-Container-Update-Override-Size": []string{strconv.FormatInt(size, 10)},
+	}
+	for k, v := range markerHeaders {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			headers[k] = v
+		}
+	}
+	for _, h := range s3ObjectHeaders {
+		if v := markerHeaders.Get(h); v != "" {
+			headers.Set(h, v)
+		}
+	}
+	sub := s.subrequest(request, "PUT", s3SwiftPath(account, bucket, key), nil, headers, bytes.NewReader(manifestData), int64(len(manifestData)))
+	if code := s.serve(sub, nil).status; code/100 != 2 {
+		return s3StatusError(code, s3NoSuchBucket)
+	}
+	s.call(request, "DELETE", s3SwiftPath(account, bucket+s3SegmentsSuffix, key+"/"+uploadID), nil)
+	// parts that were uploaded but left out of the object aren't needed anymore.
+	for _, part := range byNumber {
+		s.call(request, "DELETE", s3SwiftPath(account, bucket+s3SegmentsSuffix, part.Name), nil)
+	}
+	s3WriteXML(writer, 200, &s3CompleteMultipartUploadResult{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     "\"" + etag + "\"",
+	})
+	return nil
+}
+
+func (s *s3api) abortUpload(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, bucket, key, uploadID string) *s3Error {
+	if _, err := s.uploadMarker(request, account, bucket, key, uploadID); err != nil {
+		return err
+	}
+	parts, err := s.uploadParts(request, account, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		s.call(request, "DELETE", s3SwiftPath(account, bucket+s3SegmentsSuffix, part.Name), nil)
+	}
+	s.call(request, "DELETE", s3SwiftPath(account, bucket+s3SegmentsSuffix, key+"/"+uploadID), nil)
+	writer.WriteHeader(204)
+	return nil
+}
+
+// NewS3APIWithCredentials returns an S3 API middleware that checks signatures against credentials.
+func NewS3APIWithCredentials(config conf.Section, credentials S3Credentials) (func(http.Handler) http.Handler, error) {
+	minPartSize := config.GetInt("min_segment_size", 5*1024*1024)
+	if minPartSize < 1 {
+		return nil, fmt.Errorf("min_segment_size must be positive")
+	}
+	RegisterInfo("s3api", map[string]interface{}{"max_parts": s3MaxParts, "min_segment_size": minPartSize})
+	return func(next http.Handler) http.Handler {
+		return &s3api{
+			next:          next,
+			credentials:   credentials,
+			storageDomain: config.GetDefault("storage_domain", ""),
+			location:      config.GetDefault("location", "us-east-1"),
+			minPartSize:   minPartSize,
+		}
+	}, nil
+}
+
+// NewS3API returns an S3 API middleware using credentials from the config.  Without any it passes requests through.
+func NewS3API(config conf.Section) (func(http.Handler) http.Handler, error) {
+	credentials, err := loadS3Credentials(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return func(next http.Handler) http.Handler {
+			return next
+		}, nil
+	}
+	return NewS3APIWithCredentials(config, credentials)
+}
@@ -0,0 +1,683 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+type s3FakeObject struct {
+	headers http.Header
+	body    []byte
+}
+
+// s3FakeClient keeps a single account's containers and objects in memory.
+type s3FakeClient struct {
+	client.ProxyClient
+	containers map[string]map[string]*s3FakeObject
+}
+
+func (f *s3FakeClient) PutAccount(account string, headers http.Header) int {
+	return 201
+}
+
+func (f *s3FakeClient) HeadAccount(account string, headers http.Header) (http.Header, int) {
+	return http.Header{"X-Account-Container-Count": {strconv.Itoa(len(f.containers))},
+		"X-Account-Object-Count": {"0"}, "X-Account-Bytes-Used": {"0"}}, 204
+}
+
+func (f *s3FakeClient) GetAccount(account string, options map[string]string, headers http.Header) (io.ReadCloser, http.Header, int) {
+	var names []string
+	for name := range f.containers {
+		if name > options["marker"] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var listing []map[string]interface{}
+	for _, name := range names {
+		listing = append(listing, map[string]interface{}{"name": name, "count": len(f.containers[name]), "bytes": 0})
+	}
+	data, _ := json.Marshal(listing)
+	return ioutil.NopCloser(bytes.NewReader(data)), http.Header{}, 200
+}
+
+func (f *s3FakeClient) PutContainer(account string, container string, headers http.Header) int {
+	if _, ok := f.containers[container]; ok {
+		return 202
+	}
+	f.containers[container] = map[string]*s3FakeObject{}
+	return 201
+}
+
+func (f *s3FakeClient) HeadContainer(account string, container string, headers http.Header) (http.Header, int) {
+	if _, ok := f.containers[container]; !ok {
+		return http.Header{}, 404
+	}
+	return http.Header{"X-Container-Object-Count": {"0"}, "X-Container-Bytes-Used": {"0"}}, 204
+}
+
+func (f *s3FakeClient) DeleteContainer(account string, container string, headers http.Header) int {
+	if objs, ok := f.containers[container]; !ok {
+		return 404
+	} else if len(objs) > 0 {
+		return 409
+	}
+	delete(f.containers, container)
+	return 204
+}
+
+func (f *s3FakeClient) GetContainer(account string, container string, options map[string]string, headers http.Header) (io.ReadCloser, http.Header, int) {
+	objs, ok := f.containers[container]
+	if !ok {
+		return nil, http.Header{}, 404
+	}
+	limit, err := strconv.Atoi(options["limit"])
+	if err != nil {
+		limit = 10000
+	}
+	var names []string
+	for name := range objs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	listing := []map[string]interface{}{}
+	lastSubdir := ""
+	for _, name := range names {
+		if name <= options["marker"] || !strings.HasPrefix(name, options["prefix"]) || len(listing) >= limit {
+			continue
+		}
+		if d := options["delimiter"]; d != "" {
+			if i := strings.Index(name[len(options["prefix"]):], d); i >= 0 {
+				subdir := name[:len(options["prefix"])+i+len(d)]
+				if subdir != lastSubdir && subdir > options["marker"] {
+					listing = append(listing, map[string]interface{}{"subdir": subdir})
+					lastSubdir = subdir
+				}
+				continue
+			}
+		}
+		o := objs[name]
+		hash := common.HeaderGetDefault(o.headers, "X-Backend-Container-Update-Override-Etag", o.headers.Get("Etag"))
+		size, _ := strconv.Atoi(common.HeaderGetDefault(o.headers, "X-Backend-Container-Update-Override-Size", strconv.Itoa(len(o.body))))
+		listing = append(listing, map[string]interface{}{"name": name, "hash": hash, "bytes": size,
+			"last_modified": "2017-03-04T05:06:07.123456"})
+	}
+	data, _ := json.Marshal(listing)
+	return ioutil.NopCloser(bytes.NewReader(data)), http.Header{}, 200
+}
+
+func (f *s3FakeClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) int {
+	objs, ok := f.containers[container]
+	if !ok {
+		return 404
+	}
+	body, err := ioutil.ReadAll(src)
+	if err != nil {
+		return 499
+	}
+	hash := md5.Sum(body)
+	etag := hex.EncodeToString(hash[:])
+	if e := headers.Get("Etag"); e != "" && e != etag {
+		return 422
+	}
+	stored := http.Header{}
+	for k, v := range headers {
+		stored[k] = v
+	}
+	stored.Set("Etag", etag)
+	stored.Set("Content-Length", strconv.Itoa(len(body)))
+	stored.Set("Last-Modified", "Sat, 04 Mar 2017 05:06:07 GMT")
+	objs[obj] = &s3FakeObject{headers: stored, body: body}
+	return 201
+}
+
+func (f *s3FakeClient) HeadObject(account string, container string, obj string, headers http.Header) (http.Header, int) {
+	body, respHeaders, code := f.GetObject(account, container, obj, headers)
+	body.Close()
+	return respHeaders, code
+}
+
+func (f *s3FakeClient) GetObject(account string, container string, obj string, headers http.Header) (io.ReadCloser, http.Header, int) {
+	o, ok := f.containers[container][obj]
+	if !ok {
+		return ioutil.NopCloser(bytes.NewReader(nil)), http.Header{}, 404
+	}
+	respHeaders := http.Header{}
+	for k, v := range o.headers {
+		respHeaders[k] = v
+	}
+	if im := headers.Get("If-Match"); im != "" && im != o.headers.Get("Etag") {
+		return ioutil.NopCloser(bytes.NewReader(nil)), respHeaders, 412
+	}
+	if r := headers.Get("Range"); r != "" {
+		ranges, err := common.ParseRange(r, int64(len(o.body)))
+		if err != nil {
+			return ioutil.NopCloser(bytes.NewReader(nil)), http.Header{}, 416
+		}
+		respHeaders.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ranges[0].Start, ranges[0].End-1, len(o.body)))
+		respHeaders.Set("Content-Length", strconv.FormatInt(ranges[0].End-ranges[0].Start, 10))
+		return ioutil.NopCloser(bytes.NewReader(o.body[ranges[0].Start:ranges[0].End])), respHeaders, 206
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.body)), respHeaders, 200
+}
+
+func (f *s3FakeClient) DeleteObject(account string, container string, obj string, headers http.Header) int {
+	if _, ok := f.containers[container][obj]; !ok {
+		return 404
+	}
+	delete(f.containers[container], obj)
+	return 204
+}
+
+// s3FakeSwift stands in for the rest of the proxy pipeline, serving the Swift API subrequests s3api makes from
+// an s3FakeClient.  Requests passed through without a proxy context get a 418.
+func s3FakeSwift(fc *s3FakeClient) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		if ctx == nil {
+			writer.WriteHeader(418)
+			return
+		}
+		if ctx.Authorize == nil || !ctx.Authorize(request) {
+			writer.WriteHeader(401)
+			return
+		}
+		_, account, container, obj := getPathParts(request)
+		options := map[string]string{}
+		for _, k := range []string{"format", "limit", "marker", "prefix", "delimiter"} {
+			options[k] = request.FormValue(k)
+		}
+		var body io.ReadCloser
+		var headers http.Header
+		var code int
+		switch {
+		case container == "" && request.Method == "GET":
+			body, headers, code = fc.GetAccount(account, options, request.Header)
+		case obj == "" && request.Method == "GET":
+			body, headers, code = fc.GetContainer(account, container, options, request.Header)
+		case obj == "" && request.Method == "HEAD":
+			headers, code = fc.HeadContainer(account, container, request.Header)
+		case obj == "" && request.Method == "PUT":
+			code = fc.PutContainer(account, container, request.Header)
+		case obj == "" && request.Method == "DELETE":
+			code = fc.DeleteContainer(account, container, request.Header)
+		case request.Method == "GET":
+			body, headers, code = fc.GetObject(account, container, obj, request.Header)
+		case request.Method == "HEAD":
+			headers, code = fc.HeadObject(account, container, obj, request.Header)
+		case request.Method == "PUT":
+			if request.ContentLength < 0 {
+				code = 411
+			} else {
+				code = fc.PutObject(account, container, obj, request.Header, request.Body)
+			}
+		case request.Method == "DELETE":
+			code = fc.DeleteObject(account, container, obj, request.Header)
+		default:
+			code = 405
+		}
+		for k := range headers {
+			writer.Header().Set(k, headers.Get(k))
+		}
+		writer.WriteHeader(code)
+		if body != nil {
+			defer body.Close()
+			if request.Method != "HEAD" {
+				io.Copy(writer, body)
+			}
+		}
+	})
+}
+
+func newTestS3API(t *testing.T) (http.Handler, *s3FakeClient) {
+	fc := &s3FakeClient{containers: map[string]map[string]*s3FakeObject{}}
+	config, err := conf.StringConfig("[filter:s3api]\ncredential_AKID=secret AUTH_test\nmin_segment_size=10")
+	require.Nil(t, err)
+	mid, err := NewS3API(config.GetSection("filter:s3api"))
+	require.Nil(t, err)
+	return mid(s3FakeSwift(fc)), fc
+}
+
+// s3Do sends a request signed with the v2 scheme through the middleware.
+func s3Do(h http.Handler, fc *s3FakeClient, method, target string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	signature := hmacSum(sha1.New, []byte("secret"), s3V2StringToSign(req, req.Header.Get("Date"), ""))
+	req.Header.Set("Authorization", "AWS AKID:"+base64.StdEncoding.EncodeToString(signature))
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{c: fc, Cache: &test.FakeMemcacheRing{}},
+		Logger:                 test.FakeLogger{},
+		containerInfoCache:     map[string]*ContainerInfo{},
+		accountInfoCache:       map[string]*AccountInfo{},
+	}
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func s3ErrorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	var resp s3ErrorResponse
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	return resp.Code
+}
+
+func TestS3PassesThroughUnsigned(t *testing.T) {
+	h, _ := newTestS3API(t)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/AUTH_test/c", nil))
+	require.Equal(t, 418, w.Code)
+
+	// without any credentials, even signed requests go to the next handler.
+	config, err := conf.StringConfig("[filter:s3api]\nstorage_domain=example.com")
+	require.Nil(t, err)
+	mid, err := NewS3API(config.GetSection("filter:s3api"))
+	require.Nil(t, err)
+	h = mid(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(418)
+	}))
+	require.Equal(t, 418, s3Do(h, &s3FakeClient{}, "GET", "/", nil, nil).Code)
+}
+
+func TestS3BadSignature(t *testing.T) {
+	h, fc := newTestS3API(t)
+	w := s3Do(h, fc, "GET", "/", nil, map[string]string{"X-Amz-Meta-Signed": "yes"})
+	require.Equal(t, 200, w.Code)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	req.Header.Set("Authorization", "AWS AKID:bm9wZQ==")
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", &ProxyContext{}))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 403, w.Code)
+	require.Equal(t, "SignatureDoesNotMatch", s3ErrorCode(t, w))
+}
+
+func TestS3Buckets(t *testing.T) {
+	h, fc := newTestS3API(t)
+	w := s3Do(h, fc, "PUT", "/bucket1", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "/bucket1", w.Header().Get("Location"))
+	w = s3Do(h, fc, "PUT", "/bucket1", nil, nil)
+	require.Equal(t, 409, w.Code)
+	require.Equal(t, "BucketAlreadyOwnedByYou", s3ErrorCode(t, w))
+	w = s3Do(h, fc, "PUT", "/bad+name", nil, nil)
+	require.Equal(t, 400, w.Code)
+	require.Equal(t, "InvalidBucketName", s3ErrorCode(t, w))
+	fc.containers["bucket2"] = map[string]*s3FakeObject{}
+	fc.containers["bucket2+segments"] = map[string]*s3FakeObject{}
+
+	w = s3Do(h, fc, "GET", "/", nil, nil)
+	require.Equal(t, 200, w.Code)
+	var list s3ListAllMyBucketsResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &list))
+	require.Equal(t, []s3Bucket{{"bucket1", s3CreationDate}, {"bucket2", s3CreationDate}}, list.Buckets)
+	require.Equal(t, "AUTH_test", list.Owner.ID)
+
+	w = s3Do(h, fc, "HEAD", "/bucket1", nil, nil)
+	require.Equal(t, 200, w.Code)
+	w = s3Do(h, fc, "HEAD", "/nope", nil, nil)
+	require.Equal(t, 404, w.Code)
+	require.Equal(t, "", w.Body.String())
+
+	w = s3Do(h, fc, "GET", "/bucket1?location", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "<LocationConstraint xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"></LocationConstraint>")
+
+	w = s3Do(h, fc, "GET", "/bucket1?acl", nil, nil)
+	require.Equal(t, 501, w.Code)
+	require.Equal(t, "NotImplemented", s3ErrorCode(t, w))
+
+	fc.containers["bucket2"]["obj"] = &s3FakeObject{headers: http.Header{}}
+	w = s3Do(h, fc, "DELETE", "/bucket2", nil, nil)
+	require.Equal(t, 409, w.Code)
+	require.Equal(t, "BucketNotEmpty", s3ErrorCode(t, w))
+	delete(fc.containers["bucket2"], "obj")
+	w = s3Do(h, fc, "DELETE", "/bucket2", nil, nil)
+	require.Equal(t, 204, w.Code)
+	require.Nil(t, fc.containers["bucket2"])
+	require.Nil(t, fc.containers["bucket2+segments"])
+	w = s3Do(h, fc, "DELETE", "/bucket2", nil, nil)
+	require.Equal(t, 404, w.Code)
+	require.Equal(t, "NoSuchBucket", s3ErrorCode(t, w))
+}
+
+func TestS3ListObjects(t *testing.T) {
+	h, fc := newTestS3API(t)
+	fc.containers["bkt"] = map[string]*s3FakeObject{}
+	for _, name := range []string{"a", "dir/1", "dir/2", "x y", "z"} {
+		fc.containers["bkt"][name] = &s3FakeObject{headers: http.Header{"Etag": {"d41d8cd98f00b204e9800998ecf8427e"}}}
+	}
+	var result s3ListBucketResult
+	w := s3Do(h, fc, "GET", "/bkt?delimiter=/&max-keys=2", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	require.True(t, result.IsTruncated)
+	require.Equal(t, "dir/", result.NextMarker)
+	require.Equal(t, 1, len(result.Contents))
+	require.Equal(t, s3Object{Key: "a", LastModified: "2017-03-04T05:06:07.123Z", ETag: "\"d41d8cd98f00b204e9800998ecf8427e\"",
+		StorageClass: "STANDARD", Owner: &s3Owner{"AUTH_test", "AUTH_test"}}, result.Contents[0])
+	require.Equal(t, []s3CommonPrefix{{"dir/"}}, result.CommonPrefixes)
+
+	result = s3ListBucketResult{}
+	w = s3Do(h, fc, "GET", "/bkt?delimiter=/&marker=dir/", nil, nil)
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	require.False(t, result.IsTruncated)
+	require.Equal(t, 2, len(result.Contents))
+	require.Equal(t, "x y", result.Contents[0].Key)
+
+	result = s3ListBucketResult{}
+	w = s3Do(h, fc, "GET", "/bkt?list-type=2&prefix=dir/&max-keys=1", nil, nil)
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	require.True(t, result.IsTruncated)
+	require.Equal(t, 1, *result.KeyCount)
+	require.Nil(t, result.Contents[0].Owner)
+	token := result.NextContinuationToken
+	require.NotEqual(t, "", token)
+
+	result = s3ListBucketResult{}
+	w = s3Do(h, fc, "GET", "/bkt?list-type=2&prefix=dir/&continuation-token="+token, nil, nil)
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	require.False(t, result.IsTruncated)
+	require.Equal(t, "dir/2", result.Contents[0].Key)
+
+	result = s3ListBucketResult{}
+	w = s3Do(h, fc, "GET", "/bkt?encoding-type=url&prefix=x", nil, nil)
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(t, "x%20y", result.Contents[0].Key)
+
+	w = s3Do(h, fc, "GET", "/nope", nil, nil)
+	require.Equal(t, 404, w.Code)
+	require.Equal(t, "NoSuchBucket", s3ErrorCode(t, w))
+	w = s3Do(h, fc, "GET", "/bkt?max-keys=lots", nil, nil)
+	require.Equal(t, 400, w.Code)
+	require.Equal(t, "InvalidArgument", s3ErrorCode(t, w))
+}
+
+func TestS3Objects(t *testing.T) {
+	h, fc := newTestS3API(t)
+	fc.containers["bkt"] = map[string]*s3FakeObject{}
+	data := []byte("hello world")
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+
+	w := s3Do(h, fc, "PUT", "/bkt/dir/obj", data, map[string]string{"Content-Type": "text/plain", "X-Amz-Meta-Color": "blue"})
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "\""+etag+"\"", w.Header().Get("Etag"))
+	require.Equal(t, "blue", fc.containers["bkt"]["dir/obj"].headers.Get("X-Object-Meta-Color"))
+
+	w = s3Do(h, fc, "PUT", "/bkt/obj2", data, map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(make([]byte, 16))})
+	require.Equal(t, 400, w.Code)
+	require.Equal(t, "BadDigest", s3ErrorCode(t, w))
+	w = s3Do(h, fc, "PUT", "/bkt/obj2", data, map[string]string{"Content-MD5": "nope"})
+	require.Equal(t, "InvalidDigest", s3ErrorCode(t, w))
+	w = s3Do(h, fc, "PUT", "/nope/obj2", data, nil)
+	require.Equal(t, "NoSuchBucket", s3ErrorCode(t, w))
+
+	w = s3Do(h, fc, "GET", "/bkt/dir/obj?response-content-type=text/html", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, data, w.Body.Bytes())
+	require.Equal(t, "\""+etag+"\"", w.Header().Get("Etag"))
+	require.Equal(t, "blue", w.Header().Get("X-Amz-Meta-Color"))
+	require.Equal(t, "text/html", w.Header().Get("Content-Type"))
+	require.Equal(t, "", w.Header().Get("X-Object-Meta-Color"))
+
+	w = s3Do(h, fc, "GET", "/bkt/dir/obj", nil, map[string]string{"Range": "bytes=6-"})
+	require.Equal(t, 206, w.Code)
+	require.Equal(t, "world", w.Body.String())
+	w = s3Do(h, fc, "HEAD", "/bkt/dir/obj", nil, map[string]string{"If-Match": "nope"})
+	require.Equal(t, 412, w.Code)
+	w = s3Do(h, fc, "GET", "/bkt/missing", nil, nil)
+	require.Equal(t, 404, w.Code)
+	require.Equal(t, "NoSuchKey", s3ErrorCode(t, w))
+
+	w = s3Do(h, fc, "PUT", "/bkt/copy", nil, map[string]string{"X-Amz-Copy-Source": "/bkt/dir/obj"})
+	require.Equal(t, 200, w.Code)
+	var copyResult s3CopyObjectResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &copyResult))
+	require.Equal(t, "\""+etag+"\"", copyResult.ETag)
+	require.Equal(t, data, fc.containers["bkt"]["copy"].body)
+	require.Equal(t, "blue", fc.containers["bkt"]["copy"].headers.Get("X-Object-Meta-Color"))
+
+	w = s3Do(h, fc, "PUT", "/bkt/copy", nil, map[string]string{"X-Amz-Copy-Source": "bkt/dir/obj",
+		"X-Amz-Metadata-Directive": "REPLACE", "X-Amz-Meta-Size": "big"})
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "", fc.containers["bkt"]["copy"].headers.Get("X-Object-Meta-Color"))
+	require.Equal(t, "big", fc.containers["bkt"]["copy"].headers.Get("X-Object-Meta-Size"))
+	w = s3Do(h, fc, "PUT", "/bkt/copy", nil, map[string]string{"X-Amz-Copy-Source": "bkt/copy"})
+	require.Equal(t, "InvalidRequest", s3ErrorCode(t, w))
+	w = s3Do(h, fc, "PUT", "/bkt/copy", nil, map[string]string{"X-Amz-Copy-Source": "bkt/missing"})
+	require.Equal(t, "NoSuchKey", s3ErrorCode(t, w))
+
+	w = s3Do(h, fc, "DELETE", "/bkt/copy", nil, nil)
+	require.Equal(t, 204, w.Code)
+	require.Nil(t, fc.containers["bkt"]["copy"])
+	w = s3Do(h, fc, "DELETE", "/bkt/copy", nil, nil)
+	require.Equal(t, 204, w.Code)
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	h, fc := newTestS3API(t)
+	fc.containers["bkt"] = map[string]*s3FakeObject{}
+
+	w := s3Do(h, fc, "POST", "/bkt/big?uploads", nil, map[string]string{"X-Amz-Meta-Color": "red"})
+	require.Equal(t, 200, w.Code)
+	var initiate s3InitiateMultipartUploadResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &initiate))
+	uploadID := initiate.UploadID
+	require.NotEqual(t, "", uploadID)
+	require.NotNil(t, fc.containers["bkt+segments"]["big/"+uploadID])
+
+	parts := [][]byte{[]byte("0123456789abcdef"), []byte("ghijklmnopqrstuv"), []byte("wxyz")}
+	etags := make([]string, len(parts))
+	for i, part := range parts {
+		w = s3Do(h, fc, "PUT", fmt.Sprintf("/bkt/big?partNumber=%d&uploadId=%s", i+1, uploadID), part, nil)
+		require.Equal(t, 200, w.Code)
+		etags[i] = w.Header().Get("Etag")
+	}
+	w = s3Do(h, fc, "PUT", "/bkt/big?partNumber=10001&uploadId="+uploadID, parts[0], nil)
+	require.Equal(t, "InvalidArgument", s3ErrorCode(t, w))
+	w = s3Do(h, fc, "PUT", "/bkt/big?partNumber=1&uploadId=nope", parts[0], nil)
+	require.Equal(t, "NoSuchUpload", s3ErrorCode(t, w))
+	// an extra part that won't be used.
+	w = s3Do(h, fc, "PUT", "/bkt/big?partNumber=9&uploadId="+uploadID, parts[0], nil)
+	require.Equal(t, 200, w.Code)
+
+	w = s3Do(h, fc, "GET", "/bkt/big?max-parts=2&uploadId="+uploadID, nil, nil)
+	require.Equal(t, 200, w.Code)
+	var list s3ListPartsResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &list))
+	require.True(t, list.IsTruncated)
+	require.Equal(t, 2, list.NextPartNumberMarker)
+	require.Equal(t, []int{1, 2}, []int{list.Parts[0].PartNumber, list.Parts[1].PartNumber})
+	require.Equal(t, etags[1], list.Parts[1].ETag)
+
+	complete := func(parts ...s3Part) *httptest.ResponseRecorder {
+		data, err := xml.Marshal(&s3CompleteMultipartUpload{Parts: parts})
+		require.Nil(t, err)
+		return s3Do(h, fc, "POST", "/bkt/big?uploadId="+uploadID, data, nil)
+	}
+	w = complete(s3Part{PartNumber: 2, ETag: etags[1]}, s3Part{PartNumber: 1, ETag: etags[0]})
+	require.Equal(t, "InvalidPartOrder", s3ErrorCode(t, w))
+	w = complete(s3Part{PartNumber: 1, ETag: etags[1]})
+	require.Equal(t, "InvalidPart", s3ErrorCode(t, w))
+	w = complete(s3Part{PartNumber: 3, ETag: etags[2]}, s3Part{PartNumber: 9, ETag: etags[0]})
+	require.Equal(t, "EntityTooSmall", s3ErrorCode(t, w))
+	w = s3Do(h, fc, "POST", "/bkt/big?uploadId="+uploadID, []byte("<nope"), nil)
+	require.Equal(t, "MalformedXML", s3ErrorCode(t, w))
+
+	w = complete(s3Part{PartNumber: 1, ETag: etags[0]}, s3Part{PartNumber: 2, ETag: etags[1]}, s3Part{PartNumber: 3, ETag: etags[2]})
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var result s3CompleteMultipartUploadResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	hashes := md5.New()
+	for _, etag := range etags {
+		digest, _ := hex.DecodeString(strings.Trim(etag, "\""))
+		hashes.Write(digest)
+	}
+	expectedEtag := fmt.Sprintf("\"%x-3\"", hashes.Sum(nil))
+	require.Equal(t, expectedEtag, result.ETag)
+	require.Nil(t, fc.containers["bkt+segments"]["big/"+uploadID])
+	require.Nil(t, fc.containers["bkt+segments"]["big/"+uploadID+"/9"])
+	require.Equal(t, 3, len(fc.containers["bkt+segments"]))
+
+	whole := bytes.Join(parts, nil)
+	w = s3Do(h, fc, "GET", "/bkt/big", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, whole, w.Body.Bytes())
+	require.Equal(t, expectedEtag, w.Header().Get("Etag"))
+	require.Equal(t, "red", w.Header().Get("X-Amz-Meta-Color"))
+	require.Equal(t, strconv.Itoa(len(whole)), w.Header().Get("Content-Length"))
+
+	w = s3Do(h, fc, "GET", "/bkt/big", nil, map[string]string{"Range": "bytes=10-33"})
+	require.Equal(t, 206, w.Code)
+	require.Equal(t, whole[10:34], w.Body.Bytes())
+	require.Equal(t, fmt.Sprintf("bytes 10-33/%d", len(whole)), w.Header().Get("Content-Range"))
+
+	w = s3Do(h, fc, "HEAD", "/bkt/big", nil, map[string]string{"If-None-Match": expectedEtag})
+	require.Equal(t, 304, w.Code)
+	w = s3Do(h, fc, "GET", "/bkt/big", nil, map[string]string{"Range": "bytes=100-"})
+	require.Equal(t, 416, w.Code)
+
+	var listing s3ListBucketResult
+	w = s3Do(h, fc, "GET", "/bkt", nil, nil)
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &listing))
+	require.Equal(t, expectedEtag, listing.Contents[0].ETag)
+	require.Equal(t, int64(len(whole)), listing.Contents[0].Size)
+
+	w = s3Do(h, fc, "PUT", "/bkt/bigcopy", nil, map[string]string{"X-Amz-Copy-Source": "bkt/big"})
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, whole, fc.containers["bkt"]["bigcopy"].body)
+
+	w = s3Do(h, fc, "DELETE", "/bkt/big", nil, nil)
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, 0, len(fc.containers["bkt+segments"]))
+}
+
+func TestS3AbortMultipartUpload(t *testing.T) {
+	h, fc := newTestS3API(t)
+	fc.containers["bkt"] = map[string]*s3FakeObject{}
+	w := s3Do(h, fc, "POST", "/bkt/big?uploads", nil, nil)
+	var initiate s3InitiateMultipartUploadResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &initiate))
+	w = s3Do(h, fc, "PUT", "/bkt/big?partNumber=1&uploadId="+initiate.UploadID, []byte("data"), nil)
+	require.Equal(t, 200, w.Code)
+	w = s3Do(h, fc, "DELETE", "/bkt/big?uploadId="+initiate.UploadID, nil, nil)
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, 0, len(fc.containers["bkt+segments"]))
+	w = s3Do(h, fc, "DELETE", "/bkt/big?uploadId="+initiate.UploadID, nil, nil)
+	require.Equal(t, 404, w.Code)
+	require.Equal(t, "NoSuchUpload", s3ErrorCode(t, w))
+}
+
+func TestS3SubrequestsUsePipeline(t *testing.T) {
+	fc := &s3FakeClient{containers: map[string]map[string]*s3FakeObject{"bkt": {}}}
+	config, err := conf.StringConfig("[filter:s3api]\ncredential_AKID=secret AUTH_test")
+	require.Nil(t, err)
+	mid, err := NewS3API(config.GetSection("filter:s3api"))
+	require.Nil(t, err)
+	// a copy reads its source while the destination is written, so the log can be added to concurrently.
+	var lock sync.Mutex
+	var paths []string
+	swift := s3FakeSwift(fc)
+	h := mid(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		paths = append(paths, request.Method+" "+request.URL.Path)
+		lock.Unlock()
+		ctx := GetProxyContext(request)
+		require.False(t, ctx.Authorize(httptest.NewRequest("GET", "/v1/AUTH_other/bkt/obj", nil)))
+		require.False(t, ctx.Authorize(httptest.NewRequest("GET", "/bkt/obj", nil)))
+		// stands in for a check further down the pipeline, like the object constraints.
+		if request.Method == "PUT" && strings.HasSuffix(request.URL.Path, "/huge") {
+			writer.WriteHeader(413)
+			return
+		}
+		swift.ServeHTTP(writer, request)
+	}))
+
+	w := s3Do(h, fc, "PUT", "/bkt/obj", []byte("data"), nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, []string{"PUT /v1/AUTH_test/bkt/obj"}, paths)
+	w = s3Do(h, fc, "PUT", "/bkt/huge", []byte("data"), nil)
+	require.Equal(t, 400, w.Code)
+	require.Equal(t, "EntityTooLarge", s3ErrorCode(t, w))
+	require.Nil(t, fc.containers["bkt"]["huge"])
+
+	paths = nil
+	w = s3Do(h, fc, "PUT", "/bkt/copy", nil, map[string]string{"X-Amz-Copy-Source": "bkt/obj"})
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, []byte("data"), fc.containers["bkt"]["copy"].body)
+	require.Contains(t, paths, "GET /v1/AUTH_test/bkt/obj")
+	require.Contains(t, paths, "PUT /v1/AUTH_test/bkt/copy")
+}
+
+// s3MissingCache misses like memcache does for tokens it hasn't seen.
+type s3MissingCache struct {
+	test.FakeMemcacheRing
+}
+
+func (c *s3MissingCache) Get(key string) (interface{}, error) {
+	return nil, ring.CacheMiss
+}
+
+func TestS3BucketStartingWithV1(t *testing.T) {
+	s3, fc := newTestS3API(t)
+	config, err := conf.StringConfig("[filter:tempauth]\nuser_test_tester=testing .admin")
+	require.Nil(t, err)
+	mid, err := NewTempAuth(config.GetSection("filter:tempauth"))
+	require.Nil(t, err)
+	tempauth := mid(s3)
+	h := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		GetProxyContext(request).Cache = &s3MissingCache{}
+		tempauth.ServeHTTP(writer, request)
+	})
+	w := s3Do(h, fc, "PUT", "/v1-logs", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.NotNil(t, fc.containers["v1-logs"])
+	w = s3Do(h, fc, "PUT", "/v1-logs/obj", []byte("data"), nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, []byte("data"), fc.containers["v1-logs"]["obj"].body)
+}
@@ -0,0 +1,391 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+const (
+	s3V4Algorithm       = "AWS4-HMAC-SHA256"
+	s3V4DateFormat      = "20060102T150405Z"
+	s3UnsignedPayload   = "UNSIGNED-PAYLOAD"
+	s3MaxRequestSkew    = 15 * time.Minute
+	s3MaxPresignExpires = 7 * 24 * 60 * 60
+)
+
+// s3Now is the clock signatures are checked against; tests replace it to replay recorded requests.
+var s3Now = time.Now
+
+// sub-resources that are part of the string to sign for v2 signatures.
+var s3V2SubResources = map[string]bool{
+	"acl": true, "cors": true, "delete": true, "lifecycle": true, "location": true, "logging": true,
+	"notification": true, "partNumber": true, "policy": true, "requestPayment": true, "restore": true,
+	"tagging": true, "torrent": true, "uploadId": true, "uploads": true, "versionId": true,
+	"versioning": true, "versions": true, "website": true,
+	"response-cache-control": true, "response-content-disposition": true, "response-content-encoding": true,
+	"response-content-language": true, "response-content-type": true, "response-expires": true,
+}
+
+// S3Credentials looks up the secret key and the account an S3 access key belongs to.
+type S3Credentials interface {
+	Lookup(accessKey string) (secret string, account string, ok bool)
+}
+
+type configS3Credentials map[string][2]string
+
+func (c configS3Credentials) Lookup(accessKey string) (string, string, bool) {
+	cred, ok := c[accessKey]
+	return cred[0], cred[1], ok
+}
+
+// NewS3ConfigCredentials reads credentials from "credential_<access key> = <secret key> <account>" lines.
+func NewS3ConfigCredentials(config conf.Section) (S3Credentials, error) {
+	return loadS3Credentials(config)
+}
+
+func loadS3Credentials(config conf.Section) (configS3Credentials, error) {
+	creds := configS3Credentials{}
+	for key, val := range config.Section {
+		if !strings.HasPrefix(key, "credential_") {
+			continue
+		}
+		fields := strings.Fields(val)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s should be \"<secret key> <account>\"", key)
+		}
+		creds[strings.TrimPrefix(key, "credential_")] = [2]string{fields[0], fields[1]}
+	}
+	return creds, nil
+}
+
+func isS3Request(request *http.Request) bool {
+	auth := request.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "AWS ") || strings.HasPrefix(auth, s3V4Algorithm+" ") {
+		return true
+	}
+	query := request.URL.Query()
+	return query.Get("X-Amz-Algorithm") != "" || (query.Get("AWSAccessKeyId") != "" && query.Get("Signature") != "")
+}
+
+func hmacSum(h func() hash.Hash, key []byte, data string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode encodes a string the way AWS canonicalizes paths and query strings.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// s3RawPath returns the request path as the client sent it, which is what v2 signatures cover.
+func s3RawPath(request *http.Request) string {
+	if strings.HasPrefix(request.RequestURI, "/") {
+		return strings.SplitN(request.RequestURI, "?", 2)[0]
+	}
+	return request.URL.EscapedPath()
+}
+
+func s3V2StringToSign(request *http.Request, date string, virtualBucket string) string {
+	var amzHeaders []string
+	for key, values := range request.Header {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-amz-") {
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.TrimSpace(v)
+			}
+			amzHeaders = append(amzHeaders, key+":"+strings.Join(trimmed, ","))
+		}
+	}
+	sort.Strings(amzHeaders)
+	resource := s3RawPath(request)
+	if virtualBucket != "" {
+		resource = "/" + virtualBucket + resource
+	}
+	var subResources []string
+	for key, values := range request.URL.Query() {
+		if !s3V2SubResources[key] {
+			continue
+		}
+		if values[0] == "" {
+			subResources = append(subResources, key)
+		} else {
+			subResources = append(subResources, key+"="+values[0])
+		}
+	}
+	sort.Strings(subResources)
+	if len(subResources) > 0 {
+		resource += "?" + strings.Join(subResources, "&")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(request.Method + "\n")
+	buf.WriteString(request.Header.Get("Content-MD5") + "\n")
+	buf.WriteString(request.Header.Get("Content-Type") + "\n")
+	buf.WriteString(date + "\n")
+	for _, h := range amzHeaders {
+		buf.WriteString(h + "\n")
+	}
+	buf.WriteString(resource)
+	return buf.String()
+}
+
+func (s *s3api) authenticateV2(request *http.Request, virtualBucket string) (string, *s3Error) {
+	var accessKey, signature, date string
+	query := request.URL.Query()
+	if auth := request.Header.Get("Authorization"); auth != "" {
+		creds := strings.TrimPrefix(auth, "AWS ")
+		i := strings.LastIndex(creds, ":")
+		if i < 0 {
+			return "", s3InvalidArgument
+		}
+		accessKey, signature = creds[:i], creds[i+1:]
+		dateHeader := request.Header.Get("X-Amz-Date")
+		if dateHeader == "" {
+			dateHeader = request.Header.Get("Date")
+			date = dateHeader
+		}
+		t, err := common.ParseDate(dateHeader)
+		if err != nil {
+			return "", s3AccessDenied
+		}
+		if skew := s3Now().Sub(t); skew > s3MaxRequestSkew || skew < -s3MaxRequestSkew {
+			return "", s3RequestTimeTooSkewed
+		}
+	} else {
+		accessKey, signature, date = query.Get("AWSAccessKeyId"), query.Get("Signature"), query.Get("Expires")
+		expires, err := strconv.ParseInt(date, 10, 64)
+		if err != nil {
+			return "", s3AccessDenied
+		}
+		if s3Now().Unix() > expires {
+			return "", s3RequestExpired
+		}
+	}
+	secret, account, ok := s.credentials.Lookup(accessKey)
+	if !ok {
+		return "", s3InvalidAccessKeyID
+	}
+	expected := hmacSum(sha1.New, []byte(secret), s3V2StringToSign(request, date, virtualBucket))
+	provided, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, provided) {
+		return "", s3SignatureDoesNotMatch
+	}
+	return account, nil
+}
+
+func s3V4CanonicalRequest(request *http.Request, signedHeaders string, payloadHash string) string {
+	query := request.URL.Query()
+	var params []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			params = append(params, s3URIEncode(key, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	var headers bytes.Buffer
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := request.Header.Get(name)
+		if name == "host" {
+			value = request.Host
+		} else if values := request.Header[http.CanonicalHeaderKey(name)]; len(values) > 1 {
+			value = strings.Join(values, ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	path := request.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{request.Method, s3URIEncode(path, false), strings.Join(params, "&"),
+		headers.String(), signedHeaders, payloadHash}, "\n")
+}
+
+func s3SignsHost(signedHeaders string) bool {
+	for _, name := range strings.Split(signedHeaders, ";") {
+		if name == "host" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *s3api) authenticateV4(request *http.Request) (string, *s3Error) {
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	query := request.URL.Query()
+	if auth := request.Header.Get("Authorization"); auth != "" {
+		for _, part := range strings.Split(strings.TrimPrefix(auth, s3V4Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				return "", s3AuthorizationHeaderMalformed
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzDate = request.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			// clients may send the request time in the Date header instead, which is signed as an ISO 8601 time.
+			amzDate = request.Header.Get("Date")
+			if t, err := common.ParseDate(amzDate); err == nil {
+				amzDate = t.UTC().Format(s3V4DateFormat)
+			}
+		}
+		payloadHash = request.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return "", s3InvalidRequest("Missing required header for this request: x-amz-content-sha256")
+		}
+		if strings.HasPrefix(payloadHash, "STREAMING-") {
+			return "", s3NotImplemented
+		}
+	} else {
+		if query.Get("X-Amz-Algorithm") != s3V4Algorithm {
+			return "", s3AuthorizationQueryParametersError
+		}
+		credential, signedHeaders, signature = query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = s3UnsignedPayload
+	}
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return "", s3AuthorizationHeaderMalformed
+	}
+	if scope[2] != s.location {
+		return "", s3AuthorizationHeaderMalformed
+	}
+	// without the host in the signature, a request could be replayed against another bucket's virtual host.
+	if !s3SignsHost(signedHeaders) {
+		if request.Header.Get("Authorization") != "" {
+			return "", s3AuthorizationHeaderMalformed
+		}
+		return "", s3AuthorizationQueryParametersError
+	}
+	t, err := time.Parse(s3V4DateFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scope[1]) {
+		return "", s3AccessDenied
+	}
+	if request.Header.Get("Authorization") != "" {
+		if skew := s3Now().Sub(t); skew > s3MaxRequestSkew || skew < -s3MaxRequestSkew {
+			return "", s3RequestTimeTooSkewed
+		}
+	} else {
+		expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || expires < 0 || expires > s3MaxPresignExpires {
+			return "", s3AuthorizationQueryParametersError
+		}
+		if s3Now().After(t.Add(time.Duration(expires) * time.Second)) {
+			return "", s3RequestExpired
+		}
+	}
+	secret, account, ok := s.credentials.Lookup(scope[0])
+	if !ok {
+		return "", s3InvalidAccessKeyID
+	}
+	canonicalRequest := sha256.Sum256([]byte(s3V4CanonicalRequest(request, signedHeaders, payloadHash)))
+	stringToSign := strings.Join([]string{s3V4Algorithm, amzDate, strings.Join(scope[1:], "/"),
+		hex.EncodeToString(canonicalRequest[:])}, "\n")
+	key := hmacSum(sha256.New, []byte("AWS4"+secret), scope[1])
+	key = hmacSum(sha256.New, key, scope[2])
+	key = hmacSum(sha256.New, key, scope[3])
+	key = hmacSum(sha256.New, key, scope[4])
+	provided, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(hmacSum(sha256.New, key, stringToSign), provided) {
+		return "", s3SignatureDoesNotMatch
+	}
+	if payloadHash != s3UnsignedPayload {
+		expected, err := hex.DecodeString(payloadHash)
+		if err != nil || len(expected) != sha256.Size {
+			return "", s3InvalidArgument
+		}
+		request.Body = &s3PayloadReader{Reader: request.Body, hash: sha256.New(), expected: expected}
+	}
+	return account, nil
+}
+
+// s3PayloadReader checks the body against the signed x-amz-content-sha256, failing the read at EOF on a mismatch
+// so that nothing gets stored.
+type s3PayloadReader struct {
+	io.Reader
+	hash     hash.Hash
+	expected []byte
+	mismatch bool
+}
+
+func (r *s3PayloadReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expected) {
+		r.mismatch = true
+		return n, errors.New("x-amz-content-sha256 mismatch")
+	}
+	return n, err
+}
+
+func (r *s3PayloadReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// s3PayloadMismatch reports whether the request body didn't match its signed hash.
+func s3PayloadMismatch(request *http.Request) bool {
+	pr, ok := request.Body.(*s3PayloadReader)
+	return ok && pr.mismatch
+}
+
+func (s *s3api) authenticate(request *http.Request, virtualBucket string) (string, *s3Error) {
+	if strings.HasPrefix(request.Header.Get("Authorization"), s3V4Algorithm+" ") || request.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return s.authenticateV4(request)
+	}
+	return s.authenticateV2(request, virtualBucket)
+}
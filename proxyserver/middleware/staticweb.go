@@ -0,0 +1,415 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// staticWebWriter holds back the response of a subrequest so staticweb can decide
+// what to do with it.  Successful and redirect responses are passed on to the
+// client unless the writer is only probing, anything else is swallowed.
+type staticWebWriter struct {
+	http.ResponseWriter
+	header   http.Header
+	status   int
+	passed   bool
+	probe    bool
+	override int
+}
+
+func newStaticWebWriter(w http.ResponseWriter) *staticWebWriter {
+	return &staticWebWriter{ResponseWriter: w, header: make(http.Header)}
+}
+
+func (w *staticWebWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *staticWebWriter) WriteHeader(status int) {
+	w.status = status
+	if w.probe || (status/100 != 2 && status/100 != 3) {
+		return
+	}
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	w.passed = true
+	if w.override != 0 {
+		status = w.override
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *staticWebWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	if w.passed {
+		return w.ResponseWriter.Write(b)
+	}
+	return len(b), nil
+}
+
+// staticWebCaptureWriter keeps the whole response of a subrequest, for listings.
+type staticWebCaptureWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *staticWebCaptureWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *staticWebCaptureWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *staticWebCaptureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.body.Write(b)
+}
+
+type staticWebListingRecord struct {
+	Name         string `json:"name"`
+	Subdir       string `json:"subdir"`
+	Bytes        int64  `json:"bytes"`
+	LastModified string `json:"last_modified"`
+	ContentType  string `json:"content_type"`
+}
+
+type staticWebHandler struct {
+	next http.Handler
+}
+
+type staticWebRequest struct {
+	*staticWebHandler
+	ctx       *ProxyContext
+	request   *http.Request
+	account   string
+	container string
+	index     string
+	errorPage string
+	listings  bool
+	css       string
+}
+
+func humanReadable(size int64) string {
+	suffixes := []string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+	fsize := float64(size)
+	i := 0
+	for fsize >= 1024 && i < len(suffixes)-1 {
+		fsize /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatInt(size, 10)
+	}
+	return fmt.Sprintf("%.0f%s", fsize, suffixes[i])
+}
+
+func (s *staticWebRequest) subrequest(method, obj string) *http.Request {
+	r := s.request.WithContext(s.request.Context())
+	u := *s.request.URL
+	u.Path = fmt.Sprintf("/v1/%s/%s/%s", s.account, s.container, obj)
+	u.RawQuery = ""
+	r.URL = &u
+	r.RequestURI = u.RequestURI()
+	r.Method = method
+	r.Header = make(http.Header, len(s.request.Header))
+	for k, v := range s.request.Header {
+		r.Header[k] = v
+	}
+	return r
+}
+
+// tryObject issues a GET or HEAD for obj through the rest of the pipeline,
+// passing a successful response through to the client.
+func (s *staticWebRequest) tryObject(writer http.ResponseWriter, obj string) int {
+	w := newStaticWebWriter(writer)
+	s.next.ServeHTTP(w, s.subrequest(s.request.Method, obj))
+	return w.status
+}
+
+// objectExists checks for obj without sending anything to the client.
+func (s *staticWebRequest) objectExists(obj string) bool {
+	w := newStaticWebWriter(nil)
+	w.probe = true
+	s.next.ServeHTTP(w, s.subrequest("HEAD", obj))
+	return w.status/100 == 2
+}
+
+func (s *staticWebRequest) listing(prefix string, limit int) ([]staticWebListingRecord, int) {
+	query := url.Values{"format": {"json"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	// listings go through the rest of the pipeline like any other request, so they're authorized the same way.
+	r := s.subrequest("GET", "")
+	r.URL.Path = fmt.Sprintf("/v1/%s/%s", s.account, s.container)
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+	w := &staticWebCaptureWriter{header: make(http.Header)}
+	s.next.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = 200
+	}
+	if w.status/100 != 2 {
+		return nil, w.status
+	}
+	var records []staticWebListingRecord
+	if w.status == 200 {
+		if err := json.Unmarshal(w.body.Bytes(), &records); err != nil {
+			return nil, 500
+		}
+	}
+	return records, 200
+}
+
+func (s *staticWebRequest) errorResponse(writer http.ResponseWriter, status int) {
+	if s.errorPage != "" {
+		w := newStaticWebWriter(writer)
+		w.override = status
+		r := s.subrequest("GET", fmt.Sprintf("%d%s", status, s.errorPage))
+		if s.request.Method == "HEAD" {
+			r.Method = "HEAD"
+		}
+		s.next.ServeHTTP(w, r)
+		if w.passed {
+			return
+		}
+	}
+	srv.StandardResponse(writer, status)
+}
+
+func (s *staticWebRequest) redirect(writer http.ResponseWriter) {
+	writer.Header().Set("Location", s.request.URL.Path+"/")
+	srv.StandardResponse(writer, 301)
+}
+
+func (s *staticWebRequest) cssPath(prefix string) string {
+	if strings.HasPrefix(s.css, "/") || strings.Contains(s.css, "://") {
+		return s.css
+	}
+	return strings.Repeat("../", strings.Count(prefix, "/")) + s.css
+}
+
+func (s *staticWebRequest) renderListing(writer http.ResponseWriter, prefix string) {
+	records, code := s.listing(prefix, 0)
+	if code/100 != 2 {
+		s.errorResponse(writer, code)
+		return
+	}
+	if prefix != "" && len(records) == 0 {
+		s.errorResponse(writer, 404)
+		return
+	}
+	title := html.EscapeString(fmt.Sprintf("Listing of /v1/%s/%s/%s", s.account, s.container, prefix))
+	body := "<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 4.01 Transitional//EN\"\n" +
+		" \"http://www.w3.org/TR/html4/loose.dtd\">\n" +
+		"<html>\n <head>\n  <title>" + title + "</title>\n"
+	if s.css != "" {
+		body += "  <link rel=\"stylesheet\" type=\"text/css\" href=\"" + html.EscapeString(s.cssPath(prefix)) + "\" />\n"
+	} else {
+		body += "  <style type=\"text/css\">\n" +
+			"   h1 {font-size: 1em; font-weight: bold;}\n" +
+			"   th {text-align: left; padding: 0px 1em 0px 1em;}\n" +
+			"   td {padding: 0px 1em 0px 1em;}\n" +
+			"   a {text-decoration: none;}\n" +
+			"  </style>\n"
+	}
+	body += " </head>\n <body>\n  <h1 id=\"title\">" + title + "</h1>\n  <table id=\"listing\">\n" +
+		"   <tr id=\"heading\">\n    <th class=\"colname\">Name</th>\n" +
+		"    <th class=\"colsize\">Size</th>\n    <th class=\"coldate\">Date</th>\n   </tr>\n"
+	if prefix != "" {
+		body += "   <tr id=\"parent\" class=\"item\">\n" +
+			"    <td class=\"colname\"><a href=\"../\">../</a></td>\n" +
+			"    <td class=\"colsize\">&nbsp;</td>\n    <td class=\"coldate\">&nbsp;</td>\n   </tr>\n"
+	}
+	for _, rec := range records {
+		if rec.Subdir == "" {
+			continue
+		}
+		name := strings.TrimPrefix(rec.Subdir, prefix)
+		body += "   <tr class=\"item subdir\">\n" +
+			"    <td class=\"colname\"><a href=\"" + html.EscapeString(common.Urlencode(name)) + "\">" + html.EscapeString(name) + "</a></td>\n" +
+			"    <td class=\"colsize\">&nbsp;</td>\n    <td class=\"coldate\">&nbsp;</td>\n   </tr>\n"
+	}
+	for _, rec := range records {
+		if rec.Subdir != "" {
+			continue
+		}
+		name := strings.TrimPrefix(rec.Name, prefix)
+		class := "item"
+		if ext := strings.LastIndex(name, "."); ext != -1 && ext < len(name)-1 {
+			class += " ext-" + strings.ToLower(name[ext+1:])
+		}
+		if ct := strings.SplitN(rec.ContentType, "/", 2); len(ct) == 2 {
+			class += " type-" + ct[0] + " type-" + ct[0] + "-" + ct[1]
+		}
+		date := strings.Replace(rec.LastModified, "T", " ", 1)
+		if dot := strings.Index(date, "."); dot != -1 {
+			date = date[:dot]
+		}
+		body += "   <tr class=\"" + html.EscapeString(class) + "\">\n" +
+			"    <td class=\"colname\"><a href=\"" + html.EscapeString(common.Urlencode(name)) + "\">" + html.EscapeString(name) + "</a></td>\n" +
+			"    <td class=\"colsize\">" + humanReadable(rec.Bytes) + "</td>\n" +
+			"    <td class=\"coldate\">" + html.EscapeString(date) + "</td>\n   </tr>\n"
+	}
+	body += "  </table>\n </body>\n</html>\n"
+	writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(200)
+	if s.request.Method != "HEAD" {
+		writer.Write([]byte(body))
+	}
+}
+
+// serveDirectory handles requests for the container itself or for a pseudo-directory ending in "/".
+func (s *staticWebRequest) serveDirectory(writer http.ResponseWriter, prefix string) {
+	if s.index != "" {
+		status := s.tryObject(writer, prefix+s.index)
+		if status/100 == 2 || status/100 == 3 {
+			return
+		} else if status != 404 {
+			s.errorResponse(writer, status)
+			return
+		}
+	}
+	if s.listings {
+		s.renderListing(writer, prefix)
+		return
+	}
+	s.errorResponse(writer, 404)
+}
+
+func (s *staticWebRequest) serveObject(writer http.ResponseWriter, obj string) {
+	status := s.tryObject(writer, obj)
+	if status/100 == 2 || status/100 == 3 {
+		return
+	} else if status != 404 {
+		s.errorResponse(writer, status)
+		return
+	}
+	if s.index != "" && s.objectExists(obj+"/"+s.index) {
+		s.redirect(writer)
+		return
+	}
+	if s.listings {
+		if records, code := s.listing(obj+"/", 1); code == 200 && len(records) > 0 {
+			s.redirect(writer)
+			return
+		}
+	}
+	s.errorResponse(writer, 404)
+}
+
+func (sw *staticWebHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		sw.next.ServeHTTP(writer, request)
+		return
+	}
+	ctx := GetProxyContext(request)
+	webMode := common.LooksTrue(request.Header.Get("X-Web-Mode"))
+	anonymous := ctx.Authorize == nil && request.Header.Get("X-Auth-Token") == ""
+	if !webMode && !anonymous {
+		sw.next.ServeHTTP(writer, request)
+		return
+	}
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || account == "" || container == "" {
+		sw.next.ServeHTTP(writer, request)
+		return
+	}
+	ci := ctx.GetContainerInfo(account, container)
+	if ci == nil {
+		sw.next.ServeHTTP(writer, request)
+		return
+	}
+	s := &staticWebRequest{
+		staticWebHandler: sw,
+		ctx:              ctx,
+		request:          request,
+		account:          account,
+		container:        container,
+		index:            ci.Metadata["Web-Index"],
+		errorPage:        ci.Metadata["Web-Error"],
+		listings:         common.LooksTrue(ci.Metadata["Web-Listings"]),
+		css:              ci.Metadata["Web-Listings-Css"],
+	}
+	if s.index == "" && !s.listings {
+		sw.next.ServeHTTP(writer, request)
+		return
+	}
+	if anonymous {
+		// the web metadata only changes how a container is shown; whether anonymous users can see it at all is up
+		// to its read ACL.
+		publicRead, publicListings := referrerACL(ci.ReadACL)
+		if !publicRead {
+			sw.next.ServeHTTP(writer, request)
+			return
+		}
+		ctx.Authorize = func(r *http.Request) bool {
+			ar, a, c, o := getPathParts(r)
+			return ar && a == account && c == container && (r.Method == "GET" || r.Method == "HEAD") && (o != "" || publicListings)
+		}
+	}
+	if obj == "" {
+		if !strings.HasSuffix(request.URL.Path, "/") {
+			s.redirect(writer)
+			return
+		}
+		s.serveDirectory(writer, "")
+	} else if strings.HasSuffix(obj, "/") {
+		s.serveDirectory(writer, obj)
+	} else {
+		s.serveObject(writer, obj)
+	}
+}
+
+// referrerACL returns whether a container read ACL lets anyone read its objects (".r:*") and list it (".rlistings").
+func referrerACL(acl string) (read bool, listings bool) {
+	for _, item := range strings.Split(acl, ",") {
+		switch strings.TrimSpace(item) {
+		case ".r:*":
+			read = true
+		case ".rlistings":
+			listings = true
+		}
+	}
+	return read, read && listings
+}
+
+func NewStaticWeb(config conf.Section) (func(http.Handler) http.Handler, error) {
+	RegisterInfo("staticweb", map[string]interface{}{})
+	return func(next http.Handler) http.Handler {
+		return &staticWebHandler{next: next}
+	}, nil
+}
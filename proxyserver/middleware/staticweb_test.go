@@ -0,0 +1,272 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+// staticWebBackend serves objects out of a map of name to contents, and container listings out of a map of prefix to
+// records, honouring any authorization the context has.
+func staticWebBackend(objects map[string]string, listings map[string][]staticWebListingRecord) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		if ctx.Authorize != nil && !ctx.Authorize(request) {
+			writer.WriteHeader(401)
+			return
+		}
+		_, _, _, obj := getPathParts(request)
+		if obj == "" {
+			records, ok := listings[request.URL.Query().Get("prefix")]
+			if !ok {
+				records = []staticWebListingRecord{}
+			}
+			json.NewEncoder(writer).Encode(records)
+			return
+		}
+		if body, ok := objects[obj]; ok {
+			writer.WriteHeader(200)
+			writer.Write([]byte(body))
+			return
+		}
+		writer.WriteHeader(404)
+		writer.Write([]byte("not found"))
+	})
+}
+
+func staticWebObjects(objects map[string]string) http.Handler {
+	return staticWebBackend(objects, nil)
+}
+
+func staticWebRequestWithACL(method, path string, acl string, meta map[string]string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	ctx := &ProxyContext{
+		containerInfoCache: map[string]*ContainerInfo{
+			"container/a/c": {ReadACL: acl, Metadata: meta},
+		},
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
+
+func staticWebRequestWithMeta(method, path string, meta map[string]string) *http.Request {
+	return staticWebRequestWithACL(method, path, ".r:*,.rlistings", meta)
+}
+
+func TestStaticWebPassAuthenticated(t *testing.T) {
+	r := staticWebRequestWithMeta("GET", "/v1/a/c/", map[string]string{"Web-Index": "index.html"})
+	r.Header.Set("X-Auth-Token", "abc")
+	w := httptest.NewRecorder()
+	served := false
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Equal(t, r, request)
+		served = true
+	})
+	mid, err := NewStaticWeb(conf.Section{})
+	require.Nil(t, err)
+	mid(handler).ServeHTTP(w, r)
+	require.True(t, served)
+}
+
+func TestStaticWebPassNotWebEnabled(t *testing.T) {
+	r := staticWebRequestWithMeta("GET", "/v1/a/c/", map[string]string{})
+	w := httptest.NewRecorder()
+	served := false
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Equal(t, r, request)
+		served = true
+	})
+	sw := &staticWebHandler{next: handler}
+	sw.ServeHTTP(w, r)
+	require.True(t, served)
+	require.Nil(t, GetProxyContext(r).Authorize)
+}
+
+func TestStaticWebRedirectContainer(t *testing.T) {
+	r := staticWebRequestWithMeta("GET", "/v1/a/c", map[string]string{"Web-Index": "index.html"})
+	w := httptest.NewRecorder()
+	sw := &staticWebHandler{next: staticWebObjects(nil)}
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 301, w.Result().StatusCode)
+	require.Equal(t, "/v1/a/c/", w.Result().Header.Get("Location"))
+}
+
+func TestStaticWebIndex(t *testing.T) {
+	objects := map[string]string{"index.html": "root index", "dir/index.html": "dir index"}
+	r := staticWebRequestWithMeta("GET", "/v1/a/c/", map[string]string{"Web-Index": "index.html"})
+	w := httptest.NewRecorder()
+	sw := &staticWebHandler{next: staticWebObjects(objects)}
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "root index", w.Body.String())
+
+	r = staticWebRequestWithMeta("GET", "/v1/a/c/dir/", map[string]string{"Web-Index": "index.html"})
+	w = httptest.NewRecorder()
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "dir index", w.Body.String())
+
+	r = staticWebRequestWithMeta("GET", "/v1/a/c/dir", map[string]string{"Web-Index": "index.html"})
+	w = httptest.NewRecorder()
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 301, w.Result().StatusCode)
+	require.Equal(t, "/v1/a/c/dir/", w.Result().Header.Get("Location"))
+}
+
+func TestStaticWebObjectPassthrough(t *testing.T) {
+	objects := map[string]string{"page.html": "a page"}
+	r := staticWebRequestWithMeta("GET", "/v1/a/c/page.html", map[string]string{"Web-Index": "index.html"})
+	w := httptest.NewRecorder()
+	sw := &staticWebHandler{next: staticWebObjects(objects)}
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "a page", w.Body.String())
+
+	// the authorization granted should not extend to writes or other containers
+	ctx := GetProxyContext(r)
+	require.NotNil(t, ctx.Authorize)
+	require.False(t, ctx.Authorize(httptest.NewRequest("PUT", "/v1/a/c/page.html", nil)))
+	require.False(t, ctx.Authorize(httptest.NewRequest("GET", "/v1/a/c2/page.html", nil)))
+}
+
+func TestStaticWebErrorPage(t *testing.T) {
+	objects := map[string]string{"404error.html": "custom not found"}
+	r := staticWebRequestWithMeta("GET", "/v1/a/c/missing.html",
+		map[string]string{"Web-Index": "index.html", "Web-Error": "error.html"})
+	w := httptest.NewRecorder()
+	sw := &staticWebHandler{next: staticWebObjects(objects)}
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 404, w.Result().StatusCode)
+	require.Equal(t, "custom not found", w.Body.String())
+
+	r = staticWebRequestWithMeta("GET", "/v1/a/c/missing.html", map[string]string{"Web-Index": "index.html"})
+	w = httptest.NewRecorder()
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 404, w.Result().StatusCode)
+	require.NotContains(t, w.Body.String(), "not found")
+}
+
+func TestStaticWebListing(t *testing.T) {
+	listings := map[string][]staticWebListingRecord{
+		"": {
+			{Subdir: "sub/"},
+			{Name: "file.txt", Bytes: 2048, LastModified: "2017-05-02T07:04:28.123456", ContentType: "text/plain"},
+		},
+		"sub/": {
+			{Name: "sub/<b>.txt", Bytes: 10, ContentType: "text/plain"},
+		},
+	}
+	meta := map[string]string{"Web-Listings": "true", "Web-Listings-Css": "style.css"}
+	r := staticWebRequestWithMeta("GET", "/v1/a/c/", meta)
+	w := httptest.NewRecorder()
+	sw := &staticWebHandler{next: staticWebBackend(nil, listings)}
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	body := w.Body.String()
+	require.Contains(t, body, "Listing of /v1/a/c/")
+	require.Contains(t, body, "<a href=\"sub/\">sub/</a>")
+	require.Contains(t, body, "<a href=\"file.txt\">file.txt</a>")
+	require.Contains(t, body, "2Ki")
+	require.Contains(t, body, "2017-05-02 07:04:28")
+	require.Contains(t, body, "href=\"style.css\"")
+	require.NotContains(t, body, "id=\"parent\"")
+
+	r = staticWebRequestWithMeta("GET", "/v1/a/c/sub/", meta)
+	w = httptest.NewRecorder()
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	body = w.Body.String()
+	require.Contains(t, body, "id=\"parent\"")
+	require.Contains(t, body, "&lt;b&gt;.txt")
+	require.Contains(t, body, "href=\"../style.css\"")
+
+	r = staticWebRequestWithMeta("GET", "/v1/a/c/sub", meta)
+	w = httptest.NewRecorder()
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 301, w.Result().StatusCode)
+
+	r = staticWebRequestWithMeta("GET", "/v1/a/c/nothing/", meta)
+	w = httptest.NewRecorder()
+	sw.ServeHTTP(w, r)
+	require.Equal(t, 404, w.Result().StatusCode)
+}
+
+func TestStaticWebPrivateContainer(t *testing.T) {
+	objects := map[string]string{"index.html": "root index"}
+	meta := map[string]string{"Web-Index": "index.html", "Web-Listings": "true"}
+	for _, acl := range []string{"", ".rlistings", "a:b"} {
+		r := staticWebRequestWithACL("GET", "/v1/a/c/", acl, meta)
+		w := httptest.NewRecorder()
+		served := false
+		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			require.Equal(t, r, request)
+			served = true
+		})
+		(&staticWebHandler{next: handler}).ServeHTTP(w, r)
+		require.True(t, served)
+		require.Nil(t, GetProxyContext(r).Authorize)
+	}
+
+	// objects are public, but listings aren't without .rlistings.
+	r := staticWebRequestWithACL("GET", "/v1/a/c/", ".r:*", meta)
+	w := httptest.NewRecorder()
+	(&staticWebHandler{next: staticWebObjects(objects)}).ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "root index", w.Body.String())
+	r = staticWebRequestWithACL("GET", "/v1/a/c/", ".r:*", map[string]string{"Web-Listings": "true"})
+	w = httptest.NewRecorder()
+	(&staticWebHandler{next: staticWebObjects(objects)}).ServeHTTP(w, r)
+	require.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestStaticWebModeWithToken(t *testing.T) {
+	// with a token, staticweb renders the site but leaves authorizing it to the auth middleware.
+	objects := map[string]string{"index.html": "root index"}
+	r := staticWebRequestWithACL("GET", "/v1/a/c/", "", map[string]string{"Web-Index": "index.html"})
+	r.Header.Set("X-Web-Mode", "true")
+	r.Header.Set("X-Auth-Token", "bogus")
+	w := httptest.NewRecorder()
+	denied := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Nil(t, GetProxyContext(request).Authorize)
+		require.Equal(t, "bogus", request.Header.Get("X-Auth-Token"))
+		writer.WriteHeader(401)
+	})
+	(&staticWebHandler{next: denied}).ServeHTTP(w, r)
+	require.NotEqual(t, 200, w.Result().StatusCode)
+	require.Nil(t, GetProxyContext(r).Authorize)
+
+	r = staticWebRequestWithACL("GET", "/v1/a/c/", "", map[string]string{"Web-Index": "index.html"})
+	r.Header.Set("X-Web-Mode", "true")
+	r.Header.Set("X-Auth-Token", "good")
+	w = httptest.NewRecorder()
+	(&staticWebHandler{next: staticWebObjects(objects)}).ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "root index", w.Body.String())
+	require.Nil(t, GetProxyContext(r).Authorize)
+}
+
+func TestHumanReadable(t *testing.T) {
+	require.Equal(t, "100", humanReadable(100))
+	require.Equal(t, "1Ki", humanReadable(1024))
+	require.Equal(t, "5Mi", humanReadable(5*1024*1024))
+}
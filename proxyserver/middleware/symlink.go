@@ -0,0 +1,227 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+const (
+	symlinkTargetSysmeta        = "X-Object-Sysmeta-Symlink-Target"
+	symlinkTargetAccountSysmeta = "X-Object-Sysmeta-Symlink-Target-Account"
+)
+
+// symlinkWriter holds back the response for a symlink so it can be followed
+// instead, passing any other response through to the client.  When the
+// client asked for the link itself, the link's target is exposed in headers.
+type symlinkWriter struct {
+	http.ResponseWriter
+	header        http.Header
+	status        int
+	follow        bool
+	target        string
+	targetAccount string
+}
+
+func newSymlinkWriter(w http.ResponseWriter, follow bool) *symlinkWriter {
+	return &symlinkWriter{ResponseWriter: w, header: make(http.Header), follow: follow}
+}
+
+func (w *symlinkWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *symlinkWriter) WriteHeader(status int) {
+	w.status = status
+	if target := w.header.Get(symlinkTargetSysmeta); target != "" && status/100 == 2 {
+		if w.follow {
+			w.target = target
+			w.targetAccount = w.header.Get(symlinkTargetAccountSysmeta)
+			return
+		}
+		w.header.Set("X-Symlink-Target", target)
+		if account := w.header.Get(symlinkTargetAccountSysmeta); account != "" {
+			w.header.Set("X-Symlink-Target-Account", account)
+		}
+	}
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *symlinkWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	if w.target != "" {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func symlinkError(writer http.ResponseWriter, status int, message string) {
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(message)))
+	writer.WriteHeader(status)
+	writer.Write([]byte(message))
+}
+
+type symlink struct {
+	next       http.Handler
+	symloopMax int
+}
+
+// splitSymlinkTarget splits a "<container>/<object>" symlink target into its parts.
+func splitSymlinkTarget(target string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(target, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (s *symlink) handlePut(writer http.ResponseWriter, request *http.Request, account, container, obj string) {
+	target := request.Header.Get("X-Symlink-Target")
+	targetAccount := request.Header.Get("X-Symlink-Target-Account")
+	if request.ContentLength != 0 {
+		symlinkError(writer, 400, "Symlink requests require a zero byte body")
+		return
+	}
+	targetContainer, targetObj, ok := splitSymlinkTarget(target)
+	if !ok {
+		symlinkError(writer, 412, "X-Symlink-Target header must be of the form <container name>/<object name>")
+		return
+	}
+	if targetAccount != "" && strings.Contains(targetAccount, "/") {
+		symlinkError(writer, 412, "Account name cannot contain slashes")
+		return
+	}
+	linkAccount := targetAccount
+	if linkAccount == "" {
+		linkAccount = account
+	}
+	if linkAccount == account && targetContainer == container && targetObj == obj {
+		symlinkError(writer, 400, "Symlink cannot target itself")
+		return
+	}
+	request.Header.Del("X-Symlink-Target")
+	request.Header.Del("X-Symlink-Target-Account")
+	request.Header.Set(symlinkTargetSysmeta, targetContainer+"/"+targetObj)
+	if targetAccount != "" {
+		request.Header.Set(symlinkTargetAccountSysmeta, targetAccount)
+	}
+	if request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/symlink")
+	}
+	// the container server splits this back out into the listing's symlink_path.
+	request.Header.Set("X-Backend-Container-Update-Override-Content-Type", request.Header.Get("Content-Type")+
+		";symlink_path="+common.Urlencode(fmt.Sprintf("/v1/%s/%s/%s", linkAccount, targetContainer, targetObj)))
+	s.next.ServeHTTP(writer, request)
+}
+
+// follow fetches a symlink's target with the proxy client, following any further links up to symloopMax.
+func (s *symlink) follow(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, target, targetAccount string) {
+	for links := 1; ; links++ {
+		if links > s.symloopMax {
+			symlinkError(writer, 409, fmt.Sprintf("Too many levels of symbolic links, maximum allowed is %d", s.symloopMax))
+			return
+		}
+		if targetAccount != "" {
+			account = targetAccount
+		}
+		container, obj, ok := splitSymlinkTarget(target)
+		if !ok {
+			srv.StandardResponse(writer, 404)
+			return
+		}
+		path := fmt.Sprintf("/v1/%s/%s/%s", account, container, obj)
+		r := request.WithContext(request.Context())
+		u := *request.URL
+		u.Path = path
+		u.RawQuery = ""
+		r.URL = &u
+		if ctx.Authorize != nil && !ctx.Authorize(r) {
+			srv.StandardResponse(writer, 401)
+			return
+		}
+		var body io.ReadCloser
+		var headers http.Header
+		var code int
+		if request.Method == "HEAD" {
+			headers, code = ctx.c.HeadObject(account, container, obj, request.Header)
+		} else {
+			body, headers, code = ctx.c.GetObject(account, container, obj, request.Header)
+		}
+		if code/100 == 2 && headers.Get(symlinkTargetSysmeta) != "" {
+			if body != nil {
+				body.Close()
+			}
+			target, targetAccount = headers.Get(symlinkTargetSysmeta), headers.Get(symlinkTargetAccountSysmeta)
+			continue
+		}
+		for k := range headers {
+			writer.Header().Set(k, headers.Get(k))
+		}
+		writer.Header().Set("Content-Location", common.Urlencode(path))
+		writer.WriteHeader(code)
+		if body != nil {
+			defer body.Close()
+			common.Copy(body, writer)
+		}
+		return
+	}
+}
+
+func (s *symlink) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || obj == "" {
+		s.next.ServeHTTP(writer, request)
+		return
+	}
+	if request.Method == "PUT" && (request.Header.Get("X-Symlink-Target") != "" || request.Header.Get("X-Symlink-Target-Account") != "") {
+		s.handlePut(writer, request, account, container, obj)
+		return
+	}
+	if request.Method != "GET" && request.Method != "HEAD" {
+		s.next.ServeHTTP(writer, request)
+		return
+	}
+	w := newSymlinkWriter(writer, request.URL.Query().Get("symlink") != "get")
+	s.next.ServeHTTP(w, request)
+	if w.target != "" {
+		s.follow(writer, request, GetProxyContext(request), account, w.target, w.targetAccount)
+	}
+}
+
+func NewSymlink(config conf.Section) (func(http.Handler) http.Handler, error) {
+	symloopMax := int(config.GetInt("symloop_max", 2))
+	if symloopMax < 1 {
+		return nil, fmt.Errorf("symloop_max must be a positive integer")
+	}
+	RegisterInfo("symlink", map[string]interface{}{"symloop_max": symloopMax})
+	return func(next http.Handler) http.Handler {
+		return &symlink{next: next, symloopMax: symloopMax}
+	}, nil
+}
@@ -0,0 +1,209 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+type symlinkObject struct {
+	headers http.Header
+	body    string
+}
+
+// symlinkProxyClient serves objects out of a map of account/container/object paths.
+type symlinkProxyClient struct {
+	client.ProxyClient
+	objects map[string]symlinkObject
+}
+
+func (f *symlinkProxyClient) HeadObject(account string, container string, obj string, headers http.Header) (http.Header, int) {
+	if o, ok := f.objects[account+"/"+container+"/"+obj]; ok {
+		return o.headers, 200
+	}
+	return http.Header{}, 404
+}
+
+func (f *symlinkProxyClient) GetObject(account string, container string, obj string, headers http.Header) (io.ReadCloser, http.Header, int) {
+	if o, ok := f.objects[account+"/"+container+"/"+obj]; ok {
+		return ioutil.NopCloser(strings.NewReader(o.body)), o.headers, 200
+	}
+	return ioutil.NopCloser(strings.NewReader("")), http.Header{}, 404
+}
+
+// symlinkObjects stands in for the proxy's object handlers, serving GETs and HEADs from the fake client and saving PUT headers.
+func symlinkObjects(fc *symlinkProxyClient) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, account, container, obj := getPathParts(request)
+		if request.Method == "PUT" {
+			fc.objects[account+"/"+container+"/"+obj] = symlinkObject{headers: request.Header}
+			writer.WriteHeader(201)
+			return
+		}
+		body, headers, code := fc.GetObject(account, container, obj, request.Header)
+		for k := range headers {
+			writer.Header().Set(k, headers.Get(k))
+		}
+		writer.WriteHeader(code)
+		io.Copy(writer, body)
+	})
+}
+
+func symlinkRequest(method, path string, fc *symlinkProxyClient, authorize AuthorizeFunc) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{c: fc},
+		Authorize:              authorize,
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
+
+func newTestSymlink(t *testing.T, fc *symlinkProxyClient) http.Handler {
+	config, err := conf.StringConfig("[filter:symlink]\nsymloop_max=2")
+	require.Nil(t, err)
+	mid, err := NewSymlink(config.GetSection("filter:symlink"))
+	require.Nil(t, err)
+	return mid(symlinkObjects(fc))
+}
+
+func TestSymlinkPut(t *testing.T) {
+	fc := &symlinkProxyClient{objects: map[string]symlinkObject{}}
+	h := newTestSymlink(t, fc)
+
+	w := httptest.NewRecorder()
+	req := symlinkRequest("PUT", "/v1/a/c/link", fc, nil)
+	req.Header.Set("X-Symlink-Target", "c2/o;1")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+	headers := fc.objects["a/c/link"].headers
+	require.Equal(t, "c2/o;1", headers.Get("X-Object-Sysmeta-Symlink-Target"))
+	require.Equal(t, "", headers.Get("X-Object-Sysmeta-Symlink-Target-Account"))
+	require.Equal(t, "", headers.Get("X-Symlink-Target"))
+	require.Equal(t, "application/symlink", headers.Get("Content-Type"))
+	require.Equal(t, "application/symlink;symlink_path=/v1/a/c2/o%3B1", headers.Get("X-Backend-Container-Update-Override-Content-Type"))
+
+	w = httptest.NewRecorder()
+	req = symlinkRequest("PUT", "/v1/a/c/link", fc, nil)
+	req.Header.Set("X-Symlink-Target", "c2/o")
+	req.Header.Set("X-Symlink-Target-Account", "b")
+	req.Header.Set("Content-Type", "text/plain")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+	headers = fc.objects["a/c/link"].headers
+	require.Equal(t, "b", headers.Get("X-Object-Sysmeta-Symlink-Target-Account"))
+	require.Equal(t, "text/plain;symlink_path=/v1/b/c2/o", headers.Get("X-Backend-Container-Update-Override-Content-Type"))
+
+	for _, target := range []string{"c2", "/o", "c2/"} {
+		w = httptest.NewRecorder()
+		req = symlinkRequest("PUT", "/v1/a/c/link", fc, nil)
+		req.Header.Set("X-Symlink-Target", target)
+		h.ServeHTTP(w, req)
+		require.Equal(t, 412, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req = symlinkRequest("PUT", "/v1/a/c/link", fc, nil)
+	req.Header.Set("X-Symlink-Target", "c/link")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("PUT", "/v1/a/c/link", strings.NewReader("data"))
+	req = req.WithContext(symlinkRequest("PUT", "/v1/a/c/link", fc, nil).Context())
+	req.Header.Set("X-Symlink-Target", "c2/o")
+	h.ServeHTTP(w, req)
+	require.Equal(t, 400, w.Code)
+	require.Equal(t, "Symlink requests require a zero byte body", w.Body.String())
+}
+
+func TestSymlinkGet(t *testing.T) {
+	fc := &symlinkProxyClient{objects: map[string]symlinkObject{
+		"a/c/o":     {headers: http.Header{"Content-Type": {"text/plain"}}, body: "target data"},
+		"a/c/link":  {headers: http.Header{"X-Object-Sysmeta-Symlink-Target": {"c/o"}}},
+		"a/c/link2": {headers: http.Header{"X-Object-Sysmeta-Symlink-Target": {"c/link"}}},
+		"a/c/link3": {headers: http.Header{"X-Object-Sysmeta-Symlink-Target": {"c/link2"}}},
+		"a/c/other": {headers: http.Header{"X-Object-Sysmeta-Symlink-Target": {"c/o"}, "X-Object-Sysmeta-Symlink-Target-Account": {"b"}}},
+		"b/c/o":     {headers: http.Header{}, body: "other account"},
+		"a/c/gone":  {headers: http.Header{"X-Object-Sysmeta-Symlink-Target": {"c/missing"}}},
+	}}
+	h := newTestSymlink(t, fc)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, symlinkRequest("GET", "/v1/a/c/link", fc, nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "target data", w.Body.String())
+	require.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	require.Equal(t, "/v1/a/c/o", w.Header().Get("Content-Location"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, symlinkRequest("HEAD", "/v1/a/c/link2", fc, nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, symlinkRequest("GET", "/v1/a/c/link3", fc, nil))
+	require.Equal(t, 409, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, symlinkRequest("GET", "/v1/a/c/other", fc, nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "other account", w.Body.String())
+	require.Equal(t, "/v1/b/c/o", w.Header().Get("Content-Location"))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, symlinkRequest("GET", "/v1/a/c/gone", fc, nil))
+	require.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, symlinkRequest("GET", "/v1/a/c/other?symlink=get", fc, nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "", w.Body.String())
+	require.Equal(t, "c/o", w.Header().Get("X-Symlink-Target"))
+	require.Equal(t, "b", w.Header().Get("X-Symlink-Target-Account"))
+}
+
+func TestSymlinkChecksTargetACL(t *testing.T) {
+	fc := &symlinkProxyClient{objects: map[string]symlinkObject{
+		"a/c/link": {headers: http.Header{"X-Object-Sysmeta-Symlink-Target": {"c/o"}, "X-Object-Sysmeta-Symlink-Target-Account": {"b"}}},
+		"b/c/o":    {headers: http.Header{}, body: "secret"},
+	}}
+	h := newTestSymlink(t, fc)
+	onlyAccountA := func(r *http.Request) bool {
+		_, account, _, _ := getPathParts(r)
+		return account == "a"
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, symlinkRequest("GET", "/v1/a/c/link", fc, onlyAccountA))
+	require.Equal(t, 401, w.Code)
+	require.NotContains(t, w.Body.String(), "secret")
+}
+
+func TestNewSymlinkBadConfig(t *testing.T) {
+	config, err := conf.StringConfig("[filter:symlink]\nsymloop_max=0")
+	require.Nil(t, err)
+	_, err = NewSymlink(config.GetSection("filter:symlink"))
+	require.NotNil(t, err)
+}
@@ -76,6 +76,12 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 			writer.Header().Set("X-Storage-URL", fmt.Sprintf("http://%s/v1/AUTH_%s", request.Host, account))
 		}
 		srv.StandardResponse(writer, 200)
+	} else if request.Method == "OPTIONS" {
+		// CORS preflight requests are sent without credentials.
+		ta.next.ServeHTTP(writer, request)
+	} else if isS3Request(request) {
+		// s3api authenticates these itself, and a bucket's name can start with "v1" too.
+		ta.next.ServeHTTP(writer, request)
 	} else if strings.HasPrefix(request.URL.Path, "/v1") || strings.HasPrefix(request.URL.Path, "/V1") {
 		token := request.Header.Get("X-Auth-Token")
 		ctx := GetProxyContext(request)
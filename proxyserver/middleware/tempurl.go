@@ -18,8 +18,14 @@ package middleware
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -39,11 +45,13 @@ const (
 
 type tuWriter struct {
 	http.ResponseWriter
-	method   string
-	filename string
-	obj      string
-	expires  string
-	inline   bool
+	method        string
+	filename      string
+	obj           string
+	expires       string
+	inline        bool
+	removeHeaders []string
+	allowHeaders  []string
 }
 
 func dispositionFormat(dtype string, filename string) string {
@@ -52,12 +60,8 @@ func dispositionFormat(dtype string, filename string) string {
 }
 
 func (w *tuWriter) WriteHeader(status int) {
+	removeHeaders(w.Header(), w.removeHeaders, w.allowHeaders)
 	if (w.method == "GET" || w.method == "HEAD") && status/100 == 2 {
-		for k := range w.Header() {
-			if strings.HasPrefix(k, "X-Object-Meta") && !strings.HasPrefix(k, "X-Object-Meta-Public-") {
-				w.Header().Del(k)
-			}
-		}
 		if w.inline {
 			if w.filename == "" {
 				w.Header().Set("Content-Disposition", "inline")
@@ -84,126 +88,311 @@ func parseExpires(s string) (expires time.Time, err error) {
 	}
 }
 
-func checkhmac(key, sig []byte, method, path string, expires time.Time) bool {
+var tempURLDigests = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// parseSignature decodes a temp url signature, which is either hex or prefixed with its digest and base64 encoded
+// (e.g. "sha512:..."), and makes sure its digest is one we allow.
+func parseSignature(sig string, allowedDigests map[string]bool) ([]byte, error) {
+	var sigb []byte
+	var err error
+	digest := ""
+	if i := strings.Index(sig, ":"); i != -1 {
+		digest, sig = sig[:i], sig[i+1:]
+		if strings.ContainsAny(sig, "-_") && !strings.ContainsAny(sig, "+/") {
+			sig = strings.NewReplacer("-", "+", "_", "/").Replace(sig)
+		}
+		sig = strings.TrimRight(sig, "=")
+		if sigb, err = base64.RawStdEncoding.DecodeString(sig); err != nil {
+			return nil, err
+		}
+	} else if sigb, err = hex.DecodeString(sig); err != nil {
+		return nil, err
+	}
+	if digest == "" {
+		switch len(sigb) {
+		case sha1.Size:
+			digest = "sha1"
+		case sha256.Size:
+			digest = "sha256"
+		case sha512.Size:
+			digest = "sha512"
+		}
+	}
+	if newHash, ok := tempURLDigests[digest]; !ok || !allowedDigests[digest] || newHash().Size() != len(sigb) {
+		return nil, fmt.Errorf("Digest not allowed: %q", digest)
+	}
+	return sigb, nil
+}
+
+// checkhmacMessage compares sig to the HMAC of message, using the digest that matches the signature's length.
+func checkhmacMessage(key, sig []byte, message string) bool {
+	var newHash func() hash.Hash
+	switch len(sig) {
+	case sha1.Size:
+		newHash = sha1.New
+	case sha256.Size:
+		newHash = sha256.New
+	case sha512.Size:
+		newHash = sha512.New
+	default:
+		return false
+	}
+	mac := hmac.New(newHash, key)
+	io.WriteString(mac, message)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func checkhmac(key, sig []byte, method, path string, expires time.Time, ipRange string) bool {
+	prefix := ""
+	if ipRange != "" {
+		prefix = fmt.Sprintf("ip=%s\n", ipRange)
+	}
 	if method == "HEAD" {
 		for _, meth := range []string{"HEAD", "GET", "POST", "PUT"} {
-			mac := hmac.New(sha1.New, key)
-			fmt.Fprintf(mac, "%s\n%d\n%s", meth, expires.Unix(), path)
-			if hmac.Equal(sig, mac.Sum(nil)) {
+			if checkhmacMessage(key, sig, fmt.Sprintf("%s%s\n%d\n%s", prefix, meth, expires.Unix(), path)) {
 				return true
 			}
 		}
 		return false
 	} else {
-		mac := hmac.New(sha1.New, key)
-		fmt.Fprintf(mac, "%s\n%d\n%s", method, expires.Unix(), path)
-		return hmac.Equal(sig, mac.Sum(nil))
+		return checkhmacMessage(key, sig, fmt.Sprintf("%s%s\n%d\n%s", prefix, method, expires.Unix(), path))
 	}
 }
 
-func tempurl(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method == "OPTIONS" {
-			next.ServeHTTP(writer, request)
-			return
-		}
-		ctx := GetProxyContext(request)
-		if ctx.Authorize != nil {
-			next.ServeHTTP(writer, request)
-			return
-		}
-		q := request.URL.Query()
-		sig := q.Get("temp_url_sig")
-		exps := q.Get("temp_url_expires")
-		_, inline := q["inline"]
+// ipInRange checks whether the request's remote address matches ipRange, which may be a single address or a CIDR.
+func ipInRange(remoteAddr, ipRange string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if strings.Contains(ipRange, "/") {
+		_, network, err := net.ParseCIDR(ipRange)
+		return err == nil && network.Contains(ip)
+	}
+	rangeIP := net.ParseIP(ipRange)
+	return rangeIP != nil && rangeIP.Equal(ip)
+}
 
-		if sig == "" && exps == "" {
-			next.ServeHTTP(writer, request)
-			return
-		} else if sig == "" || exps == "" {
-			srv.StandardResponse(writer, 401)
-			return
+// headerMatches checks a header name against a list of header names, which may end in a "*" wildcard.
+func headerMatches(header string, patterns []string) bool {
+	header = strings.ToLower(header)
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(header, p[:len(p)-1]) {
+				return true
+			}
+		} else if header == p {
+			return true
 		}
+	}
+	return false
+}
 
-		expires, err := parseExpires(exps)
-		if err != nil || time.Now().After(expires) {
-			srv.StandardResponse(writer, 401)
-			return
+func removeHeaders(headers http.Header, remove, allow []string) {
+	for k := range headers {
+		if headerMatches(k, remove) && !headerMatches(k, allow) {
+			delete(headers, k)
 		}
+	}
+}
 
-		sigb, err := hex.DecodeString(sig)
-		if err != nil {
-			srv.StandardResponse(writer, 401)
-			return
+// tempURLKeyScope tries the account's and then the container's Temp-Url-Keys with check, and returns the scope of the first key that passes.
+func tempURLKeyScope(ctx *ProxyContext, account, container string, check func(key []byte) bool) int {
+	if ai := ctx.GetAccountInfo(account); ai != nil {
+		if key, ok := ai.Metadata["Temp-Url-Key"]; ok && check([]byte(key)) {
+			return SCOPE_ACCOUNT
+		} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && check([]byte(key)) {
+			return SCOPE_ACCOUNT
+		} else if ci := ctx.GetContainerInfo(account, container); ci != nil {
+			if key, ok := ci.Metadata["Temp-Url-Key"]; ok && check([]byte(key)) {
+				return SCOPE_CONTAINER
+			} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && check([]byte(key)) {
+				return SCOPE_CONTAINER
+			}
 		}
+	}
+	return SCOPE_INVALID
+}
 
-		apiReq, account, container, obj := getPathParts(request)
-		if !apiReq || account == "" || container == "" {
-			srv.StandardResponse(writer, 401)
-			return
-		}
+type tempURL struct {
+	next           http.Handler
+	methods        []string
+	allowedDigests map[string]bool
+	incomingRemove []string
+	incomingAllow  []string
+	outgoingRemove []string
+	outgoingAllow  []string
+}
 
-		if bh := request.Header.Get("X-Object-Manifest"); bh != "" && (request.Method == "PUT" || request.Method == "POST") {
-			srv.StandardResponse(writer, 400)
-			return
-		}
+func (tu *tempURL) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == "OPTIONS" {
+		tu.next.ServeHTTP(writer, request)
+		return
+	}
+	ctx := GetProxyContext(request)
+	if ctx.Authorize != nil {
+		tu.next.ServeHTTP(writer, request)
+		return
+	}
+	q := request.URL.Query()
+	sig := q.Get("temp_url_sig")
+	exps := q.Get("temp_url_expires")
+	_, inline := q["inline"]
 
-		path := ""
-		if _, hasPrefix := q["temp_url_prefix"]; hasPrefix {
-			prefix := q.Get("temp_url_prefix")
-			if !strings.HasPrefix(obj, prefix) {
-				srv.StandardResponse(writer, 401)
-				return
-			}
-			path = fmt.Sprintf("prefix:/v1/%s/%s/%s", account, container, prefix)
-		} else {
-			path = fmt.Sprintf("/v1/%s/%s/%s", account, container, obj)
-		}
+	if sig == "" && exps == "" {
+		tu.next.ServeHTTP(writer, request)
+		return
+	} else if sig == "" || exps == "" {
+		srv.StandardResponse(writer, 401)
+		return
+	}
 
-		scope := SCOPE_INVALID
-		if ai := ctx.GetAccountInfo(account); ai != nil {
-			if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-				scope = SCOPE_ACCOUNT
-			} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-				scope = SCOPE_ACCOUNT
-			} else if ci := ctx.GetContainerInfo(account, container); ci != nil {
-				if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-					scope = SCOPE_CONTAINER
-				} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-					scope = SCOPE_CONTAINER
-				}
-			}
+	expires, err := parseExpires(exps)
+	if err != nil || time.Now().After(expires) {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	methodAllowed := false
+	for _, m := range tu.methods {
+		if m == request.Method {
+			methodAllowed = true
 		}
-		if scope == SCOPE_INVALID {
+	}
+	if !methodAllowed {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	ipRange := q.Get("temp_url_ip_range")
+	if ipRange != "" && !ipInRange(request.RemoteAddr, ipRange) {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || account == "" || container == "" {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	if bh := request.Header.Get("X-Object-Manifest"); bh != "" && (request.Method == "PUT" || request.Method == "POST") {
+		srv.StandardResponse(writer, 400)
+		return
+	}
+
+	sigb, err := parseSignature(sig, tu.allowedDigests)
+	if err != nil {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	path := ""
+	if _, hasPrefix := q["temp_url_prefix"]; hasPrefix {
+		prefix := q.Get("temp_url_prefix")
+		if !strings.HasPrefix(obj, prefix) {
 			srv.StandardResponse(writer, 401)
 			return
 		}
+		path = fmt.Sprintf("prefix:/v1/%s/%s/%s", account, container, prefix)
+	} else {
+		path = fmt.Sprintf("/v1/%s/%s/%s", account, container, obj)
+	}
 
-		ctx.Authorize = func(r *http.Request) bool {
-			ar, a, c, _ := getPathParts(r)
-			return ar && ((scope == SCOPE_ACCOUNT && a == account) || (scope == SCOPE_CONTAINER && c == container))
-		}
-
-		next.ServeHTTP(
-			&tuWriter{
-				ResponseWriter: writer,
-				method:         request.Method,
-				obj:            obj,
-				filename:       q.Get("filename"),
-				expires:        expires.Format(time.RFC1123),
-				inline:         inline,
-			},
-			request,
-		)
+	scope := tempURLKeyScope(ctx, account, container, func(key []byte) bool {
+		return checkhmac(key, sigb, request.Method, path, expires, ipRange)
 	})
+	if scope == SCOPE_INVALID {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	removeHeaders(request.Header, tu.incomingRemove, tu.incomingAllow)
+	ctx.Authorize = func(r *http.Request) bool {
+		ar, a, c, _ := getPathParts(r)
+		return ar && ((scope == SCOPE_ACCOUNT && a == account) || (scope == SCOPE_CONTAINER && c == container))
+	}
+
+	tu.next.ServeHTTP(
+		&tuWriter{
+			ResponseWriter: writer,
+			method:         request.Method,
+			obj:            obj,
+			filename:       q.Get("filename"),
+			expires:        expires.Format(time.RFC1123),
+			inline:         inline,
+			removeHeaders:  tu.outgoingRemove,
+			allowHeaders:   tu.outgoingAllow,
+		},
+		request,
+	)
+}
+
+func configList(config conf.Section, key, dfl string, lower bool) []string {
+	value := config.GetDefault(key, dfl)
+	if lower {
+		value = strings.ToLower(value)
+	}
+	return strings.Fields(value)
+}
+
+// configDigests reads the allowed_digests setting shared by tempurl and formpost.
+func configDigests(config conf.Section, name string) ([]string, map[string]bool, error) {
+	digests := []string{}
+	allowedDigests := map[string]bool{}
+	for _, digest := range configList(config, "allowed_digests", "sha1 sha256 sha512", true) {
+		if _, ok := tempURLDigests[digest]; !ok {
+			return nil, nil, fmt.Errorf("Unsupported %s digest: %q", name, digest)
+		}
+		if !allowedDigests[digest] {
+			digests = append(digests, digest)
+			allowedDigests[digest] = true
+		}
+	}
+	if len(digests) == 0 {
+		return nil, nil, fmt.Errorf("No %s digests allowed", name)
+	}
+	return digests, allowedDigests, nil
 }
 
 func NewTempURL(config conf.Section) (func(http.Handler) http.Handler, error) {
+	methods := configList(config, "methods", "GET HEAD PUT POST DELETE", false)
+	for i := range methods {
+		methods[i] = strings.ToUpper(methods[i])
+	}
+	incomingRemove := configList(config, "incoming_remove_headers", "x-timestamp", true)
+	incomingAllow := configList(config, "incoming_allow_headers", "", true)
+	outgoingRemove := configList(config, "outgoing_remove_headers", "x-object-meta-*", true)
+	outgoingAllow := configList(config, "outgoing_allow_headers", "x-object-meta-public-*", true)
+	digests, allowedDigests, err := configDigests(config, "tempurl")
+	if err != nil {
+		return nil, err
+	}
 	RegisterInfo("tempurl", map[string]interface{}{
-		"methods":                 []string{"GET", "HEAD", "PUT", "POST", "DELETE"},
-		"incoming_remove_headers": []string{"x-timestamp"},
-		"incoming_allow_headers":  []string{},
-		"outgoing_remove_headers": []string{"x-object-meta-*"}, "outgoing_allow_headers": []string{"x-object-meta-public-*"},
+		"methods":                 methods,
+		"incoming_remove_headers": incomingRemove,
+		"incoming_allow_headers":  incomingAllow,
+		"outgoing_remove_headers": outgoingRemove,
+		"outgoing_allow_headers":  outgoingAllow,
+		"allowed_digests":         digests,
 	})
-	return tempurl, nil
+	return func(next http.Handler) http.Handler {
+		return &tempURL{
+			next:           next,
+			methods:        methods,
+			allowedDigests: allowedDigests,
+			incomingRemove: incomingRemove,
+			incomingAllow:  incomingAllow,
+			outgoingRemove: outgoingRemove,
+			outgoingAllow:  outgoingAllow,
+		}
+	}, nil
 }
@@ -24,8 +24,15 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
 )
 
+func defaultTempURL(t *testing.T, next http.Handler) http.Handler {
+	mid, err := NewTempURL(conf.Section{})
+	require.Nil(t, err)
+	return mid(next)
+}
+
 func TestDispositionFormat(t *testing.T) {
 	require.Equal(t, "inline; filename=\"a.txt\"; filename*=UTF-8''a.txt", dispositionFormat("inline", "a.txt"))
 	require.Equal(t, "attachment; filename=\"%25.txt\"; filename*=UTF-8''%25.txt", dispositionFormat("attachment", "%.txt"))
@@ -49,24 +56,25 @@ func TestCheckHmac(t *testing.T) {
 	sig, err := hex.DecodeString("6deb0c7da21f396f1368681dc0bd57df0d1c4369")
 	require.Nil(t, err)
 	require.True(t, checkhmac([]byte("mykey"), sig, "GET",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), ""))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1ad2301fcc4e525ee0167298c0fbb426e90fb3b1")
 	require.Nil(t, err)
 	require.True(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), ""))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1111111111111111111111111111111111111111")
 	require.Nil(t, err)
 	require.False(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), ""))
 }
 
 func TestTuWriter(t *testing.T) {
 	w := &tuWriter{ResponseWriter: httptest.NewRecorder(), method: "GET", obj: "a.txt",
-		filename: "", expires: "whatever", inline: true}
+		filename: "", expires: "whatever", inline: true,
+		removeHeaders: []string{"x-object-meta-*"}, allowHeaders: []string{"x-object-meta-public-*"}}
 	w.Header().Set("X-Object-Meta-Test", "XXX")
 	w.Header().Set("X-Object-Meta-Public-Test", "ZZZ")
 	w.WriteHeader(200)
@@ -99,7 +107,7 @@ func TestTempurlMiddlewarePassOptions(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -119,7 +127,7 @@ func TestTempurlMiddlewarePassAlreadyAuthorized(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -134,7 +142,7 @@ func TestTempurlMiddlewarePassNoQuery(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -144,7 +152,7 @@ func TestTempurlMiddleware401OnlySig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -154,7 +162,7 @@ func TestTempurlMiddleware401Expired(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -164,7 +172,7 @@ func TestTempurlMiddleware401BadSig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -174,7 +182,7 @@ func TestTempurlMiddleware401NoContainer(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -185,7 +193,7 @@ func TestTempurlMiddleware400PuttingManifest(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 400, w.Result().StatusCode)
 }
@@ -203,7 +211,7 @@ func TestTempurlMiddleware401NoKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -221,7 +229,7 @@ func TestTempurlMiddleware401WrongKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -247,7 +255,7 @@ func TestTempurlMiddlewareContainerKey(t *testing.T) {
 		require.True(t, ctx.Authorize(httptest.NewRequest("GET", "/v1/a/c/o2", nil)))
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -269,7 +277,7 @@ func TestTempurlMiddlewarePath(t *testing.T) {
 		require.True(t, ctx.Authorize(request))
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -296,7 +304,146 @@ func TestTempurlMiddlewareAccountKey(t *testing.T) {
 		require.False(t, ctx.Authorize(httptest.NewRequest("GET", "/v1/a2/b/o", nil)))
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(handler)
+	mid := defaultTempURL(t, handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
+
+func tempURLConfig(t *testing.T, settings string) conf.Section {
+	config, err := conf.StringConfig("[filter:tempurl]\n" + settings)
+	require.Nil(t, err)
+	return config.GetSection("filter:tempurl")
+}
+
+func tempURLRequest(path string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	ctx := &ProxyContext{
+		containerInfoCache: map[string]*ContainerInfo{
+			"container/a/c": {Metadata: map[string]string{"Temp-Url-Key": "mykey"}},
+		},
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
+
+func tempURLAuthorized(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ctx.Authorize == nil || !ctx.Authorize(request) {
+		writer.WriteHeader(401)
+		return
+	}
+	writer.WriteHeader(200)
+}
+
+func TestParseSignature(t *testing.T) {
+	all := map[string]bool{"sha1": true, "sha256": true, "sha512": true}
+	sig, err := parseSignature("a3ec2e3b3e5e6a7f5a2a5b5b4e1e8e9c7f3f0b1d", all)
+	require.Nil(t, err)
+	require.Equal(t, 20, len(sig))
+	sig, err = parseSignature("f80dab871904cb255498a5605767554fd7e73285e0b1813619036fc32b2b99cf", all)
+	require.Nil(t, err)
+	require.Equal(t, 32, len(sig))
+	sig, err = parseSignature("sha512:FIJu3WZBgH44HOE0N5_10rmAJNkJXyte17S8IxX4WiZppej43qap48ltM3ImjoJj-D4CxNSpmC988c_bfkd4Ow", all)
+	require.Nil(t, err)
+	require.Equal(t, 64, len(sig))
+	_, err = parseSignature("sha256:FIJu3WZBgH44HOE0N5_10rmAJNkJXyte17S8IxX4WiZppej43qap48ltM3ImjoJj-D4CxNSpmC988c_bfkd4Ow", all)
+	require.NotNil(t, err)
+	_, err = parseSignature("md5:abcd", all)
+	require.NotNil(t, err)
+	_, err = parseSignature("a3ec2e3b3e5e6a7f5a2a5b5b4e1e8e9c7f3f0b1d", map[string]bool{"sha256": true})
+	require.NotNil(t, err)
+}
+
+func TestTempurlMiddlewareSha256(t *testing.T) {
+	r := tempURLRequest("/v1/a/c/o?temp_url_sig=f80dab871904cb255498a5605767554fd7e73285e0b1813619036fc32b2b99cf&" +
+		"temp_url_expires=9999999999")
+	w := httptest.NewRecorder()
+	defaultTempURL(t, http.HandlerFunc(tempURLAuthorized)).ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+}
+
+func TestTempurlMiddlewareSha512Base64(t *testing.T) {
+	r := tempURLRequest("/v1/a/c/o?temp_url_sig=sha512:FIJu3WZBgH44HOE0N5_10rmAJNkJXyte17S8IxX4WiZppej43qap48ltM3ImjoJj-D4CxNSpmC988c_bfkd4Ow&" +
+		"temp_url_expires=9999999999")
+	w := httptest.NewRecorder()
+	defaultTempURL(t, http.HandlerFunc(tempURLAuthorized)).ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	mid, err := NewTempURL(tempURLConfig(t, "allowed_digests = sha256"))
+	require.Nil(t, err)
+	r = tempURLRequest("/v1/a/c/o?temp_url_sig=sha512:FIJu3WZBgH44HOE0N5_10rmAJNkJXyte17S8IxX4WiZppej43qap48ltM3ImjoJj-D4CxNSpmC988c_bfkd4Ow&" +
+		"temp_url_expires=9999999999")
+	w = httptest.NewRecorder()
+	mid(http.HandlerFunc(tempURLAuthorized)).ServeHTTP(w, r)
+	require.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestTempurlMiddlewareIPRange(t *testing.T) {
+	r := tempURLRequest("/v1/a/c/o?temp_url_sig=5e7a1dcb47b2d03fa667d05728ca9a4def09dbf9&" +
+		"temp_url_expires=9999999999&temp_url_ip_range=10.0.0.0/8")
+	r.RemoteAddr = "10.1.2.3:5000"
+	w := httptest.NewRecorder()
+	defaultTempURL(t, http.HandlerFunc(tempURLAuthorized)).ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	r = tempURLRequest("/v1/a/c/o?temp_url_sig=5e7a1dcb47b2d03fa667d05728ca9a4def09dbf9&" +
+		"temp_url_expires=9999999999&temp_url_ip_range=10.0.0.0/8")
+	r.RemoteAddr = "192.168.1.1:5000"
+	w = httptest.NewRecorder()
+	defaultTempURL(t, http.HandlerFunc(tempURLAuthorized)).ServeHTTP(w, r)
+	require.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestIPInRange(t *testing.T) {
+	require.True(t, ipInRange("1.2.3.4:80", "1.2.3.4"))
+	require.False(t, ipInRange("1.2.3.5:80", "1.2.3.4"))
+	require.True(t, ipInRange("1.2.3.5:80", "1.2.3.0/24"))
+	require.False(t, ipInRange("1.2.4.5:80", "1.2.3.0/24"))
+	require.False(t, ipInRange("1.2.4.5:80", "garbage"))
+}
+
+func TestTempurlMethodsConfig(t *testing.T) {
+	mid, err := NewTempURL(tempURLConfig(t, "methods = GET HEAD"))
+	require.Nil(t, err)
+	r := tempURLRequest("/v1/a/c/o?temp_url_sig=202ee7536ff1c47dfdbaf79a7dfe62b60163e16d&" +
+		"temp_url_expires=9999999999")
+	r.Method = "DELETE"
+	w := httptest.NewRecorder()
+	mid(http.HandlerFunc(tempURLAuthorized)).ServeHTTP(w, r)
+	require.Equal(t, 401, w.Result().StatusCode)
+
+	r = tempURLRequest("/v1/a/c/o?temp_url_sig=202ee7536ff1c47dfdbaf79a7dfe62b60163e16d&" +
+		"temp_url_expires=9999999999")
+	r.Method = "DELETE"
+	w = httptest.NewRecorder()
+	defaultTempURL(t, http.HandlerFunc(tempURLAuthorized)).ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+}
+
+func TestTempurlHeaderFilters(t *testing.T) {
+	h := http.Header{
+		"X-Object-Meta-Secret":     []string{"1"},
+		"X-Object-Meta-Public-Foo": []string{"2"},
+		"Content-Type":             []string{"text/plain"},
+	}
+	removeHeaders(h, []string{"x-object-meta-*"}, []string{"x-object-meta-public-*"})
+	require.Equal(t, "", h.Get("X-Object-Meta-Secret"))
+	require.Equal(t, "2", h.Get("X-Object-Meta-Public-Foo"))
+	require.Equal(t, "text/plain", h.Get("Content-Type"))
+
+	r := tempURLRequest("/v1/a/c/o?temp_url_sig=202ee7536ff1c47dfdbaf79a7dfe62b60163e16d&" +
+		"temp_url_expires=9999999999")
+	r.Method = "DELETE"
+	r.Header.Set("X-Timestamp", "12345")
+	w := httptest.NewRecorder()
+	defaultTempURL(t, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Equal(t, "", request.Header.Get("X-Timestamp"))
+		writer.WriteHeader(204)
+	})).ServeHTTP(w, r)
+	require.Equal(t, 204, w.Result().StatusCode)
+}
+
+func TestNewTempURLBadDigest(t *testing.T) {
+	_, err := NewTempURL(tempURLConfig(t, "allowed_digests = md5"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,234 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// shardAccountPrefix is prepended to an account's name to get the hidden account its shard containers live in.
+const shardAccountPrefix = ".shards_"
+
+// shardRange is a range of a sharded container's object names, as returned by the container server.
+type shardRange struct {
+	Name  string `json:"name"`
+	Lower string `json:"lower"`
+	Upper string `json:"upper"`
+	State string `json:"state"`
+}
+
+// listingRecord is an object or subdir entry from a json container listing.
+type listingRecord struct {
+	Name         string `json:"name"`
+	Subdir       string `json:"subdir"`
+	LastModified string `json:"last_modified"`
+	Size         int64  `json:"bytes"`
+	ContentType  string `json:"content_type"`
+	ETag         string `json:"hash"`
+	SymlinkPath  string `json:"symlink_path"`
+}
+
+type objectListingRecord struct {
+	XMLName      xml.Name `xml:"object" json:"-"`
+	Name         string   `xml:"name" json:"name"`
+	LastModified string   `xml:"last_modified" json:"last_modified"`
+	Size         int64    `xml:"bytes" json:"bytes"`
+	ContentType  string   `xml:"content_type" json:"content_type"`
+	ETag         string   `xml:"hash" json:"hash"`
+	SymlinkPath  string   `xml:"symlink_path,omitempty" json:"symlink_path,omitempty"`
+}
+
+type subdirListingRecord struct {
+	XMLName xml.Name `xml:"subdir" json:"-"`
+	Name2   string   `xml:"name,attr" json:"-"`
+	Name    string   `xml:"name" json:"subdir"`
+}
+
+// listingFetcher gets a json container listing, returning its records and the status code.
+type listingFetcher func(account, container string, options map[string]string) ([]listingRecord, int)
+
+// mergeShardListings lists a sharded container by listing each of its shard ranges in order, from the shard container
+// for active ranges and from the root container for the rest, with the markers clipped to the range's bounds.
+func mergeShardListings(account, container string, ranges []shardRange, options map[string]string, fetch listingFetcher) ([]interface{}, int) {
+	limit, err := strconv.Atoi(options["limit"])
+	if err != nil || limit <= 0 || limit > 10000 {
+		limit = 10000
+	}
+	marker := options["marker"]
+	endMarker := options["end_marker"]
+	listing := []interface{}{}
+	lastSubdir := ""
+	for _, r := range ranges {
+		if len(listing) >= limit || (endMarker != "" && r.Lower >= endMarker) {
+			break
+		}
+		if r.Upper != "" && r.Upper <= marker {
+			continue
+		}
+		rangeMarker := marker
+		if r.Lower > rangeMarker {
+			rangeMarker = r.Lower
+		}
+		rangeEndMarker := endMarker
+		if r.Upper != "" && (rangeEndMarker == "" || r.Upper+"\x00" < rangeEndMarker) {
+			// the range includes its upper bound, but end_marker is exclusive.
+			rangeEndMarker = r.Upper + "\x00"
+		}
+		listAccount, listContainer := account, container
+		if r.State == "active" {
+			listAccount, listContainer = shardAccountPrefix+account, r.Name
+		}
+		records, code := fetch(listAccount, listContainer, map[string]string{
+			"format":     "json",
+			"limit":      strconv.Itoa(limit - len(listing)),
+			"marker":     rangeMarker,
+			"end_marker": rangeEndMarker,
+			"prefix":     options["prefix"],
+			"delimiter":  options["delimiter"],
+		})
+		if code == http.StatusNotFound && r.State == "active" {
+			// the shard hasn't been created yet, so it has nothing to list.
+			continue
+		} else if code/100 != 2 {
+			return nil, code
+		}
+		for _, record := range records {
+			if len(listing) >= limit {
+				break
+			}
+			if record.Subdir != "" {
+				// a subdir can span ranges, and the range marker can bring back the one the client asked to start after.
+				if record.Subdir == lastSubdir || record.Subdir <= marker {
+					continue
+				}
+				lastSubdir = record.Subdir
+				listing = append(listing, &subdirListingRecord{Name2: record.Subdir, Name: record.Subdir})
+			} else if record.Name > marker {
+				listing = append(listing, &objectListingRecord{Name: record.Name, LastModified: record.LastModified,
+					Size: record.Size, ContentType: record.ContentType, ETag: record.ETag, SymlinkPath: record.SymlinkPath})
+			}
+		}
+	}
+	return listing, http.StatusOK
+}
+
+// shardedContainerGet responds to a GET of a sharded container with a listing merged from its shard ranges.
+func (server *ProxyServer) shardedContainerGet(writer http.ResponseWriter, request *http.Request, account, container string,
+	options map[string]string, rootHeaders http.Header) {
+	rangeHeaders := http.Header{}
+	for key := range request.Header {
+		rangeHeaders.Set(key, request.Header.Get(key))
+	}
+	rangeHeaders.Set("X-Backend-Record-Type", "shard")
+	body, _, code := server.C.GetContainer(account, container, map[string]string{"format": "json"}, rangeHeaders)
+	if body != nil {
+		defer body.Close()
+	}
+	if code/100 != 2 {
+		srv.StandardResponse(writer, code)
+		return
+	}
+	var ranges []shardRange
+	if err := json.NewDecoder(body).Decode(&ranges); err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	listing, code := mergeShardListings(account, container, ranges, options,
+		func(account, container string, options map[string]string) ([]listingRecord, int) {
+			body, _, code := server.C.GetContainer(account, container, options, request.Header)
+			if body == nil {
+				return nil, code
+			}
+			defer body.Close()
+			if code/100 != 2 {
+				return nil, code
+			}
+			var records []listingRecord
+			if err := json.NewDecoder(body).Decode(&records); err != nil {
+				return nil, http.StatusInternalServerError
+			}
+			return records, code
+		})
+	if code/100 != 2 {
+		srv.StandardResponse(writer, code)
+		return
+	}
+	headers := writer.Header()
+	for key := range rootHeaders {
+		if key != "Content-Length" && key != "Content-Type" {
+			headers.Set(key, rootHeaders.Get(key))
+		}
+	}
+	format := options["format"]
+	if format == "" {
+		accept := request.Header.Get("Accept")
+		if strings.Contains(accept, "application/json") {
+			format = "json"
+		} else if strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml") {
+			format = "xml"
+		} else {
+			format = "text"
+		}
+	}
+	var output []byte
+	switch format {
+	case "json":
+		var err error
+		if output, err = json.Marshal(listing); err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		headers.Set("Content-Type", "application/json; charset=utf-8")
+	case "xml":
+		type Container struct {
+			XMLName xml.Name `xml:"container"`
+			Name    string   `xml:"name,attr"`
+			Objects []interface{}
+		}
+		containerOutput, err := xml.Marshal(&Container{Name: container, Objects: listing})
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		output = append([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"), containerOutput...)
+		headers.Set("Content-Type", "application/xml; charset=utf-8")
+	default:
+		text := ""
+		for _, record := range listing {
+			if or, ok := record.(*objectListingRecord); ok {
+				text += or.Name + "\n"
+			} else if sr, ok := record.(*subdirListingRecord); ok {
+				text += sr.Name + "\n"
+			}
+		}
+		if text == "" {
+			headers.Set("Content-Length", "0")
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		output = []byte(text)
+		headers.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	headers.Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(output)
+}
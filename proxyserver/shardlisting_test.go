@@ -0,0 +1,117 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeListings serves json listings from in-memory containers, applying the markers, prefix, delimiter and limit.
+func fakeListings(containers map[string][]string) listingFetcher {
+	return func(account, container string, options map[string]string) ([]listingRecord, int) {
+		names, ok := containers[account+"/"+container]
+		if !ok {
+			return nil, http.StatusNotFound
+		}
+		sort.Strings(names)
+		limit, _ := strconv.Atoi(options["limit"])
+		var records []listingRecord
+		for _, name := range names {
+			if len(records) >= limit {
+				break
+			}
+			if name <= options["marker"] || (options["end_marker"] != "" && name >= options["end_marker"]) ||
+				!strings.HasPrefix(name, options["prefix"]) {
+				continue
+			}
+			if d := options["delimiter"]; d != "" {
+				if i := strings.Index(name[len(options["prefix"]):], d); i >= 0 {
+					subdir := name[:len(options["prefix"])+i+len(d)]
+					if len(records) == 0 || records[len(records)-1].Subdir != subdir {
+						records = append(records, listingRecord{Subdir: subdir})
+					}
+					continue
+				}
+			}
+			records = append(records, listingRecord{Name: name, Size: 1})
+		}
+		return records, http.StatusOK
+	}
+}
+
+func listingNames(listing []interface{}) []string {
+	var names []string
+	for _, record := range listing {
+		if or, ok := record.(*objectListingRecord); ok {
+			names = append(names, or.Name)
+		} else if sr, ok := record.(*subdirListingRecord); ok {
+			names = append(names, sr.Name)
+		}
+	}
+	return names
+}
+
+func TestMergeShardListings(t *testing.T) {
+	ranges := []shardRange{
+		{Name: "c-0", Lower: "", Upper: "b/2", State: "active"},
+		{Name: "c-1", Lower: "b/2", Upper: "d", State: "created"},
+		{Name: "c-2", Lower: "d", Upper: "", State: "active"},
+	}
+	fetch := fakeListings(map[string][]string{
+		".shards_a/c-0": {"a", "b/1", "b/2"},
+		"a/c":           {"b/3", "c", "d"},
+		".shards_a/c-2": {"e", "f"},
+	})
+
+	listing, code := mergeShardListings("a", "c", ranges, map[string]string{}, fetch)
+	require.Equal(t, 200, code)
+	require.Equal(t, []string{"a", "b/1", "b/2", "b/3", "c", "d", "e", "f"}, listingNames(listing))
+
+	listing, code = mergeShardListings("a", "c", ranges, map[string]string{"marker": "b/1", "end_marker": "e", "limit": "3"}, fetch)
+	require.Equal(t, 200, code)
+	require.Equal(t, []string{"b/2", "b/3", "c"}, listingNames(listing))
+
+	// a subdir that spans shard ranges is only listed once.
+	listing, code = mergeShardListings("a", "c", ranges, map[string]string{"delimiter": "/"}, fetch)
+	require.Equal(t, 200, code)
+	require.Equal(t, []string{"a", "b/", "c", "d", "e", "f"}, listingNames(listing))
+	listing, code = mergeShardListings("a", "c", ranges, map[string]string{"delimiter": "/", "marker": "b/"}, fetch)
+	require.Equal(t, 200, code)
+	require.Equal(t, []string{"c", "d", "e", "f"}, listingNames(listing))
+
+	listing, code = mergeShardListings("a", "c", ranges, map[string]string{"prefix": "b/"}, fetch)
+	require.Equal(t, 200, code)
+	require.Equal(t, []string{"b/1", "b/2", "b/3"}, listingNames(listing))
+}
+
+func TestMergeShardListingsMissingShard(t *testing.T) {
+	ranges := []shardRange{
+		{Name: "c-0", Lower: "", Upper: "m", State: "active"},
+		{Name: "c-1", Lower: "m", Upper: "", State: "created"},
+	}
+	listing, code := mergeShardListings("a", "c", ranges, map[string]string{}, fakeListings(map[string][]string{"a/c": {"x"}}))
+	require.Equal(t, 200, code)
+	require.Equal(t, []string{"x"}, listingNames(listing))
+
+	_, code = mergeShardListings("a", "c", ranges, map[string]string{}, fakeListings(map[string][]string{}))
+	require.Equal(t, 404, code)
+}
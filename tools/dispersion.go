@@ -0,0 +1,544 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+const (
+	dispersionPrefix           = "dispersion_"
+	dispersionObjectsContainer = "dispersion_objects"
+)
+
+// PartitionReport describes a partition that is missing at least one of its copies.
+type PartitionReport struct {
+	Partition uint64   `json:"partition"`
+	Name      string   `json:"name"`
+	Found     int      `json:"found"`
+	Missing   []string `json:"missing"`
+}
+
+// DispersionReport summarizes how many copies of the dispersion containers or objects could be found on their primary nodes.
+type DispersionReport struct {
+	Partitions     int               `json:"partitions"`
+	Overlapping    int               `json:"overlapping"`
+	CopiesExpected int               `json:"copies_expected"`
+	CopiesFound    int               `json:"copies_found"`
+	PctFound       float64           `json:"pct_found"`
+	Errors         int               `json:"errors"`
+	Missing        map[int]int       `json:"missing"`
+	Degraded       []PartitionReport `json:"degraded"`
+}
+
+type dispersion struct {
+	cli           client.Client
+	account       string
+	containerRing ring.Ring
+	objectRing    ring.Ring
+	policy        *conf.Policy
+	httpClient    *http.Client
+	coverage      float64
+	concurrency   int
+}
+
+// parallel calls f for 0..count-1 using up to concurrency goroutines.
+func parallel(count, concurrency int, f func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// names returns enough dispersion names to cover the configured percentage of the ring's partitions, one name per partition.
+// If container is empty the names are for containers, otherwise they are objects in that container.
+func (d *dispersion) names(r ring.Ring, container string) []string {
+	partitions := int(r.PartitionCount())
+	wanted := int(math.Ceil(float64(partitions) * d.coverage / 100))
+	if wanted < 1 {
+		wanted = 1
+	} else if wanted > partitions {
+		wanted = partitions
+	}
+	covered := make(map[uint64]bool, wanted)
+	names := make([]string, 0, wanted)
+	for i := 0; len(names) < wanted; i++ {
+		name := fmt.Sprintf("%s%d", dispersionPrefix, i)
+		var partition uint64
+		if container == "" {
+			partition = r.GetPartition(d.account, name, "")
+		} else {
+			partition = r.GetPartition(d.account, container, name)
+		}
+		if !covered[partition] {
+			covered[partition] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// objectsContainer is the container holding the dispersion objects for the policy being checked.  Policy 0 keeps
+// the plain name so existing dispersion objects are still found.
+func (d *dispersion) objectsContainer() string {
+	if d.policy == nil || d.policy.Index == 0 {
+		return dispersionObjectsContainer
+	}
+	return fmt.Sprintf("%s-%d", dispersionObjectsContainer, d.policy.Index)
+}
+
+// policyIndex is the storage policy index sent with object HEADs.
+func (d *dispersion) policyIndex() int {
+	if d.policy == nil {
+		return 0
+	}
+	return d.policy.Index
+}
+
+func (d *dispersion) populateContainers() (int, int) {
+	names := d.names(d.containerRing, "")
+	var lock sync.Mutex
+	errorCount := 0
+	parallel(len(names), d.concurrency, func(i int) {
+		if err := d.cli.PutContainer(names[i], nil); err != nil {
+			lock.Lock()
+			errorCount++
+			lock.Unlock()
+		}
+	})
+	return len(names) - errorCount, errorCount
+}
+
+func (d *dispersion) populateObjects() (int, int, error) {
+	container := d.objectsContainer()
+	var headers map[string]string
+	if d.policy != nil {
+		headers = map[string]string{"X-Storage-Policy": d.policy.Name}
+	}
+	if err := d.cli.PutContainer(container, headers); err != nil {
+		return 0, 0, fmt.Errorf("Unable to create %s container: %v", container, err)
+	}
+	names := d.names(d.objectRing, container)
+	var lock sync.Mutex
+	errorCount := 0
+	parallel(len(names), d.concurrency, func(i int) {
+		if err := d.cli.PutObject(container, names[i], map[string]string{"Content-Type": "text/plain"}, bytes.NewReader([]byte(names[i]))); err != nil {
+			lock.Lock()
+			errorCount++
+			lock.Unlock()
+		}
+	})
+	return len(names) - errorCount, errorCount, nil
+}
+
+func (d *dispersion) listContainers() ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		containers, _, err := d.cli.GetAccount(marker, "", 0, dispersionPrefix, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(containers) == 0 {
+			return names, nil
+		}
+		for _, c := range containers {
+			if !strings.HasPrefix(c.Name, dispersionObjectsContainer) {
+				names = append(names, c.Name)
+			}
+		}
+		marker = containers[len(containers)-1].Name
+	}
+}
+
+func (d *dispersion) listObjects() ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		objects, _, err := d.cli.GetContainer(d.objectsContainer(), marker, "", 0, dispersionPrefix, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) == 0 {
+			return names, nil
+		}
+		for _, o := range objects {
+			names = append(names, o.Name)
+		}
+		marker = objects[len(objects)-1].Name
+	}
+}
+
+// headNode returns whether the node has a copy of the path, or an error if the node couldn't tell us.
+func (d *dispersion) headNode(dev *ring.Device, partition uint64, path string, policy int) (bool, error) {
+	url := fmt.Sprintf("http://%s:%d/%s/%d/%s", dev.Ip, dev.Port, dev.Device, partition, path)
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy))
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return true, nil
+	} else if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return false, fmt.Errorf("%s returned %d", url, resp.StatusCode)
+}
+
+// check HEADs every primary copy of the given names, where path turns a name into its partition and request path.
+func (d *dispersion) check(r ring.Ring, policy int, names []string, path func(name string) (uint64, string)) *DispersionReport {
+	report := &DispersionReport{Missing: map[int]int{}, Degraded: []PartitionReport{}}
+	type job struct {
+		partition uint64
+		name      string
+		path      string
+	}
+	var jobs []job
+	seen := map[uint64]bool{}
+	for _, name := range names {
+		partition, p := path(name)
+		if seen[partition] {
+			report.Overlapping++
+			continue
+		}
+		seen[partition] = true
+		jobs = append(jobs, job{partition: partition, name: name, path: p})
+	}
+	var lock sync.Mutex
+	parallel(len(jobs), d.concurrency, func(i int) {
+		nodes := r.GetNodes(jobs[i].partition)
+		found := 0
+		errorCount := 0
+		var missing []string
+		for _, dev := range nodes {
+			ok, err := d.headNode(dev, jobs[i].partition, jobs[i].path, policy)
+			if ok {
+				found++
+				continue
+			} else if err != nil {
+				errorCount++
+			}
+			missing = append(missing, fmt.Sprintf("%s:%d/%s", dev.Ip, dev.Port, dev.Device))
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		report.Partitions++
+		report.CopiesExpected += len(nodes)
+		report.CopiesFound += found
+		report.Errors += errorCount
+		report.Missing[len(nodes)-found]++
+		if len(missing) > 0 {
+			report.Degraded = append(report.Degraded, PartitionReport{Partition: jobs[i].partition, Name: jobs[i].name, Found: found, Missing: missing})
+		}
+	})
+	sort.Slice(report.Degraded, func(i, j int) bool { return report.Degraded[i].Partition < report.Degraded[j].Partition })
+	if report.CopiesExpected > 0 {
+		report.PctFound = float64(report.CopiesFound) * 100 / float64(report.CopiesExpected)
+	}
+	return report
+}
+
+func (d *dispersion) containerReport() (*DispersionReport, error) {
+	names, err := d.listContainers()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list dispersion containers: %v", err)
+	}
+	return d.check(d.containerRing, 0, names, func(name string) (uint64, string) {
+		return d.containerRing.GetPartition(d.account, name, ""), common.Urlencode(d.account) + "/" + common.Urlencode(name)
+	}), nil
+}
+
+func (d *dispersion) objectReport() (*DispersionReport, error) {
+	names, err := d.listObjects()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list dispersion objects: %v", err)
+	}
+	container := d.objectsContainer()
+	return d.check(d.objectRing, d.policyIndex(), names, func(name string) (uint64, string) {
+		return d.objectRing.GetPartition(d.account, container, name),
+			common.Urlencode(d.account) + "/" + container + "/" + common.Urlencode(name)
+	}), nil
+}
+
+func printDispersionReport(kind string, report *DispersionReport) {
+	for _, p := range report.Degraded {
+		fmt.Printf("%s partition %d (%s) has %d copies, missing from %s\n", strings.Title(kind), p.Partition, p.Name, p.Found, strings.Join(p.Missing, ", "))
+	}
+	if report.Overlapping > 0 {
+		fmt.Printf("Warning: %d %ss are on the same partitions as others and were not checked\n", report.Overlapping, kind)
+	}
+	var missing []int
+	for m := range report.Missing {
+		missing = append(missing, m)
+	}
+	sort.Ints(missing)
+	for _, m := range missing {
+		if m == 0 {
+			continue
+		}
+		fmt.Printf("There were %d partitions missing %d copies.\n", report.Missing[m], m)
+	}
+	if report.Errors > 0 {
+		fmt.Printf("There were %d errors talking to %s servers.\n", report.Errors, kind)
+	}
+	fmt.Printf("%.2f%% of %s copies found (%d of %d) across %d partitions\n", report.PctFound, kind, report.CopiesFound, report.CopiesExpected, report.Partitions)
+}
+
+// accountFromURL pulls the account name off the end of a storage url.
+func accountFromURL(storageURL string) (string, error) {
+	parts := strings.Split(strings.TrimRight(storageURL, "/"), "/")
+	if account, err := url.PathUnescape(parts[len(parts)-1]); err != nil {
+		return "", err
+	} else if account == "" {
+		return "", errors.New("no account in storage url")
+	} else {
+		return account, nil
+	}
+}
+
+// dispersionPolicies returns the policies to populate or report on: the one matching name (by name, alias or index),
+// or every policy that isn't deprecated if name is empty.
+func dispersionPolicies(policies conf.PolicyList, name string) ([]*conf.Policy, error) {
+	var selected []*conf.Policy
+	for _, p := range policies {
+		if name == "" {
+			if !p.Deprecated {
+				selected = append(selected, p)
+			}
+			continue
+		}
+		if strings.EqualFold(p.Name, name) || strconv.Itoa(p.Index) == name {
+			return []*conf.Policy{p}, nil
+		}
+		for _, alias := range p.Aliases {
+			if strings.EqualFold(alias, name) {
+				return []*conf.Policy{p}, nil
+			}
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("No policy named %q", name)
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Index < selected[j].Index })
+	return selected, nil
+}
+
+// objectReportKey is the key an object report is stored under; policy 0 keeps the plain "object" key.
+func objectReportKey(policy *conf.Policy) string {
+	if policy.Index == 0 {
+		return "object"
+	}
+	return fmt.Sprintf("object-%d", policy.Index)
+}
+
+func findDispersionConfig() string {
+	for _, path := range []string{"/etc/hummingbird/dispersion.conf", "/etc/swift/dispersion.conf"} {
+		if fs.Exists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+func dispersionUsage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "hummingbird dispersion [ARGS] populate|report\n")
+	fmt.Fprintf(os.Stderr, "  populate creates dispersion containers and objects covering a percentage of the ring partitions.\n")
+	fmt.Fprintf(os.Stderr, "  report checks every replica of them on their primary nodes.\n")
+	flags.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "The configuration file should look something like:\n")
+	fmt.Fprintf(os.Stderr, "    [dispersion]\n")
+	fmt.Fprintf(os.Stderr, "    auth_url = http://localhost:8080/auth/v1.0\n")
+	fmt.Fprintf(os.Stderr, "    auth_user = test:tester\n")
+	fmt.Fprintf(os.Stderr, "    auth_key = testing\n")
+	fmt.Fprintf(os.Stderr, "    dispersion_coverage = 1.0\n")
+	fmt.Fprintf(os.Stderr, "    concurrency = 25\n")
+	fmt.Fprintf(os.Stderr, "    dump_json = no\n")
+}
+
+// Dispersion populates or reports on the dispersion containers and objects, like Swift's swift-dispersion-populate
+// and swift-dispersion-report.
+func Dispersion(args []string) {
+	flags := flag.NewFlagSet("dispersion", flag.ExitOnError)
+	configFile := flags.String("c", findDispersionConfig(), "Config file to use")
+	jsonOutput := flags.Bool("json", false, "Print the report as json")
+	noContainers := flags.Bool("no-container", false, "Skip the containers")
+	noObjects := flags.Bool("no-object", false, "Skip the objects")
+	policyName := flags.String("policy", "", "Only populate or report on the objects in this storage policy (default: all policies)")
+	flags.Usage = func() { dispersionUsage(flags) }
+	flags.Parse(args)
+	if flags.NArg() != 1 || (flags.Arg(0) != "populate" && flags.Arg(0) != "report") {
+		flags.Usage()
+		os.Exit(1)
+	}
+	config, err := conf.LoadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(1)
+	}
+	var cli client.Client
+	authURL := config.GetDefault("dispersion", "auth_url", "http://localhost:8080/auth/v1.0")
+	authUser := config.GetDefault("dispersion", "auth_user", "test:tester")
+	authKey := config.GetDefault("dispersion", "auth_key", "testing")
+	if config.GetBool("dispersion", "allow_insecure_auth_cert", false) {
+		cli, err = client.NewInsecureClient("", authUser, "", authKey, "", authURL, false)
+	} else {
+		cli, err = client.NewClient("", authUser, "", authKey, "", authURL, false)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating client:", err)
+		os.Exit(1)
+	}
+	account, err := accountFromURL(cli.GetURL())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding account:", err)
+		os.Exit(1)
+	}
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	containerRing, err := ring.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading container ring:", err)
+		os.Exit(1)
+	}
+	policies, err := dispersionPolicies(conf.LoadPolicies(), *policyName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	objectRings := make([]ring.Ring, len(policies))
+	for i, policy := range policies {
+		if objectRings[i], err = ring.GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading object ring for policy %d: %v\n", policy.Index, err)
+			os.Exit(1)
+		}
+	}
+	d := &dispersion{
+		cli:           cli,
+		account:       account,
+		containerRing: containerRing,
+		coverage:      config.GetFloat("dispersion", "dispersion_coverage", 1.0),
+		concurrency:   int(config.GetInt("dispersion", "concurrency", 25)),
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Dial: (&net.Dialer{Timeout: 10 * time.Second}).Dial,
+			},
+			Timeout: time.Duration(config.GetFloat("dispersion", "node_timeout", 10) * float64(time.Second)),
+		},
+	}
+	doContainers := !*noContainers && config.GetBool("dispersion", "container_"+flags.Arg(0), true)
+	doObjects := !*noObjects && config.GetBool("dispersion", "object_"+flags.Arg(0), true)
+
+	if flags.Arg(0) == "populate" {
+		if doContainers {
+			created, errorCount := d.populateContainers()
+			fmt.Printf("Created %d containers for dispersion reporting, %d errors\n", created, errorCount)
+		}
+		for i := 0; doObjects && i < len(policies); i++ {
+			d.policy, d.objectRing = policies[i], objectRings[i]
+			created, errorCount, err := d.populateObjects()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Created %d objects in policy %s for dispersion reporting, %d errors\n", created, policies[i].Name, errorCount)
+		}
+		return
+	}
+
+	reports := map[string]*DispersionReport{}
+	healthy := true
+	if doContainers {
+		if reports["container"], err = d.containerReport(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for i := 0; doObjects && i < len(policies); i++ {
+		d.policy, d.objectRing = policies[i], objectRings[i]
+		if reports[objectReportKey(policies[i])], err = d.objectReport(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for _, report := range reports {
+		healthy = healthy && report.CopiesFound == report.CopiesExpected
+	}
+	if *jsonOutput || config.GetBool("dispersion", "dump_json", false) {
+		b, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error encoding report:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+	} else {
+		if report, ok := reports["container"]; ok {
+			fmt.Printf("Queried %d containers for dispersion reporting\n", report.Partitions)
+			printDispersionReport("container", report)
+		}
+		for _, policy := range policies {
+			if report, ok := reports[objectReportKey(policy)]; ok {
+				fmt.Printf("Queried %d objects in policy %s for dispersion reporting\n", report.Partitions, policy.Name)
+				printDispersionReport("object", report)
+			}
+		}
+	}
+	if !healthy {
+		os.Exit(1)
+	}
+}
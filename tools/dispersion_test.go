@@ -0,0 +1,223 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+type dispersionClient struct {
+	client.Client
+	lock       sync.Mutex
+	containers []string
+	objects    []string
+	created    map[string]map[string]string
+}
+
+func (c *dispersionClient) PutContainer(container string, headers map[string]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if strings.HasPrefix(container, dispersionObjectsContainer) {
+		if c.created == nil {
+			c.created = map[string]map[string]string{}
+		}
+		c.created[container] = headers
+	} else {
+		c.containers = append(c.containers, container)
+	}
+	return nil
+}
+
+func (c *dispersionClient) PutObject(container string, obj string, headers map[string]string, src io.Reader) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.objects = append(c.objects, obj)
+	return nil
+}
+
+func (c *dispersionClient) GetAccount(marker string, endMarker string, limit int, prefix string, delimiter string, headers map[string]string) ([]client.ContainerRecord, map[string]string, error) {
+	var records []client.ContainerRecord
+	if marker == "" {
+		for _, name := range append(c.containers, dispersionObjectsContainer) {
+			records = append(records, client.ContainerRecord{Name: name})
+		}
+	}
+	return records, nil, nil
+}
+
+func (c *dispersionClient) GetContainer(container string, marker string, endMarker string, limit int, prefix string, delimiter string, headers map[string]string) ([]client.ObjectRecord, map[string]string, error) {
+	var records []client.ObjectRecord
+	if marker == "" {
+		for _, name := range c.objects {
+			records = append(records, client.ObjectRecord{Name: name})
+		}
+	}
+	return records, nil, nil
+}
+
+func dispersionServer(t *testing.T, status int) (*httptest.Server, *ring.Device) {
+	return dispersionPolicyServer(t, status, "0")
+}
+
+func dispersionPolicyServer(t *testing.T, status int, policy string) (*httptest.Server, *ring.Device) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+		require.Equal(t, policy, r.Header.Get("X-Backend-Storage-Policy-Index"))
+		w.WriteHeader(status)
+	}))
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	host, ports, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(ports)
+	require.Nil(t, err)
+	return ts, &ring.Device{Ip: host, Port: port, Device: "sda"}
+}
+
+func TestDispersionPopulateAndReport(t *testing.T) {
+	var devs []*ring.Device
+	for _, status := range []int{204, 200, 404} {
+		ts, dev := dispersionServer(t, status)
+		defer ts.Close()
+		devs = append(devs, dev)
+	}
+	fakeRing := &test.FakeRing{MockDevices: devs}
+	cli := &dispersionClient{}
+	d := &dispersion{
+		cli:           cli,
+		account:       "AUTH_test",
+		containerRing: fakeRing,
+		objectRing:    fakeRing,
+		httpClient:    http.DefaultClient,
+		coverage:      100,
+		concurrency:   2,
+	}
+
+	created, errorCount := d.populateContainers()
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 0, errorCount)
+	created, errorCount, err := d.populateObjects()
+	require.Nil(t, err)
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 0, errorCount)
+
+	containerReport, err := d.containerReport()
+	require.Nil(t, err)
+	objectReport, err := d.objectReport()
+	require.Nil(t, err)
+	for _, report := range []*DispersionReport{containerReport, objectReport} {
+		assert.Equal(t, 1, report.Partitions)
+		assert.Equal(t, 3, report.CopiesExpected)
+		assert.Equal(t, 2, report.CopiesFound)
+		assert.Equal(t, 0, report.Errors)
+		assert.Equal(t, map[int]int{1: 1}, report.Missing)
+		require.Equal(t, 1, len(report.Degraded))
+		assert.Equal(t, "dispersion_0", report.Degraded[0].Name)
+		assert.Equal(t, []string{devs[2].Ip + ":" + strconv.Itoa(devs[2].Port) + "/sda"}, report.Degraded[0].Missing)
+	}
+}
+
+func TestDispersionReportErrors(t *testing.T) {
+	ts, dev := dispersionServer(t, 503)
+	defer ts.Close()
+	fakeRing := &test.FakeRing{MockDevices: []*ring.Device{dev, dev, dev}}
+	cli := &dispersionClient{objects: []string{"dispersion_0", "dispersion_1"}}
+	d := &dispersion{cli: cli, account: "AUTH_test", objectRing: fakeRing, httpClient: http.DefaultClient, concurrency: 1}
+	report, err := d.objectReport()
+	require.Nil(t, err)
+	// the fake ring puts everything on partition 0, so the second object isn't checked.
+	assert.Equal(t, 1, report.Overlapping)
+	assert.Equal(t, 3, report.Errors)
+	assert.Equal(t, 0, report.CopiesFound)
+	assert.Equal(t, map[int]int{3: 1}, report.Missing)
+}
+
+func TestDispersionPolicy(t *testing.T) {
+	ts, dev := dispersionPolicyServer(t, 200, "2")
+	defer ts.Close()
+	fakeRing := &test.FakeRing{MockDevices: []*ring.Device{dev, dev, dev}}
+	cli := &dispersionClient{}
+	d := &dispersion{
+		cli:         cli,
+		account:     "AUTH_test",
+		objectRing:  fakeRing,
+		policy:      &conf.Policy{Index: 2, Name: "gold"},
+		httpClient:  http.DefaultClient,
+		coverage:    100,
+		concurrency: 1,
+	}
+	created, errorCount, err := d.populateObjects()
+	require.Nil(t, err)
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 0, errorCount)
+	assert.Equal(t, map[string]map[string]string{"dispersion_objects-2": {"X-Storage-Policy": "gold"}}, cli.created)
+	report, err := d.objectReport()
+	require.Nil(t, err)
+	assert.Equal(t, 3, report.CopiesFound)
+	assert.Equal(t, "object-2", objectReportKey(d.policy))
+	// the per-policy object containers aren't dispersion containers themselves.
+	cli.containers = nil
+	names, err := d.listContainers()
+	require.Nil(t, err)
+	assert.Nil(t, names)
+}
+
+func TestDispersionPolicies(t *testing.T) {
+	policies := conf.PolicyList{
+		0: &conf.Policy{Index: 0, Name: "Policy-0"},
+		1: &conf.Policy{Index: 1, Name: "silver", Deprecated: true},
+		2: &conf.Policy{Index: 2, Name: "gold", Aliases: []string{"yellow"}},
+	}
+	selected, err := dispersionPolicies(policies, "")
+	require.Nil(t, err)
+	assert.Equal(t, []*conf.Policy{policies[0], policies[2]}, selected)
+	for _, name := range []string{"gold", "Yellow", "2"} {
+		selected, err = dispersionPolicies(policies, name)
+		require.Nil(t, err)
+		assert.Equal(t, []*conf.Policy{policies[2]}, selected)
+	}
+	selected, err = dispersionPolicies(policies, "silver")
+	require.Nil(t, err)
+	assert.Equal(t, []*conf.Policy{policies[1]}, selected)
+	_, err = dispersionPolicies(policies, "bronze")
+	require.NotNil(t, err)
+}
+
+func TestAccountFromURL(t *testing.T) {
+	account, err := accountFromURL("http://127.0.0.1:8080/v1/AUTH_test/")
+	require.Nil(t, err)
+	assert.Equal(t, "AUTH_test", account)
+	account, err = accountFromURL("http://127.0.0.1:8080/v1/AUTH_a%20b")
+	require.Nil(t, err)
+	assert.Equal(t, "AUTH_a b", account)
+	_, err = accountFromURL("")
+	assert.NotNil(t, err)
+}
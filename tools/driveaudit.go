@@ -0,0 +1,350 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/middleware"
+)
+
+// defaultDriveAuditPatterns match kernel log lines reporting errors on a disk, capturing the kernel's name for it.
+var defaultDriveAuditPatterns = []string{
+	`\berror\b.*\b(sd[a-z]{1,2}\d?)\b`,
+	`\b(sd[a-z]{1,2}\d?)\b.*\berror\b`,
+}
+
+// deviceID returns the id of the filesystem mounted at path, overridable for tests.
+var deviceID = func(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
+
+// DriveAudit watches the kernel log for disk errors and marks devices with too many of them as failed, so the servers
+// and replicators stop using them.  A mark is cleared when a different filesystem is mounted for the device, when it
+// is older than failedMaxAge (if set), or by hand with "hummingbird drive-audit unmark".
+type DriveAudit struct {
+	logger            srv.LowLevelLogger
+	driveRoot         string
+	logFile           string
+	mountsFile        string
+	patterns          []*regexp.Regexp
+	errorLimit        int
+	window            time.Duration
+	interval          time.Duration
+	unmount           bool
+	failedDevicesFile string
+	failedMaxAge      time.Duration
+	reconCachePath    string
+	// lastFailed is the failed devices as of the last pass, and cleared is when each device's mark was last cleared;
+	// errors logged before then were for the failed drive and don't count against the device any more.
+	lastFailed map[string]bool
+	cleared    map[string]time.Time
+}
+
+// LogError logs an error with the drive auditor's logger.
+func (d *DriveAudit) LogError(format string, args ...interface{}) {
+	d.logger.Err(fmt.Sprintf(format, args...))
+}
+
+// LogInfo logs a message with the drive auditor's logger.
+func (d *DriveAudit) LogInfo(format string, args ...interface{}) {
+	d.logger.Info(fmt.Sprintf(format, args...))
+}
+
+// LogPanics logs any panic in progress, along with the message and a stack trace.
+func (d *DriveAudit) LogPanics(m string) {
+	if e := recover(); e != nil {
+		d.LogError("%s: %s: %s", m, e, debug.Stack())
+	}
+}
+
+// mountedDevices maps the kernel names of the disks mounted under the drive root to their device names.
+func (d *DriveAudit) mountedDevices() (map[string]string, error) {
+	fp, err := os.Open(d.mountsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	devices := make(map[string]string)
+	driveRoot := filepath.Clean(d.driveRoot)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") || filepath.Dir(filepath.Clean(fields[1])) != driveRoot {
+			continue
+		}
+		devices[filepath.Base(fields[0])] = filepath.Base(fields[1])
+	}
+	return devices, scanner.Err()
+}
+
+// logTime parses the timestamp at the start of a log line, in either the traditional syslog or RFC 3339 format.
+func logTime(line string, now time.Time) (time.Time, bool) {
+	if len(line) >= len(time.Stamp) {
+		if t, err := time.ParseInLocation(time.Stamp, line[:len(time.Stamp)], now.Location()); err == nil {
+			// syslog leaves out the year, so assume the most recent one that doesn't put the line in the future.
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			return t, true
+		}
+	}
+	if fields := strings.Fields(line); len(fields) > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func trimPartition(kernelDevice string) string {
+	return strings.TrimRight(kernelDevice, "0123456789")
+}
+
+// countErrors returns the number of errors logged for each device within the window.
+func (d *DriveAudit) countErrors(devices map[string]string, now time.Time) (map[string]int, error) {
+	fp, err := os.Open(d.logFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	disks := make(map[string]string)
+	for kernelDevice, device := range devices {
+		disks[trimPartition(kernelDevice)] = device
+	}
+	errors := make(map[string]int)
+	since := now.Add(-d.window)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		t, ok := logTime(line, now)
+		if !ok || t.Before(since) {
+			continue
+		}
+		for _, pattern := range d.patterns {
+			if m := pattern.FindStringSubmatch(line); len(m) > 1 {
+				device, ok := devices[m[1]]
+				if !ok {
+					device, ok = disks[trimPartition(m[1])]
+				}
+				if ok && !t.Before(d.cleared[device]) {
+					errors[device]++
+				}
+				break
+			}
+		}
+	}
+	return errors, scanner.Err()
+}
+
+// audit scans the log once, marking devices over the error limit as failed and unmounting them if configured to.
+func (d *DriveAudit) audit() {
+	now := time.Now()
+	devices, err := d.mountedDevices()
+	if err != nil {
+		d.LogError("Unable to list mounted devices: %v", err)
+		return
+	}
+	failed, err := fs.ReadFailedDevices(d.failedDevicesFile)
+	if err != nil {
+		d.LogError("Unable to read failed devices from %s: %v", d.failedDevicesFile, err)
+		return
+	}
+	changed := d.clearFailed(failed, devices, now)
+	errors, err := d.countErrors(devices, now)
+	if err != nil {
+		d.LogError("Unable to read kernel log %s: %v", d.logFile, err)
+		return
+	}
+	total := 0
+	for device, count := range errors {
+		total += count
+		if count < d.errorLimit {
+			continue
+		}
+		if _, ok := failed[device]; ok {
+			continue
+		}
+		d.LogError("Marking device %s failed after %d errors", device, count)
+		devicePath := filepath.Join(d.driveRoot, device)
+		dev, err := deviceID(devicePath)
+		if err != nil {
+			d.LogError("Unable to stat %s: %v", devicePath, err)
+		}
+		failed[device] = fs.FailedDevice{Errors: count, FailedAt: float64(now.UnixNano()) / float64(time.Second), Dev: dev}
+		changed = true
+		if d.unmount {
+			if err := syscall.Unmount(devicePath, 0); err != nil {
+				d.LogError("Unable to unmount %s: %v", devicePath, err)
+			} else {
+				d.LogInfo("Unmounted %s", devicePath)
+			}
+		}
+	}
+	if changed {
+		if err := fs.WriteFailedDevices(d.failedDevicesFile, failed); err != nil {
+			d.LogError("Unable to save failed devices to %s: %v", d.failedDevicesFile, err)
+		}
+	}
+	failedList := make([]string, 0, len(failed))
+	d.lastFailed = make(map[string]bool, len(failed))
+	for device := range failed {
+		failedList = append(failedList, device)
+		d.lastFailed[device] = true
+	}
+	sort.Strings(failedList)
+	if err := middleware.DumpReconCache(d.reconCachePath, "drive",
+		map[string]interface{}{"drive_audit_errors": total, "failed_devices": failedList}); err != nil {
+		d.LogError("Unable to update recon cache: %v", err)
+	}
+}
+
+// clearFailed removes the marks on failed devices that have been replaced or have been failed for longer than
+// failedMaxAge, returning whether any were removed.  devices are the mounted devices, by kernel name.
+func (d *DriveAudit) clearFailed(failed map[string]fs.FailedDevice, devices map[string]string, now time.Time) bool {
+	if d.cleared == nil {
+		d.cleared = make(map[string]time.Time)
+	}
+	// devices that were unmarked by hand since the last pass
+	for device := range d.lastFailed {
+		if _, ok := failed[device]; !ok {
+			d.cleared[device] = now
+		}
+	}
+	mounted := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		mounted[device] = true
+	}
+	changed := false
+	for device, f := range failed {
+		failedAt := time.Unix(0, int64(f.FailedAt*float64(time.Second)))
+		if d.failedMaxAge > 0 && now.Sub(failedAt) >= d.failedMaxAge {
+			d.LogInfo("Clearing failed mark on device %s, set at %s", device, failedAt.Format(time.RFC3339))
+		} else if !mounted[device] || f.Dev == 0 {
+			continue
+		} else if dev, err := deviceID(filepath.Join(d.driveRoot, device)); err != nil || dev == f.Dev {
+			continue
+		} else {
+			d.LogInfo("Clearing failed mark on device %s, which has been remounted", device)
+		}
+		delete(failed, device)
+		d.cleared[device] = now
+		changed = true
+	}
+	return changed
+}
+
+// Run a single drive audit pass.
+func (d *DriveAudit) Run() {
+	defer d.LogPanics("PANIC AUDITING DRIVES")
+	d.audit()
+}
+
+// RunForever runs drive audit passes every interval.
+func (d *DriveAudit) RunForever() {
+	for {
+		d.Run()
+		time.Sleep(d.interval)
+	}
+}
+
+// NewDriveAudit returns a drive auditor configured from the drive-audit config section.
+func NewDriveAudit(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, error) {
+	if !serverconf.HasSection("drive-audit") {
+		return nil, fmt.Errorf("Unable to find drive-audit config section")
+	}
+	d := &DriveAudit{
+		driveRoot:         serverconf.GetDefault("drive-audit", "devices", "/srv/node"),
+		logFile:           serverconf.GetDefault("drive-audit", "log_file", "/var/log/kern.log"),
+		mountsFile:        serverconf.GetDefault("drive-audit", "mounts_file", "/proc/mounts"),
+		errorLimit:        int(serverconf.GetInt("drive-audit", "error_limit", 1)),
+		window:            time.Duration(serverconf.GetInt("drive-audit", "minutes", 60)) * time.Minute,
+		interval:          time.Duration(serverconf.GetInt("drive-audit", "interval", 300)) * time.Second,
+		unmount:           serverconf.GetBool("drive-audit", "unmount_failed_device", true),
+		failedDevicesFile: serverconf.GetDefault("drive-audit", "failed_devices_file", fs.DefaultFailedDevicesFile),
+		failedMaxAge:      time.Duration(serverconf.GetInt("drive-audit", "failed_device_max_age", 0)) * time.Second,
+		reconCachePath:    serverconf.GetDefault("drive-audit", "recon_cache_path", "/var/cache/swift"),
+	}
+	var patternKeys []string
+	for key := range serverconf.File["drive-audit"] {
+		if strings.HasPrefix(key, "regex_pattern_") {
+			patternKeys = append(patternKeys, key)
+		}
+	}
+	patterns := defaultDriveAuditPatterns
+	if len(patternKeys) > 0 {
+		sort.Strings(patternKeys)
+		patterns = nil
+		for _, key := range patternKeys {
+			patterns = append(patterns, serverconf.GetDefault("drive-audit", key, ""))
+		}
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid drive-audit pattern %q: %v", pattern, err)
+		}
+		d.patterns = append(d.patterns, re)
+	}
+	var err error
+	if d.logger, err = srv.SetupLogger(serverconf, flags, "drive-audit", "drive-audit"); err != nil {
+		return nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	return d, nil
+}
+
+// DriveAuditUnmark clears the failed marks drive-audit has set on the given devices, using the failed devices file
+// from the drive-audit section of configFile.
+func DriveAuditUnmark(configFile string, devices []string) {
+	if len(devices) == 0 {
+		fmt.Fprintln(os.Stderr, "USAGE: hummingbird drive-audit [-c config] unmark DEVICE...")
+		os.Exit(1)
+	}
+	serverconf, err := conf.LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(1)
+	}
+	failedDevicesFile := serverconf.GetDefault("drive-audit", "failed_devices_file", fs.DefaultFailedDevicesFile)
+	for _, device := range devices {
+		if marked, err := fs.UnmarkFailedDevice(failedDevicesFile, device); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to unmark %s: %v\n", device, err)
+			os.Exit(1)
+		} else if marked {
+			fmt.Printf("Unmarked %s\n", device)
+		} else {
+			fmt.Printf("%s was not marked failed\n", device)
+		}
+	}
+}
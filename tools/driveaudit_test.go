@@ -0,0 +1,159 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestDriveAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mounts := "/dev/sdb1 /srv/node/sdb1 xfs rw 0 0\n/dev/sdc1 /srv/node/sdc1 xfs rw 0 0\n/dev/sda1 / ext4 rw 0 0\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "mounts"), []byte(mounts), 0666))
+	now := time.Now()
+	old := now.Add(-2 * time.Hour).Format(time.Stamp)
+	recent := now.Add(-time.Minute).Format(time.Stamp)
+	kernLog := fmt.Sprintf("%s host kernel: end_request: I/O error, dev sdc, sector 1234\n", old) +
+		fmt.Sprintf("%s host kernel: end_request: I/O error, dev sdb, sector 1234\n", recent) +
+		fmt.Sprintf("%s host kernel: Buffer I/O error on device sdb1, logical block 5\n", recent) +
+		fmt.Sprintf("%s host kernel: end_request: I/O error, dev sda, sector 1234\n", recent) +
+		fmt.Sprintf("%s host kernel: sdc: unrelated message\n", recent)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "kern.log"), []byte(kernLog), 0666))
+
+	d := &DriveAudit{
+		logger:            test.FakeLowLevelLogger{},
+		driveRoot:         "/srv/node",
+		logFile:           filepath.Join(dir, "kern.log"),
+		mountsFile:        filepath.Join(dir, "mounts"),
+		errorLimit:        2,
+		window:            time.Hour,
+		failedDevicesFile: filepath.Join(dir, "failed_devices.json"),
+		reconCachePath:    dir,
+	}
+	for _, pattern := range defaultDriveAuditPatterns {
+		d.patterns = append(d.patterns, regexp.MustCompile(pattern))
+	}
+	d.Run()
+
+	failed, err := fs.ReadFailedDevices(d.failedDevicesFile)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(failed))
+	require.Equal(t, 2, failed["sdb1"].Errors)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "drive.recon"))
+	require.Nil(t, err)
+	var recon map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &recon))
+	require.Equal(t, float64(2), recon["drive_audit_errors"])
+	require.Equal(t, []interface{}{"sdb1"}, recon["failed_devices"])
+}
+
+func TestDriveAuditClearsFailedDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(f func(string) (uint64, error)) { deviceID = f }(deviceID)
+	devs := map[string]uint64{"/srv/node/sdb1": 1, "/srv/node/sdc1": 2}
+	deviceID = func(path string) (uint64, error) { return devs[path], nil }
+	mounts := "/dev/sdb1 /srv/node/sdb1 xfs rw 0 0\n/dev/sdc1 /srv/node/sdc1 xfs rw 0 0\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "mounts"), []byte(mounts), 0666))
+	now := time.Now()
+	kernLog := fmt.Sprintf("%s host kernel: end_request: I/O error, dev sdb, sector 1234\n", now.Add(-time.Minute).Format(time.Stamp)) +
+		fmt.Sprintf("%s host kernel: end_request: I/O error, dev sdc, sector 1234\n", now.Add(-time.Minute).Format(time.Stamp))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "kern.log"), []byte(kernLog), 0666))
+	d := &DriveAudit{
+		logger:            test.FakeLowLevelLogger{},
+		driveRoot:         "/srv/node",
+		logFile:           filepath.Join(dir, "kern.log"),
+		mountsFile:        filepath.Join(dir, "mounts"),
+		errorLimit:        1,
+		window:            time.Hour,
+		failedDevicesFile: filepath.Join(dir, "failed_devices.json"),
+		reconCachePath:    dir,
+	}
+	for _, pattern := range defaultDriveAuditPatterns {
+		d.patterns = append(d.patterns, regexp.MustCompile(pattern))
+	}
+	d.Run()
+	failed, err := fs.ReadFailedDevices(d.failedDevicesFile)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), failed["sdb1"].Dev)
+	require.Equal(t, uint64(2), failed["sdc1"].Dev)
+
+	// a new drive mounted as sdb1 clears its mark, and the old drive's errors don't count against it.
+	devs["/srv/node/sdb1"] = 3
+	d.Run()
+	failed, err = fs.ReadFailedDevices(d.failedDevicesFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{"sdc1"}, failedNames(failed))
+
+	// so does unmarking sdc1 by hand.
+	marked, err := fs.UnmarkFailedDevice(d.failedDevicesFile, "sdc1")
+	require.Nil(t, err)
+	require.True(t, marked)
+	d.Run()
+	failed, err = fs.ReadFailedDevices(d.failedDevicesFile)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(failed))
+
+	// marks older than the max age are cleared too.
+	failed["sdb1"] = fs.FailedDevice{Errors: 1, FailedAt: float64(now.Add(-2 * time.Hour).Unix()), Dev: 3}
+	require.Nil(t, fs.WriteFailedDevices(d.failedDevicesFile, failed))
+	d.Run()
+	failed, err = fs.ReadFailedDevices(d.failedDevicesFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{"sdb1"}, failedNames(failed))
+	d.failedMaxAge = time.Hour
+	d.Run()
+	failed, err = fs.ReadFailedDevices(d.failedDevicesFile)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(failed))
+}
+
+func failedNames(failed map[string]fs.FailedDevice) []string {
+	var names []string
+	for device := range failed {
+		names = append(names, device)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDriveAuditLogTime(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 30, 0, 0, time.UTC)
+	ts, ok := logTime("Dec 31 23:59:00 host kernel: message", now)
+	require.True(t, ok)
+	require.Equal(t, time.Date(2016, 12, 31, 23, 59, 0, 0, time.UTC), ts)
+	ts, ok = logTime("2016-12-31T23:59:00.5+00:00 host kernel: message", now)
+	require.True(t, ok)
+	require.Equal(t, time.Date(2016, 12, 31, 23, 59, 0, 500000000, time.UTC), ts.UTC())
+	_, ok = logTime("not a log line", now)
+	require.False(t, ok)
+}
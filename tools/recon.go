@@ -0,0 +1,444 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// ReconStats summarizes one value reported by every host.
+type ReconStats struct {
+	Low       float64 `json:"low"`
+	High      float64 `json:"high"`
+	Avg       float64 `json:"avg"`
+	Total     float64 `json:"total"`
+	Reported  int     `json:"reported"`
+	NoResult  int     `json:"no_result"`
+	FailedPct float64 `json:"failed_pct"`
+}
+
+// MD5Check lists the hosts whose copies of the ring or swift.conf files don't match.
+type MD5Check struct {
+	Matched    int                 `json:"matched"`
+	Mismatched map[string][]string `json:"mismatched"`
+	Errors     int                 `json:"errors"`
+}
+
+// ReplicationCompletion records when a host last completed a replication pass.
+type ReplicationCompletion struct {
+	Host string  `json:"host"`
+	Time float64 `json:"time"`
+}
+
+// ReconReport is everything the recon command found out about the cluster.
+type ReconReport struct {
+	ServerType       string                 `json:"server_type"`
+	Hosts            []string               `json:"hosts"`
+	Errors           map[string]string      `json:"errors"`
+	ReplicationTime  *ReconStats            `json:"replication_time"`
+	OldestCompletion *ReplicationCompletion `json:"oldest_completion"`
+	NewestCompletion *ReplicationCompletion `json:"newest_completion"`
+	AsyncPending     *ReconStats            `json:"async_pending,omitempty"`
+	DiskUsage        *ReconStats            `json:"disk_usage"`
+	Unmounted        []string               `json:"unmounted"`
+	Quarantined      map[string]*ReconStats `json:"quarantined"`
+	RingMD5          *MD5Check              `json:"ringmd5"`
+	SwiftConfMD5     *MD5Check              `json:"swiftconfmd5"`
+}
+
+type reconClient struct {
+	client      *http.Client
+	serverType  string
+	hosts       []string
+	concurrency int
+	errors      map[string]string
+	lock        sync.Mutex
+}
+
+func newReconStats(values []float64, hosts int) *ReconStats {
+	stats := &ReconStats{Reported: len(values), NoResult: hosts - len(values)}
+	if hosts > 0 {
+		stats.FailedPct = float64(stats.NoResult) * 100 / float64(hosts)
+	}
+	for i, v := range values {
+		if i == 0 || v < stats.Low {
+			stats.Low = v
+		}
+		if i == 0 || v > stats.High {
+			stats.High = v
+		}
+		stats.Total += v
+	}
+	if len(values) > 0 {
+		stats.Avg = stats.Total / float64(len(values))
+	}
+	return stats
+}
+
+// reconHosts returns every host:port in the rings for the server type, sorted and without duplicates.
+func reconHosts(rings []ring.Ring) []string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, r := range rings {
+		for _, dev := range r.AllDevices() {
+			if dev.Ip == "" {
+				continue
+			}
+			host := net.JoinHostPort(dev.Ip, strconv.Itoa(dev.Port))
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// query GETs the recon endpoint from every host concurrently, returning the decoded json of the hosts that answered.
+func (rc *reconClient) query(endpoint string) map[string]interface{} {
+	results := map[string]interface{}{}
+	var lock sync.Mutex
+	parallel(len(rc.hosts), rc.concurrency, func(i int) {
+		host := rc.hosts[i]
+		var data interface{}
+		resp, err := rc.client.Get(fmt.Sprintf("http://%s/recon/%s", host, endpoint))
+		if err == nil {
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("/recon/%s returned %d", endpoint, resp.StatusCode)
+			} else {
+				err = json.NewDecoder(resp.Body).Decode(&data)
+			}
+			resp.Body.Close()
+		}
+		if err != nil {
+			rc.lock.Lock()
+			if _, ok := rc.errors[host]; !ok {
+				rc.errors[host] = err.Error()
+			}
+			rc.lock.Unlock()
+			return
+		}
+		lock.Lock()
+		results[host] = data
+		lock.Unlock()
+	})
+	return results
+}
+
+// floatValue pulls a number out of a recon response, whether it was sent as a number or a string.
+func floatValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (rc *reconClient) replication(report *ReconReport) {
+	timeKey, lastKey := "replication_time", "replication_last"
+	if rc.serverType == "object" {
+		timeKey, lastKey = "object_replication_time", "object_replication_last"
+	}
+	var times []float64
+	for host, data := range rc.query("replication/" + rc.serverType) {
+		values, _ := data.(map[string]interface{})
+		if t, ok := floatValue(values[timeKey]); ok {
+			times = append(times, t)
+		}
+		if last, ok := floatValue(values[lastKey]); ok {
+			if report.OldestCompletion == nil || last < report.OldestCompletion.Time {
+				report.OldestCompletion = &ReplicationCompletion{Host: host, Time: last}
+			}
+			if report.NewestCompletion == nil || last > report.NewestCompletion.Time {
+				report.NewestCompletion = &ReplicationCompletion{Host: host, Time: last}
+			}
+		}
+	}
+	report.ReplicationTime = newReconStats(times, len(rc.hosts))
+}
+
+func (rc *reconClient) async(report *ReconReport) {
+	var pendings []float64
+	for _, data := range rc.query("async") {
+		values, _ := data.(map[string]interface{})
+		if p, ok := floatValue(values["async_pending"]); ok {
+			pendings = append(pendings, p)
+		}
+	}
+	report.AsyncPending = newReconStats(pendings, len(rc.hosts))
+}
+
+func (rc *reconClient) diskUsage(report *ReconReport) {
+	var percents []float64
+	for host, data := range rc.query("diskusage") {
+		devices, _ := data.([]interface{})
+		for _, d := range devices {
+			device, _ := d.(map[string]interface{})
+			if mounted, _ := device["mounted"].(bool); !mounted {
+				report.Unmounted = append(report.Unmounted, fmt.Sprintf("%s/%v", host, device["device"]))
+				continue
+			}
+			used, ok1 := floatValue(device["used"])
+			size, ok2 := floatValue(device["size"])
+			if ok1 && ok2 && size > 0 {
+				percents = append(percents, used*100/size)
+			}
+		}
+	}
+	sort.Strings(report.Unmounted)
+	// these stats are per device rather than per host, so there's no count of hosts that failed to answer.
+	report.DiskUsage = newReconStats(percents, len(percents))
+}
+
+func (rc *reconClient) quarantined(report *ReconReport) {
+	counts := map[string][]float64{}
+	for _, data := range rc.query("quarantined") {
+		values, _ := data.(map[string]interface{})
+		for _, kind := range []string{"objects", "containers", "accounts"} {
+			if c, ok := floatValue(values[kind]); ok {
+				counts[kind] = append(counts[kind], c)
+			}
+		}
+	}
+	report.Quarantined = map[string]*ReconStats{}
+	for _, kind := range []string{"objects", "containers", "accounts"} {
+		report.Quarantined[kind] = newReconStats(counts[kind], len(rc.hosts))
+	}
+}
+
+func localMD5(path string) (string, bool) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer fp.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, fp); err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), true
+}
+
+// md5Check compares every host's md5s of the files in the endpoint against our own copies of those files, or if we
+// don't have a copy, against the md5 most of the hosts agree on.
+func (rc *reconClient) md5Check(endpoint string) *MD5Check {
+	check := &MD5Check{Mismatched: map[string][]string{}}
+	results := rc.query(endpoint)
+	check.Errors = len(rc.hosts) - len(results)
+	expected := map[string]string{}
+	votes := map[string]map[string]int{}
+	for _, data := range results {
+		files, _ := data.(map[string]interface{})
+		for file, sum := range files {
+			if votes[file] == nil {
+				votes[file] = map[string]int{}
+			}
+			votes[file][fmt.Sprintf("%v", sum)]++
+		}
+	}
+	for file, counts := range votes {
+		if sum, ok := localMD5(file); ok {
+			expected[file] = sum
+			continue
+		}
+		best := 0
+		for sum, count := range counts {
+			if count > best || (count == best && sum < expected[file]) {
+				best = count
+				expected[file] = sum
+			}
+		}
+	}
+	for host, data := range results {
+		files, _ := data.(map[string]interface{})
+		for file, sum := range files {
+			if fmt.Sprintf("%v", sum) != expected[file] {
+				check.Mismatched[host] = append(check.Mismatched[host], file)
+			}
+		}
+		if _, ok := check.Mismatched[host]; ok {
+			sort.Strings(check.Mismatched[host])
+		} else {
+			check.Matched++
+		}
+	}
+	return check
+}
+
+func (rc *reconClient) run() *ReconReport {
+	report := &ReconReport{ServerType: rc.serverType, Hosts: rc.hosts, Unmounted: []string{}}
+	rc.replication(report)
+	if rc.serverType == "object" {
+		rc.async(report)
+	}
+	rc.diskUsage(report)
+	rc.quarantined(report)
+	report.RingMD5 = rc.md5Check("ringmd5")
+	report.SwiftConfMD5 = rc.md5Check("swiftconfmd5")
+	report.Errors = rc.errors
+	return report
+}
+
+func printStats(name string, stats *ReconStats) {
+	fmt.Printf("[%s] low: %.2f, high: %.2f, avg: %.2f, total: %.2f, Failed: %.1f%%, no_result: %d, reported: %d\n",
+		name, stats.Low, stats.High, stats.Avg, stats.Total, stats.FailedPct, stats.NoResult, stats.Reported)
+}
+
+func printMD5Check(name string, check *MD5Check, hosts int) {
+	for _, host := range sortedKeys(check.Mismatched) {
+		fmt.Printf("!! %s %s doesn't match: %s\n", host, name, strings.Join(check.Mismatched[host], ", "))
+	}
+	fmt.Printf("%d/%d hosts matched, %d error[s] while checking hosts.\n", check.Matched, hosts, check.Errors)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func printCompletion(label string, c *ReplicationCompletion) {
+	if c == nil {
+		return
+	}
+	when := time.Unix(0, int64(c.Time*float64(time.Second)))
+	fmt.Printf("%s completion was %s (%s ago) by %s.\n", label, when.UTC().Format("2006-01-02 15:04:05"),
+		time.Since(when).Truncate(time.Second), c.Host)
+}
+
+func printReconReport(report *ReconReport) {
+	fmt.Println(strings.Repeat("=", 79))
+	fmt.Printf("--> Starting reconnaissance on %d hosts (%s)\n", len(report.Hosts), report.ServerType)
+	fmt.Println(strings.Repeat("=", 79))
+	fmt.Println("Checking on replication")
+	printStats("replication_time", report.ReplicationTime)
+	printCompletion("Oldest", report.OldestCompletion)
+	printCompletion("Most recent", report.NewestCompletion)
+	if report.AsyncPending != nil {
+		fmt.Println(strings.Repeat("=", 79))
+		fmt.Println("Checking async pendings")
+		printStats("async_pending", report.AsyncPending)
+	}
+	fmt.Println(strings.Repeat("=", 79))
+	fmt.Println("Checking disk usage")
+	printStats("disk_usage_pct", report.DiskUsage)
+	for _, dev := range report.Unmounted {
+		fmt.Printf("Not mounted: %s\n", dev)
+	}
+	fmt.Println(strings.Repeat("=", 79))
+	fmt.Println("Checking quarantine")
+	for _, kind := range []string{"objects", "containers", "accounts"} {
+		printStats("quarantined_"+kind, report.Quarantined[kind])
+	}
+	fmt.Println(strings.Repeat("=", 79))
+	fmt.Println("Checking ring md5sums")
+	printMD5Check("ring", report.RingMD5, len(report.Hosts))
+	fmt.Println(strings.Repeat("=", 79))
+	fmt.Println("Checking swift.conf md5sum")
+	printMD5Check("swift.conf", report.SwiftConfMD5, len(report.Hosts))
+	if len(report.Errors) > 0 {
+		fmt.Println(strings.Repeat("=", 79))
+		hosts := make([]string, 0, len(report.Errors))
+		for host := range report.Errors {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			fmt.Printf("-> %s: %s\n", host, report.Errors[host])
+		}
+	}
+	fmt.Println(strings.Repeat("=", 79))
+}
+
+// Recon queries the recon endpoint of every server in the rings and summarizes the results, like Swift's swift-recon.
+func Recon(args []string) {
+	flags := flag.NewFlagSet("recon", flag.ExitOnError)
+	serverType := flags.String("type", "object", "Server type to check: object, container or account")
+	jsonOutput := flags.Bool("json", false, "Print the report as json")
+	timeout := flags.Int("timeout", 5, "Seconds to wait for each host to answer")
+	concurrency := flags.Int("concurrency", 25, "Number of hosts to query at once")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird recon [ARGS]\n")
+		fmt.Fprintf(os.Stderr, "  Query every server in the rings for replication, async pending, disk usage, quarantine and md5 stats.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *serverType != "object" && *serverType != "container" && *serverType != "account" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	policies := []int{0}
+	if *serverType == "object" {
+		policies = policies[:0]
+		for index := range conf.LoadPolicies() {
+			policies = append(policies, index)
+		}
+	}
+	var rings []ring.Ring
+	for _, policy := range policies {
+		r, err := ring.GetRing(*serverType, hashPathPrefix, hashPathSuffix, policy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading %s ring for policy %d: %v\n", *serverType, policy, err)
+			os.Exit(1)
+		}
+		rings = append(rings, r)
+	}
+	rc := &reconClient{
+		client:      &http.Client{Timeout: time.Duration(*timeout) * time.Second},
+		serverType:  *serverType,
+		hosts:       reconHosts(rings),
+		concurrency: *concurrency,
+		errors:      map[string]string{},
+	}
+	report := rc.run()
+	if *jsonOutput {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error encoding report:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+	} else {
+		printReconReport(report)
+	}
+}
@@ -0,0 +1,87 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reconServer(asyncs int, ringSum string, mounted bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/recon/replication/object":
+			fmt.Fprintf(w, `{"object_replication_time": %d, "object_replication_last": %d}`, asyncs, 1500000000+asyncs)
+		case "/recon/async":
+			fmt.Fprintf(w, `{"async_pending": %d}`, asyncs)
+		case "/recon/diskusage":
+			fmt.Fprintf(w, `[{"device": "sda", "mounted": true, "size": 100, "used": %d, "avail": 0}, {"device": "sdb", "mounted": %v, "size": "", "used": "", "avail": ""}]`, asyncs*10, mounted)
+		case "/recon/quarantined":
+			fmt.Fprintf(w, `{"objects": %d, "containers": 0, "accounts": 0}`, asyncs)
+		case "/recon/ringmd5":
+			fmt.Fprintf(w, `{"/nonexistent/object.ring.gz": "%s"}`, ringSum)
+		case "/recon/swiftconfmd5":
+			fmt.Fprintf(w, `{"/nonexistent/swift.conf": "abc"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestReconRun(t *testing.T) {
+	var hosts []string
+	for i, sum := range []string{"aaa", "aaa", "bbb"} {
+		ts := reconServer(i+1, sum, i != 2)
+		defer ts.Close()
+		hosts = append(hosts, strings.TrimPrefix(ts.URL, "http://"))
+	}
+	// one host that isn't listening
+	ts := httptest.NewServer(http.NotFoundHandler())
+	hosts = append(hosts, strings.TrimPrefix(ts.URL, "http://"))
+	ts.Close()
+
+	rc := &reconClient{client: http.DefaultClient, serverType: "object", hosts: hosts, concurrency: 2, errors: map[string]string{}}
+	report := rc.run()
+
+	require.NotNil(t, report.AsyncPending)
+	assert.Equal(t, &ReconStats{Low: 1, High: 3, Avg: 2, Total: 6, Reported: 3, NoResult: 1, FailedPct: 25}, report.AsyncPending)
+	assert.Equal(t, 2.0, report.ReplicationTime.Avg)
+	require.NotNil(t, report.OldestCompletion)
+	assert.Equal(t, hosts[0], report.OldestCompletion.Host)
+	assert.Equal(t, hosts[2], report.NewestCompletion.Host)
+	assert.Equal(t, 10.0, report.DiskUsage.Low)
+	assert.Equal(t, 30.0, report.DiskUsage.High)
+	assert.Equal(t, []string{hosts[2] + "/sdb"}, report.Unmounted)
+	assert.Equal(t, 6.0, report.Quarantined["objects"].Total)
+	assert.Equal(t, 2, report.RingMD5.Matched)
+	assert.Equal(t, map[string][]string{hosts[2]: {"/nonexistent/object.ring.gz"}}, report.RingMD5.Mismatched)
+	assert.Equal(t, 1, report.RingMD5.Errors)
+	assert.Equal(t, 3, report.SwiftConfMD5.Matched)
+	assert.Equal(t, 0, len(report.SwiftConfMD5.Mismatched))
+	assert.Equal(t, 1, len(report.Errors))
+	assert.Contains(t, report.Errors, hosts[3])
+}
+
+func TestNewReconStats(t *testing.T) {
+	assert.Equal(t, &ReconStats{NoResult: 2, FailedPct: 100}, newReconStats(nil, 2))
+	assert.Equal(t, &ReconStats{Low: -1, High: 5, Avg: 2, Total: 4, Reported: 2}, newReconStats([]float64{5, -1}, 2))
+}